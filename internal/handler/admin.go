@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"voidrun/internal/model"
+	"voidrun/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminHandler serves operator endpoints that are not scoped to an org
+type AdminHandler struct {
+	reconciler *service.ReconcilerService
+	network    *service.NetworkService
+}
+
+func NewAdminHandler(reconciler *service.ReconcilerService, network *service.NetworkService) *AdminHandler {
+	return &AdminHandler{reconciler: reconciler, network: network}
+}
+
+// ReconcileReport handles GET /admin/reconcile
+func (h *AdminHandler) ReconcileReport(c *gin.Context) {
+	report := h.reconciler.LastReport()
+	if report == nil {
+		c.JSON(http.StatusNotFound, model.NewErrorResponse("Reconciler has not run yet", ""))
+		return
+	}
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Reconcile report fetched", report))
+}
+
+// Reconcile handles POST /admin/reconcile and runs the reconciler immediately
+func (h *AdminHandler) Reconcile(c *gin.Context) {
+	report := h.reconciler.Run(c.Request.Context(), false)
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Reconcile finished", report))
+}
+
+// NetworkLeases handles GET /admin/network/leases, listing the IP, MAC and CID held by each sandbox
+func (h *AdminHandler) NetworkLeases(c *gin.Context) {
+	page := 1
+	pageSize := 0 // Let service use default from config
+
+	if p := c.Query("page"); p != "" {
+		if v, err := strconv.Atoi(p); err == nil && v > 0 {
+			page = v
+		}
+	}
+	if s := c.Query("limit"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v > 0 {
+			pageSize = v
+		}
+	}
+
+	leases, total, actualPageSize, err := h.network.ListLeases(c.Request.Context(), page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Failed to fetch leases", err.Error()))
+		return
+	}
+
+	totalPages := (total + int64(actualPageSize) - 1) / int64(actualPageSize)
+
+	c.JSON(http.StatusOK, model.NewSuccessResponseWithMeta("Network leases fetched", leases, map[string]interface{}{
+		"page":       page,
+		"limit":      actualPageSize,
+		"total":      total,
+		"totalPages": totalPages,
+	}))
+}
+
+// NetworkPools handles GET /admin/network/pools, reporting the size and usage of each address pool
+func (h *AdminHandler) NetworkPools(c *gin.Context) {
+	stats, err := h.network.PoolStats(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Failed to fetch pools", err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Network pools fetched", stats))
+}
@@ -27,11 +27,8 @@ func NewCommandsHandler(commandsService *service.CommandsService, sandboxService
 // Run starts a background process
 // POST /sandboxes/:id/commands/run
 func (h *CommandsHandler) Run(c *gin.Context) {
-	id := c.Param("id")
-
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -62,11 +59,8 @@ func (h *CommandsHandler) Run(c *gin.Context) {
 // List returns all running processes
 // GET /sandboxes/:id/commands/list
 func (h *CommandsHandler) List(c *gin.Context) {
-	id := c.Param("id")
-
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -84,11 +78,8 @@ func (h *CommandsHandler) List(c *gin.Context) {
 // Kill terminates a process
 // POST /sandboxes/:id/commands/kill
 func (h *CommandsHandler) Kill(c *gin.Context) {
-	id := c.Param("id")
-
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -117,11 +108,8 @@ func (h *CommandsHandler) Kill(c *gin.Context) {
 // Attach streams output from a running process
 // POST /sandboxes/:id/commands/attach
 func (h *CommandsHandler) Attach(c *gin.Context) {
-	id := c.Param("id")
-
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -153,11 +141,8 @@ func (h *CommandsHandler) Attach(c *gin.Context) {
 // Wait waits for a process to complete
 // POST /sandboxes/:id/commands/wait
 func (h *CommandsHandler) Wait(c *gin.Context) {
-	id := c.Param("id")
-
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"voidrun/internal/model"
+	"voidrun/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// ConsoleHandler serves the serial console of sandboxes
+type ConsoleHandler struct {
+	sandboxService *service.SandboxService
+}
+
+func NewConsoleHandler(sandboxService *service.SandboxService) *ConsoleHandler {
+	return &ConsoleHandler{sandboxService: sandboxService}
+}
+
+// Log handles GET /sandboxes/:id/console/log
+func (h *ConsoleHandler) Log(c *gin.Context) {
+	var tail int64
+	if v := c.Query("tail"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, model.NewErrorResponse("tail must be a non-negative number of bytes", ""))
+			return
+		}
+		tail = n
+	}
+
+	sandbox, found := resolveSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
+
+	data, err := h.sandboxService.ConsoleLog(c.Request.Context(), sandbox, tail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Failed to read console log", err.Error()))
+		return
+	}
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", data)
+}
+
+// Attach handles the WebSocket at GET /sandboxes/:id/console. Binary and text messages
+// from the client are written to the serial port; console output is sent as binary messages.
+func (h *ConsoleHandler) Attach(c *gin.Context) {
+	sandbox, found := resolveSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
+
+	session, err := h.sandboxService.AttachConsole(c.Request.Context(), sandbox)
+	if err != nil {
+		if errors.Is(err, model.ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse("cannot attach to the console while the sandbox is "+sandbox.Status, ""))
+			return
+		}
+		c.JSON(http.StatusServiceUnavailable, model.NewErrorResponse("Console unavailable", err.Error()))
+		return
+	}
+	defer session.Close()
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Client -> serial port
+	go func() {
+		defer session.Close()
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, err := session.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Serial port -> client, until the VM exits or the client leaves
+	for out := range session.Output() {
+		if err := conn.WriteMessage(websocket.BinaryMessage, out); err != nil {
+			return
+		}
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "console closed"))
+}
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/service"
+	"voidrun/pkg/util"
+
+	"github.com/gin-gonic/gin"
+)
+
+// eventHeartbeatInterval keeps idle streams open through proxies
+const eventHeartbeatInterval = 15 * time.Second
+
+type EventHandler struct {
+	eventService *service.EventService
+}
+
+func NewEventHandler(eventService *service.EventService) *EventHandler {
+	return &EventHandler{eventService: eventService}
+}
+
+// Stream handles GET /events as Server-Sent Events. Only events of the caller's org are
+// sent, optionally narrowed by ?sandboxId= and ?types=. A client that reconnects with
+// Last-Event-ID (or ?lastEventId=) first receives every event it missed. A client too slow
+// to keep up has its stream ended so that it reconnects that way.
+func (h *EventHandler) Stream(c *gin.Context) {
+	orgIDHex := c.GetString("orgID")
+	if orgIDHex == "" {
+		c.JSON(http.StatusUnauthorized, model.NewErrorResponse("missing org context", ""))
+		return
+	}
+	orgID, err := util.ParseObjectID(orgIDHex)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, model.NewErrorResponse("missing org context", ""))
+		return
+	}
+
+	sandboxID := c.Query("sandboxId")
+	types := map[string]bool{}
+	if v := c.Query("types"); v != "" {
+		for _, t := range strings.Split(v, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+	wanted := func(ev *model.Event) bool {
+		if sandboxID != "" && ev.SandboxID.Hex() != sandboxID {
+			return false
+		}
+		return len(types) == 0 || types[ev.Type]
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+
+	// Subscribe before replaying so nothing published in between is lost
+	live, cancel := h.eventService.Subscribe(orgID)
+	defer cancel()
+
+	var missed []*model.Event
+	more := false
+	if lastEventID != "" {
+		missed, more, err = h.eventService.Since(c.Request.Context(), orgIDHex, lastEventID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, model.NewErrorResponse("Invalid Last-Event-ID", err.Error()))
+			return
+		}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	// Replay page by page until the store has nothing newer. Paging follows the last
+	// stored event rather than the last one sent, so filtered events are not fetched twice.
+	sent := make(map[string]bool, len(missed))
+	for {
+		for _, ev := range missed {
+			sent[ev.ID.Hex()] = true
+			if wanted(ev) {
+				if err := writeEvent(c.Writer, ev); err != nil {
+					return
+				}
+			}
+		}
+		c.Writer.Flush()
+		if !more {
+			break
+		}
+		missed, more, err = h.eventService.Since(c.Request.Context(), orgIDHex, missed[len(missed)-1].ID.Hex())
+		if err != nil {
+			// The client resumes from the last event it received
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(c.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-live:
+			if !ok {
+				// Fell behind; the client resumes from its Last-Event-ID
+				return
+			}
+			if sent[ev.ID.Hex()] || !wanted(ev) {
+				continue
+			}
+			if err := writeEvent(c.Writer, ev); err != nil {
+				return
+			}
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, ev *model.Event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", ev.ID.Hex(), ev.Type, data)
+	return err
+}
@@ -35,12 +35,9 @@ func NewExecHandler(execService *service.ExecService, sessionService *service.Se
 
 // Exec handles POST /sandboxes/:id/exec
 func (h *ExecHandler) Exec(c *gin.Context) {
-	id := c.Param("id")
-
 	// Get sandbox from database to retrieve instance name
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -104,11 +101,8 @@ func (h *ExecHandler) Exec(c *gin.Context) {
 
 // SessionExec handles POST /sandboxes/:id/session-exec
 func (h *ExecHandler) SessionExec(c *gin.Context) {
-	id := c.Param("id")
-
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -135,11 +129,8 @@ func (h *ExecHandler) SessionExec(c *gin.Context) {
 
 // SessionExecStream handles POST /sandboxes/:id/session-exec-stream (streaming)
 func (h *ExecHandler) SessionExecStream(c *gin.Context) {
-	id := c.Param("id")
-
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -200,11 +191,8 @@ func (h *ExecHandler) SessionExecStream(c *gin.Context) {
 // @Failure 500 {object} model.ErrorResponse
 // @Router /sandboxes/{id}/exec-stream [post]
 func (h *ExecHandler) ExecStream(c *gin.Context) {
-	id := c.Param("id")
-
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -118,7 +118,6 @@ func (h *FSHandler) streamCopy(dst io.Writer, src io.Reader) (int64, error) {
 
 // ListFiles handles GET /sandboxes/:id/fs?path=/path/to/dir
 func (h *FSHandler) ListFiles(c *gin.Context) {
-	id := c.Param("id")
 	path := c.DefaultQuery("path", "/root")
 
 	if err := validatePath(path); err != nil {
@@ -126,9 +125,8 @@ func (h *FSHandler) ListFiles(c *gin.Context) {
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -144,7 +142,6 @@ func (h *FSHandler) ListFiles(c *gin.Context) {
 
 // DownloadFile handles GET /sandboxes/:id/fs/download?path=/path/to/file
 func (h *FSHandler) DownloadFile(c *gin.Context) {
-	id := c.Param("id")
 	filePath := c.Query("path")
 	if filePath == "" {
 		c.JSON(http.StatusBadRequest, model.NewErrorResponse("path is required", ""))
@@ -156,9 +153,8 @@ func (h *FSHandler) DownloadFile(c *gin.Context) {
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -190,7 +186,6 @@ func (h *FSHandler) DownloadFile(c *gin.Context) {
 
 // UploadFile handles POST /sandboxes/:id/fs/upload?path=/path/to/file
 func (h *FSHandler) UploadFile(c *gin.Context) {
-	id := c.Param("id")
 	targetPath := c.Query("path")
 
 	if targetPath == "" {
@@ -203,9 +198,8 @@ func (h *FSHandler) UploadFile(c *gin.Context) {
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -282,16 +276,14 @@ func (h *FSHandler) UploadFile(c *gin.Context) {
 
 // DeleteFile handles DELETE /sandboxes/:id/fs?path=/path/to/file
 func (h *FSHandler) DeleteFile(c *gin.Context) {
-	id := c.Param("id")
 	filePath := c.Query("path")
 	if filePath == "" {
 		c.JSON(http.StatusBadRequest, model.NewErrorResponse("path is required", ""))
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -307,16 +299,14 @@ func (h *FSHandler) DeleteFile(c *gin.Context) {
 
 // CreateDirectory handles POST /sandboxes/:id/fs/mkdir?path=/path/to/dir
 func (h *FSHandler) CreateDirectory(c *gin.Context) {
-	id := c.Param("id")
 	dirPath := c.Query("path")
 	if dirPath == "" {
 		c.JSON(http.StatusBadRequest, model.NewErrorResponse("path is required", ""))
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -332,7 +322,6 @@ func (h *FSHandler) CreateDirectory(c *gin.Context) {
 
 // MoveFile handles POST /sandboxes/:id/fs/move?from=/path/from&to=/path/to
 func (h *FSHandler) MoveFile(c *gin.Context) {
-	id := c.Param("id")
 	sourcePath := c.Query("from")
 	destPath := c.Query("to")
 
@@ -341,9 +330,8 @@ func (h *FSHandler) MoveFile(c *gin.Context) {
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -359,16 +347,14 @@ func (h *FSHandler) MoveFile(c *gin.Context) {
 
 // CreateFile handles POST /sandboxes/:id/files/create?path=/path/to/file
 func (h *FSHandler) CreateFile(c *gin.Context) {
-	id := c.Param("id")
 	filePath := c.Query("path")
 	if filePath == "" {
 		c.JSON(http.StatusBadRequest, model.NewErrorResponse("path is required", ""))
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -384,16 +370,14 @@ func (h *FSHandler) CreateFile(c *gin.Context) {
 
 // StatFile handles GET /sandboxes/:id/fs/stat?path=/path/to/file
 func (h *FSHandler) StatFile(c *gin.Context) {
-	id := c.Param("id")
 	filePath := c.Query("path")
 	if filePath == "" {
 		c.JSON(http.StatusBadRequest, model.NewErrorResponse("path is required", ""))
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -409,7 +393,6 @@ func (h *FSHandler) StatFile(c *gin.Context) {
 
 // CopyFile handles POST /sandboxes/:id/files/copy?from=...&to=...
 func (h *FSHandler) CopyFile(c *gin.Context) {
-	id := c.Param("id")
 	from := c.Query("from")
 	to := c.Query("to")
 	if from == "" || to == "" {
@@ -417,9 +400,8 @@ func (h *FSHandler) CopyFile(c *gin.Context) {
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -435,7 +417,6 @@ func (h *FSHandler) CopyFile(c *gin.Context) {
 
 // HeadTail handles GET /sandboxes/:id/files/head-tail?path=...&lines=10&head=true
 func (h *FSHandler) HeadTail(c *gin.Context) {
-	id := c.Param("id")
 	path := c.Query("path")
 	if path == "" {
 		c.JSON(http.StatusBadRequest, model.NewErrorResponse("path required", ""))
@@ -460,9 +441,8 @@ func (h *FSHandler) HeadTail(c *gin.Context) {
 
 	isHead := c.DefaultQuery("head", "true") == "true"
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -478,7 +458,6 @@ func (h *FSHandler) HeadTail(c *gin.Context) {
 
 // ChangePermissions handles POST /sandboxes/:id/files/chmod?path=...&mode=755
 func (h *FSHandler) ChangePermissions(c *gin.Context) {
-	id := c.Param("id")
 	path := c.Query("path")
 	mode := c.Query("mode")
 	if path == "" || mode == "" {
@@ -496,9 +475,8 @@ func (h *FSHandler) ChangePermissions(c *gin.Context) {
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -514,15 +492,13 @@ func (h *FSHandler) ChangePermissions(c *gin.Context) {
 
 // DiskUsage handles GET /sandboxes/:id/files/du?path=...
 func (h *FSHandler) DiskUsage(c *gin.Context) {
-	id := c.Param("id")
 	path := c.Query("path")
 	if path == "" {
 		path = "/root"
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -538,7 +514,6 @@ func (h *FSHandler) DiskUsage(c *gin.Context) {
 
 // SearchFiles handles GET /sandboxes/:id/files/search?path=...&pattern=...
 func (h *FSHandler) SearchFiles(c *gin.Context) {
-	id := c.Param("id")
 	path := c.Query("path")
 	pattern := c.Query("pattern")
 	if path == "" {
@@ -559,9 +534,8 @@ func (h *FSHandler) SearchFiles(c *gin.Context) {
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -577,7 +551,6 @@ func (h *FSHandler) SearchFiles(c *gin.Context) {
 
 // CompressFile handles POST /sandboxes/:id/files/compress?path=...&format=tar.gz
 func (h *FSHandler) CompressFile(c *gin.Context) {
-	id := c.Param("id")
 	path := c.Query("path")
 	format := c.Query("format")
 	if path == "" || format == "" {
@@ -585,9 +558,8 @@ func (h *FSHandler) CompressFile(c *gin.Context) {
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -603,7 +575,6 @@ func (h *FSHandler) CompressFile(c *gin.Context) {
 
 // ExtractArchive handles POST /sandboxes/:id/files/extract?archive=...&dest=...
 func (h *FSHandler) ExtractArchive(c *gin.Context) {
-	id := c.Param("id")
 	archive := c.Query("archive")
 	dest := c.Query("dest")
 	if archive == "" {
@@ -614,9 +585,8 @@ func (h *FSHandler) ExtractArchive(c *gin.Context) {
 		dest = filepath.Dir(archive)
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -632,8 +602,6 @@ func (h *FSHandler) ExtractArchive(c *gin.Context) {
 
 // StartWatch handles POST /sandboxes/:id/files/watch/start
 func (h *FSHandler) StartWatch(c *gin.Context) {
-	id := c.Param("id")
-
 	var req struct {
 		Path         string `json:"path" binding:"required"`
 		Recursive    bool   `json:"recursive"`
@@ -645,9 +613,8 @@ func (h *FSHandler) StartWatch(c *gin.Context) {
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
@@ -692,7 +659,6 @@ func (h *FSHandler) StartWatch(c *gin.Context) {
 
 // StreamWatchEvents handles WebSocket streaming of file watch events
 func (h *FSHandler) StreamWatchEvents(c *gin.Context) {
-	id := c.Param("id")
 	sessionID := c.Param("sessionId")
 
 	if sessionID == "" {
@@ -700,9 +666,8 @@ func (h *FSHandler) StreamWatchEvents(c *gin.Context) {
 		return
 	}
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 	sbxInstance := sandbox.ID.Hex()
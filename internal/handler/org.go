@@ -64,8 +64,43 @@ func (h *OrgHandler) GetCurrentOrg(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, model.NewSuccessResponse("org", gin.H{
-		"id":   org.ID.Hex(),
-		"name": org.Name,
+		"id":             org.ID.Hex(),
+		"name":           org.Name,
+		"sandboxPeering": org.SandboxPeering,
+	}))
+}
+
+// UpdateNetwork sets whether the org's sandboxes may reach each other (PATCH /api/orgs/:orgId/network)
+func (h *OrgHandler) UpdateNetwork(c *gin.Context) {
+	if !ensureOrgAccess(c) {
+		return
+	}
+	orgID, err := primitive.ObjectIDFromHex(c.Param("orgId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse("Invalid org ID format", err.Error()))
+		return
+	}
+
+	var req model.UpdateOrgNetworkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+		return
+	}
+
+	org, err := h.orgService.SetSandboxPeering(c.Request.Context(), orgID, *req.SandboxPeering)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Failed to update org network", err.Error()))
+		return
+	}
+	if org == nil {
+		c.JSON(http.StatusNotFound, model.NewErrorResponse("org not found", ""))
+		return
+	}
+
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Org network updated", gin.H{
+		"id":             org.ID.Hex(),
+		"name":           org.Name,
+		"sandboxPeering": org.SandboxPeering,
 	}))
 }
 
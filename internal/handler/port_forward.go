@@ -0,0 +1,118 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// PortForwardHandler tunnels TCP connections to guest ports over WebSockets
+type PortForwardHandler struct {
+	sandboxService *service.SandboxService
+}
+
+func NewPortForwardHandler(sandboxService *service.SandboxService) *PortForwardHandler {
+	return &PortForwardHandler{sandboxService: sandboxService}
+}
+
+// Forward handles the WebSocket at GET /sandboxes/:id/port-forward?port=N. Each WebSocket
+// carries one TCP connection to localhost:N in the guest; clients open one per local
+// connection to run several streams at once. Binary and text messages from the client are
+// written to the stream and guest output is sent as binary messages. An empty binary
+// message half-closes the stream. The server closes with 1000 when the guest closes the
+// connection and with 1011 when the stream fails.
+func (h *PortForwardHandler) Forward(c *gin.Context) {
+	port, err := strconv.Atoi(c.Query("port"))
+	if err != nil || port < 1 || port > 65535 {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse("port must be between 1 and 65535", ""))
+		return
+	}
+
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
+
+	// Dial before upgrading so a closed port is reported with a plain HTTP status
+	stream, err := h.sandboxService.OpenPortForward(c.Request.Context(), sandbox, port)
+	if err != nil {
+		if errors.Is(err, model.ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse("cannot forward a port while the sandbox is "+sandbox.Status, ""))
+			return
+		}
+		if errors.Is(err, model.ErrPortForwardUnsupported) {
+			c.JSON(http.StatusNotImplemented, model.NewErrorResponse("The guest agent of this sandbox does not support port forwarding; rebuild the image with an agent that serves /port-forward", ""))
+			return
+		}
+		c.JSON(http.StatusBadGateway, model.NewErrorResponse(fmt.Sprintf("Failed to connect to port %d", port), err.Error()))
+		return
+	}
+	defer stream.Close()
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sbxID := sandbox.ID.Hex()
+	start := time.Now()
+	var sent, received int64
+	fmt.Printf("[port-forward] Sandbox %s port %d: stream opened from %s\n", sbxID, port, c.ClientIP())
+	defer func() {
+		fmt.Printf("[port-forward] Sandbox %s port %d: stream closed after %s (%d bytes in, %d bytes out)\n",
+			sbxID, port, time.Since(start).Round(time.Millisecond), atomic.LoadInt64(&sent), received)
+	}()
+
+	// Client -> guest
+	go func() {
+		defer stream.Close()
+		for {
+			mt, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if mt == websocket.BinaryMessage && len(msg) == 0 {
+				if cw, ok := stream.(interface{ CloseWrite() error }); ok {
+					cw.CloseWrite()
+				}
+				continue
+			}
+			n, err := stream.Write(msg)
+			atomic.AddInt64(&sent, int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Guest -> client, until either side closes
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := stream.Read(buf)
+		if n > 0 {
+			if werr := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+				return
+			}
+			received += int64(n)
+		}
+		if err != nil {
+			closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "connection closed")
+			if !errors.Is(err, io.EOF) {
+				closeMsg = websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "stream failed")
+			}
+			conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+			return
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PreviewHandler manages sandbox preview URLs and proxies preview traffic
+type PreviewHandler struct {
+	previewService *service.PreviewService
+	sandboxService *service.SandboxService
+	apiKeyService  *service.APIKeyService
+}
+
+// NewPreviewHandler creates a new PreviewHandler
+func NewPreviewHandler(previewSvc *service.PreviewService, sandboxSvc *service.SandboxService, apiKeySvc *service.APIKeyService) *PreviewHandler {
+	return &PreviewHandler{previewService: previewSvc, sandboxService: sandboxSvc, apiKeyService: apiKeySvc}
+}
+
+// Get handles GET /sandboxes/:id/preview, listing the ports listening in a running sandbox
+func (h *PreviewHandler) Get(c *gin.Context) {
+	sandbox, found := resolveSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
+
+	ports := []model.PreviewPort{}
+	if sandbox.Status == model.SandboxStatusRunning {
+		detected, err := h.previewService.Ports(c.Request.Context(), sandbox)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, model.NewErrorResponse("Failed to list sandbox ports", err.Error()))
+			return
+		}
+		ports = detected
+	}
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Sandbox preview", model.SandboxPreview{
+		Enabled: sandbox.PreviewEnabled,
+		Ports:   ports,
+	}))
+}
+
+// Update handles PATCH /sandboxes/:id/preview
+func (h *PreviewHandler) Update(c *gin.Context) {
+	sandbox, found := resolveSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
+
+	var req model.UpdatePreviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse("Invalid request", err.Error()))
+		return
+	}
+
+	sandbox, err := h.previewService.SetEnabled(c.Request.Context(), sandbox, *req.Enabled)
+	if err != nil {
+		if errors.Is(err, model.ErrNetworkless) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse(err.Error(), ""))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Failed to update sandbox preview", err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Sandbox preview updated", model.SandboxPreview{
+		Enabled: sandbox.PreviewEnabled,
+		Ports:   []model.PreviewPort{},
+	}))
+}
+
+// CreateToken handles POST /sandboxes/:id/preview/tokens
+func (h *PreviewHandler) CreateToken(c *gin.Context) {
+	sandbox, found := resolveSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
+
+	var req model.CreatePreviewTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse("Invalid request", err.Error()))
+		return
+	}
+
+	token, err := h.previewService.IssueToken(sandbox, req.Port, req.TTLSec)
+	if err != nil {
+		if errors.Is(err, model.ErrPreviewDisabled) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse(err.Error(), ""))
+			return
+		}
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse("Invalid request", err.Error()))
+		return
+	}
+	c.JSON(http.StatusCreated, model.NewSuccessResponse("Preview token created", token))
+}
+
+// ProxyPath handles /preview/:id/:port/*path
+func (h *PreviewHandler) ProxyPath(c *gin.Context) {
+	port, err := service.ParsePreviewPort(c.Param("port"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse("Invalid port", err.Error()))
+		return
+	}
+	id := c.Param("id")
+	base := fmt.Sprintf("/preview/%s/%d/", id, port)
+	c.Request.URL.Path = "/" + strings.TrimPrefix(c.Param("path"), "/")
+	c.Request.URL.RawPath = ""
+	h.proxy(c, id, port, base)
+}
+
+// HostRouter proxies requests for preview hosts, <port>-<sandboxId>.<PREVIEW_DOMAIN>, and
+// passes every other request on to the API routes
+func (h *PreviewHandler) HostRouter() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, port, ok := h.previewService.ParseHost(c.Request.Host)
+		if !ok {
+			c.Next()
+			return
+		}
+		h.proxy(c, id, port, "/")
+		c.Abort()
+	}
+}
+
+// proxy authenticates a preview request and forwards it to the sandbox. cookiePath scopes
+// the cookie that keeps a share token for the rest of the browsing session.
+func (h *PreviewHandler) proxy(c *gin.Context, id string, port int, cookiePath string) {
+	start := time.Now()
+	via := ""
+	defer func() {
+		fmt.Printf("[preview] %s %d %s %s:%d %s via=%s client=%s %s\n",
+			start.Format(time.RFC3339), c.Writer.Status(), c.Request.Method, id, port,
+			redactedURI(c.Request.URL), via, c.ClientIP(), time.Since(start).Round(time.Millisecond))
+	}()
+
+	sandbox, via, ok := h.authorize(c, id, port)
+	if !ok {
+		// Every failure looks the same, so the proxy does not reveal which sandboxes exist
+		c.JSON(http.StatusNotFound, model.NewErrorResponse("Preview not found", ""))
+		return
+	}
+	if !sandbox.PreviewEnabled {
+		c.JSON(http.StatusForbidden, model.NewErrorResponse(model.ErrPreviewDisabled.Error(), ""))
+		return
+	}
+
+	// A token in the URL is moved into a cookie so the app's own links keep working
+	if token := c.Query(service.PreviewTokenParam); token != "" && via == "token" {
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     service.PreviewCookie,
+			Value:    token,
+			Path:     cookiePath,
+			HttpOnly: true,
+			Secure:   c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+		if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+			u := *c.Request.URL
+			q := u.Query()
+			q.Del(service.PreviewTokenParam)
+			u.RawQuery = q.Encode()
+			location := u.RequestURI()
+			if cookiePath != "/" {
+				location = strings.TrimSuffix(cookiePath, "/") + location
+			}
+			c.Redirect(http.StatusFound, location)
+			return
+		}
+	}
+
+	sandbox, err := h.sandboxService.EnsureAwake(c.Request.Context(), sandbox)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, model.NewErrorResponse("Failed to wake sandbox", err.Error()))
+		return
+	}
+	if sandbox.Status != model.SandboxStatusRunning {
+		c.JSON(http.StatusServiceUnavailable, model.NewErrorResponse(fmt.Sprintf("Sandbox is %s", sandbox.Status), ""))
+		return
+	}
+
+	// Preview traffic keeps the sandbox from being reaped as idle
+	sandboxID := sandbox.ID.Hex()
+	h.sandboxService.BeginActivity(sandboxID)
+	defer h.sandboxService.EndActivity(sandboxID)
+
+	proxy := h.previewService.Proxy(sandbox, port, func(w http.ResponseWriter, err error) {
+		c.JSON(http.StatusBadGateway, model.NewErrorResponse(fmt.Sprintf("Nothing reachable on port %d of the sandbox", port), err.Error()))
+	})
+	proxy.ServeHTTP(c.Writer, c.Request)
+}
+
+// authorize loads the sandbox for a request that carries an API key of its org or a share
+// token for this port. The credentials are checked before the sandbox is looked up.
+func (h *PreviewHandler) authorize(c *gin.Context, id string, port int) (*model.Sandbox, string, bool) {
+	ctx := c.Request.Context()
+	if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+		keyDoc, err := h.apiKeyService.ValidateKey(ctx, apiKey, c.ClientIP())
+		if err != nil || keyDoc == nil || !keyDoc.IsActive {
+			return nil, "", false
+		}
+		sandbox, found := h.sandboxService.GetForOrg(ctx, id, keyDoc.OrgID.Hex())
+		return sandbox, "api-key", found && sandbox != nil
+	}
+
+	token := c.Query(service.PreviewTokenParam)
+	if token == "" {
+		token = c.GetHeader(service.PreviewTokenHeader)
+	}
+	if token == "" {
+		token, _ = c.Cookie(service.PreviewCookie)
+	}
+	if token == "" {
+		return nil, "", false
+	}
+	if tokenSandbox, err := h.previewService.TokenSandbox(token); err != nil || tokenSandbox != id {
+		return nil, "", false
+	}
+	sandbox, found := h.sandboxService.Get(ctx, id)
+	if !found || sandbox == nil || h.previewService.VerifyToken(token, sandbox, port) != nil {
+		return nil, "", false
+	}
+	return sandbox, "token", true
+}
+
+// redactedURI is the request URI of u without a share token in its query, for logging
+func redactedURI(u *url.URL) string {
+	if q := u.Query(); q.Has(service.PreviewTokenParam) {
+		q.Del(service.PreviewTokenParam)
+		redacted := *u
+		redacted.RawQuery = q.Encode()
+		return redacted.RequestURI()
+	}
+	return u.RequestURI()
+}
@@ -33,7 +33,11 @@ var wsUpgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { re
 
 // Proxy handles the ephemeral PTY WebSocket connection (existing functionality)
 func (h *PTYHandler) Proxy(c *gin.Context) {
-	sbxInstance := c.Param("id")
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
+	sbxInstance := sandbox.ID.Hex()
 
 	clientConn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -129,11 +133,8 @@ func (h *PTYHandler) Proxy(c *gin.Context) {
 
 // CreateSession handles POST /sandboxes/:id/pty/sessions
 func (h *PTYHandler) CreateSession(c *gin.Context) {
-	id := c.Param("id")
-
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -151,11 +152,8 @@ func (h *PTYHandler) CreateSession(c *gin.Context) {
 
 // ListSessions handles GET /sandboxes/:id/pty/sessions
 func (h *PTYHandler) ListSessions(c *gin.Context) {
-	id := c.Param("id")
-
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -173,12 +171,10 @@ func (h *PTYHandler) ListSessions(c *gin.Context) {
 
 // ConnectSession handles WebSocket connection to a persistent session
 func (h *PTYHandler) ConnectSession(c *gin.Context) {
-	id := c.Param("id")
 	sessionID := c.Param("sessionId")
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -275,12 +271,10 @@ func (h *PTYHandler) ConnectSession(c *gin.Context) {
 
 // DeleteSession handles DELETE /sandboxes/:id/pty/sessions/:sessionId
 func (h *PTYHandler) DeleteSession(c *gin.Context) {
-	id := c.Param("id")
 	sessionID := c.Param("sessionId")
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -297,12 +291,10 @@ func (h *PTYHandler) DeleteSession(c *gin.Context) {
 
 // ExecuteCommand handles POST /sandboxes/:id/pty/sessions/:sessionId/execute
 func (h *PTYHandler) ExecuteCommand(c *gin.Context) {
-	id := c.Param("id")
 	sessionID := c.Param("sessionId")
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -328,12 +320,10 @@ func (h *PTYHandler) ExecuteCommand(c *gin.Context) {
 
 // GetBuffer handles GET /sandboxes/:id/pty/sessions/:sessionId/buffer
 func (h *PTYHandler) GetBuffer(c *gin.Context) {
-	id := c.Param("id")
 	sessionID := c.Param("sessionId")
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
@@ -351,12 +341,10 @@ func (h *PTYHandler) GetBuffer(c *gin.Context) {
 
 // ResizeTerminal handles POST /sandboxes/:id/pty/sessions/:sessionId/resize
 func (h *PTYHandler) ResizeTerminal(c *gin.Context) {
-	id := c.Param("id")
 	sessionID := c.Param("sessionId")
 
-	sandbox, found := h.sandboxService.Get(c.Request.Context(), id)
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
 	if !found {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
 		return
 	}
 
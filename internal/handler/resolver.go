@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"net/http"
+
+	"voidrun/internal/model"
+	"voidrun/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestOrgID returns the org of the authenticated API key. On failure the response
+// has already been written.
+func requestOrgID(c *gin.Context) (string, bool) {
+	orgID, ok := c.Get("orgID")
+	if id, isString := orgID.(string); ok && isString && id != "" {
+		return id, true
+	}
+	c.JSON(http.StatusUnauthorized, model.NewErrorResponse("missing org context", ""))
+	return "", false
+}
+
+// resolveSandbox loads the sandbox named by the :id path param, scoped to the
+// org of the authenticated API key. Sandboxes owned by other orgs are reported
+// as 404 so that callers cannot probe for foreign IDs. On failure the response
+// has already been written and the caller should return. A resolved sandbox is
+// marked active for the idle reaper until the request completes.
+func resolveSandbox(c *gin.Context, sandboxService *service.SandboxService) (*model.Sandbox, bool) {
+	orgID, ok := requestOrgID(c)
+	if !ok {
+		return nil, false
+	}
+
+	sandbox, found := sandboxService.GetForOrg(c.Request.Context(), c.Param("id"), orgID)
+	if !found || sandbox == nil {
+		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
+		return nil, false
+	}
+
+	// Count the request as sandbox activity until middleware.SandboxActivity ends it
+	if _, tracked := c.Get(model.CtxActivitySandboxID); !tracked {
+		id := sandbox.ID.Hex()
+		sandboxService.BeginActivity(id)
+		c.Set(model.CtxActivitySandboxID, id)
+	}
+	return sandbox, true
+}
+
+// resolveAwakeSandbox is resolveSandbox for requests that reach into the guest.
+// A hibernated sandbox is woken before it is returned.
+func resolveAwakeSandbox(c *gin.Context, sandboxService *service.SandboxService) (*model.Sandbox, bool) {
+	sandbox, found := resolveSandbox(c, sandboxService)
+	if !found {
+		return nil, false
+	}
+	sandbox, err := sandboxService.EnsureAwake(c.Request.Context(), sandbox)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, model.NewErrorResponse("Failed to wake sandbox", err.Error()))
+		return nil, false
+	}
+	return sandbox, true
+}
+
+// resolveSnapshot loads the snapshot named by the :id path param, scoped to the
+// org of the authenticated API key, with the same 404 semantics as resolveSandbox.
+func resolveSnapshot(c *gin.Context, snapshotService *service.SnapshotService) (*model.Snapshot, bool) {
+	orgID, ok := requestOrgID(c)
+	if !ok {
+		return nil, false
+	}
+
+	snapshot, found := snapshotService.GetForOrg(c.Request.Context(), c.Param("id"), orgID)
+	if !found || snapshot == nil {
+		c.JSON(http.StatusNotFound, model.NewErrorResponse("Snapshot not found", ""))
+		return nil, false
+	}
+	return snapshot, true
+}
+
+// resolveWebhook loads the webhook named by the :id path param, scoped to the
+// org of the authenticated API key, with the same 404 semantics as resolveSandbox.
+func resolveWebhook(c *gin.Context, webhookService *service.WebhookService) (*model.Webhook, bool) {
+	orgID, ok := requestOrgID(c)
+	if !ok {
+		return nil, false
+	}
+
+	webhook, found := webhookService.GetForOrg(c.Request.Context(), c.Param("id"), orgID)
+	if !found || webhook == nil {
+		c.JSON(http.StatusNotFound, model.NewErrorResponse("Webhook not found", ""))
+		return nil, false
+	}
+	return webhook, true
+}
@@ -1,8 +1,9 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"net/http"
-	"path/filepath"
 	"strconv"
 
 	"voidrun/internal/model"
@@ -110,10 +111,7 @@ func (h *SandboxHandler) Create(c *gin.Context) {
 	}
 	req.OrgID = orgIDVal.(string)
 
-	// userIDVal, ok := c.Get("userID")
-	// if ok {
-	// 	req.UserID = userIDVal.(string)
-	// }
+	req.UserID = c.GetString("userID")
 
 	spec, err := h.sandboxService.Create(c.Request.Context(), req)
 	if err != nil {
@@ -121,6 +119,12 @@ func (h *SandboxHandler) Create(c *gin.Context) {
 		if err.Error() == "Sandbox ID already exists in DB" {
 			status = http.StatusConflict
 		}
+		if errors.Is(err, model.ErrLifetimeExceedsPlan) || errors.Is(err, model.ErrInvalidNetworkPolicy) || errors.Is(err, model.ErrInvalidIOLimits) {
+			status = http.StatusBadRequest
+		}
+		if errors.Is(err, model.ErrAddressPoolExhausted) || errors.Is(err, model.ErrEgressUnavailable) {
+			status = http.StatusServiceUnavailable
+		}
 		c.JSON(status, model.NewErrorResponse(err.Error(), ""))
 		return
 	}
@@ -128,112 +132,242 @@ func (h *SandboxHandler) Create(c *gin.Context) {
 	c.JSON(http.StatusCreated, model.NewSuccessResponse("Sandbox created", spec))
 }
 
-func (h *SandboxHandler) Restore(c *gin.Context) {
-	var req model.RestoreSandboxRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+func (h *SandboxHandler) Get(c *gin.Context) {
+	sandbox, found := resolveSandbox(c, h.sandboxService)
+	if !found {
 		return
 	}
 
-	// Extract orgID and userID from context
-	orgIDVal, ok := c.Get("orgID")
-	if ok {
-		req.OrgID = orgIDVal.(string)
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Sandbox details fetched", sandbox))
+}
+
+func (h *SandboxHandler) Delete(c *gin.Context) {
+	sandbox, found := resolveSandbox(c, h.sandboxService)
+	if !found {
+		return
 	}
-	userIDVal, ok := c.Get("userID")
-	if ok {
-		req.UserID = userIDVal.(string)
+
+	if err := h.sandboxService.Delete(c.Request.Context(), sandbox.ID.Hex()); err != nil {
+		if errors.Is(err, model.ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse("Delete not allowed while sandbox is "+sandbox.Status, ""))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Delete failed", err.Error()))
+		return
 	}
 
-	// Validate CPU count
-	if req.CPU < minCPU || req.CPU > maxCPU {
-		c.JSON(http.StatusBadRequest, model.NewErrorResponse(
-			"invalid cpu count: must be between 1 and 16",
-			"",
-		))
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Sandbox deleted", nil))
+}
+
+// Stop handles POST /sandboxes/:id/stop
+func (h *SandboxHandler) Stop(c *gin.Context) {
+	h.sandboxAction(c, "stop", "stopped", h.sandboxService.Stop)
+}
+
+// Start handles POST /sandboxes/:id/start
+func (h *SandboxHandler) Start(c *gin.Context) {
+	h.sandboxAction(c, "start", "started", h.sandboxService.Start)
+}
+
+// Pause handles POST /sandboxes/:id/pause
+func (h *SandboxHandler) Pause(c *gin.Context) {
+	h.sandboxAction(c, "pause", "paused", h.sandboxService.Pause)
+}
+
+// Resume handles POST /sandboxes/:id/resume
+func (h *SandboxHandler) Resume(c *gin.Context) {
+	h.sandboxAction(c, "resume", "resumed", h.sandboxService.Resume)
+}
+
+// Hibernate handles POST /sandboxes/:id/hibernate
+func (h *SandboxHandler) Hibernate(c *gin.Context) {
+	h.sandboxAction(c, "hibernate", "hibernated", h.sandboxService.Hibernate)
+}
+
+// Resize handles PATCH /sandboxes/:id/resources
+func (h *SandboxHandler) Resize(c *gin.Context) {
+	sandbox, found := resolveSandbox(c, h.sandboxService)
+	if !found {
 		return
 	}
 
-	// Validate Memory (MiB)
-	if req.Mem < minMemMiB || req.Mem > maxMemMiB {
-		c.JSON(http.StatusBadRequest, model.NewErrorResponse(
-			"invalid memory size: must be between 1 GiB and 16 GiB",
-			"",
-		))
+	var req model.ResizeSandboxRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+		return
+	}
+	if req.CPU == nil && req.Mem == nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse("cpu or mem is required", ""))
 		return
 	}
 
-	ip, err := h.sandboxService.Restore(c.Request.Context(), req)
+	updated, err := h.sandboxService.Resize(c.Request.Context(), sandbox, req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, model.NewErrorResponse(err.Error(), ""))
+		if errors.Is(err, model.ErrResizeOutOfBounds) {
+			c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+			return
+		}
+		if errors.Is(err, model.ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse("cannot resize sandbox while it is "+sandbox.Status, ""))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Resize failed", err.Error()))
 		return
 	}
 
-	c.JSON(http.StatusCreated, model.NewSuccessResponse("Sandbox restored", gin.H{"ip": ip}))
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Sandbox resized", updated))
 }
 
-func (h *SandboxHandler) Get(c *gin.Context) {
-	id := c.Param("id")
+// UpdateNetwork handles PATCH /sandboxes/:id/network
+func (h *SandboxHandler) UpdateNetwork(c *gin.Context) {
+	sandbox, found := resolveSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
 
-	sandbox, ok := h.sandboxService.Get(c.Request.Context(), id)
-	if !ok || sandbox == nil {
-		c.JSON(http.StatusNotFound, model.NewErrorResponse("Sandbox not found", ""))
+	var req model.UpdateNetworkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
 		return
 	}
 
-	c.JSON(http.StatusOK, model.NewSuccessResponse("Sandbox details fetched", sandbox))
-}
+	updated, err := h.sandboxService.UpdateNetworkPolicy(c.Request.Context(), sandbox, req)
+	if err != nil {
+		if errors.Is(err, model.ErrInvalidNetworkPolicy) {
+			c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+			return
+		}
+		if errors.Is(err, model.ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse("cannot update network of sandbox while it is "+sandbox.Status, ""))
+			return
+		}
+		if errors.Is(err, model.ErrEgressUnavailable) {
+			c.JSON(http.StatusServiceUnavailable, model.NewErrorResponse(err.Error(), ""))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Network update failed", err.Error()))
+		return
+	}
 
-func (h *SandboxHandler) Delete(c *gin.Context) {
-	id := c.Param("id")
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Sandbox network updated", updated))
+}
 
-	if err := h.sandboxService.Delete(c.Request.Context(), id); err != nil {
-		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Delete failed", err.Error()))
+// UpdateIOLimits handles PATCH /sandboxes/:id/io-limits
+func (h *SandboxHandler) UpdateIOLimits(c *gin.Context) {
+	sandbox, found := resolveSandbox(c, h.sandboxService)
+	if !found {
 		return
 	}
 
-	c.JSON(http.StatusOK, model.NewSuccessResponse("Sandbox deleted", nil))
-}
+	var req model.UpdateIOLimitsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+		return
+	}
 
-func (h *SandboxHandler) Stop(c *gin.Context) {
-	h.sandboxAction(c, "stop", h.sandboxService.Stop)
-}
+	updated, err := h.sandboxService.UpdateIOLimits(c.Request.Context(), sandbox, req)
+	if err != nil {
+		if errors.Is(err, model.ErrInvalidIOLimits) {
+			c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+			return
+		}
+		if errors.Is(err, model.ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse("cannot update I/O limits of sandbox while it is "+sandbox.Status, ""))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("I/O limits update failed", err.Error()))
+		return
+	}
 
-func (h *SandboxHandler) Pause(c *gin.Context) {
-	h.sandboxAction(c, "pause", h.sandboxService.Pause)
+	message := "Sandbox I/O limits updated"
+	if updated.Status != model.SandboxStatusStopped && updated.Status != model.SandboxStatusHibernated {
+		message = "Sandbox I/O limits updated; they apply when the sandbox next boots or wakes"
+	}
+	c.JSON(http.StatusOK, model.NewSuccessResponse(message, updated))
 }
 
-func (h *SandboxHandler) Resume(c *gin.Context) {
-	h.sandboxAction(c, "resume", h.sandboxService.Resume)
-}
+// Extend handles POST /sandboxes/:id/extend
+func (h *SandboxHandler) Extend(c *gin.Context) {
+	sandbox, found := resolveSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
 
-func (h *SandboxHandler) Snapshot(c *gin.Context) {
-	id := c.Param("id")
+	var req model.ExtendSandboxRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+		return
+	}
 
-	if err := h.sandboxService.CreateSnapshot(id); err != nil {
-		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Snapshot failed", err.Error()))
+	updated, err := h.sandboxService.Extend(c.Request.Context(), sandbox, req.TimeoutSec)
+	if err != nil {
+		if errors.Is(err, model.ErrLifetimeExceedsPlan) {
+			c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+			return
+		}
+		if errors.Is(err, model.ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse("cannot extend sandbox while it is "+sandbox.Status, ""))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Extend failed", err.Error()))
 		return
 	}
 
-	c.JSON(http.StatusOK, model.NewSuccessResponse("Snapshot created", gin.H{
-		"base_path": h.sandboxService.GetSnapshotsBasePath(id),
-	}))
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Sandbox timeout extended", updated))
 }
 
-func (h *SandboxHandler) ListSnapshots(c *gin.Context) {
-	id := c.Param("id")
+// Fork handles POST /sandboxes/:id/fork?count=N
+func (h *SandboxHandler) Fork(c *gin.Context) {
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
+
+	count := 1
+	if v := c.Query("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, model.NewErrorResponse("invalid count: must be a positive integer", ""))
+			return
+		}
+		count = n
+	}
+	if max := h.sandboxService.MaxForkCount(); count > max {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse("invalid count: must be at most "+strconv.Itoa(max), ""))
+		return
+	}
 
-	snaps, err := h.sandboxService.ListSnapshots(id)
+	children, err := h.sandboxService.Fork(c.Request.Context(), sandbox, c.GetString("userID"), count)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Failed to scan snapshots", ""))
+		if errors.Is(err, model.ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse("cannot fork sandbox while it is "+sandbox.Status, ""))
+			return
+		}
+		if errors.Is(err, model.ErrAddressPoolExhausted) || errors.Is(err, model.ErrEgressUnavailable) {
+			c.JSON(http.StatusServiceUnavailable, model.NewErrorResponse("Fork failed", err.Error()))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Fork failed", err.Error()))
 		return
 	}
 
-	c.JSON(http.StatusOK, snaps)
+	ids := make([]string, 0, len(children))
+	for _, child := range children {
+		ids = append(ids, child.ID.Hex())
+	}
+	c.JSON(http.StatusCreated, model.NewSuccessResponse("Sandbox forked", gin.H{
+		"sourceId":  sandbox.ID.Hex(),
+		"ids":       ids,
+		"sandboxes": children,
+	}))
 }
 
 func (h *SandboxHandler) Upload(c *gin.Context) {
-	id := c.Param("id")
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
+	id := sandbox.ID.Hex()
 
 	// Get target path from form data
 	targetPath := c.PostForm("targetPath")
@@ -279,18 +413,28 @@ func (h *SandboxHandler) Upload(c *gin.Context) {
 	}))
 }
 
-func (h *SandboxHandler) sandboxAction(c *gin.Context, action string, fn func(string) error) {
-	id := c.Param("id")
+// sandboxAction runs a lifecycle operation on the resolved sandbox. Operations that
+// are not allowed from the sandbox's current state are rejected with 409.
+func (h *SandboxHandler) sandboxAction(c *gin.Context, action, done string, fn func(context.Context, string) error) {
+	sandbox, found := resolveSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
 
-	if err := fn(id); err != nil {
+	if err := fn(c.Request.Context(), sandbox.ID.Hex()); err != nil {
+		if errors.Is(err, model.ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse(
+				"cannot "+action+" sandbox while it is "+sandbox.Status, "",
+			))
+			return
+		}
+		if errors.Is(err, model.ErrEgressUnavailable) {
+			c.JSON(http.StatusServiceUnavailable, model.NewErrorResponse(action+" failed", err.Error()))
+			return
+		}
 		c.JSON(http.StatusInternalServerError, model.NewErrorResponse(action+" failed", err.Error()))
 		return
 	}
 
-	c.JSON(http.StatusOK, model.NewSuccessResponse("Sandbox "+action+"d", nil))
-}
-
-func GetSnapshotsBasePath(id string) string {
-	pwd, _ := filepath.Abs(".")
-	return filepath.Join(pwd, "instances", id, "snapshots")
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Sandbox "+done, nil))
 }
@@ -0,0 +1,211 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"voidrun/internal/model"
+	"voidrun/internal/service"
+	"voidrun/pkg/util"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SnapshotHandler struct {
+	snapshotService *service.SnapshotService
+	sandboxService  *service.SandboxService
+}
+
+func NewSnapshotHandler(snapshotService *service.SnapshotService, sandboxService *service.SandboxService) *SnapshotHandler {
+	return &SnapshotHandler{snapshotService: snapshotService, sandboxService: sandboxService}
+}
+
+// Create handles POST /sandboxes/:id/snapshots
+func (h *SnapshotHandler) Create(c *gin.Context) {
+	sandbox, found := resolveAwakeSandbox(c, h.sandboxService)
+	if !found {
+		return
+	}
+
+	// Body is optional; an empty name is generated from the sandbox name
+	var req model.CreateSnapshotRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+		return
+	}
+	if req.Name != "" {
+		if err := util.ValidateDNS1123Subdomain(req.Name); err != nil {
+			c.JSON(http.StatusBadRequest, model.NewErrorResponse("invalid name: "+err.Error(), ""))
+			return
+		}
+	}
+
+	snapshot, err := h.snapshotService.Create(c.Request.Context(), sandbox, c.GetString("userID"), req)
+	if err != nil {
+		if errors.Is(err, model.ErrInvalidTransition) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse("cannot snapshot sandbox while it is "+sandbox.Status, ""))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Snapshot failed", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusCreated, model.NewSuccessResponse("Snapshot created", snapshot))
+}
+
+// List handles GET /snapshots with pagination and an optional sandboxId filter
+func (h *SnapshotHandler) List(c *gin.Context) {
+	orgIDHex, ok := c.Get("orgID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, model.NewErrorResponse("missing org context", ""))
+		return
+	}
+
+	page := 1
+	pageSize := 0 // Let service use default from config
+
+	if p := c.Query("page"); p != "" {
+		if v, err := strconv.Atoi(p); err == nil && v > 0 {
+			page = v
+		}
+	}
+	if s := c.Query("limit"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v > 0 {
+			pageSize = v
+		}
+	}
+
+	snapshots, total, actualPageSize, err := h.snapshotService.ListByOrgPaginated(c.Request.Context(), orgIDHex.(string), c.Query("sandboxId"), page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+		return
+	}
+
+	totalPages := (total + int64(actualPageSize) - 1) / int64(actualPageSize)
+
+	c.JSON(http.StatusOK, model.NewSuccessResponseWithMeta("Snapshots fetched", snapshots, map[string]interface{}{
+		"page":       page,
+		"limit":      actualPageSize,
+		"total":      total,
+		"totalPages": totalPages,
+	}))
+}
+
+// Delete handles DELETE /snapshots/:id
+func (h *SnapshotHandler) Delete(c *gin.Context) {
+	snapshot, found := resolveSnapshot(c, h.snapshotService)
+	if !found {
+		return
+	}
+
+	if err := h.snapshotService.Delete(c.Request.Context(), snapshot); err != nil {
+		if errors.Is(err, model.ErrSnapshotNotReady) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse("Snapshot is not ready", "still being created or being deleted"))
+			return
+		}
+		if errors.Is(err, model.ErrSnapshotInUse) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse("Snapshot is in use", "delete the sandboxes restored from it first"))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Delete failed", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Snapshot deleted", nil))
+}
+
+// Restore handles POST /snapshots/:id/restore
+func (h *SnapshotHandler) Restore(c *gin.Context) {
+	snapshot, found := resolveSnapshot(c, h.snapshotService)
+	if !found {
+		return
+	}
+
+	var req model.RestoreSandboxRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+		return
+	}
+	if err := util.ValidateDNS1123Subdomain(req.Name); err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse("invalid name: "+err.Error(), ""))
+		return
+	}
+
+	req.OrgID = c.GetString("orgID")
+	req.UserID = c.GetString("userID")
+
+	sandbox, err := h.snapshotService.Restore(c.Request.Context(), snapshot, req)
+	if err != nil {
+		if errors.Is(err, model.ErrSnapshotNotReady) {
+			c.JSON(http.StatusConflict, model.NewErrorResponse("Snapshot is not ready", "still being created or being deleted"))
+			return
+		}
+		if errors.Is(err, model.ErrLifetimeExceedsPlan) || errors.Is(err, model.ErrInvalidNetworkPolicy) || errors.Is(err, model.ErrInvalidIOLimits) {
+			c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+			return
+		}
+		if errors.Is(err, model.ErrAddressPoolExhausted) || errors.Is(err, model.ErrEgressUnavailable) {
+			c.JSON(http.StatusServiceUnavailable, model.NewErrorResponse(err.Error(), ""))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse(err.Error(), ""))
+		return
+	}
+
+	c.JSON(http.StatusCreated, model.NewSuccessResponse("Sandbox restored", sandbox))
+}
+
+// Export handles GET /snapshots/:id/export, streaming the snapshot as a tar.zst archive
+func (h *SnapshotHandler) Export(c *gin.Context) {
+	snapshot, found := resolveSnapshot(c, h.snapshotService)
+	if !found {
+		return
+	}
+	if snapshot.Status != model.SnapshotStatusReady {
+		c.JSON(http.StatusConflict, model.NewErrorResponse("Snapshot is not ready", "still being created or being deleted"))
+		return
+	}
+
+	filename := sanitizeFilename(snapshot.Name) + ".tar.zst"
+	c.Header("Content-Type", "application/zstd")
+	c.Header("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	c.Status(http.StatusOK)
+
+	// Headers are sent; a failure can only cut the stream short, which the
+	// checksums let the importer detect
+	if err := h.snapshotService.Export(c.Request.Context(), snapshot, c.Writer); err != nil {
+		log.Printf("[snapshot] export of %s failed: %v", snapshot.ID.Hex(), err)
+	}
+}
+
+// Import handles POST /snapshots/import. The body is a raw archive produced by Export;
+// the optional name query parameter replaces the name recorded in it.
+func (h *SnapshotHandler) Import(c *gin.Context) {
+	name := c.Query("name")
+	if name != "" {
+		if err := util.ValidateDNS1123Subdomain(name); err != nil {
+			c.JSON(http.StatusBadRequest, model.NewErrorResponse("invalid name: "+err.Error(), ""))
+			return
+		}
+	}
+
+	snapshot, err := h.snapshotService.Import(c.Request.Context(), c.Request.Body, c.GetString("orgID"), c.GetString("userID"), name)
+	if err != nil {
+		switch {
+		case errors.Is(err, model.ErrSnapshotTooLarge):
+			c.JSON(http.StatusRequestEntityTooLarge, model.NewErrorResponse(err.Error(), ""))
+		case errors.Is(err, model.ErrInvalidSnapshotArchive):
+			c.JSON(http.StatusBadRequest, model.NewErrorResponse("Invalid snapshot archive", err.Error()))
+		case errors.Is(err, model.ErrIncompatibleSnapshot):
+			c.JSON(http.StatusUnprocessableEntity, model.NewErrorResponse("Snapshot cannot be restored on this host", err.Error()))
+		default:
+			c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Import failed", err.Error()))
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, model.NewSuccessResponse("Snapshot imported", snapshot))
+}
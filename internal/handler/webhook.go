@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"voidrun/internal/model"
+	"voidrun/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type WebhookHandler struct {
+	webhookService *service.WebhookService
+}
+
+func NewWebhookHandler(webhookService *service.WebhookService) *WebhookHandler {
+	return &WebhookHandler{webhookService: webhookService}
+}
+
+// Create handles POST /webhooks. The signing secret is only returned in this response.
+func (h *WebhookHandler) Create(c *gin.Context) {
+	var req model.CreateWebhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+		return
+	}
+
+	webhook, err := h.webhookService.Create(c.Request.Context(), c.GetString("orgID"), c.GetString("userID"), req)
+	if err != nil {
+		if errors.Is(err, model.ErrUnknownEventType) || errors.Is(err, model.ErrInvalidWebhookURL) {
+			c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Failed to create webhook", err.Error()))
+		return
+	}
+
+	c.JSON(http.StatusCreated, model.NewSuccessResponse("Webhook created", webhook))
+}
+
+// List handles GET /webhooks
+func (h *WebhookHandler) List(c *gin.Context) {
+	webhooks, err := h.webhookService.ListByOrg(c.Request.Context(), c.GetString("orgID"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, model.NewErrorResponse(err.Error(), ""))
+		return
+	}
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Webhooks fetched", webhooks))
+}
+
+// Delete handles DELETE /webhooks/:id
+func (h *WebhookHandler) Delete(c *gin.Context) {
+	webhook, found := resolveWebhook(c, h.webhookService)
+	if !found {
+		return
+	}
+
+	if err := h.webhookService.Delete(c.Request.Context(), webhook); err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Delete failed", err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, model.NewSuccessResponse("Webhook deleted", nil))
+}
+
+// Deliveries handles GET /webhooks/:id/deliveries, newest first with pagination
+func (h *WebhookHandler) Deliveries(c *gin.Context) {
+	webhook, found := resolveWebhook(c, h.webhookService)
+	if !found {
+		return
+	}
+
+	page := 1
+	pageSize := 0 // Let service use default from config
+
+	if p := c.Query("page"); p != "" {
+		if v, err := strconv.Atoi(p); err == nil && v > 0 {
+			page = v
+		}
+	}
+	if s := c.Query("limit"); s != "" {
+		if v, err := strconv.Atoi(s); err == nil && v > 0 {
+			pageSize = v
+		}
+	}
+
+	deliveries, total, actualPageSize, err := h.webhookService.ListDeliveries(c.Request.Context(), webhook, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, model.NewErrorResponse("Failed to fetch deliveries", err.Error()))
+		return
+	}
+
+	totalPages := (total + int64(actualPageSize) - 1) / int64(actualPageSize)
+
+	c.JSON(http.StatusOK, model.NewSuccessResponseWithMeta("Deliveries fetched", deliveries, map[string]interface{}{
+		"page":       page,
+		"limit":      actualPageSize,
+		"total":      total,
+		"totalPages": totalPages,
+	}))
+}
@@ -5,16 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
 	"time"
 
 	"voidrun/internal/config"
 	"voidrun/internal/sandboxclient"
+	"voidrun/pkg/machine"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -23,6 +22,7 @@ import (
 )
 
 type Manager struct {
+	hv           machine.Hypervisor
 	interval     time.Duration
 	diskInterval time.Duration
 	concurrency  int
@@ -65,6 +65,11 @@ type Manager struct {
 	hostAllocVcpu      *prometheus.GaugeVec
 	hostAllocMemBytes  *prometheus.GaugeVec
 	hostAllocDiskBytes *prometheus.GaugeVec
+	warmPoolClaims     *prometheus.CounterVec
+	warmPoolReady      *prometheus.GaugeVec
+	ipPoolSize         *prometheus.GaugeVec
+	ipPoolLeased       *prometheus.GaugeVec
+	ipPoolExhausted    *prometheus.CounterVec
 }
 
 type allocSpec struct {
@@ -73,17 +78,6 @@ type allocSpec struct {
 	diskBytes int64
 }
 
-type countersResponse struct {
-	CPU    *usageField `json:"cpu"`
-	Memory *usageField `json:"memory"`
-	Disks  map[string]diskCounters
-	Nets   map[string]netCounters
-}
-
-type usageField struct {
-	Usage float64 `json:"usage"`
-}
-
 type agentMetrics struct {
 	CPUUsagePercent   float64 `json:"cpuUsagePercent"`
 	MemTotalBytes     uint64  `json:"memTotalBytes"`
@@ -97,27 +91,7 @@ type agentMetrics struct {
 	DiskError         string  `json:"diskError"`
 }
 
-type diskCounters struct {
-	ReadBytes       uint64  `json:"read_bytes"`
-	WriteBytes      uint64  `json:"write_bytes"`
-	ReadOps         uint64  `json:"read_ops"`
-	WriteOps        uint64  `json:"write_ops"`
-	ReadLatencyMin  float64 `json:"read_latency_min"`
-	ReadLatencyMax  float64 `json:"read_latency_max"`
-	ReadLatencyAvg  float64 `json:"read_latency_avg"`
-	WriteLatencyMin float64 `json:"write_latency_min"`
-	WriteLatencyMax float64 `json:"write_latency_max"`
-	WriteLatencyAvg float64 `json:"write_latency_avg"`
-}
-
-type netCounters struct {
-	RxBytes  uint64 `json:"rx_bytes"`
-	TxBytes  uint64 `json:"tx_bytes"`
-	RxFrames uint64 `json:"rx_frames"`
-	TxFrames uint64 `json:"tx_frames"`
-}
-
-func NewManager(cfg config.MetricsConfig) *Manager {
+func NewManager(cfg config.MetricsConfig, hv machine.Hypervisor) *Manager {
 	interval := time.Duration(cfg.IntervalSec) * time.Second
 	if interval <= 0 {
 		interval = 10 * time.Second
@@ -210,6 +184,42 @@ func NewManager(cfg config.MetricsConfig) *Manager {
 		[]string{"voidrun_host"},
 	)
 
+	warmPoolClaims := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voidrun_warm_pool_claims_total",
+			Help: "Sandbox creates served from the warm pool (result=hit) or booted on demand (result=miss)",
+		},
+		[]string{"image", "size", "result", "voidrun_host"},
+	)
+	warmPoolReady := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "voidrun_warm_pool_ready",
+			Help: "Booted, unclaimed sandboxes waiting in the warm pool",
+		},
+		[]string{"image", "size", "voidrun_host"},
+	)
+	ipPoolSize := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "voidrun_ip_pool_size",
+			Help: "Addresses an IP pool can lease",
+		},
+		[]string{"pool", "voidrun_host"},
+	)
+	ipPoolLeased := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "voidrun_ip_pool_leased",
+			Help: "Addresses of an IP pool currently leased to sandboxes",
+		},
+		[]string{"pool", "voidrun_host"},
+	)
+	ipPoolExhausted := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voidrun_ip_pool_exhausted_total",
+			Help: "Allocations that failed because an IP pool had no free address",
+		},
+		[]string{"pool", "voidrun_host"},
+	)
+
 	diskReadBytes := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "voidrun_sbx_disk_read_bytes",
@@ -321,6 +331,11 @@ func NewManager(cfg config.MetricsConfig) *Manager {
 		hostAllocVcpu,
 		hostAllocMemBytes,
 		hostAllocDiskBytes,
+		warmPoolClaims,
+		warmPoolReady,
+		ipPoolSize,
+		ipPoolLeased,
+		ipPoolExhausted,
 		diskReadBytes,
 		diskWriteBytes,
 		diskReadOps,
@@ -342,6 +357,7 @@ func NewManager(cfg config.MetricsConfig) *Manager {
 	)
 
 	return &Manager{
+		hv:                 hv,
 		interval:           interval,
 		diskInterval:       diskInterval,
 		concurrency:        concurrency,
@@ -377,6 +393,11 @@ func NewManager(cfg config.MetricsConfig) *Manager {
 		hostAllocVcpu:      hostAllocVcpu,
 		hostAllocMemBytes:  hostAllocMemBytes,
 		hostAllocDiskBytes: hostAllocDiskBytes,
+		warmPoolClaims:     warmPoolClaims,
+		warmPoolReady:      warmPoolReady,
+		ipPoolSize:         ipPoolSize,
+		ipPoolLeased:       ipPoolLeased,
+		ipPoolExhausted:    ipPoolExhausted,
 	}
 }
 
@@ -407,6 +428,31 @@ func (m *Manager) Middleware() gin.HandlerFunc {
 	}
 }
 
+// ObserveWarmPoolClaim counts a create that hit or missed the warm pool of a size class
+func (m *Manager) ObserveWarmPoolClaim(image, size string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.warmPoolClaims.WithLabelValues(image, size, result, m.host).Inc()
+}
+
+// SetWarmPoolReady records how many warm sandboxes of a size class are available
+func (m *Manager) SetWarmPoolReady(image, size string, ready int) {
+	m.warmPoolReady.WithLabelValues(image, size, m.host).Set(float64(ready))
+}
+
+// SetIPPoolUsage records the size of an IP pool and how much of it is leased
+func (m *Manager) SetIPPoolUsage(pool string, size, leased int) {
+	m.ipPoolSize.WithLabelValues(pool, m.host).Set(float64(size))
+	m.ipPoolLeased.WithLabelValues(pool, m.host).Set(float64(leased))
+}
+
+// ObserveIPPoolExhausted counts an allocation refused because an IP pool was full
+func (m *Manager) ObserveIPPoolExhausted(pool string) {
+	m.ipPoolExhausted.WithLabelValues(pool, m.host).Inc()
+}
+
 func (m *Manager) RegisterSandbox(vmID, sbxName, socketPath string, cpu, memMB, diskMB int) {
 	if vmID == "" || socketPath == "" {
 		return
@@ -538,7 +584,7 @@ func (m *Manager) pollOnce(ctx context.Context) {
 				}
 			}
 
-			stats, err := fetchCounters(ctx, socketPath)
+			stats, err := m.hv.Counters(ctx, vmID)
 			if err == nil {
 				up = true
 				if stats.CPU != nil {
@@ -608,60 +654,6 @@ func (m *Manager) sandboxLabels(vmID string) (string, string, string) {
 	return vmID, name, m.host
 }
 
-func fetchCounters(ctx context.Context, socketPath string) (*countersResponse, error) {
-	body, status, err := unixGet(ctx, socketPath, "/vm.counters")
-	if err != nil {
-		return nil, err
-	}
-	if status == http.StatusNotFound {
-		body, status, err = unixGet(ctx, socketPath, "/api/v1/vm.counters")
-		if err != nil {
-			return nil, err
-		}
-	}
-	if status != http.StatusOK {
-		return nil, fmt.Errorf("vm.counters status %d", status)
-	}
-
-	var raw map[string]json.RawMessage
-	if err := json.Unmarshal(body, &raw); err != nil {
-		return nil, fmt.Errorf("decode vm.counters: %w", err)
-	}
-
-	resp := &countersResponse{
-		Disks: map[string]diskCounters{},
-		Nets:  map[string]netCounters{},
-	}
-	if cpuRaw, ok := raw["cpu"]; ok {
-		var cpu usageField
-		if err := json.Unmarshal(cpuRaw, &cpu); err == nil {
-			resp.CPU = &cpu
-		}
-	}
-	if memRaw, ok := raw["memory"]; ok {
-		var mem usageField
-		if err := json.Unmarshal(memRaw, &mem); err == nil {
-			resp.Memory = &mem
-		}
-	}
-	for key, payload := range raw {
-		switch {
-		case strings.HasPrefix(key, "_disk"):
-			var disk diskCounters
-			if err := json.Unmarshal(payload, &disk); err == nil {
-				resp.Disks[key] = disk
-			}
-		case strings.HasPrefix(key, "_net"):
-			var netc netCounters
-			if err := json.Unmarshal(payload, &netc); err == nil {
-				resp.Nets[key] = netc
-			}
-		}
-	}
-
-	return resp, nil
-}
-
 func fetchAgentMetrics(ctx context.Context, sbxID string) (*agentMetrics, error) {
 	client := sandboxclient.GetSandboxHTTPClient()
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+sbxID+"/metrics", nil)
@@ -691,34 +683,6 @@ func fetchAgentMetrics(ctx context.Context, sbxID string) (*agentMetrics, error)
 	return &metrics, nil
 }
 
-func unixGet(ctx context.Context, socketPath, urlPath string) ([]byte, int, error) {
-	transport := &http.Transport{
-		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
-			return net.Dial("unix", socketPath)
-		},
-		DisableKeepAlives: true,
-	}
-
-	client := &http.Client{Transport: transport}
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://unix"+urlPath, nil)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, 0, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
-	if err != nil {
-		return nil, resp.StatusCode, err
-	}
-
-	return body, resp.StatusCode, nil
-}
-
 func (m *Manager) shouldScrapeDisk(vmID string) bool {
 	if m.diskInterval == 0 {
 		return false
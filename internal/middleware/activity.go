@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"voidrun/internal/model"
+	"voidrun/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SandboxActivity closes the activity opened when a handler resolved its sandbox,
+// so the idle reaper sees streams and WebSockets as in flight until they end.
+func SandboxActivity(sandboxSvc *service.SandboxService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if id := c.GetString(model.CtxActivitySandboxID); id != "" {
+			sandboxSvc.EndActivity(id)
+		}
+	}
+}
@@ -34,7 +34,7 @@ func AuthMiddleware(apiKeySvc *service.APIKeyService) gin.HandlerFunc {
 			return
 		}
 
-		keyDoc, err := apiKeySvc.ValidateKey(c.Request.Context(), apiKey)
+		keyDoc, err := apiKeySvc.ValidateKey(c.Request.Context(), apiKey, c.ClientIP())
 		if err != nil || keyDoc == nil || !keyDoc.IsActive {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or inactive API key"})
 			return
@@ -46,12 +46,19 @@ func AuthMiddleware(apiKeySvc *service.APIKeyService) gin.HandlerFunc {
 		// Inject orgID and a generic role for org API access
 		ctx := context.WithValue(c.Request.Context(), CtxOrgIDKey, orgId)
 		ctx = context.WithValue(ctx, CtxUserRoleKey, "org_api")
-		c.Request = c.Request.WithContext(ctx)
 
 		// Also expose in gin context for handlers that read from gin
 		c.Set("orgID", orgId)
 		c.Set("role", "org_api")
 
+		// Requests act on behalf of the user who created the key, when it has one
+		if !keyDoc.CreatedBy.IsZero() {
+			userId := keyDoc.CreatedBy.Hex()
+			ctx = context.WithValue(ctx, CtxUserIDKey, userId)
+			c.Set("userID", userId)
+		}
+		c.Request = c.Request.WithContext(ctx)
+
 		c.Next()
 	}
 }
@@ -11,7 +11,9 @@ type APIKey struct {
 	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
 	OrgID      primitive.ObjectID `bson:"orgId" json:"orgId"`
 	Name       string             `bson:"name" json:"name"`
-	Hash       string             `bson:"hash" json:"hash"` // Bcrypt hash - never expose
+	KeyID      string             `bson:"keyId,omitempty" json:"keyId,omitempty"` // Public lookup ID embedded in the key
+	Hash       string             `bson:"hash" json:"hash"`                       // Key hash - never expose
+	HashAlgo   string             `bson:"hashAlgo,omitempty" json:"-"`            // "sha256", or empty for legacy bcrypt hashes
 	CreatedBy  primitive.ObjectID `bson:"createdBy" json:"createdBy"`
 	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
 	LastUsedAt time.Time          `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
@@ -19,11 +21,18 @@ type APIKey struct {
 	UpdatedAt  time.Time          `bson:"updatedAt" json:"updatedAt"`
 }
 
+// Supported API key hash algorithms
+const (
+	APIKeyHashSHA256 = "sha256"
+	APIKeyHashBcrypt = ""
+)
+
 // APIKeyResponse represents the response when returning API key info (hash is omitted)
 type APIKeyResponse struct {
 	ID         string    `json:"id"`
 	OrgID      string    `json:"orgId"`
 	Name       string    `json:"name"`
+	KeyID      string    `json:"keyId,omitempty"`
 	CreatedBy  string    `json:"createdBy"`
 	CreatedAt  time.Time `json:"createdAt"`
 	LastUsedAt time.Time `json:"lastUsedAt,omitempty"`
@@ -37,6 +46,7 @@ func (a *APIKey) ToResponse() APIKeyResponse {
 		ID:         a.ID.Hex(),
 		OrgID:      a.OrgID.Hex(),
 		Name:       a.Name,
+		KeyID:      a.KeyID,
 		CreatedBy:  a.CreatedBy.Hex(),
 		CreatedAt:  a.CreatedAt,
 		LastUsedAt: a.LastUsedAt,
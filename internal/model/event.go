@@ -0,0 +1,86 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Event types published on the event bus
+const (
+	EventSandboxCreated  = "sandbox.created"
+	EventSandboxReady    = "sandbox.ready"
+	EventSandboxPaused   = "sandbox.paused"
+	EventSandboxStopped  = "sandbox.stopped"
+	EventSandboxCrashed  = "sandbox.crashed"
+	EventSandboxDeleted  = "sandbox.deleted"
+	EventSnapshotCreated = "snapshot.created"
+)
+
+// EventTypes lists every event type, e.g. to validate webhook subscriptions
+var EventTypes = []string{
+	EventSandboxCreated,
+	EventSandboxReady,
+	EventSandboxPaused,
+	EventSandboxStopped,
+	EventSandboxCrashed,
+	EventSandboxDeleted,
+	EventSnapshotCreated,
+}
+
+// ErrUnknownEventType is returned when a webhook subscribes to an event type that does not exist
+var ErrUnknownEventType = errors.New("unknown event type")
+
+// ErrInvalidWebhookURL is returned for webhook URLs that are not http(s) or name an internal address
+var ErrInvalidWebhookURL = errors.New("webhook url must be http or https and publicly routable")
+
+// Event is a lifecycle change of a sandbox. IDs grow monotonically, so a client resumes
+// a stream by sending the last ID it saw.
+type Event struct {
+	ID        primitive.ObjectID     `bson:"_id" json:"id"`
+	Type      string                 `bson:"type" json:"type"`
+	OrgID     primitive.ObjectID     `bson:"orgId" json:"-"`
+	SandboxID primitive.ObjectID     `bson:"sandboxId" json:"sandboxId"`
+	Data      map[string]interface{} `bson:"data,omitempty" json:"data,omitempty"`
+	CreatedAt time.Time              `bson:"createdAt" json:"createdAt"`
+}
+
+// Webhook is an org-registered endpoint that receives events as signed POST requests
+type Webhook struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	OrgID     primitive.ObjectID `bson:"orgId" json:"orgId"`
+	URL       string             `bson:"url" json:"url"`
+	Events    []string           `bson:"events,omitempty" json:"events,omitempty"` // Empty means every event
+	Secret    string             `bson:"secret" json:"secret,omitempty"`           // Only returned on create
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	CreatedBy primitive.ObjectID `bson:"createdBy" json:"createdBy"`
+}
+
+// Wants reports whether the webhook subscribes to the event type
+func (w *Webhook) Wants(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, t := range w.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery records one attempt to deliver an event to a webhook
+type WebhookDelivery struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	WebhookID  primitive.ObjectID `bson:"webhookId" json:"webhookId"`
+	OrgID      primitive.ObjectID `bson:"orgId" json:"-"`
+	EventID    primitive.ObjectID `bson:"eventId" json:"eventId"`
+	EventType  string             `bson:"eventType" json:"eventType"`
+	Attempt    int                `bson:"attempt" json:"attempt"`
+	StatusCode int                `bson:"statusCode,omitempty" json:"statusCode,omitempty"`
+	Error      string             `bson:"error,omitempty" json:"error,omitempty"`
+	Success    bool               `bson:"success" json:"success"`
+	DurationMs int64              `bson:"durationMs" json:"durationMs"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+}
@@ -0,0 +1,22 @@
+package model
+
+import "errors"
+
+// ErrInvalidIOLimits is returned when I/O limits are negative or above the org plan's
+var ErrInvalidIOLimits = errors.New("invalid I/O limits")
+
+// IOLimits throttles the disk and network of a sandbox; a nil device is unlimited
+type IOLimits struct {
+	Disk *IOLimit `bson:"disk,omitempty" json:"disk,omitempty"`
+	Net  *IOLimit `bson:"net,omitempty" json:"net,omitempty"`
+}
+
+// IOLimit caps the throughput of a device with a bandwidth and an operations token
+// bucket, refilled every second. A burst is granted once on top of the rate. Zero is
+// unlimited. Network operations are packets.
+type IOLimit struct {
+	BandwidthBytesPerSec int64 `bson:"bandwidthBytesPerSec,omitempty" json:"bandwidthBytesPerSec,omitempty"`
+	BandwidthBurstBytes  int64 `bson:"bandwidthBurstBytes,omitempty" json:"bandwidthBurstBytes,omitempty"`
+	OpsPerSec            int64 `bson:"opsPerSec,omitempty" json:"opsPerSec,omitempty"`
+	OpsBurst             int64 `bson:"opsBurst,omitempty" json:"opsBurst,omitempty"`
+}
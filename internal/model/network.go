@@ -0,0 +1,84 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrLeaseConflict is returned when a new lease repeats the IP, MAC or CID of an existing one
+var ErrLeaseConflict = errors.New("network lease conflicts with an existing lease")
+
+// ErrAddressPoolExhausted is returned when the pool serving a sandbox has no free address
+var ErrAddressPoolExhausted = errors.New("no free address in the sandbox's address pool")
+
+// ErrNetworkless is returned for network features requested on a sandbox without a network
+var ErrNetworkless = errors.New("sandbox has no network")
+
+// Sandbox network modes
+const (
+	// NetworkModeBridge attaches the sandbox to the host bridge with a leased IP and MAC
+	NetworkModeBridge = "bridge"
+	// NetworkModeNone boots the sandbox without a NIC; it is reachable over vsock only
+	NetworkModeNone = "none"
+)
+
+// NetworkLease is the network identity held by one sandbox: its address on the bridge,
+// the MAC of its NIC and the vsock CID of its VM. No two leases share any of the three.
+// Pool names the address pool the IP was drawn from. Leases of networkless sandboxes
+// hold a CID only.
+type NetworkLease struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	SandboxID primitive.ObjectID `bson:"sandboxId" json:"sandboxId"`
+	Pool      string             `bson:"pool" json:"pool"`
+	IP        string             `bson:"ip,omitempty" json:"ip,omitempty"`
+	MAC       string             `bson:"mac,omitempty" json:"mac,omitempty"`
+	CID       uint32             `bson:"cid" json:"cid"`
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+}
+
+// IPPoolStats reports the usage of one address pool
+type IPPoolStats struct {
+	Name   string `json:"name"`
+	CIDR   string `json:"cidr"`
+	OrgID  string `json:"orgId,omitempty"`
+	Host   string `json:"host,omitempty"`
+	Size   int    `json:"size"`
+	Leased int    `json:"leased"`
+	Free   int    `json:"free"`
+}
+
+// Egress policy modes
+const (
+	// NetworkPolicyAllowAll leaves egress unrestricted; it is the default
+	NetworkPolicyAllowAll = "allow-all"
+	// NetworkPolicyDenyAll drops everything the sandbox sends off the VM
+	NetworkPolicyDenyAll = "deny-all"
+	// NetworkPolicyAllowList drops everything but the listed destinations and domains
+	NetworkPolicyAllowList = "allow-list"
+)
+
+var (
+	// ErrInvalidNetworkPolicy is returned when a network policy is malformed
+	ErrInvalidNetworkPolicy = errors.New("invalid network policy")
+	// ErrEgressUnavailable is returned when this host cannot enforce a restrictive policy
+	ErrEgressUnavailable = errors.New("egress policies are unavailable on this host")
+)
+
+// NetworkPolicy restricts where a sandbox may connect to. Allow and Domains are only
+// meaningful in allow-list mode; domains also allow their subdomains, and a leading
+// "*." allows the subdomains only.
+type NetworkPolicy struct {
+	Mode    string       `bson:"mode" json:"mode"`
+	Allow   []EgressRule `bson:"allow,omitempty" json:"allow,omitempty"`
+	Domains []string     `bson:"domains,omitempty" json:"domains,omitempty"`
+}
+
+// EgressRule allows traffic to a CIDR (or single IP), optionally only to some ports of
+// one protocol. Without ports every protocol is allowed, unless Protocol names one.
+type EgressRule struct {
+	CIDR     string `bson:"cidr" json:"cidr"`
+	Protocol string `bson:"protocol,omitempty" json:"protocol,omitempty"`
+	Ports    []int  `bson:"ports,omitempty" json:"ports,omitempty"`
+}
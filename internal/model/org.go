@@ -13,6 +13,8 @@ type Organization struct {
 	Members    []primitive.ObjectID `bson:"members" json:"members"`
 	Plan       string               `bson:"plan" json:"plan"`
 	UsageCount int                  `bson:"usage" json:"usage"`
+	// SandboxPeering lets the org's sandboxes reach each other on the bridge
+	SandboxPeering bool `bson:"sandboxPeering" json:"sandboxPeering"`
 
 	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
 	CreatedBy primitive.ObjectID `json:"createdBy" bson:"createdBy"`
@@ -0,0 +1,55 @@
+package model
+
+import "errors"
+
+// Organization plans
+const (
+	PlanFree       = "free"
+	PlanPro        = "pro"
+	PlanEnterprise = "enterprise"
+)
+
+// ErrLifetimeExceedsPlan is returned when a requested timeout is outside the org plan's limits
+var ErrLifetimeExceedsPlan = errors.New("timeout exceeds plan limit")
+
+// PlanLimits holds the sandbox defaults and caps of a plan. A zero maximum means unlimited.
+// IOLimits are both the defaults and the caps of sandbox disk and network throughput.
+type PlanLimits struct {
+	DefaultTimeoutSec     int
+	MaxTimeoutSec         int
+	DefaultIdleTimeoutSec int
+	MaxIdleTimeoutSec     int
+	IOLimits              IOLimits
+}
+
+var planLimits = map[string]PlanLimits{
+	PlanFree: {
+		DefaultTimeoutSec:     3600,
+		MaxTimeoutSec:         86400,
+		DefaultIdleTimeoutSec: 900,
+		MaxIdleTimeoutSec:     3600,
+		IOLimits: IOLimits{
+			Disk: &IOLimit{BandwidthBytesPerSec: 50 << 20, OpsPerSec: 1000},
+			Net:  &IOLimit{BandwidthBytesPerSec: 100_000_000 / 8, OpsPerSec: 10000},
+		},
+	},
+	PlanPro: {
+		DefaultTimeoutSec:     86400,
+		MaxTimeoutSec:         7 * 86400,
+		DefaultIdleTimeoutSec: 3600,
+		MaxIdleTimeoutSec:     86400,
+		IOLimits: IOLimits{
+			Disk: &IOLimit{BandwidthBytesPerSec: 200 << 20, OpsPerSec: 5000},
+			Net:  &IOLimit{BandwidthBytesPerSec: 1_000_000_000 / 8, OpsPerSec: 50000},
+		},
+	},
+	PlanEnterprise: {},
+}
+
+// LimitsForPlan returns the limits of a plan; unknown plans get the free tier
+func LimitsForPlan(plan string) PlanLimits {
+	if limits, ok := planLimits[plan]; ok {
+		return limits
+	}
+	return planLimits[PlanFree]
+}
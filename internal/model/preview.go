@@ -0,0 +1,38 @@
+package model
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrPreviewDisabled is returned when a preview is requested for a sandbox that has them off
+	ErrPreviewDisabled = errors.New("previews are disabled for this sandbox")
+	// ErrInvalidPreviewToken is returned for share tokens that are malformed, forged,
+	// expired, revoked or issued for another sandbox or port
+	ErrInvalidPreviewToken = errors.New("invalid preview token")
+)
+
+// SandboxPreview is the preview state of a sandbox and the TCP ports listening in it
+type SandboxPreview struct {
+	Enabled bool          `json:"enabled"`
+	Ports   []PreviewPort `json:"ports"`
+}
+
+// PreviewPort is a TCP port listening in a sandbox. Ports bound to loopback only cannot be
+// reached by the preview proxy and have no URL.
+type PreviewPort struct {
+	Port      int    `json:"port"`
+	Address   string `json:"address"`
+	Reachable bool   `json:"reachable"`
+	URL       string `json:"url,omitempty"`
+}
+
+// PreviewToken is a signed share token granting access to the preview of a sandbox
+type PreviewToken struct {
+	Token     string    `json:"token"`
+	Port      int       `json:"port,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// URL opens the preview with the token; omitted for tokens valid on every port
+	URL string `json:"url,omitempty"`
+}
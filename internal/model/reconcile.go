@@ -0,0 +1,55 @@
+package model
+
+import "time"
+
+// Kinds of mismatch the reconciler finds between the host and the database
+const (
+	// ReconcileOrphanProcess is a VMM process with no sandbox record, or one whose record says it should not run
+	ReconcileOrphanProcess = "orphan_process"
+	// ReconcileStalePID is a vm.pid naming a process that is gone, for a sandbox recorded as running or paused
+	ReconcileStalePID = "stale_pid"
+	// ReconcileOrphanTap is a TAP with the configured prefix that no instance owns
+	ReconcileOrphanTap = "orphan_tap"
+	// ReconcileOrphanDir is an instance directory with no sandbox record
+	ReconcileOrphanDir = "orphan_dir"
+	// ReconcileMissingDir is a sandbox record whose instance directory is gone
+	ReconcileMissingDir = "missing_dir"
+	// ReconcileStuckTransition is a sandbox left in a transient state by a crashed server
+	ReconcileStuckTransition = "stuck_transition"
+	// ReconcileOrphanLease is a network lease held by a sandbox that has no record
+	ReconcileOrphanLease = "orphan_lease"
+	// ReconcileStuckSnapshot is a snapshot left creating or deleting by a crashed server
+	ReconcileStuckSnapshot = "stuck_snapshot"
+	// ReconcileOrphanSnapshot is a fork capture that no sandbox is backed by any more
+	ReconcileOrphanSnapshot = "orphan_snapshot"
+)
+
+// ReconcileFinding is one mismatch and what the reconciler did about it
+type ReconcileFinding struct {
+	Kind      string `json:"kind"`
+	SandboxID string `json:"sandboxId,omitempty"`
+	Resource  string `json:"resource,omitempty"`
+	// Action is what was done, or would have been done in dry-run mode; "deferred"
+	// means the mismatch is acted on only if the next run still sees it
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReconcileInventory counts what a reconciler run looked at
+type ReconcileInventory struct {
+	Records      int `json:"records"`
+	InstanceDirs int `json:"instanceDirs"`
+	Processes    int `json:"processes"`
+	Taps         int `json:"taps"`
+}
+
+// ReconcileReport is the outcome of one reconciler run
+type ReconcileReport struct {
+	StartedAt  time.Time          `json:"startedAt"`
+	FinishedAt time.Time          `json:"finishedAt"`
+	Startup    bool               `json:"startup"`
+	DryRun     bool               `json:"dryRun"`
+	Inventory  ReconcileInventory `json:"inventory"`
+	Findings   []ReconcileFinding `json:"findings"`
+	Error      string             `json:"error,omitempty"`
+}
@@ -1,5 +1,14 @@
 package model
 
+// Bounds of the VM shape a sandbox can be created with, as enforced by the binding of
+// CreateSandboxRequest. Sandboxes made some other way, e.g. from imported snapshots, are
+// held to the same limits.
+const (
+	MaxSandboxCPU   = 8
+	MinSandboxMemMB = 1024
+	MaxSandboxMemMB = 16384
+)
+
 // CreateSandboxRequest represents the request to create a new sandbox
 type CreateSandboxRequest struct {
 	Name       string            `json:"name" binding:"required"`
@@ -10,18 +19,83 @@ type CreateSandboxRequest struct {
 	UserID     string            `json:"userId,omitempty"`
 	Sync       *bool             `json:"sync"`
 	EnvVars    map[string]string `json:"envVars,omitempty"`
+	// Lifetime in seconds; omitted values use the org plan default, 0 disables when the plan allows it
+	TimeoutSec     *int `json:"timeoutSec,omitempty"`
+	IdleTimeoutSec *int `json:"idleTimeoutSec,omitempty"`
+	// RestartPolicy decides whether a crashed sandbox is booted again (default never)
+	RestartPolicy string `json:"restartPolicy,omitempty" binding:"omitempty,oneof=never on-failure always"`
+	MaxRestarts   *int   `json:"maxRestarts,omitempty" binding:"omitempty,min=0,max=100"`
+	// Network "none" boots the sandbox without a NIC, reachable over vsock only (default bridge)
+	Network string `json:"network,omitempty" binding:"omitempty,oneof=bridge none"`
+	// NetworkPolicy restricts egress; omitted allows everything
+	NetworkPolicy *NetworkPolicy `json:"networkPolicy,omitempty"`
+	// IOLimits throttles disk and network; omitted values use the org plan default
+	IOLimits *IOLimits `json:"ioLimits,omitempty"`
+}
+
+// ExtendSandboxRequest moves a sandbox deadline to timeoutSec seconds from now
+type ExtendSandboxRequest struct {
+	TimeoutSec int `json:"timeoutSec" binding:"required,min=1"`
+}
+
+// ResizeSandboxRequest changes the vCPUs and/or memory (MiB) of a running sandbox
+type ResizeSandboxRequest struct {
+	CPU *int `json:"cpu,omitempty"`
+	Mem *int `json:"mem,omitempty"`
 }
 
-// RestoreSandboxRequest represents the request to restore a sandbox from snapshot
+// CreateSnapshotRequest represents the request to snapshot a sandbox
+type CreateSnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+// RestoreSandboxRequest represents the request to restore a sandbox from a registered snapshot.
+// CPU, memory, disk and image come from the snapshot record.
 type RestoreSandboxRequest struct {
-	NewID        string `json:"new_id" binding:"required"`
-	SnapshotPath string `json:"snapshot_path" binding:"required"`
-	NewIP        string `json:"new_ip"`
-	Cold         bool   `json:"cold"`
-	CPU          int    `json:"cpu"`
-	Mem          int    `json:"mem"`
-	OrgID        string `json:"orgId"`
-	UserID       string `json:"userId"`
+	Name   string `json:"name" binding:"required"`
+	Cold   bool   `json:"cold"`
+	Sync   *bool  `json:"sync"`
+	OrgID  string `json:"orgId,omitempty"`
+	UserID string `json:"userId,omitempty"`
+	// NetworkPolicy restricts egress of the restored sandbox; omitted allows everything
+	NetworkPolicy *NetworkPolicy `json:"networkPolicy,omitempty"`
+	// IOLimits throttles disk and network; omitted values use the org plan default
+	IOLimits *IOLimits `json:"ioLimits,omitempty"`
+}
+
+// UpdateNetworkRequest replaces the egress policy of a sandbox
+type UpdateNetworkRequest struct {
+	NetworkPolicy *NetworkPolicy `json:"networkPolicy" binding:"required"`
+}
+
+// UpdateIOLimitsRequest replaces the I/O limits of a sandbox; omitted values use the org
+// plan default
+type UpdateIOLimitsRequest struct {
+	IOLimits
+}
+
+// UpdatePreviewRequest enables or disables the preview URLs of a sandbox
+type UpdatePreviewRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// CreatePreviewTokenRequest issues a share token for one port of a sandbox, or for all of
+// them when Port is omitted
+type CreatePreviewTokenRequest struct {
+	Port   int `json:"port,omitempty" binding:"omitempty,min=1,max=65535"`
+	TTLSec int `json:"ttlSec,omitempty" binding:"omitempty,min=1"`
+}
+
+// UpdateOrgNetworkRequest sets whether the sandboxes of an org may reach each other
+type UpdateOrgNetworkRequest struct {
+	SandboxPeering *bool `json:"sandboxPeering" binding:"required"`
+}
+
+// CreateWebhookRequest registers an endpoint for the org's events. An empty Events list
+// subscribes to every event type.
+type CreateWebhookRequest struct {
+	URL    string   `json:"url" binding:"required,url"`
+	Events []string `json:"events"`
 }
 
 // ExecRequest represents a command execution request
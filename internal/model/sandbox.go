@@ -1,6 +1,7 @@
 package model
 
 import (
+	"errors"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -12,6 +13,8 @@ type Sandbox struct {
 	Name      string             `bson:"name" json:"name"`
 	ImageId   string             `bson:"imageId" json:"imageId"`
 	IP        string             `bson:"ip" json:"ip"`
+	MAC       string             `bson:"mac,omitempty" json:"mac,omitempty"`
+	CID       uint32             `bson:"cid,omitempty" json:"cid,omitempty"`
 	CPU       int                `bson:"cpu" json:"cpu"`
 	Mem       int                `bson:"mem" json:"mem"`
 	DiskMB    int                `bson:"diskMb" json:"diskMb"`
@@ -20,6 +23,44 @@ type Sandbox struct {
 	CreatedBy primitive.ObjectID `bson:"createdBy" json:"createdBy"`
 	OrgID     primitive.ObjectID `bson:"orgId" json:"orgId"`
 	EnvVars   map[string]string  `bson:"envVars,omitempty" json:"envVars,omitempty"`
+
+	// Network is the network mode; "none" sandboxes have no NIC, IP or MAC, only a CID
+	Network string `bson:"network,omitempty" json:"network"`
+
+	// Resize limits the VM was booted with; zero means no headroom beyond CPU and Mem
+	MaxCPU int `bson:"maxCpu,omitempty" json:"maxCpu,omitempty"`
+	MaxMem int `bson:"maxMem,omitempty" json:"maxMem,omitempty"`
+
+	// Crash recovery: restarts since the last manual start and why the VM last died.
+	// MaxRestarts is nil for the server default; 0 disables automatic restarts.
+	RestartPolicy  string     `bson:"restartPolicy,omitempty" json:"restartPolicy,omitempty"`
+	MaxRestarts    *int       `bson:"maxRestarts,omitempty" json:"maxRestarts,omitempty"`
+	RestartCount   int        `bson:"restartCount,omitempty" json:"restartCount,omitempty"`
+	LastRestartAt  *time.Time `bson:"lastRestartAt,omitempty" json:"lastRestartAt,omitempty"`
+	LastExitReason string     `bson:"lastExitReason,omitempty" json:"lastExitReason,omitempty"`
+	LastExitAt     *time.Time `bson:"lastExitAt,omitempty" json:"lastExitAt,omitempty"`
+
+	// Lifetime: the reaper deletes the sandbox after ExpiresAt and stops it after
+	// IdleTimeoutSec without API activity or running commands
+	TimeoutSec     int        `bson:"timeoutSec,omitempty" json:"timeoutSec,omitempty"`
+	IdleTimeoutSec int        `bson:"idleTimeoutSec,omitempty" json:"idleTimeoutSec,omitempty"`
+	ExpiresAt      *time.Time `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	LastActiveAt   *time.Time `bson:"lastActiveAt,omitempty" json:"lastActiveAt,omitempty"`
+
+	// BaseSnapshotID is the snapshot whose disk backs the overlay of a restored sandbox;
+	// it holds a reference on that snapshot until the sandbox is deleted
+	BaseSnapshotID *primitive.ObjectID `bson:"baseSnapshotId,omitempty" json:"baseSnapshotId,omitempty"`
+
+	// NetworkPolicy restricts the sandbox's egress; nil allows everything
+	NetworkPolicy *NetworkPolicy `bson:"networkPolicy,omitempty" json:"networkPolicy,omitempty"`
+
+	// PreviewEnabled exposes the sandbox's ports through the preview proxy. PreviewEpoch
+	// is bumped whenever previews are disabled, revoking the share tokens issued before.
+	PreviewEnabled bool `bson:"previewEnabled,omitempty" json:"previewEnabled"`
+	PreviewEpoch   int  `bson:"previewEpoch,omitempty" json:"-"`
+
+	// IOLimits throttles the disk and network of the VM; changes apply when it next boots
+	IOLimits *IOLimits `bson:"ioLimits,omitempty" json:"ioLimits,omitempty"`
 }
 
 type SandboxSpec struct {
@@ -30,11 +71,39 @@ type SandboxSpec struct {
 	DiskMB    int               `json:"disk_mb"`
 	IPAddress string            `json:"ip_address"`
 	EnvVars   map[string]string `json:"env_vars"`
+	// MaxCPUs and MaxMemoryMB bound live resizes; values below CPUs and MemoryMB mean no headroom
+	MaxCPUs     int `json:"max_cpus"`
+	MaxMemoryMB int `json:"max_memory_mb"`
+
+	// MACAddress and CID come from the sandbox's network lease
+	MACAddress string `json:"mac_address"`
+	CID        uint32 `json:"cid"`
+
+	// IOLimits become the rate limiters of the VM's disk and NIC
+	IOLimits *IOLimits `json:"io_limits,omitempty"`
+
+	// Network "none" boots the VM without a NIC; IPAddress and MACAddress are then empty
+	Network string `json:"network,omitempty"`
 }
 
-// Snapshot represents a sandbox snapshot summary
-type Snapshot struct {
-	ID        string `json:"id"`
-	CreatedAt string `json:"created_at"`
-	FullPath  string `json:"full_path"`
+// Networkless reports whether the sandbox was created without a network
+func (s *Sandbox) Networkless() bool {
+	return s.Network == NetworkModeNone
 }
+
+// CtxActivitySandboxID is the gin context key holding the sandbox whose activity
+// the current request keeps open
+const CtxActivitySandboxID = "activitySandboxID"
+
+// Restart policies applied when a sandbox VM dies without being stopped through the API
+const (
+	RestartPolicyNever     = "never"
+	RestartPolicyOnFailure = "on-failure"
+	RestartPolicyAlways    = "always"
+)
+
+// ErrResizeOutOfBounds is returned when a resize asks for more than the sandbox was booted to allow
+var ErrResizeOutOfBounds = errors.New("requested resources are outside the sandbox limits")
+
+// ErrPortForwardUnsupported is returned when the guest agent has no /port-forward endpoint
+var ErrPortForwardUnsupported = errors.New("guest agent does not support port forwarding")
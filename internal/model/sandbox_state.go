@@ -0,0 +1,75 @@
+package model
+
+import "errors"
+
+// Sandbox lifecycle states persisted in Sandbox.Status
+const (
+	SandboxStatusCreating = "creating"
+	SandboxStatusStarting = "starting"
+	SandboxStatusRunning  = "running"
+	SandboxStatusPaused   = "paused"
+	SandboxStatusStopping = "stopping"
+	SandboxStatusStopped  = "stopped"
+	SandboxStatusDeleting = "deleting"
+	// SandboxStatusWarm marks a booted, unclaimed VM held in the warm pool
+	SandboxStatusWarm = "warm"
+	// A hibernated sandbox has its RAM saved to disk and no VM process; it keeps
+	// its IP and wakes on the next guest request
+	SandboxStatusHibernating = "hibernating"
+	SandboxStatusHibernated  = "hibernated"
+)
+
+// ErrInvalidTransition is returned when a lifecycle operation is not allowed from the current state
+var ErrInvalidTransition = errors.New("invalid sandbox state transition")
+
+// sandboxTransitions lists the states reachable from each state:
+//
+//	creating → running ⇄ paused → stopping → stopped → deleting
+//	stopped → starting → running (cold boot from the existing overlay)
+//	creating → warm → running (claimed from the warm pool)
+//	running|paused → hibernating → hibernated → starting → running (RAM saved to disk and resumed)
+var sandboxTransitions = map[string][]string{
+	SandboxStatusCreating:    {SandboxStatusRunning, SandboxStatusStopped, SandboxStatusWarm},
+	SandboxStatusStarting:    {SandboxStatusRunning, SandboxStatusStopped, SandboxStatusHibernated},
+	SandboxStatusRunning:     {SandboxStatusPaused, SandboxStatusStopping, SandboxStatusDeleting, SandboxStatusHibernating},
+	SandboxStatusPaused:      {SandboxStatusRunning, SandboxStatusStopping, SandboxStatusDeleting, SandboxStatusHibernating},
+	SandboxStatusStopping:    {SandboxStatusStopped},
+	SandboxStatusStopped:     {SandboxStatusStarting, SandboxStatusDeleting},
+	SandboxStatusDeleting:    {},
+	SandboxStatusWarm:        {SandboxStatusRunning, SandboxStatusDeleting},
+	SandboxStatusHibernating: {SandboxStatusHibernated, SandboxStatusRunning, SandboxStatusPaused},
+	SandboxStatusHibernated:  {SandboxStatusStarting, SandboxStatusStopping, SandboxStatusDeleting},
+}
+
+// CanTransition reports whether a sandbox may move from one state to another
+func CanTransition(from, to string) bool {
+	for _, next := range sandboxTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionSources returns every state from which the target state is reachable
+func TransitionSources(to string) []string {
+	var sources []string
+	for from, nexts := range sandboxTransitions {
+		for _, next := range nexts {
+			if next == to {
+				sources = append(sources, from)
+				break
+			}
+		}
+	}
+	return sources
+}
+
+// IsTransientStatus reports whether the state is an in-flight operation owned by a request
+func IsTransientStatus(status string) bool {
+	switch status {
+	case SandboxStatusCreating, SandboxStatusStarting, SandboxStatusStopping, SandboxStatusDeleting, SandboxStatusHibernating:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package model
+
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Snapshot lifecycle states persisted in Snapshot.Status
+const (
+	SnapshotStatusCreating = "creating"
+	SnapshotStatusReady    = "ready"
+	SnapshotStatusDeleting = "deleting"
+	// SnapshotStatusFailed marks a capture a crash interrupted; it can only be deleted
+	SnapshotStatusFailed = "failed"
+)
+
+var (
+	// ErrSnapshotNotReady is returned when a snapshot is used before its files are complete
+	ErrSnapshotNotReady = errors.New("snapshot is not ready")
+	// ErrSnapshotInUse is returned when deleting a snapshot that backs the disk of a sandbox
+	ErrSnapshotInUse = errors.New("snapshot is in use by restored sandboxes")
+)
+
+var (
+	// ErrInvalidSnapshotArchive is returned for imports that are not a well-formed archive
+	// or whose contents do not match their checksums
+	ErrInvalidSnapshotArchive = errors.New("invalid snapshot archive")
+	// ErrIncompatibleSnapshot is returned for archives this host cannot restore
+	ErrIncompatibleSnapshot = errors.New("incompatible snapshot")
+	// ErrSnapshotTooLarge is returned for archives above the configured import limit
+	ErrSnapshotTooLarge = errors.New("snapshot archive too large")
+)
+
+// SnapshotManifestVersion is the archive format written by snapshot exports
+const SnapshotManifestVersion = 1
+
+// Snapshot records a point-in-time capture of a sandbox and the spec needed to rebuild it
+type Snapshot struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name      string             `bson:"name" json:"name"`
+	SandboxID primitive.ObjectID `bson:"sandboxId" json:"sandboxId"`
+	ImageId   string             `bson:"imageId" json:"imageId"`
+	CPU       int                `bson:"cpu" json:"cpu"`
+	Mem       int                `bson:"mem" json:"mem"`
+	MaxCPU    int                `bson:"maxCpu,omitempty" json:"maxCpu,omitempty"`
+	MaxMem    int                `bson:"maxMem,omitempty" json:"maxMem,omitempty"`
+	DiskMB    int                `bson:"diskMb" json:"diskMb"`
+	SizeBytes int64              `bson:"sizeBytes" json:"sizeBytes"`
+	Status    string             `bson:"status" json:"status"`
+	EnvVars   map[string]string  `bson:"envVars,omitempty" json:"envVars,omitempty"`
+	Network   string             `bson:"network,omitempty" json:"network,omitempty"` // Network mode, restored sandboxes keep it
+	Path      string             `bson:"path" json:"-"`                              // Host directory, never exposed through the API
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	CreatedBy primitive.ObjectID `bson:"createdBy" json:"createdBy"`
+	OrgID     primitive.ObjectID `bson:"orgId" json:"orgId"`
+	// ImportedAt is set on snapshots registered from an export archive
+	ImportedAt *time.Time `bson:"importedAt,omitempty" json:"importedAt,omitempty"`
+	// RefCount is the number of sandboxes whose overlay is backed by this snapshot's disk
+	RefCount int `bson:"refCount" json:"refCount"`
+	// Ephemeral snapshots are taken by forks; they are not listed and are removed once
+	// the last sandbox restored from them is deleted
+	Ephemeral bool `bson:"ephemeral,omitempty" json:"-"`
+}
+
+// SnapshotManifest is stored as manifest.json in a snapshot export archive. It carries the
+// spec needed to restore the snapshot and the environment it was captured in.
+type SnapshotManifest struct {
+	FormatVersion     int               `json:"formatVersion"`
+	SnapshotID        string            `json:"snapshotId"`
+	Name              string            `json:"name"`
+	SandboxID         string            `json:"sandboxId"`
+	ImageId           string            `json:"imageId"`
+	CPU               int               `json:"cpu"`
+	Mem               int               `json:"mem"`
+	MaxCPU            int               `json:"maxCpu,omitempty"`
+	MaxMem            int               `json:"maxMem,omitempty"`
+	DiskMB            int               `json:"diskMb"`
+	EnvVars           map[string]string `json:"envVars,omitempty"`
+	Network           string            `json:"network,omitempty"`
+	Kernel            string            `json:"kernel"`
+	Hypervisor        string            `json:"hypervisor"`
+	HypervisorVersion string            `json:"hypervisorVersion,omitempty"`
+	CreatedAt         time.Time         `json:"createdAt"`
+	ExportedAt        time.Time         `json:"exportedAt"`
+}
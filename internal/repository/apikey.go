@@ -2,6 +2,7 @@ package repository
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"voidrun/internal/config"
@@ -17,6 +18,8 @@ type IAPIKeyRepository interface {
 	Create(ctx context.Context, apiKey *model.APIKey) (*model.APIKey, error)
 	FindByID(ctx context.Context, id primitive.ObjectID) (*model.APIKey, error)
 	FindByHash(ctx context.Context, hash string) (*model.APIKey, error)
+	FindByKeyID(ctx context.Context, keyID string) (*model.APIKey, error)
+	FindUnmigrated(ctx context.Context) ([]*model.APIKey, error)
 	FindByOrgID(ctx context.Context, orgID primitive.ObjectID) ([]*model.APIKey, error)
 	FindActive(ctx context.Context) ([]*model.APIKey, error)
 	Delete(ctx context.Context, id primitive.ObjectID) error
@@ -39,6 +42,18 @@ func NewAPIKeyRepository(cfg *config.Config, db *mongo.Database) IAPIKeyReposito
 	}
 }
 
+// Init creates the indexes used for key lookups
+func (r *APIKeyRepository) Init(ctx context.Context) error {
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{bson.E{Key: "keyId", Value: 1}},
+		Options: options.Index().SetUnique(true).SetSparse(true),
+	}
+	if _, err := r.collection.Indexes().CreateOne(ctx, indexModel); err != nil {
+		return fmt.Errorf("failed to create keyId index: %w", err)
+	}
+	return nil
+}
+
 // Create creates a new API key
 func (r *APIKeyRepository) Create(ctx context.Context, apiKey *model.APIKey) (*model.APIKey, error) {
 	apiKey.CreatedAt = time.Now()
@@ -79,6 +94,35 @@ func (r *APIKeyRepository) FindByHash(ctx context.Context, hash string) (*model.
 	return apiKey, nil
 }
 
+// FindByKeyID retrieves an active API key by its public lookup ID
+func (r *APIKeyRepository) FindByKeyID(ctx context.Context, keyID string) (*model.APIKey, error) {
+	var apiKey *model.APIKey
+	err := r.collection.FindOne(ctx, bson.M{"keyId": keyID, "isActive": true}).Decode(&apiKey)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return apiKey, nil
+}
+
+// FindUnmigrated retrieves active legacy keys that have no lookup ID yet
+func (r *APIKeyRepository) FindUnmigrated(ctx context.Context) ([]*model.APIKey, error) {
+	filter := bson.M{"isActive": true, "keyId": bson.M{"$exists": false}}
+	cursor, err := r.collection.Find(ctx, filter, options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var apiKeys []*model.APIKey
+	if err = cursor.All(ctx, &apiKeys); err != nil {
+		return nil, err
+	}
+	return apiKeys, nil
+}
+
 // FindByOrgID retrieves all active API keys for an organization
 func (r *APIKeyRepository) FindByOrgID(ctx context.Context, orgID primitive.ObjectID) ([]*model.APIKey, error) {
 	cursor, err := r.collection.Find(ctx, bson.M{"orgId": orgID}, options.Find().SetSort(bson.M{"createdAt": -1}))
@@ -124,7 +168,12 @@ func (r *APIKeyRepository) Update(ctx context.Context, id primitive.ObjectID, up
 	}
 
 	// Merge provided updates
-	if updateMap, ok := update.(bson.M); ok {
+	switch updateMap := update.(type) {
+	case bson.M:
+		for k, v := range updateMap {
+			updateDoc["$set"].(bson.M)[k] = v
+		}
+	case map[string]interface{}:
 		for k, v := range updateMap {
 			updateDoc["$set"].(bson.M)[k] = v
 		}
@@ -0,0 +1,74 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type IEventRepository interface {
+	Create(ctx context.Context, event *model.Event) error
+	FindSince(ctx context.Context, orgID, after primitive.ObjectID, limit int64) ([]*model.Event, error)
+}
+
+// EventRepository keeps recent events so streams can be resumed
+type EventRepository struct {
+	cfg        *config.Config
+	collection *mongo.Collection
+}
+
+func NewEventRepository(cfg *config.Config, db *mongo.Database) IEventRepository {
+	return &EventRepository{
+		cfg:        cfg,
+		collection: db.Collection("events"),
+	}
+}
+
+// Init creates the replay index and the TTL index that expires old events
+func (r *EventRepository) Init(ctx context.Context) error {
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{bson.E{Key: "orgId", Value: 1}, bson.E{Key: "_id", Value: 1}}},
+		{
+			Keys:    bson.D{bson.E{Key: "createdAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(max(r.cfg.Events.RetentionHours, 1) * 3600)),
+		},
+	}
+	if _, err := r.collection.Indexes().CreateMany(ctx, indexes); err != nil {
+		return fmt.Errorf("failed to create event indexes: %w", err)
+	}
+	return nil
+}
+
+// Create inserts an event. The ID is assigned by the caller so it can be streamed first.
+func (r *EventRepository) Create(ctx context.Context, event *model.Event) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	_, err := r.collection.InsertOne(ctx, event)
+	return err
+}
+
+// FindSince returns the org's events newer than after, oldest first
+func (r *EventRepository) FindSince(ctx context.Context, orgID, after primitive.ObjectID, limit int64) ([]*model.Event, error) {
+	filter := bson.M{"orgId": orgID, "_id": bson.M{"$gt": after}}
+	opts := options.Find().SetSort(bson.D{bson.E{Key: "_id", Value: 1}}).SetLimit(limit)
+	cursor, err := r.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var events []*model.Event
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,133 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ILeaseRepository interface {
+	Create(ctx context.Context, lease *model.NetworkLease) error
+	FindBySandbox(ctx context.Context, sandboxID primitive.ObjectID) (*model.NetworkLease, error)
+	Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.NetworkLease, error)
+	SetPool(ctx context.Context, id primitive.ObjectID, pool string) error
+	DeleteBySandbox(ctx context.Context, sandboxID primitive.ObjectID) error
+	Count(ctx context.Context, filter interface{}) (int64, error)
+}
+
+// LeaseRepository stores the network leases of sandboxes in MongoDB. Unique indexes make
+// the database the arbiter of IP, MAC and CID collisions, including between servers.
+type LeaseRepository struct {
+	cfg        *config.Config
+	collection *mongo.Collection
+}
+
+func NewLeaseRepository(cfg *config.Config, db *mongo.Database) ILeaseRepository {
+	return &LeaseRepository{
+		cfg:        cfg,
+		collection: db.Collection("network_leases"),
+	}
+}
+
+// Init creates the unique indexes that keep every lease's identity distinct. The IP and
+// MAC indexes are sparse since leases of networkless sandboxes hold a CID only; indexes
+// created before that are rebuilt.
+func (r *LeaseRepository) Init(ctx context.Context) error {
+	for _, key := range []string{"sandboxId", "ip", "mac", "cid"} {
+		sparse := key == "ip" || key == "mac"
+		indexModel := mongo.IndexModel{
+			Keys:    bson.D{bson.E{Key: key, Value: 1}},
+			Options: options.Index().SetUnique(true).SetSparse(sparse),
+		}
+		_, err := r.collection.Indexes().CreateOne(ctx, indexModel)
+		if sparse && isIndexOptionsConflict(err) {
+			if _, err = r.collection.Indexes().DropOne(ctx, key+"_1"); err == nil {
+				_, err = r.collection.Indexes().CreateOne(ctx, indexModel)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create lease %s index: %w", key, err)
+		}
+	}
+	poolIndex := mongo.IndexModel{Keys: bson.D{bson.E{Key: "pool", Value: 1}}}
+	if _, err := r.collection.Indexes().CreateOne(ctx, poolIndex); err != nil {
+		return fmt.Errorf("failed to create lease pool index: %w", err)
+	}
+	return nil
+}
+
+// Create inserts a lease. It returns model.ErrLeaseConflict when the sandbox already
+// holds a lease or any of the IP, MAC and CID is leased to another sandbox.
+func (r *LeaseRepository) Create(ctx context.Context, lease *model.NetworkLease) error {
+	lease.CreatedAt = time.Now()
+	result, err := r.collection.InsertOne(ctx, lease)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return model.ErrLeaseConflict
+		}
+		return err
+	}
+	lease.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindBySandbox returns the lease held by a sandbox, or nil when it holds none
+func (r *LeaseRepository) FindBySandbox(ctx context.Context, sandboxID primitive.ObjectID) (*model.NetworkLease, error) {
+	var lease *model.NetworkLease
+	err := r.collection.FindOne(ctx, bson.M{"sandboxId": sandboxID}).Decode(&lease)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Find retrieves leases matching the filter
+func (r *LeaseRepository) Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.NetworkLease, error) {
+	cursor, err := r.collection.Find(ctx, filter, &opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var leases []*model.NetworkLease
+	if err = cursor.All(ctx, &leases); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// SetPool records the pool a lease's IP belongs to
+func (r *LeaseRepository) SetPool(ctx context.Context, id primitive.ObjectID, pool string) error {
+	_, err := r.collection.UpdateByID(ctx, id, bson.M{"$set": bson.M{"pool": pool}})
+	return err
+}
+
+// DeleteBySandbox releases the lease held by a sandbox
+func (r *LeaseRepository) DeleteBySandbox(ctx context.Context, sandboxID primitive.ObjectID) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{"sandboxId": sandboxID})
+	return err
+}
+
+// Count returns the number of leases matching the filter
+func (r *LeaseRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.collection.CountDocuments(ctx, filter)
+}
+
+// isIndexOptionsConflict reports whether an index exists under the same name or keys
+// with different options (IndexOptionsConflict, IndexKeySpecsConflict)
+func isIndexOptionsConflict(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && (cmdErr.Code == 85 || cmdErr.Code == 86)
+}
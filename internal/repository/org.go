@@ -17,6 +17,7 @@ type IOrgRepository interface {
 	Create(ctx context.Context, org *model.Organization) (*model.Organization, error)
 	FindByOwner(ctx context.Context, ownerID primitive.ObjectID) (*model.Organization, error)
 	FindByID(ctx context.Context, id primitive.ObjectID) (*model.Organization, error)
+	SetSandboxPeering(ctx context.Context, id primitive.ObjectID, enabled bool) error
 }
 
 // OrgRepository implements org persistence
@@ -66,3 +67,10 @@ func (r *OrgRepository) FindByID(ctx context.Context, id primitive.ObjectID) (*m
 	}
 	return org, nil
 }
+
+func (r *OrgRepository) SetSandboxPeering(ctx context.Context, id primitive.ObjectID, enabled bool) error {
+	_, err := r.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+		"$set": bson.M{"sandboxPeering": enabled, "updatedAt": time.Now()},
+	})
+	return err
+}
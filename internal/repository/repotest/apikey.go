@@ -0,0 +1,99 @@
+package repotest
+
+import (
+	"context"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// APIKeyRepository keeps API keys in memory
+type APIKeyRepository struct {
+	store
+}
+
+var _ repository.IAPIKeyRepository = (*APIKeyRepository)(nil)
+
+func NewAPIKeyRepository() *APIKeyRepository {
+	return &APIKeyRepository{store: store{unique: []uniqueIndex{{field: "keyId", sparse: true}}}}
+}
+
+func (r *APIKeyRepository) Create(ctx context.Context, apiKey *model.APIKey) (*model.APIKey, error) {
+	apiKey.CreatedAt = time.Now()
+	apiKey.UpdatedAt = time.Now()
+	apiKey.IsActive = true
+	id, err := r.insert(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	apiKey.ID = id
+	return apiKey, nil
+}
+
+func (r *APIKeyRepository) FindByID(ctx context.Context, id primitive.ObjectID) (*model.APIKey, error) {
+	return decodeOne[model.APIKey](r.findOne(bson.M{"_id": id})), nil
+}
+
+func (r *APIKeyRepository) FindByHash(ctx context.Context, hash string) (*model.APIKey, error) {
+	return decodeOne[model.APIKey](r.findOne(bson.M{"hash": hash, "isActive": true})), nil
+}
+
+func (r *APIKeyRepository) FindByKeyID(ctx context.Context, keyID string) (*model.APIKey, error) {
+	return decodeOne[model.APIKey](r.findOne(bson.M{"keyId": keyID, "isActive": true})), nil
+}
+
+func (r *APIKeyRepository) FindUnmigrated(ctx context.Context) ([]*model.APIKey, error) {
+	filter := bson.M{"isActive": true, "keyId": bson.M{"$exists": false}}
+	return decodeAll[model.APIKey](r.find(filter, options.Find().SetSort(bson.M{"createdAt": -1}))), nil
+}
+
+func (r *APIKeyRepository) FindByOrgID(ctx context.Context, orgID primitive.ObjectID) ([]*model.APIKey, error) {
+	return decodeAll[model.APIKey](r.find(bson.M{"orgId": orgID}, options.Find().SetSort(bson.M{"createdAt": -1}))), nil
+}
+
+func (r *APIKeyRepository) FindActive(ctx context.Context) ([]*model.APIKey, error) {
+	return decodeAll[model.APIKey](r.find(bson.M{"isActive": true}, options.Find().SetSort(bson.M{"createdAt": -1}))), nil
+}
+
+func (r *APIKeyRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.remove(bson.M{"_id": id})
+	return nil
+}
+
+func (r *APIKeyRepository) Update(ctx context.Context, id primitive.ObjectID, update interface{}) error {
+	set := bson.M{"updatedAt": time.Now()}
+	switch fields := update.(type) {
+	case bson.M:
+		for k, v := range fields {
+			set[k] = v
+		}
+	case map[string]interface{}:
+		for k, v := range fields {
+			set[k] = v
+		}
+	}
+	r.update(bson.M{"_id": id}, bson.M{"$set": set}, nil)
+	return nil
+}
+
+func (r *APIKeyRepository) UpdateLastUsed(ctx context.Context, id primitive.ObjectID) error {
+	r.update(bson.M{"_id": id}, bson.M{"$set": bson.M{"lastUsedAt": time.Now(), "updatedAt": time.Now()}}, nil)
+	return nil
+}
+
+func (r *APIKeyRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.count(filter), nil
+}
+
+func (r *APIKeyRepository) Exists(ctx context.Context, id string) bool {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false
+	}
+	return r.count(bson.M{"_id": oid}) > 0
+}
@@ -0,0 +1,47 @@
+package repotest
+
+import (
+	"context"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// EventRepository keeps the event log in memory
+type EventRepository struct {
+	store
+}
+
+var _ repository.IEventRepository = (*EventRepository)(nil)
+
+func NewEventRepository() *EventRepository {
+	return &EventRepository{}
+}
+
+func (r *EventRepository) Create(ctx context.Context, event *model.Event) error {
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	_, err := r.insert(event)
+	return err
+}
+
+func (r *EventRepository) FindSince(ctx context.Context, orgID, after primitive.ObjectID, limit int64) ([]*model.Event, error) {
+	filter := bson.M{"orgId": orgID, "_id": bson.M{"$gt": after}}
+	opts := options.Find().SetSort(bson.D{bson.E{Key: "_id", Value: 1}}).SetLimit(limit)
+	return decodeAll[model.Event](r.find(filter, opts)), nil
+}
+
+// Types lists the types of the events of a sandbox in the order they were published
+func (r *EventRepository) Types(sandboxID primitive.ObjectID) []string {
+	var types []string
+	for _, event := range decodeAll[model.Event](r.find(bson.M{"sandboxId": sandboxID}, nil)) {
+		types = append(types, event.Type)
+	}
+	return types
+}
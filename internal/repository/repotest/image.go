@@ -0,0 +1,72 @@
+package repotest
+
+import (
+	"context"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ImageRepository keeps images in memory
+type ImageRepository struct {
+	store
+}
+
+var _ repository.IImageRepository = (*ImageRepository)(nil)
+
+func NewImageRepository() *ImageRepository {
+	return &ImageRepository{}
+}
+
+func (r *ImageRepository) Create(ctx context.Context, img *model.Image) (*model.Image, error) {
+	img.CreatedAt = time.Now()
+	id, err := r.insert(img)
+	if err != nil {
+		return nil, err
+	}
+	img.ID = id
+	return img, nil
+}
+
+func (r *ImageRepository) FindByID(ctx context.Context, id string) (*model.Image, error) {
+	return decodeOne[model.Image](r.findOne(bson.M{"_id": id})), nil
+}
+
+func (r *ImageRepository) GetLatestByName(name string) (*model.Image, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(1)
+	images := decodeAll[model.Image](r.find(bson.M{"name": name}, opts))
+	if len(images) == 0 {
+		return nil, nil
+	}
+	return images[0], nil
+}
+
+func (r *ImageRepository) Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.Image, error) {
+	return decodeAll[model.Image](r.find(filter, &opts)), nil
+}
+
+func (r *ImageRepository) Delete(ctx context.Context, id string) error {
+	r.remove(bson.M{"_id": id})
+	return nil
+}
+
+func (r *ImageRepository) EnsureSystemImage(img model.Image) error {
+	if r.count(bson.M{"name": img.Name, "tag": img.Tag, "system": true}) > 0 {
+		return nil
+	}
+	img.System = true
+	_, err := r.Create(context.Background(), &img)
+	return err
+}
+
+func (r *ImageRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.count(filter), nil
+}
+
+func (r *ImageRepository) Exists(ctx context.Context, id string) bool {
+	return r.count(bson.M{"_id": id}) > 0
+}
@@ -0,0 +1,62 @@
+package repotest
+
+import (
+	"context"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LeaseRepository keeps network leases in memory with the unique indexes of
+// repository.LeaseRepository
+type LeaseRepository struct {
+	store
+}
+
+var _ repository.ILeaseRepository = (*LeaseRepository)(nil)
+
+func NewLeaseRepository() *LeaseRepository {
+	return &LeaseRepository{store: store{unique: []uniqueIndex{
+		{field: "sandboxId"},
+		{field: "cid"},
+		{field: "ip", sparse: true},
+		{field: "mac", sparse: true},
+	}}}
+}
+
+func (r *LeaseRepository) Create(ctx context.Context, lease *model.NetworkLease) error {
+	lease.CreatedAt = time.Now()
+	id, err := r.insert(lease)
+	if err == errDuplicateKey {
+		return model.ErrLeaseConflict
+	}
+	lease.ID = id
+	return nil
+}
+
+func (r *LeaseRepository) FindBySandbox(ctx context.Context, sandboxID primitive.ObjectID) (*model.NetworkLease, error) {
+	return decodeOne[model.NetworkLease](r.findOne(bson.M{"sandboxId": sandboxID})), nil
+}
+
+func (r *LeaseRepository) Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.NetworkLease, error) {
+	return decodeAll[model.NetworkLease](r.find(filter, &opts)), nil
+}
+
+func (r *LeaseRepository) SetPool(ctx context.Context, id primitive.ObjectID, pool string) error {
+	r.update(bson.M{"_id": id}, bson.M{"$set": bson.M{"pool": pool}}, nil)
+	return nil
+}
+
+func (r *LeaseRepository) DeleteBySandbox(ctx context.Context, sandboxID primitive.ObjectID) error {
+	r.remove(bson.M{"sandboxId": sandboxID})
+	return nil
+}
+
+func (r *LeaseRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.count(filter), nil
+}
@@ -0,0 +1,48 @@
+package repotest
+
+import (
+	"context"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OrgRepository keeps organizations in memory
+type OrgRepository struct {
+	store
+}
+
+var _ repository.IOrgRepository = (*OrgRepository)(nil)
+
+func NewOrgRepository() *OrgRepository {
+	return &OrgRepository{}
+}
+
+func (r *OrgRepository) Create(ctx context.Context, org *model.Organization) (*model.Organization, error) {
+	now := time.Now()
+	org.CreatedAt = now
+	org.UpdatedAt = now
+	id, err := r.insert(org)
+	if err != nil {
+		return nil, err
+	}
+	org.ID = id
+	return org, nil
+}
+
+func (r *OrgRepository) FindByOwner(ctx context.Context, ownerID primitive.ObjectID) (*model.Organization, error) {
+	return decodeOne[model.Organization](r.findOne(bson.M{"ownerId": ownerID})), nil
+}
+
+func (r *OrgRepository) FindByID(ctx context.Context, id primitive.ObjectID) (*model.Organization, error) {
+	return decodeOne[model.Organization](r.findOne(bson.M{"_id": id})), nil
+}
+
+func (r *OrgRepository) SetSandboxPeering(ctx context.Context, id primitive.ObjectID, enabled bool) error {
+	r.update(bson.M{"_id": id}, bson.M{"$set": bson.M{"sandboxPeering": enabled, "updatedAt": time.Now()}}, nil)
+	return nil
+}
@@ -0,0 +1,123 @@
+package repotest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+	"voidrun/pkg/util"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SandboxRepository keeps sandbox records in memory
+type SandboxRepository struct {
+	store
+}
+
+var _ repository.ISandboxRepository = (*SandboxRepository)(nil)
+
+func NewSandboxRepository() *SandboxRepository {
+	return &SandboxRepository{}
+}
+
+func (r *SandboxRepository) Create(ctx context.Context, sandbox *model.Sandbox) error {
+	sandbox.CreatedAt = time.Now()
+	id, err := r.insert(sandbox)
+	if err == errDuplicateKey {
+		return fmt.Errorf("sandbox id %s already exists", sandbox.ID)
+	}
+	sandbox.ID = id
+	return nil
+}
+
+func (r *SandboxRepository) FindByID(ctx context.Context, id string) (*model.Sandbox, error) {
+	oid, err := util.ParseObjectID(id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeOne[model.Sandbox](r.findOne(bson.M{"_id": oid})), nil
+}
+
+func (r *SandboxRepository) FindByIDAndOrg(ctx context.Context, id string, orgID primitive.ObjectID) (*model.Sandbox, error) {
+	oid, err := util.ParseObjectID(id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeOne[model.Sandbox](r.findOne(bson.M{"_id": oid, "orgId": orgID})), nil
+}
+
+func (r *SandboxRepository) Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.Sandbox, error) {
+	return decodeAll[model.Sandbox](r.find(filter, &opts)), nil
+}
+
+func (r *SandboxRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.remove(bson.M{"_id": id})
+	return nil
+}
+
+func (r *SandboxRepository) UpdateStatus(ctx context.Context, id primitive.ObjectID, status string) error {
+	return r.UpdateFields(ctx, id, bson.M{"status": status})
+}
+
+func (r *SandboxRepository) UpdateFields(ctx context.Context, id primitive.ObjectID, fields bson.M) error {
+	set := bson.M{"updatedAt": time.Now()}
+	for k, v := range fields {
+		set[k] = v
+	}
+	r.update(bson.M{"_id": id}, bson.M{"$set": set}, nil)
+	return nil
+}
+
+func (r *SandboxRepository) UpdateFieldsIf(ctx context.Context, id primitive.ObjectID, from []string, fields bson.M) error {
+	set := bson.M{"updatedAt": time.Now()}
+	for k, v := range fields {
+		set[k] = v
+	}
+	if _, ok := r.update(bson.M{"_id": id, "status": bson.M{"$in": from}}, bson.M{"$set": set}, nil); !ok {
+		return model.ErrInvalidTransition
+	}
+	return nil
+}
+
+func (r *SandboxRepository) TransitionStatus(ctx context.Context, id primitive.ObjectID, from []string, to string) error {
+	filter := bson.M{"_id": id, "status": bson.M{"$in": from}}
+	if _, ok := r.update(filter, bson.M{"$set": bson.M{"status": to, "updatedAt": time.Now()}}, nil); !ok {
+		return model.ErrInvalidTransition
+	}
+	return nil
+}
+
+func (r *SandboxRepository) ClaimWarm(ctx context.Context, imageID string, cpu, mem int, claim bson.M) (*model.Sandbox, error) {
+	filter := bson.M{
+		"status":  model.SandboxStatusWarm,
+		"imageId": imageID,
+		"cpu":     cpu,
+		"mem":     mem,
+	}
+	set := bson.M{}
+	for k, v := range claim {
+		set[k] = v
+	}
+	set["status"] = model.SandboxStatusRunning
+	set["updatedAt"] = time.Now()
+
+	doc, _ := r.update(filter, bson.M{"$set": set}, bson.D{{Key: "createdAt", Value: 1}})
+	return decodeOne[model.Sandbox](doc), nil
+}
+
+func (r *SandboxRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.count(filter), nil
+}
+
+func (r *SandboxRepository) Exists(ctx context.Context, id string) bool {
+	oid, err := util.ParseObjectID(id)
+	if err != nil {
+		return false
+	}
+	return r.count(bson.M{"_id": oid}) > 0
+}
@@ -0,0 +1,97 @@
+package repotest
+
+import (
+	"context"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+	"voidrun/pkg/util"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SnapshotRepository keeps the snapshot registry in memory, with the reference counting
+// and delete guards of repository.SnapshotRepository
+type SnapshotRepository struct {
+	store
+}
+
+var _ repository.ISnapshotRepository = (*SnapshotRepository)(nil)
+
+func NewSnapshotRepository() *SnapshotRepository {
+	return &SnapshotRepository{}
+}
+
+func (r *SnapshotRepository) Create(ctx context.Context, snapshot *model.Snapshot) error {
+	snapshot.CreatedAt = time.Now()
+	id, err := r.insert(snapshot)
+	if err != nil {
+		return err
+	}
+	snapshot.ID = id
+	return nil
+}
+
+func (r *SnapshotRepository) FindByIDAndOrg(ctx context.Context, id string, orgID primitive.ObjectID) (*model.Snapshot, error) {
+	oid, err := util.ParseObjectID(id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeOne[model.Snapshot](r.findOne(bson.M{"_id": oid, "orgId": orgID})), nil
+}
+
+func (r *SnapshotRepository) Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.Snapshot, error) {
+	return decodeAll[model.Snapshot](r.find(filter, &opts)), nil
+}
+
+func (r *SnapshotRepository) MarkReady(ctx context.Context, id primitive.ObjectID, sizeBytes int64) error {
+	r.update(bson.M{"_id": id}, bson.M{"$set": bson.M{"status": model.SnapshotStatusReady, "sizeBytes": sizeBytes}}, nil)
+	return nil
+}
+
+func (r *SnapshotRepository) MarkFailed(ctx context.Context, id primitive.ObjectID) error {
+	r.update(bson.M{"_id": id, "status": model.SnapshotStatusCreating}, bson.M{"$set": bson.M{"status": model.SnapshotStatusFailed}}, nil)
+	return nil
+}
+
+func (r *SnapshotRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.remove(bson.M{"_id": id})
+	return nil
+}
+
+func (r *SnapshotRepository) AddRef(ctx context.Context, id primitive.ObjectID) error {
+	if _, ok := r.update(bson.M{"_id": id, "status": model.SnapshotStatusReady}, bson.M{"$inc": bson.M{"refCount": 1}}, nil); !ok {
+		return model.ErrSnapshotNotReady
+	}
+	return nil
+}
+
+func (r *SnapshotRepository) Release(ctx context.Context, id primitive.ObjectID) (*model.Snapshot, error) {
+	doc, _ := r.update(bson.M{"_id": id, "refCount": bson.M{"$gt": 0}}, bson.M{"$inc": bson.M{"refCount": -1}}, nil)
+	return decodeOne[model.Snapshot](doc), nil
+}
+
+func (r *SnapshotRepository) BeginDelete(ctx context.Context, id primitive.ObjectID) error {
+	deletable := []string{model.SnapshotStatusReady, model.SnapshotStatusFailed}
+	filter := bson.M{"_id": id, "status": bson.M{"$in": deletable}, "refCount": bson.M{"$not": bson.M{"$gt": 0}}}
+	if _, ok := r.update(filter, bson.M{"$set": bson.M{"status": model.SnapshotStatusDeleting}}, nil); ok {
+		return nil
+	}
+	if snapshot := decodeOne[model.Snapshot](r.findOne(bson.M{"_id": id})); snapshot != nil &&
+		snapshot.Status != model.SnapshotStatusReady && snapshot.Status != model.SnapshotStatusFailed {
+		return model.ErrSnapshotNotReady
+	}
+	return model.ErrSnapshotInUse
+}
+
+func (r *SnapshotRepository) CancelDelete(ctx context.Context, id primitive.ObjectID, status string) error {
+	r.update(bson.M{"_id": id, "status": model.SnapshotStatusDeleting}, bson.M{"$set": bson.M{"status": status}}, nil)
+	return nil
+}
+
+func (r *SnapshotRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.count(filter), nil
+}
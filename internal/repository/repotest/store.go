@@ -0,0 +1,499 @@
+// Package repotest provides in-memory implementations of the repository interfaces for
+// tests of the service and handler layers. Records are kept as BSON documents, so filters
+// and updates see the same field names and types as they would in MongoDB. Only the query
+// and update operators the services use are supported; anything else panics.
+package repotest
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// store is one in-memory collection
+type store struct {
+	mu   sync.Mutex
+	docs []bson.M
+	// unique lists fields no two documents may share; sparse ones may be absent
+	unique []uniqueIndex
+}
+
+type uniqueIndex struct {
+	field  string
+	sparse bool
+}
+
+// errDuplicateKey is returned by insert when a unique index would be violated
+var errDuplicateKey = fmt.Errorf("duplicate key")
+
+func toDoc(v interface{}) bson.M {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("repotest: cannot encode %T: %v", v, err))
+	}
+	var doc bson.M
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		panic(fmt.Sprintf("repotest: cannot decode %T: %v", v, err))
+	}
+	return doc
+}
+
+func fromDoc(doc bson.M, out interface{}) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		panic(fmt.Sprintf("repotest: cannot encode document: %v", err))
+	}
+	if err := bson.Unmarshal(data, out); err != nil {
+		panic(fmt.Sprintf("repotest: cannot decode into %T: %v", out, err))
+	}
+}
+
+// decodeOne decodes a document into a new T, or returns nil for no document
+func decodeOne[T any](doc bson.M) *T {
+	if doc == nil {
+		return nil
+	}
+	out := new(T)
+	fromDoc(doc, out)
+	return out
+}
+
+func decodeAll[T any](docs []bson.M) []*T {
+	var out []*T
+	for _, doc := range docs {
+		out = append(out, decodeOne[T](doc))
+	}
+	return out
+}
+
+// normalize gives a filter or update value the types it would have once stored
+func normalize(v interface{}) interface{} {
+	return toDoc(bson.M{"v": v})["v"]
+}
+
+// insert stores v and returns its _id, generating one when v has none
+func (s *store) insert(v interface{}) (primitive.ObjectID, error) {
+	doc := toDoc(v)
+	id, _ := doc["_id"].(primitive.ObjectID)
+	if id.IsZero() {
+		id = primitive.NewObjectID()
+		doc["_id"] = id
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.docs {
+		if existing["_id"] == id {
+			return id, errDuplicateKey
+		}
+		for _, index := range s.unique {
+			value, ok := doc[index.field]
+			if !ok && index.sparse {
+				continue
+			}
+			if other, found := existing[index.field]; (found || !index.sparse) && equal(other, value) {
+				return id, errDuplicateKey
+			}
+		}
+	}
+	s.docs = append(s.docs, doc)
+	return id, nil
+}
+
+// find returns copies of the matching documents, sorted, skipped and limited as opts asks
+func (s *store) find(filter interface{}, opts *options.FindOptions) []bson.M {
+	s.mu.Lock()
+	var found []bson.M
+	for _, doc := range s.docs {
+		if matches(doc, filter) {
+			found = append(found, toDoc(doc))
+		}
+	}
+	s.mu.Unlock()
+
+	if opts != nil {
+		if opts.Sort != nil {
+			sortDocs(found, opts.Sort)
+		}
+		if opts.Skip != nil {
+			skip := int(*opts.Skip)
+			if skip > len(found) {
+				skip = len(found)
+			}
+			found = found[skip:]
+		}
+		if opts.Limit != nil && *opts.Limit > 0 && int(*opts.Limit) < len(found) {
+			found = found[:*opts.Limit]
+		}
+	}
+	return found
+}
+
+// findOne returns a copy of the first matching document, or nil
+func (s *store) findOne(filter interface{}) bson.M {
+	found := s.find(filter, nil)
+	if len(found) == 0 {
+		return nil
+	}
+	return found[0]
+}
+
+func (s *store) count(filter interface{}) int64 {
+	return int64(len(s.find(filter, nil)))
+}
+
+// update applies update to the first document matching filter, in sort order when sortBy
+// is set. It reports whether a document matched and returns it as updated.
+func (s *store) update(filter interface{}, update bson.M, sortBy interface{}) (bson.M, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	candidates := make([]bson.M, 0, len(s.docs))
+	for _, doc := range s.docs {
+		if matches(doc, filter) {
+			candidates = append(candidates, doc)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	if sortBy != nil {
+		sortDocs(candidates, sortBy)
+	}
+	doc := candidates[0]
+	applyUpdate(doc, update)
+	return toDoc(doc), true
+}
+
+// remove deletes the first document matching filter
+func (s *store) remove(filter interface{}) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, doc := range s.docs {
+		if matches(doc, filter) {
+			s.docs = append(s.docs[:i], s.docs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func applyUpdate(doc bson.M, update bson.M) {
+	for op, arg := range update {
+		fields, ok := asDoc(normalize(arg))
+		if !ok {
+			panic(fmt.Sprintf("repotest: malformed %s update", op))
+		}
+		for path, value := range fields {
+			switch op {
+			case "$set":
+				setPath(doc, path, value)
+			case "$unset":
+				unsetPath(doc, path)
+			case "$inc":
+				current, _ := getPath(doc, path)
+				setPath(doc, path, addNumbers(current, value))
+			default:
+				panic(fmt.Sprintf("repotest: update operator %s is not supported", op))
+			}
+		}
+	}
+}
+
+func addNumbers(a, b interface{}) interface{} {
+	x, _ := number(a)
+	y, ok := number(b)
+	if !ok {
+		panic(fmt.Sprintf("repotest: cannot $inc by %T", b))
+	}
+	sum := x + y
+	if _, isFloat := b.(float64); isFloat {
+		return sum
+	}
+	return int64(sum)
+}
+
+func asDoc(v interface{}) (bson.M, bool) {
+	switch d := v.(type) {
+	case bson.M:
+		return d, true
+	case map[string]interface{}:
+		return bson.M(d), true
+	case bson.D:
+		return d.Map(), true
+	}
+	return nil, false
+}
+
+func getPath(doc bson.M, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		d, ok := asDoc(current)
+		if !ok {
+			return nil, false
+		}
+		if current, ok = d[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func setPath(doc bson.M, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := asDoc(doc[key])
+		if !ok {
+			next = bson.M{}
+			doc[key] = next
+		}
+		doc = next
+	}
+	doc[keys[len(keys)-1]] = value
+}
+
+func unsetPath(doc bson.M, path string) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := asDoc(doc[key])
+		if !ok {
+			return
+		}
+		doc = next
+	}
+	delete(doc, keys[len(keys)-1])
+}
+
+// matches evaluates a query filter against a stored document
+func matches(doc bson.M, filter interface{}) bool {
+	if filter == nil {
+		return true
+	}
+	query, ok := asDoc(normalize(filter))
+	if !ok {
+		panic(fmt.Sprintf("repotest: filter %T is not a document", filter))
+	}
+	return matchQuery(doc, query)
+}
+
+func matchQuery(doc bson.M, query bson.M) bool {
+	for key, cond := range query {
+		switch key {
+		case "$or", "$and", "$nor":
+			clauses, _ := cond.(primitive.A)
+			any := false
+			all := true
+			for _, clause := range clauses {
+				sub, _ := asDoc(clause)
+				if matchQuery(doc, sub) {
+					any = true
+				} else {
+					all = false
+				}
+			}
+			if (key == "$or" && !any) || (key == "$and" && !all) || (key == "$nor" && any) {
+				return false
+			}
+		default:
+			value, present := getPath(doc, key)
+			if !matchCond(value, present, cond) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchCond applies the condition of one field: either a value to equal or a document of operators
+func matchCond(value interface{}, present bool, cond interface{}) bool {
+	ops, isDoc := asDoc(cond)
+	if !isDoc || !isOperatorDoc(ops) {
+		return matchValue(value, present, cond)
+	}
+	for op, arg := range ops {
+		var ok bool
+		switch op {
+		case "$eq":
+			ok = matchValue(value, present, arg)
+		case "$ne":
+			ok = !matchValue(value, present, arg)
+		case "$exists":
+			want, _ := arg.(bool)
+			ok = present == want
+		case "$in":
+			ok = matchIn(value, present, arg)
+		case "$nin":
+			ok = !matchIn(value, present, arg)
+		case "$gt", "$gte", "$lt", "$lte":
+			ok = present && matchOrder(value, op, arg)
+		case "$not":
+			ok = !matchCond(value, present, arg)
+		default:
+			panic(fmt.Sprintf("repotest: query operator %s is not supported", op))
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func isOperatorDoc(d bson.M) bool {
+	if len(d) == 0 {
+		return false
+	}
+	for key := range d {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// matchValue compares like MongoDB: nil matches a missing field, and an array field
+// matches when any of its elements does
+func matchValue(value interface{}, present bool, want interface{}) bool {
+	if !present {
+		return want == nil
+	}
+	if equal(value, want) {
+		return true
+	}
+	if arr, ok := value.(primitive.A); ok {
+		for _, elem := range arr {
+			if equal(elem, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchIn(value interface{}, present bool, arg interface{}) bool {
+	candidates, _ := arg.(primitive.A)
+	for _, want := range candidates {
+		if matchValue(value, present, want) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOrder(value interface{}, op string, arg interface{}) bool {
+	c, ok := compare(value, arg)
+	if !ok {
+		return false
+	}
+	switch op {
+	case "$gt":
+		return c > 0
+	case "$gte":
+		return c >= 0
+	case "$lt":
+		return c < 0
+	}
+	return c <= 0
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case nil:
+		return 0, true
+	}
+	return 0, false
+}
+
+func equal(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compare orders two values of the same kind
+func compare(a, b interface{}) (int, bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+	switch x := a.(type) {
+	case string:
+		y, ok := b.(string)
+		return strings.Compare(x, y), ok
+	case primitive.DateTime:
+		y, ok := b.(primitive.DateTime)
+		switch {
+		case !ok:
+			return 0, false
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case primitive.ObjectID:
+		y, ok := b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:]), ok
+	}
+	return 0, false
+}
+
+// sortDocs orders documents by a sort specification such as bson.D{{"createdAt", -1}}
+func sortDocs(docs []bson.M, spec interface{}) {
+	var keys bson.D
+	switch s := spec.(type) {
+	case bson.D:
+		keys = s
+	case bson.M:
+		for k, v := range s {
+			keys = append(keys, bson.E{Key: k, Value: v})
+		}
+	default:
+		panic(fmt.Sprintf("repotest: sort %T is not supported", spec))
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		for _, key := range keys {
+			a, _ := getPath(docs[i], key.Key)
+			b, _ := getPath(docs[j], key.Key)
+			c, ok := compare(a, b)
+			if !ok || c == 0 {
+				continue
+			}
+			if dir, _ := number(key.Value); dir < 0 {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
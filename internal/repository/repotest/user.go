@@ -0,0 +1,72 @@
+package repotest
+
+import (
+	"context"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// UserRepository keeps users in memory
+type UserRepository struct {
+	store
+}
+
+var _ repository.IUserRepository = (*UserRepository)(nil)
+
+func NewUserRepository() *UserRepository {
+	return &UserRepository{}
+}
+
+func (r *UserRepository) Create(ctx context.Context, user *model.User) error {
+	user.CreatedAt = time.Now()
+	id, err := r.insert(user)
+	if err != nil {
+		return err
+	}
+	user.ID = id
+	return nil
+}
+
+func (r *UserRepository) FindByID(ctx context.Context, id primitive.ObjectID) (*model.User, error) {
+	return decodeOne[model.User](r.findOne(bson.M{"_id": id})), nil
+}
+
+func (r *UserRepository) Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.User, error) {
+	return decodeAll[model.User](r.find(filter, &opts)), nil
+}
+
+func (r *UserRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.remove(bson.M{"_id": id})
+	return nil
+}
+
+func (r *UserRepository) FindByEmail(ctx context.Context, email string) (*model.User, error) {
+	return decodeOne[model.User](r.findOne(bson.M{"email": email})), nil
+}
+
+func (r *UserRepository) EnsureSystemUser(u model.User) error {
+	if r.count(bson.M{"email": u.Email, "system": true}) > 0 {
+		return nil
+	}
+	u.System = true
+	u.Role = "system"
+	return r.Create(context.Background(), &u)
+}
+
+func (r *UserRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.count(filter), nil
+}
+
+func (r *UserRepository) Exists(ctx context.Context, id string) bool {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return false
+	}
+	return r.count(bson.M{"_id": oid}) > 0
+}
@@ -0,0 +1,85 @@
+package repotest
+
+import (
+	"context"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+	"voidrun/pkg/util"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// WebhookRepository keeps webhook registrations in memory
+type WebhookRepository struct {
+	store
+}
+
+var _ repository.IWebhookRepository = (*WebhookRepository)(nil)
+
+func NewWebhookRepository() *WebhookRepository {
+	return &WebhookRepository{}
+}
+
+func (r *WebhookRepository) Create(ctx context.Context, webhook *model.Webhook) error {
+	webhook.CreatedAt = time.Now()
+	id, err := r.insert(webhook)
+	if err != nil {
+		return err
+	}
+	webhook.ID = id
+	return nil
+}
+
+func (r *WebhookRepository) FindByIDAndOrg(ctx context.Context, id string, orgID primitive.ObjectID) (*model.Webhook, error) {
+	oid, err := util.ParseObjectID(id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeOne[model.Webhook](r.findOne(bson.M{"_id": oid, "orgId": orgID})), nil
+}
+
+func (r *WebhookRepository) Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.Webhook, error) {
+	return decodeAll[model.Webhook](r.find(filter, &opts)), nil
+}
+
+func (r *WebhookRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	r.remove(bson.M{"_id": id})
+	return nil
+}
+
+func (r *WebhookRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.count(filter), nil
+}
+
+// WebhookDeliveryRepository keeps the webhook delivery log in memory
+type WebhookDeliveryRepository struct {
+	store
+}
+
+var _ repository.IWebhookDeliveryRepository = (*WebhookDeliveryRepository)(nil)
+
+func NewWebhookDeliveryRepository() *WebhookDeliveryRepository {
+	return &WebhookDeliveryRepository{}
+}
+
+func (r *WebhookDeliveryRepository) Create(ctx context.Context, delivery *model.WebhookDelivery) error {
+	delivery.CreatedAt = time.Now()
+	id, err := r.insert(delivery)
+	if err != nil {
+		return err
+	}
+	delivery.ID = id
+	return nil
+}
+
+func (r *WebhookDeliveryRepository) Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.WebhookDelivery, error) {
+	return decodeAll[model.WebhookDelivery](r.find(filter, &opts)), nil
+}
+
+func (r *WebhookDeliveryRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.count(filter), nil
+}
@@ -3,10 +3,8 @@ package repository
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"os"
 	"path/filepath"
-	"sync"
 	"time"
 
 	"voidrun/internal/config"
@@ -14,8 +12,6 @@ import (
 	"voidrun/pkg/timer"
 	"voidrun/pkg/util"
 
-	"github.com/3th1nk/cidr"
-
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -25,36 +21,35 @@ import (
 type ISandboxRepository interface {
 	Create(ctx context.Context, sandbox *model.Sandbox) error
 	FindByID(ctx context.Context, id string) (*model.Sandbox, error)
+	FindByIDAndOrg(ctx context.Context, id string, orgID primitive.ObjectID) (*model.Sandbox, error)
 	Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.Sandbox, error)
 	Delete(ctx context.Context, id primitive.ObjectID) error
 	UpdateStatus(ctx context.Context, id primitive.ObjectID, status string) error
+	UpdateFields(ctx context.Context, id primitive.ObjectID, fields bson.M) error
+	UpdateFieldsIf(ctx context.Context, id primitive.ObjectID, from []string, fields bson.M) error
+	TransitionStatus(ctx context.Context, id primitive.ObjectID, from []string, to string) error
+	ClaimWarm(ctx context.Context, imageID string, cpu, mem int, claim bson.M) (*model.Sandbox, error)
 	Count(ctx context.Context, filter interface{}) (int64, error)
 	Exists(ctx context.Context, id string) bool
-	NextAvailableIP() (string, error)
 }
 
 // SandboxRepository handles sandbox persistence in MongoDB
 type SandboxRepository struct {
 	instancesDir string
-	networkCIDR  string
-	mu           sync.Mutex
 	cfg          *config.Config
 	collection   *mongo.Collection
-	allocatedIPs map[string]bool // Cache of all allocated IPs
 }
 
 // NewSandboxRepository creates a new sandbox repository
 func NewSandboxRepository(cfg *config.Config, db *mongo.Database) *SandboxRepository {
 	return &SandboxRepository{
 		instancesDir: cfg.Paths.InstancesDir,
-		networkCIDR:  cfg.Network.NetworkCIDR,
 		cfg:          cfg,
 		collection:   db.Collection("sandboxes"),
-		allocatedIPs: make(map[string]bool),
 	}
 }
 
-// Init initializes the repository by loading all allocated IPs from the database
+// Init creates the orgId index used by per-org listings
 func (r *SandboxRepository) Init(ctx context.Context) error {
 	// Create index on orgId for faster list queries
 	indexOpts := options.Index().SetUnique(false)
@@ -66,83 +61,9 @@ func (r *SandboxRepository) Init(ctx context.Context) error {
 		fmt.Printf("[warn] failed to create orgId index: %v\n", err)
 	}
 
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	cur, err := r.collection.Find(ctx, bson.M{"ip": bson.M{"$ne": ""}}, &options.FindOptions{
-		Projection: bson.M{"ip": 1},
-	})
-	if err != nil {
-		return fmt.Errorf("failed to fetch allocated IPs: %w", err)
-	}
-	defer cur.Close(ctx)
-
-	for cur.Next(ctx) {
-		var doc struct {
-			IP string `bson:"ip"`
-		}
-		if err := cur.Decode(&doc); err != nil {
-			return fmt.Errorf("failed to decode IP: %w", err)
-		}
-		if doc.IP != "" {
-			r.allocatedIPs[doc.IP] = true
-		}
-	}
-
-	if err := cur.Err(); err != nil {
-		return fmt.Errorf("cursor error: %w", err)
-	}
-
 	return nil
 }
 
-// NextAvailableIP returns a random available IP from the CIDR range
-func (r *SandboxRepository) NextAvailableIP() (string, error) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	defer timer.Track("NextAvailableIP (Total)")()
-
-	// Parse CIDR notation
-	c, err := cidr.Parse(r.networkCIDR)
-	if err != nil {
-		return "", fmt.Errorf("invalid CIDR notation: %w", err)
-	}
-
-	// Get total IP count in the range (excluding network and broadcast)
-	totalIPs := int(c.IPCount().Int64())
-	if totalIPs < 2 {
-		return "", fmt.Errorf("CIDR range too small: %s", r.networkCIDR)
-	}
-
-	// Try to find a random available IP (max 100 attempts)
-	for attempts := 0; attempts < 100; attempts++ {
-		// Get random index within available IPs
-		randomIndex := rand.Intn(totalIPs)
-
-		var selectedIP string
-		count := 0
-
-		// Iterate through IPs and find the random one
-		c.Each(func(ip string) bool {
-			if count == randomIndex {
-				if ip != "" && !r.allocatedIPs[ip] {
-					selectedIP = ip
-					r.allocatedIPs[selectedIP] = true
-					return false // Stop iteration
-				}
-			}
-			count++
-			return true
-		})
-
-		if selectedIP != "" {
-			return selectedIP, nil
-		}
-	}
-
-	return "", fmt.Errorf("no free IPs available in subnet %s", r.networkCIDR)
-}
-
 func (r *SandboxRepository) Create(ctx context.Context, sandbox *model.Sandbox) error {
 	defer timer.Track("SandboxRepository.Create Mongo (Total)")()
 
@@ -175,6 +96,25 @@ func (r *SandboxRepository) FindByID(ctx context.Context, id string) (*model.San
 	return sandbox, nil
 }
 
+// FindByIDAndOrg retrieves a sandbox by ID only if it belongs to the given org.
+// Sandboxes owned by other orgs are reported as not found.
+func (r *SandboxRepository) FindByIDAndOrg(ctx context.Context, id string, orgID primitive.ObjectID) (*model.Sandbox, error) {
+	oid, err := util.ParseObjectID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var sandbox *model.Sandbox
+	err = r.collection.FindOne(ctx, bson.M{"_id": oid, "orgId": orgID}).Decode(&sandbox)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return sandbox, nil
+}
+
 func (r *SandboxRepository) Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.Sandbox, error) {
 	cursor, err := r.collection.Find(ctx, filter, &opts)
 	if err != nil {
@@ -202,6 +142,83 @@ func (r *SandboxRepository) UpdateStatus(ctx context.Context, id primitive.Objec
 	return err
 }
 
+// UpdateFields sets the given fields on a sandbox record
+func (r *SandboxRepository) UpdateFields(ctx context.Context, id primitive.ObjectID, fields bson.M) error {
+	set := bson.M{"updatedAt": time.Now()}
+	for k, v := range fields {
+		set[k] = v
+	}
+	_, err := r.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": set})
+	return err
+}
+
+// UpdateFieldsIf sets the given fields on a sandbox record, but only if its current
+// status is one of from. It returns model.ErrInvalidTransition when the sandbox is in
+// any other state.
+func (r *SandboxRepository) UpdateFieldsIf(ctx context.Context, id primitive.ObjectID, from []string, fields bson.M) error {
+	set := bson.M{"updatedAt": time.Now()}
+	for k, v := range fields {
+		set[k] = v
+	}
+	res, err := r.collection.UpdateOne(ctx, bson.M{"_id": id, "status": bson.M{"$in": from}}, bson.M{"$set": set})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return model.ErrInvalidTransition
+	}
+	return nil
+}
+
+// TransitionStatus atomically moves a sandbox to a new status, but only if its
+// current status is one of from. It returns model.ErrInvalidTransition when the
+// sandbox is in any other state.
+func (r *SandboxRepository) TransitionStatus(ctx context.Context, id primitive.ObjectID, from []string, to string) error {
+	filter := bson.M{"_id": id, "status": bson.M{"$in": from}}
+	res, err := r.collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{
+		"status":    to,
+		"updatedAt": time.Now(),
+	}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return model.ErrInvalidTransition
+	}
+	return nil
+}
+
+// ClaimWarm atomically hands one warm sandbox of the given shape to a caller by moving it
+// to running and applying the claim fields. It returns (nil, nil) when the pool is empty.
+func (r *SandboxRepository) ClaimWarm(ctx context.Context, imageID string, cpu, mem int, claim bson.M) (*model.Sandbox, error) {
+	filter := bson.M{
+		"status":  model.SandboxStatusWarm,
+		"imageId": imageID,
+		"cpu":     cpu,
+		"mem":     mem,
+	}
+	set := bson.M{}
+	for k, v := range claim {
+		set[k] = v
+	}
+	set["status"] = model.SandboxStatusRunning
+	set["updatedAt"] = time.Now()
+
+	opts := options.FindOneAndUpdate().
+		SetReturnDocument(options.After).
+		SetSort(bson.D{{Key: "createdAt", Value: 1}})
+
+	var sandbox *model.Sandbox
+	err := r.collection.FindOneAndUpdate(ctx, filter, bson.M{"$set": set}, opts).Decode(&sandbox)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return sandbox, nil
+}
+
 func (r *SandboxRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
 	count, err := r.collection.CountDocuments(ctx, filter)
 	return count, err
@@ -0,0 +1,195 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+	"voidrun/pkg/util"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ISnapshotRepository interface {
+	Create(ctx context.Context, snapshot *model.Snapshot) error
+	FindByIDAndOrg(ctx context.Context, id string, orgID primitive.ObjectID) (*model.Snapshot, error)
+	Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.Snapshot, error)
+	MarkReady(ctx context.Context, id primitive.ObjectID, sizeBytes int64) error
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	AddRef(ctx context.Context, id primitive.ObjectID) error
+	Release(ctx context.Context, id primitive.ObjectID) (*model.Snapshot, error)
+	MarkFailed(ctx context.Context, id primitive.ObjectID) error
+	BeginDelete(ctx context.Context, id primitive.ObjectID) error
+	CancelDelete(ctx context.Context, id primitive.ObjectID, status string) error
+	Count(ctx context.Context, filter interface{}) (int64, error)
+}
+
+// SnapshotRepository manages the snapshot registry in MongoDB
+type SnapshotRepository struct {
+	cfg        *config.Config
+	collection *mongo.Collection
+}
+
+func NewSnapshotRepository(cfg *config.Config, db *mongo.Database) ISnapshotRepository {
+	return &SnapshotRepository{
+		cfg:        cfg,
+		collection: db.Collection("snapshots"),
+	}
+}
+
+// Init creates the indexes used for per-org listings
+func (r *SnapshotRepository) Init(ctx context.Context) error {
+	indexModel := mongo.IndexModel{
+		Keys: bson.D{bson.E{Key: "orgId", Value: 1}, bson.E{Key: "createdAt", Value: -1}},
+	}
+	if _, err := r.collection.Indexes().CreateOne(ctx, indexModel); err != nil {
+		return fmt.Errorf("failed to create snapshot orgId index: %w", err)
+	}
+	return nil
+}
+
+// Create inserts a new snapshot record
+func (r *SnapshotRepository) Create(ctx context.Context, snapshot *model.Snapshot) error {
+	snapshot.CreatedAt = time.Now()
+	result, err := r.collection.InsertOne(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+	snapshot.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindByIDAndOrg retrieves a snapshot by ID only if it belongs to the given org
+func (r *SnapshotRepository) FindByIDAndOrg(ctx context.Context, id string, orgID primitive.ObjectID) (*model.Snapshot, error) {
+	oid, err := util.ParseObjectID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshot *model.Snapshot
+	err = r.collection.FindOne(ctx, bson.M{"_id": oid, "orgId": orgID}).Decode(&snapshot)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Find retrieves snapshots matching the filter
+func (r *SnapshotRepository) Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.Snapshot, error) {
+	cursor, err := r.collection.Find(ctx, filter, &opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var snapshots []*model.Snapshot
+	if err = cursor.All(ctx, &snapshots); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// MarkReady records the final size of a snapshot once its files are complete
+func (r *SnapshotRepository) MarkReady(ctx context.Context, id primitive.ObjectID, sizeBytes int64) error {
+	_, err := r.collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"status":    model.SnapshotStatusReady,
+		"sizeBytes": sizeBytes,
+	}})
+	return err
+}
+
+// MarkFailed marks a snapshot that never finished creating as failed
+func (r *SnapshotRepository) MarkFailed(ctx context.Context, id primitive.ObjectID) error {
+	_, err := r.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "status": model.SnapshotStatusCreating},
+		bson.M{"$set": bson.M{"status": model.SnapshotStatusFailed}},
+	)
+	return err
+}
+
+// Delete removes a snapshot record
+func (r *SnapshotRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// AddRef records one more sandbox backed by the snapshot. It fails with
+// model.ErrSnapshotNotReady unless the snapshot is ready, so a snapshot being deleted
+// cannot gain new users.
+func (r *SnapshotRepository) AddRef(ctx context.Context, id primitive.ObjectID) error {
+	result, err := r.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "status": model.SnapshotStatusReady},
+		bson.M{"$inc": bson.M{"refCount": 1}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return model.ErrSnapshotNotReady
+	}
+	return nil
+}
+
+// Release drops the reference of a deleted sandbox and returns the updated snapshot,
+// or nil when the snapshot no longer exists
+func (r *SnapshotRepository) Release(ctx context.Context, id primitive.ObjectID) (*model.Snapshot, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var snapshot *model.Snapshot
+	err := r.collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": id, "refCount": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"refCount": -1}},
+		opts,
+	).Decode(&snapshot)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// BeginDelete moves an unreferenced ready or failed snapshot to deleting. It fails with
+// model.ErrSnapshotInUse while sandboxes are still backed by it.
+func (r *SnapshotRepository) BeginDelete(ctx context.Context, id primitive.ObjectID) error {
+	deletable := []string{model.SnapshotStatusReady, model.SnapshotStatusFailed}
+	result, err := r.collection.UpdateOne(ctx,
+		// Records written before reference counting have no refCount at all
+		bson.M{"_id": id, "status": bson.M{"$in": deletable}, "refCount": bson.M{"$not": bson.M{"$gt": 0}}},
+		bson.M{"$set": bson.M{"status": model.SnapshotStatusDeleting}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		var snapshot model.Snapshot
+		if err := r.collection.FindOne(ctx, bson.M{"_id": id}).Decode(&snapshot); err == nil &&
+			snapshot.Status != model.SnapshotStatusReady && snapshot.Status != model.SnapshotStatusFailed {
+			return model.ErrSnapshotNotReady
+		}
+		return model.ErrSnapshotInUse
+	}
+	return nil
+}
+
+// CancelDelete returns a snapshot whose files could not be removed to the status it had
+func (r *SnapshotRepository) CancelDelete(ctx context.Context, id primitive.ObjectID, status string) error {
+	_, err := r.collection.UpdateOne(ctx,
+		bson.M{"_id": id, "status": model.SnapshotStatusDeleting},
+		bson.M{"$set": bson.M{"status": status}},
+	)
+	return err
+}
+
+// Count returns the number of snapshots matching the filter
+func (r *SnapshotRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.collection.CountDocuments(ctx, filter)
+}
@@ -0,0 +1,168 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+	"voidrun/pkg/util"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type IWebhookRepository interface {
+	Create(ctx context.Context, webhook *model.Webhook) error
+	FindByIDAndOrg(ctx context.Context, id string, orgID primitive.ObjectID) (*model.Webhook, error)
+	Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.Webhook, error)
+	Delete(ctx context.Context, id primitive.ObjectID) error
+	Count(ctx context.Context, filter interface{}) (int64, error)
+}
+
+// WebhookRepository manages org webhook registrations in MongoDB
+type WebhookRepository struct {
+	cfg        *config.Config
+	collection *mongo.Collection
+}
+
+func NewWebhookRepository(cfg *config.Config, db *mongo.Database) IWebhookRepository {
+	return &WebhookRepository{
+		cfg:        cfg,
+		collection: db.Collection("webhooks"),
+	}
+}
+
+// Init creates the index used to find an org's webhooks for each event
+func (r *WebhookRepository) Init(ctx context.Context) error {
+	indexModel := mongo.IndexModel{
+		Keys: bson.D{bson.E{Key: "orgId", Value: 1}, bson.E{Key: "createdAt", Value: -1}},
+	}
+	if _, err := r.collection.Indexes().CreateOne(ctx, indexModel); err != nil {
+		return fmt.Errorf("failed to create webhook orgId index: %w", err)
+	}
+	return nil
+}
+
+// Create inserts a new webhook
+func (r *WebhookRepository) Create(ctx context.Context, webhook *model.Webhook) error {
+	webhook.CreatedAt = time.Now()
+	result, err := r.collection.InsertOne(ctx, webhook)
+	if err != nil {
+		return err
+	}
+	webhook.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// FindByIDAndOrg retrieves a webhook by ID only if it belongs to the given org
+func (r *WebhookRepository) FindByIDAndOrg(ctx context.Context, id string, orgID primitive.ObjectID) (*model.Webhook, error) {
+	oid, err := util.ParseObjectID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var webhook *model.Webhook
+	err = r.collection.FindOne(ctx, bson.M{"_id": oid, "orgId": orgID}).Decode(&webhook)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return webhook, nil
+}
+
+// Find retrieves webhooks matching the filter
+func (r *WebhookRepository) Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.Webhook, error) {
+	cursor, err := r.collection.Find(ctx, filter, &opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var webhooks []*model.Webhook
+	if err = cursor.All(ctx, &webhooks); err != nil {
+		return nil, err
+	}
+	return webhooks, nil
+}
+
+// Delete removes a webhook
+func (r *WebhookRepository) Delete(ctx context.Context, id primitive.ObjectID) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// Count returns the number of webhooks matching the filter
+func (r *WebhookRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.collection.CountDocuments(ctx, filter)
+}
+
+type IWebhookDeliveryRepository interface {
+	Create(ctx context.Context, delivery *model.WebhookDelivery) error
+	Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.WebhookDelivery, error)
+	Count(ctx context.Context, filter interface{}) (int64, error)
+}
+
+// WebhookDeliveryRepository is the delivery log of webhooks; entries expire with events
+type WebhookDeliveryRepository struct {
+	cfg        *config.Config
+	collection *mongo.Collection
+}
+
+func NewWebhookDeliveryRepository(cfg *config.Config, db *mongo.Database) IWebhookDeliveryRepository {
+	return &WebhookDeliveryRepository{
+		cfg:        cfg,
+		collection: db.Collection("webhook_deliveries"),
+	}
+}
+
+// Init creates the per-webhook listing index and the TTL index
+func (r *WebhookDeliveryRepository) Init(ctx context.Context) error {
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{bson.E{Key: "webhookId", Value: 1}, bson.E{Key: "createdAt", Value: -1}}},
+		{
+			Keys:    bson.D{bson.E{Key: "createdAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(max(r.cfg.Events.RetentionHours, 1) * 3600)),
+		},
+	}
+	if _, err := r.collection.Indexes().CreateMany(ctx, indexes); err != nil {
+		return fmt.Errorf("failed to create webhook delivery indexes: %w", err)
+	}
+	return nil
+}
+
+// Create appends an attempt to the delivery log
+func (r *WebhookDeliveryRepository) Create(ctx context.Context, delivery *model.WebhookDelivery) error {
+	delivery.CreatedAt = time.Now()
+	result, err := r.collection.InsertOne(ctx, delivery)
+	if err != nil {
+		return err
+	}
+	delivery.ID = result.InsertedID.(primitive.ObjectID)
+	return nil
+}
+
+// Find retrieves delivery attempts matching the filter
+func (r *WebhookDeliveryRepository) Find(ctx context.Context, filter interface{}, opts options.FindOptions) ([]*model.WebhookDelivery, error) {
+	cursor, err := r.collection.Find(ctx, filter, &opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var deliveries []*model.WebhookDelivery
+	if err = cursor.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// Count returns the number of delivery attempts matching the filter
+func (r *WebhookDeliveryRepository) Count(ctx context.Context, filter interface{}) (int64, error) {
+	return r.collection.CountDocuments(ctx, filter)
+}
@@ -10,6 +10,7 @@ import (
 	"voidrun/internal/middleware"
 	"voidrun/internal/version"
 	"voidrun/pkg/machine"
+	"voidrun/pkg/network"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -31,10 +32,23 @@ type Server struct {
 func New(cfg *config.Config) (*Server, error) {
 	// Initialize machine package with config paths
 	machine.SetInstancesRoot(cfg.Paths.InstancesDir)
+	machine.SetSnapshotsRoot(cfg.Paths.SnapshotsDir)
+	machine.SetStopGracePeriod(time.Duration(cfg.Sandbox.StopGracePeriodSec) * time.Second)
+	machine.SetConsoleLog(int64(cfg.Sandbox.ConsoleLogMaxKB)*1024, cfg.Sandbox.DebugBootConsole)
+	hv, err := machine.NewHypervisor(cfg.Sandbox.Hypervisor)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("[hypervisor] Using %s driver\n", hv.Name())
+	ipam, err := network.NewIPAM(cfg.Network.NetworkCIDR, cfg.Network.GatewayIP, cfg.Network.Pools, cfg.Network.ReservedIPs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network pools: %w", err)
+	}
+
 	var metricsManager *metrics.Manager
 	var stopFn context.CancelFunc
 	if cfg.Metrics.Enabled {
-		metricsManager = metrics.NewManager(cfg.Metrics)
+		metricsManager = metrics.NewManager(cfg.Metrics, hv)
 		ctx, cancel := context.WithCancel(context.Background())
 		metricsManager.Start(ctx)
 		stopFn = cancel
@@ -47,13 +61,28 @@ func New(cfg *config.Config) (*Server, error) {
 	db := mongoClient.Database(cfg.Mongo.Database)
 
 	repos := InitRepositories(cfg, db)
-	services := InitServices(cfg, repos, metricsManager)
+	if err := InitIndexes(context.Background(), repos); err != nil {
+		return nil, fmt.Errorf("failed to create indexes: %w", err)
+	}
+	services := InitServices(cfg, repos, hv, ipam, metricsManager)
 	handlers := InitHandlers(services)
 
 	if err := PopulateInitialData(cfg, repos); err != nil {
 		return nil, fmt.Errorf("failed to populate initial data: %w", err)
 	}
 
+	if err := services.Network.Backfill(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to lease existing sandbox addresses: %w", err)
+	}
+	if err := services.Egress.Start(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to install network policies: %w", err)
+	}
+
+	// Clean up after a crash before anything can create or touch sandboxes
+	if cfg.Reconciler.Enabled {
+		services.Reconciler.Run(context.Background(), true)
+	}
+
 	router := setupRouter(cfg, handlers, services)
 
 	if metricsManager != nil {
@@ -102,6 +131,9 @@ func (s *Server) Close() error {
 // Run starts the server
 func (s *Server) Run() error {
 	s.startHealthMonitor()
+	s.startReaper()
+	s.startReconciler()
+	s.services.Sandbox.StartWarmPool(context.Background())
 	ver := version.Get()
 	versionLine := fmt.Sprintf("%s", ver.Version)
 	if ver.Commit != "" {
@@ -133,9 +165,45 @@ func (s *Server) startHealthMonitor() {
 	}()
 }
 
+func (s *Server) startReaper() {
+	if !s.cfg.Reaper.Enabled {
+		return
+	}
+	intervalSec := s.cfg.Reaper.IntervalSec
+	if intervalSec <= 0 {
+		intervalSec = 30
+	}
+	ticker := time.NewTicker(time.Duration(intervalSec) * time.Second)
+	go func() {
+		for range ticker.C {
+			if err := s.services.Sandbox.ReapExpired(context.Background()); err != nil {
+				fmt.Printf("[reaper] sweep failed: %v\n", err)
+			}
+		}
+	}()
+}
+
+func (s *Server) startReconciler() {
+	if !s.cfg.Reconciler.Enabled {
+		return
+	}
+	intervalSec := s.cfg.Reconciler.IntervalSec
+	if intervalSec <= 0 {
+		intervalSec = 300
+	}
+	ticker := time.NewTicker(time.Duration(intervalSec) * time.Second)
+	go func() {
+		for range ticker.C {
+			s.services.Reconciler.Run(context.Background(), false)
+		}
+	}()
+}
+
 func setupRouter(cfg *config.Config, h *Handlers, s *Services) *gin.Engine {
 	r := gin.Default()
 	r.SetTrustedProxies(nil)
+	// Preview hosts are proxied to the sandbox before any API middleware runs
+	r.Use(h.Preview.HostRouter())
 	if cfg.CORS.Enabled {
 		corsCfg := cors.Config{
 			AllowOrigins:     cfg.CORS.AllowOrigins,
@@ -159,6 +227,9 @@ func setupRouter(cfg *config.Config, h *Handlers, s *Services) *gin.Engine {
 	// Static files
 	r.Static("/ui", "./static")
 
+	// Path-based preview URLs, authenticated with an API key or a preview token
+	r.Any("/preview/:id/:port/*path", h.Preview.ProxyPath)
+
 	api := r.Group("/api")
 
 	// Public metadata routes
@@ -173,17 +244,29 @@ func setupRouter(cfg *config.Config, h *Handlers, s *Services) *gin.Engine {
 
 	// Sandbox routes
 	sandboxes := protected.Group("/sandboxes")
+	sandboxes.Use(middleware.SandboxActivity(s.Sandbox))
 	{
 		sandboxes.GET("", h.Sandbox.List)
 		sandboxes.POST("", h.Sandbox.Create)
-		// sandboxes.POST("/restore", h.Sandbox.Restore)
 		sandboxes.GET("/:id", h.Sandbox.Get)
 		sandboxes.DELETE("/:id", h.Sandbox.Delete)
-		// sandboxes.POST("/:id/stop", h.Sandbox.Stop)
-		// sandboxes.POST("/:id/pause", h.Sandbox.Pause)
-		// sandboxes.POST("/:id/resume", h.Sandbox.Resume)
-		// sandboxes.POST("/:id/snapshot", h.Sandbox.Snapshot)
-		// sandboxes.GET("/:id/snapshots", h.Sandbox.ListSnapshots)
+		sandboxes.POST("/:id/stop", h.Sandbox.Stop)
+		sandboxes.POST("/:id/start", h.Sandbox.Start)
+		sandboxes.POST("/:id/pause", h.Sandbox.Pause)
+		sandboxes.POST("/:id/resume", h.Sandbox.Resume)
+		sandboxes.POST("/:id/hibernate", h.Sandbox.Hibernate)
+		sandboxes.POST("/:id/snapshots", h.Snapshot.Create)
+		sandboxes.POST("/:id/fork", h.Sandbox.Fork)
+		sandboxes.POST("/:id/extend", h.Sandbox.Extend)
+		sandboxes.PATCH("/:id/resources", h.Sandbox.Resize)
+		sandboxes.PATCH("/:id/network", h.Sandbox.UpdateNetwork)
+		sandboxes.PATCH("/:id/io-limits", h.Sandbox.UpdateIOLimits)
+		sandboxes.GET("/:id/preview", h.Preview.Get)
+		sandboxes.PATCH("/:id/preview", h.Preview.Update)
+		sandboxes.POST("/:id/preview/tokens", h.Preview.CreateToken)
+		sandboxes.GET("/:id/console", h.Console.Attach)
+		sandboxes.GET("/:id/console/log", h.Console.Log)
+		sandboxes.GET("/:id/port-forward", h.PortForward.Forward)
 		sandboxes.POST("/:id/exec", h.Exec.Exec)
 		sandboxes.POST("/:id/exec-stream", h.Exec.ExecStream)
 		sandboxes.POST("/:id/session-exec", h.Exec.SessionExec)
@@ -227,6 +310,36 @@ func setupRouter(cfg *config.Config, h *Handlers, s *Services) *gin.Engine {
 		sandboxes.GET("/:id/files/watch/:sessionId/stream", h.FS.StreamWatchEvents)
 	}
 
+	// Operator routes, authenticated with ADMIN_TOKEN instead of an org API key
+	admin := api.Group("/admin")
+	admin.Use(middleware.AdminMiddleware(cfg.AdminToken))
+	{
+		admin.GET("/reconcile", h.Admin.ReconcileReport)
+		admin.POST("/reconcile", h.Admin.Reconcile)
+		admin.GET("/network/leases", h.Admin.NetworkLeases)
+		admin.GET("/network/pools", h.Admin.NetworkPools)
+	}
+
+	// Snapshot registry routes
+	snapshots := protected.Group("/snapshots")
+	{
+		snapshots.GET("", h.Snapshot.List)
+		snapshots.POST("/import", h.Snapshot.Import)
+		snapshots.GET("/:id/export", h.Snapshot.Export)
+		snapshots.DELETE("/:id", h.Snapshot.Delete)
+		snapshots.POST("/:id/restore", h.Snapshot.Restore)
+	}
+
+	// Lifecycle event stream and webhooks
+	protected.GET("/events", h.Event.Stream)
+	webhooks := protected.Group("/webhooks")
+	{
+		webhooks.GET("", h.Webhook.List)
+		webhooks.POST("", h.Webhook.Create)
+		webhooks.DELETE("/:id", h.Webhook.Delete)
+		webhooks.GET("/:id/deliveries", h.Webhook.Deliveries)
+	}
+
 	// Image routes
 	images := protected.Group("/images")
 	{
@@ -241,6 +354,7 @@ func setupRouter(cfg *config.Config, h *Handlers, s *Services) *gin.Engine {
 	org := protected.Group("/orgs")
 	{
 		org.GET("/me", h.Org.GetCurrentOrg)
+		org.PATCH("/:orgId/network", h.Org.UpdateNetwork)
 
 		// API key routes under org
 		apiKeys := org.Group("/:orgId/apikeys")
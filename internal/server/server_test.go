@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+	"voidrun/internal/repository/repotest"
+	"voidrun/internal/service"
+	"voidrun/pkg/machine"
+	"voidrun/pkg/network"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestRouter serves the API from in-memory repositories and the Fake driver
+func newTestRouter(t *testing.T) (*gin.Engine, *Repositories, *Services) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	cfg := &config.Config{}
+	cfg.Paths.InstancesDir = t.TempDir()
+	cfg.Network.NetworkCIDR = "10.0.0.0/24"
+	cfg.Network.GatewayIP = "10.0.0.1/24"
+	machine.SetInstancesRoot(cfg.Paths.InstancesDir)
+
+	ipam, err := network.NewIPAM(cfg.Network.NetworkCIDR, cfg.Network.GatewayIP, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repos := &Repositories{
+		User:     repotest.NewUserRepository(),
+		Sandbox:  repotest.NewSandboxRepository(),
+		Image:    repotest.NewImageRepository(),
+		APIKey:   repotest.NewAPIKeyRepository(),
+		Org:      repotest.NewOrgRepository(),
+		Snapshot: repotest.NewSnapshotRepository(),
+		Event:    repotest.NewEventRepository(),
+		Webhook:  repotest.NewWebhookRepository(),
+		Delivery: repotest.NewWebhookDeliveryRepository(),
+		Lease:    repotest.NewLeaseRepository(),
+	}
+	services := InitServices(cfg, repos, machine.NewFake(), ipam, nil)
+	return setupRouter(cfg, InitHandlers(services), services), repos, services
+}
+
+// newTestKey returns an API key of a new org
+func newTestKey(t *testing.T, services *Services) (string, primitive.ObjectID) {
+	t.Helper()
+	orgID := primitive.NewObjectID()
+	key, err := services.APIKey.GenerateKey(context.Background(), orgID, primitive.NewObjectID(), "test")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	return key.PlainKey, orgID
+}
+
+// requireHidden sends every route under prefix, with :id set to id, using key and fails
+// unless each answers 404. It returns the number of routes tested.
+func requireHidden(t *testing.T, router *gin.Engine, prefix, id, key string) int {
+	t.Helper()
+	// Well-formed parameters, so every route gets as far as looking up the resource
+	query := "?path=/tmp/a&from=/tmp/a&to=/tmp/b&pattern=a&port=8080&format=tar.gz&archive=/tmp/a.tar.gz&mode=755"
+	body := `{"path":"/tmp/a","from":"/tmp/a","to":"/tmp/b","pattern":"a","format":"tar.gz","archive":"/tmp/a.tar.gz","mode":"755","command":"true","cmd":"true","name":"n"}`
+
+	tested := 0
+	for _, route := range router.Routes() {
+		if !strings.HasPrefix(route.Path, prefix) {
+			continue
+		}
+		tested++
+		path := strings.NewReplacer(":id", id, ":sessionId", "s1").Replace(route.Path) + query
+		t.Run(route.Method+" "+route.Path, func(t *testing.T) {
+			req := httptest.NewRequest(route.Method, path, strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", key)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("status = %d, want 404; body: %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+	return tested
+}
+
+// Every route on a sandbox must treat a sandbox of another org as missing, without
+// revealing that it exists or acting on it
+func TestSandboxRoutesHideOtherOrgs(t *testing.T) {
+	router, repos, services := newTestRouter(t)
+	_, ownerOrg := newTestKey(t, services)
+	otherKey, _ := newTestKey(t, services)
+
+	sandbox := &model.Sandbox{
+		ID:      primitive.NewObjectID(),
+		Name:    "private",
+		ImageId: "alpine",
+		OrgID:   ownerOrg,
+		Status:  model.SandboxStatusRunning,
+	}
+	if err := repos.Sandbox.Create(context.Background(), sandbox); err != nil {
+		t.Fatal(err)
+	}
+	id := sandbox.ID.Hex()
+
+	if tested := requireHidden(t, router, "/api/sandboxes/:id", id, otherKey); tested < 50 {
+		t.Fatalf("only %d sandbox routes found", tested)
+	}
+
+	stored, _ := repos.Sandbox.FindByID(context.Background(), id)
+	if stored == nil || stored.Status != model.SandboxStatusRunning || stored.Name != "private" {
+		t.Fatalf("sandbox = %+v after requests of another org, want it untouched", stored)
+	}
+}
+
+func TestSnapshotRoutesHideOtherOrgs(t *testing.T) {
+	router, repos, services := newTestRouter(t)
+	_, ownerOrg := newTestKey(t, services)
+	otherKey, _ := newTestKey(t, services)
+
+	snapshot := &model.Snapshot{
+		ID:      primitive.NewObjectID(),
+		Name:    "private",
+		ImageId: "alpine",
+		CPU:     1,
+		Mem:     1024,
+		Status:  model.SnapshotStatusReady,
+		Path:    t.TempDir(),
+		OrgID:   ownerOrg,
+	}
+	if err := repos.Snapshot.Create(context.Background(), snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if tested := requireHidden(t, router, "/api/snapshots/:id", snapshot.ID.Hex(), otherKey); tested < 3 {
+		t.Fatalf("only %d snapshot routes found", tested)
+	}
+
+	stored, _ := repos.Snapshot.FindByIDAndOrg(context.Background(), snapshot.ID.Hex(), ownerOrg)
+	if stored == nil || stored.Status != model.SnapshotStatusReady || stored.RefCount != 0 {
+		t.Fatalf("snapshot = %+v after requests of another org, want it untouched", stored)
+	}
+}
+
+func TestWebhookRoutesHideOtherOrgs(t *testing.T) {
+	router, repos, services := newTestRouter(t)
+	_, ownerOrg := newTestKey(t, services)
+	otherKey, _ := newTestKey(t, services)
+
+	webhook := &model.Webhook{ID: primitive.NewObjectID(), OrgID: ownerOrg, URL: "https://hooks.example.com/voidrun", Secret: "s"}
+	if err := repos.Webhook.Create(context.Background(), webhook); err != nil {
+		t.Fatal(err)
+	}
+
+	if tested := requireHidden(t, router, "/api/webhooks/:id", webhook.ID.Hex(), otherKey); tested < 2 {
+		t.Fatalf("only %d webhook routes found", tested)
+	}
+
+	if stored, _ := repos.Webhook.FindByIDAndOrg(context.Background(), webhook.ID.Hex(), ownerOrg); stored == nil {
+		t.Fatal("webhook deleted by another org")
+	}
+}
+
+// The preview proxy must not tell a sandbox it refuses from one that does not exist
+func TestPreviewHidesSandboxesWithoutAccess(t *testing.T) {
+	router, repos, services := newTestRouter(t)
+	ownerKey, ownerOrg := newTestKey(t, services)
+	otherKey, otherOrg := newTestKey(t, services)
+
+	newSandbox := func(orgID primitive.ObjectID) *model.Sandbox {
+		sandbox := &model.Sandbox{
+			ID:             primitive.NewObjectID(),
+			OrgID:          orgID,
+			Status:         model.SandboxStatusRunning,
+			IP:             "10.0.0.2",
+			PreviewEnabled: true,
+		}
+		if err := repos.Sandbox.Create(context.Background(), sandbox); err != nil {
+			t.Fatal(err)
+		}
+		return sandbox
+	}
+	sandbox := newSandbox(ownerOrg)
+	otherSandbox := newSandbox(otherOrg)
+	otherToken, err := services.Preview.IssueToken(otherSandbox, 0, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	portToken, err := services.Preview.IssueToken(sandbox, 3000, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := sandbox.ID.Hex()
+	cases := map[string]struct {
+		path    string
+		headers map[string]string
+	}{
+		"no credentials":           {"/preview/" + id + "/8080/", nil},
+		"missing sandbox":          {"/preview/" + primitive.NewObjectID().Hex() + "/8080/", nil},
+		"missing sandbox, own key": {"/preview/" + primitive.NewObjectID().Hex() + "/8080/", map[string]string{"X-API-Key": ownerKey}},
+		"key of another org":       {"/preview/" + id + "/8080/", map[string]string{"X-API-Key": otherKey}},
+		"invalid key":              {"/preview/" + id + "/8080/", map[string]string{"X-API-Key": "org_0123456789abcdef_nope"}},
+		"token of another sandbox": {"/preview/" + id + "/8080/?" + service.PreviewTokenParam + "=" + otherToken.Token, nil},
+		"token for another port":   {"/preview/" + id + "/8080/", map[string]string{service.PreviewTokenHeader: portToken.Token}},
+		"forged token":             {"/preview/" + id + "/8080/", map[string]string{service.PreviewTokenHeader: "AAAA.AAAA"}},
+	}
+	var bodies []string
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("status = %d, want 404; body: %s", rec.Code, rec.Body.String())
+			}
+			bodies = append(bodies, rec.Body.String())
+		})
+	}
+	for _, body := range bodies {
+		if body != bodies[0] {
+			t.Errorf("responses differ: %s vs %s", body, bodies[0])
+		}
+	}
+
+	// The owner's key gets past authentication
+	req := httptest.NewRequest(http.MethodGet, "/preview/"+id+"/8080/", nil)
+	req.Header.Set("X-API-Key", ownerKey)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code == http.StatusNotFound {
+		t.Fatalf("owner's request = 404; body: %s", rec.Body.String())
+	}
+}
+
+func TestSandboxRoutesServeOwnOrg(t *testing.T) {
+	router, repos, services := newTestRouter(t)
+	key, orgID := newTestKey(t, services)
+
+	sandbox := &model.Sandbox{ID: primitive.NewObjectID(), OrgID: orgID, Status: model.SandboxStatusRunning}
+	if err := repos.Sandbox.Create(context.Background(), sandbox); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/sandboxes/"+sandbox.ID.Hex(), nil)
+	req.Header.Set("X-API-Key", key)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET own sandbox = %d, want 200; body: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// Requests act for the user who created the key, so what they create is credited to that user
+func TestRequestsActForCreatorOfKey(t *testing.T) {
+	router, repos, services := newTestRouter(t)
+	orgID, userID := primitive.NewObjectID(), primitive.NewObjectID()
+	key, err := services.APIKey.GenerateKey(context.Background(), orgID, userID, "test")
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/orgs/"+orgID.Hex()+"/apikeys", strings.NewReader(`{"keyName":"second"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", key.PlainKey)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated && rec.Code != http.StatusOK {
+		t.Fatalf("POST apikeys = %d; body: %s", rec.Code, rec.Body.String())
+	}
+
+	keys, _ := repos.APIKey.FindByOrgID(context.Background(), orgID)
+	if len(keys) != 2 {
+		t.Fatalf("org has %d keys, want 2", len(keys))
+	}
+	for _, k := range keys {
+		if k.CreatedBy != userID {
+			t.Errorf("key %q CreatedBy = %s, want %s", k.Name, k.CreatedBy.Hex(), userID.Hex())
+		}
+	}
+}
+
+// A resumed stream replays every missed event, however many pages they take
+func TestEventStreamReplaysEveryMissedEvent(t *testing.T) {
+	router, repos, services := newTestRouter(t)
+	key, orgID := newTestKey(t, services)
+
+	const total = 2500
+	var first primitive.ObjectID
+	for i := 0; i < total; i++ {
+		event := &model.Event{ID: primitive.NewObjectID(), Type: "sandbox.created", OrgID: orgID}
+		if i == total-1 {
+			event.Type = "sandbox.deleted"
+		}
+		if i == 0 {
+			first = event.ID
+		}
+		if err := repos.Event.Create(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for query, want := range map[string]int{"": total - 1, "&types=sandbox.deleted": 1} {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		req := httptest.NewRequest(http.MethodGet, "/api/events?lastEventId="+first.Hex()+query, nil).WithContext(ctx)
+		req.Header.Set("X-API-Key", key)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		cancel()
+		if got := strings.Count(rec.Body.String(), "\nevent: "); got != want {
+			t.Errorf("query %q: %d events replayed, want %d", query, got, want)
+		}
+	}
+}
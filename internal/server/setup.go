@@ -1,12 +1,16 @@
 package server
 
 import (
+	"context"
+
 	"voidrun/internal/config"
 	"voidrun/internal/handler"
 	"voidrun/internal/metrics"
 	"voidrun/internal/model"
 	"voidrun/internal/repository"
 	"voidrun/internal/service"
+	"voidrun/pkg/machine"
+	"voidrun/pkg/network"
 	"voidrun/pkg/util"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -15,20 +19,30 @@ import (
 
 // Repositories holds all data stores
 type Repositories struct {
-	User    repository.IUserRepository
-	Sandbox repository.ISandboxRepository
-	Image   repository.IImageRepository
-	APIKey  repository.IAPIKeyRepository
-	Org     repository.IOrgRepository
+	User     repository.IUserRepository
+	Sandbox  repository.ISandboxRepository
+	Image    repository.IImageRepository
+	APIKey   repository.IAPIKeyRepository
+	Org      repository.IOrgRepository
+	Snapshot repository.ISnapshotRepository
+	Event    repository.IEventRepository
+	Webhook  repository.IWebhookRepository
+	Delivery repository.IWebhookDeliveryRepository
+	Lease    repository.ILeaseRepository
 }
 
 func InitRepositories(cfg *config.Config, db *mongo.Database) *Repositories {
 	return &Repositories{
-		User:    repository.NewUserRepository(cfg, db),
-		Sandbox: repository.NewSandboxRepository(cfg, db),
-		Image:   repository.NewImageRepository(cfg, db),
-		APIKey:  repository.NewAPIKeyRepository(cfg, db),
-		Org:     repository.NewOrgRepository(cfg, db),
+		User:     repository.NewUserRepository(cfg, db),
+		Sandbox:  repository.NewSandboxRepository(cfg, db),
+		Image:    repository.NewImageRepository(cfg, db),
+		APIKey:   repository.NewAPIKeyRepository(cfg, db),
+		Org:      repository.NewOrgRepository(cfg, db),
+		Snapshot: repository.NewSnapshotRepository(cfg, db),
+		Event:    repository.NewEventRepository(cfg, db),
+		Webhook:  repository.NewWebhookRepository(cfg, db),
+		Delivery: repository.NewWebhookDeliveryRepository(cfg, db),
+		Lease:    repository.NewLeaseRepository(cfg, db),
 	}
 }
 
@@ -36,6 +50,7 @@ func InitRepositories(cfg *config.Config, db *mongo.Database) *Repositories {
 type Services struct {
 	User       *service.UserService
 	Sandbox    *service.SandboxService
+	Snapshot   *service.SnapshotService
 	Image      *service.ImageService
 	Exec       *service.ExecService
 	Session    *service.SessionExecService
@@ -45,53 +60,97 @@ type Services struct {
 	PTY        *service.VsockWSDialer
 	PTYSession *service.PTYSessionService
 	Commands   *service.CommandsService
+	Reconciler *service.ReconcilerService
+	Event      *service.EventService
+	Webhook    *service.WebhookService
+	Network    *service.NetworkService
+	Egress     *service.EgressService
+	Preview    *service.PreviewService
 	Metrics    *metrics.Manager
 }
 
-func InitServices(cfg *config.Config, repos *Repositories, metricsManager *metrics.Manager) *Services {
+func InitServices(cfg *config.Config, repos *Repositories, hv machine.Hypervisor, ipam *network.IPAM, metricsManager *metrics.Manager) *Services {
+	webhookService := service.NewWebhookService(cfg, repos.Webhook, repos.Delivery)
+	eventService := service.NewEventService(repos.Event, webhookService)
+	networkService := service.NewNetworkService(cfg, ipam, repos.Lease, repos.Sandbox, metricsManager)
+	egressService := service.NewEgressService(cfg, repos.Sandbox, repos.Org)
+	sandboxService := service.NewSandboxService(cfg, repos.Sandbox, repos.Image, repos.Org, repos.Snapshot, networkService, egressService, hv, eventService, metricsManager)
 	return &Services{
 		User:       service.NewUserService(cfg, repos.User),
-		Sandbox:    service.NewSandboxService(cfg, repos.Sandbox, repos.Image, metricsManager),
+		Sandbox:    sandboxService,
+		Snapshot:   service.NewSnapshotService(cfg, repos.Snapshot, sandboxService),
 		Image:      service.NewImageService(cfg, repos.Image),
 		Exec:       service.NewExecService(cfg),
 		Session:    service.NewSessionExecService(cfg),
 		FS:         service.NewFSService(),
 		APIKey:     service.NewAPIKeyService(repos.APIKey, cfg),
-		Org:        service.NewOrgService(repos.Org),
+		Org:        service.NewOrgService(repos.Org, egressService),
 		PTY:        service.NewVsockWSDialer(),
 		PTYSession: service.NewPTYSessionService(),
 		Commands:   service.NewCommandsService(cfg),
+		Reconciler: service.NewReconcilerService(cfg, repos.Sandbox, sandboxService, metricsManager),
+		Event:      eventService,
+		Webhook:    webhookService,
+		Network:    networkService,
+		Egress:     egressService,
+		Preview:    service.NewPreviewService(cfg, repos.Sandbox),
 		Metrics:    metricsManager,
 	}
 }
 
 // Handlers holds all HTTP handlers
 type Handlers struct {
-	User     *handler.UserHandler
-	Sandbox  *handler.SandboxHandler
-	Image    *handler.ImageHandler
-	Exec     *handler.ExecHandler
-	FS       *handler.FSHandler
-	Org      *handler.OrgHandler
-	Auth     *handler.AuthHandler
-	PTY      *handler.PTYHandler
-	Commands *handler.CommandsHandler
-	Version  *handler.VersionHandler
+	User        *handler.UserHandler
+	Sandbox     *handler.SandboxHandler
+	Snapshot    *handler.SnapshotHandler
+	Image       *handler.ImageHandler
+	Exec        *handler.ExecHandler
+	FS          *handler.FSHandler
+	Org         *handler.OrgHandler
+	Auth        *handler.AuthHandler
+	PTY         *handler.PTYHandler
+	Commands    *handler.CommandsHandler
+	Version     *handler.VersionHandler
+	Admin       *handler.AdminHandler
+	Console     *handler.ConsoleHandler
+	Event       *handler.EventHandler
+	Webhook     *handler.WebhookHandler
+	Preview     *handler.PreviewHandler
+	PortForward *handler.PortForwardHandler
 }
 
 func InitHandlers(services *Services) *Handlers {
 	return &Handlers{
-		User:     handler.NewUserHandler(services.User),
-		Sandbox:  handler.NewSandboxHandler(services.Sandbox),
-		Image:    handler.NewImageHandler(services.Image),
-		Exec:     handler.NewExecHandler(services.Exec, services.Session, services.Sandbox, services.Commands),
-		FS:       handler.NewFSHandler(services.FS, services.Sandbox),
-		Org:      handler.NewOrgHandler(services.Org, services.APIKey),
-		Auth:     handler.NewAuthHandler(services.User, services.Org, services.APIKey),
-		PTY:      handler.NewPTYHandler(services.PTY, services.PTYSession, services.Sandbox),
-		Commands: handler.NewCommandsHandler(services.Commands, services.Sandbox),
-		Version:  handler.NewVersionHandler(),
+		User:        handler.NewUserHandler(services.User),
+		Sandbox:     handler.NewSandboxHandler(services.Sandbox),
+		Snapshot:    handler.NewSnapshotHandler(services.Snapshot, services.Sandbox),
+		Image:       handler.NewImageHandler(services.Image),
+		Exec:        handler.NewExecHandler(services.Exec, services.Session, services.Sandbox, services.Commands),
+		FS:          handler.NewFSHandler(services.FS, services.Sandbox),
+		Org:         handler.NewOrgHandler(services.Org, services.APIKey),
+		Auth:        handler.NewAuthHandler(services.User, services.Org, services.APIKey),
+		PTY:         handler.NewPTYHandler(services.PTY, services.PTYSession, services.Sandbox),
+		Commands:    handler.NewCommandsHandler(services.Commands, services.Sandbox),
+		Version:     handler.NewVersionHandler(),
+		Admin:       handler.NewAdminHandler(services.Reconciler, services.Network),
+		Console:     handler.NewConsoleHandler(services.Sandbox),
+		Event:       handler.NewEventHandler(services.Event),
+		Webhook:     handler.NewWebhookHandler(services.Webhook),
+		Preview:     handler.NewPreviewHandler(services.Preview, services.Sandbox, services.APIKey),
+		PortForward: handler.NewPortForwardHandler(services.Sandbox),
+	}
+}
+
+// InitIndexes creates the indexes repositories rely on for fast lookups
+func InitIndexes(ctx context.Context, repos *Repositories) error {
+	for _, repo := range []interface{}{repos.APIKey, repos.Snapshot, repos.Event, repos.Webhook, repos.Delivery, repos.Lease} {
+		if initRepo, ok := repo.(interface{ Init(context.Context) error }); ok {
+			if err := initRepo.Init(ctx); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
 }
 
 // PopulateInitialData seeds system users/images
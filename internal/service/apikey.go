@@ -12,6 +12,7 @@ import (
 	"voidrun/pkg/timer"
 	"voidrun/pkg/util"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -21,13 +22,30 @@ type apiKeyCacheEntry struct {
 	expiresAt time.Time
 }
 
+const (
+	// maxRejectCacheEntries bounds the negative cache so a flood of random keys cannot exhaust memory
+	maxRejectCacheEntries = 100000
+	// legacyScanInterval is the least time between two bcrypt scans of unmigrated keys for one client
+	legacyScanInterval = time.Second
+	// maxLegacyClients bounds the clients whose last legacy scan is remembered
+	maxLegacyClients = 100000
+)
+
 // APIKeyService handles API key business logic
 type APIKeyService struct {
 	repo          repository.IAPIKeyRepository
 	cfg           *config.Config
 	keyCache      map[string]*apiKeyCacheEntry // plainKey -> cached result
+	rejectCache   map[string]time.Time         // key digest -> rejection expiry
 	keyCacheMutex sync.RWMutex
 	cacheTTL      time.Duration
+	rejectTTL     time.Duration
+
+	// legacyScan admits one legacy scan at a time; legacyNext is the earliest time each
+	// client may start its next
+	legacyScan chan struct{}
+	legacyMu   sync.Mutex
+	legacyNext map[string]time.Time
 }
 
 // NewAPIKeyService creates a new API key service
@@ -37,31 +55,35 @@ func NewAPIKeyService(repo repository.IAPIKeyRepository, cfg *config.Config) *AP
 		cacheSeconds = 300 // fallback to 5 minutes if misconfigured
 	}
 
-	return &APIKeyService{
-		repo:     repo,
-		cfg:      cfg,
-		keyCache: make(map[string]*apiKeyCacheEntry),
-		cacheTTL: time.Duration(cacheSeconds) * time.Second,
+	rejectSeconds := cfg.APIKeyNegativeCacheTTLSeconds
+	if rejectSeconds <= 0 {
+		rejectSeconds = 60
 	}
-}
 
-func generateAndHash() (plainKey string, hash string, err error) {
-	plainKey, err = util.GenerateAPIKey()
-	if err != nil {
-		return "", "", fmt.Errorf("failed to generate key: %w", err)
+	return &APIKeyService{
+		repo:        repo,
+		cfg:         cfg,
+		keyCache:    make(map[string]*apiKeyCacheEntry),
+		rejectCache: make(map[string]time.Time),
+		cacheTTL:    time.Duration(cacheSeconds) * time.Second,
+		rejectTTL:   time.Duration(rejectSeconds) * time.Second,
+		legacyScan:  make(chan struct{}, 1),
+		legacyNext:  make(map[string]time.Time),
 	}
+}
 
-	hash, err = util.HashAPIKey(plainKey)
+func generateAndHash() (plainKey string, keyID string, hash string, err error) {
+	plainKey, keyID, err = util.GenerateAPIKey()
 	if err != nil {
-		return "", "", fmt.Errorf("failed to hash key: %w", err)
+		return "", "", "", fmt.Errorf("failed to generate key: %w", err)
 	}
 
-	return plainKey, hash, nil
+	return plainKey, keyID, util.DigestAPIKey(plainKey), nil
 }
 
 // GenerateKey creates a new API key for an organization
 func (s *APIKeyService) GenerateKey(ctx context.Context, orgID, userID primitive.ObjectID, keyName string) (*model.GeneratedAPIKeyResponse, error) {
-	plainKey, hash, err := generateAndHash()
+	plainKey, keyID, hash, err := generateAndHash()
 	if err != nil {
 		return nil, err
 	}
@@ -69,7 +91,9 @@ func (s *APIKeyService) GenerateKey(ctx context.Context, orgID, userID primitive
 	apiKey := &model.APIKey{
 		OrgID:     orgID,
 		Name:      keyName,
+		KeyID:     keyID,
 		Hash:      hash,
+		HashAlgo:  model.APIKeyHashSHA256,
 		CreatedBy: userID,
 		CreatedAt: time.Now(),
 		IsActive:  true,
@@ -155,6 +179,7 @@ func (s *APIKeyService) RevokeKey(ctx context.Context, keyID string) error {
 	if err := s.repo.Delete(ctx, objID); err != nil {
 		return fmt.Errorf("failed to revoke key: %w", err)
 	}
+	s.invalidateKey(objID)
 
 	return nil
 }
@@ -169,6 +194,7 @@ func (s *APIKeyService) DeactivateKey(ctx context.Context, keyID string) error {
 	if err := s.repo.Update(ctx, objID, map[string]interface{}{"isActive": false}); err != nil {
 		return fmt.Errorf("failed to deactivate key: %w", err)
 	}
+	s.invalidateKey(objID)
 
 	return nil
 }
@@ -183,12 +209,16 @@ func (s *APIKeyService) ActivateKey(ctx context.Context, keyID string) error {
 	if err := s.repo.Update(ctx, objID, map[string]interface{}{"isActive": true}); err != nil {
 		return fmt.Errorf("failed to activate key: %w", err)
 	}
+	s.invalidateKey(objID)
 
 	return nil
 }
 
-// ValidateKey verifies a plain key against stored hash and updates last used
-func (s *APIKeyService) ValidateKey(ctx context.Context, plainKey string) (*model.APIKey, error) {
+// ValidateKey verifies a plain key against its stored hash and updates last used.
+// The key's embedded lookup ID selects a single candidate, so validation costs one
+// indexed query and one hash comparison regardless of how many keys exist. client
+// identifies the caller, e.g. by address, for the rate limit on legacy keys.
+func (s *APIKeyService) ValidateKey(ctx context.Context, plainKey, client string) (*model.APIKey, error) {
 	defer timer.Track("Validate Auth Key (Total)")()
 	// Check cache first
 	s.keyCacheMutex.RLock()
@@ -199,29 +229,169 @@ func (s *APIKeyService) ValidateKey(ctx context.Context, plainKey string) (*mode
 	}
 	s.keyCacheMutex.RUnlock()
 
-	// Cache miss or expired: query database
-	keys, err := s.repo.FindActive(ctx)
+	digest := util.DigestAPIKey(plainKey)
+	if s.isRejected(digest) {
+		return nil, fmt.Errorf("invalid api key")
+	}
+
+	// Cache miss or expired: look up the single candidate by its lookup ID
+	keyID, isCurrentFormat := util.ParseAPIKeyID(plainKey)
+	if !isCurrentFormat {
+		keyID = util.LegacyAPIKeyID(plainKey)
+	}
+
+	key, err := s.repo.FindByKeyID(ctx, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to validate key: %w", err)
+	}
+	if key != nil && !verifyStoredKey(plainKey, key) {
+		key = nil
+	}
+
+	// Legacy keys without a lookup ID are verified once through bcrypt and then migrated
+	if key == nil && !isCurrentFormat && s.cfg.APIKeyLegacyFallback {
+		key, err = s.validateLegacyKey(ctx, plainKey, keyID, client)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if key == nil {
+		s.reject(digest)
+		return nil, fmt.Errorf("invalid api key")
+	}
+
+	_ = s.repo.UpdateLastUsed(ctx, key.ID)
+
+	// Cache the valid key
+	s.keyCacheMutex.Lock()
+	s.keyCache[plainKey] = &apiKeyCacheEntry{
+		key:       key,
+		expiresAt: time.Now().Add(s.cacheTTL),
+	}
+	s.keyCacheMutex.Unlock()
+
+	return key, nil
+}
+
+// validateLegacyKey scans keys that predate lookup IDs. On a match the key is
+// rewritten with a derived lookup ID and a SHA-256 digest so later validations
+// take the single-lookup path. The scan costs a bcrypt per unmigrated key, so scans
+// run one at a time and each client may start one per legacyScanInterval. A key
+// refused by that limit is rejected without being remembered as invalid, and one
+// client sending junk keys cannot hold back the keys of others.
+func (s *APIKeyService) validateLegacyKey(ctx context.Context, plainKey, legacyKeyID, client string) (*model.APIKey, error) {
+	if !s.admitLegacyScan(client) {
+		return nil, fmt.Errorf("invalid api key")
+	}
+	select {
+	case s.legacyScan <- struct{}{}:
+		defer func() { <-s.legacyScan }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	keys, err := s.repo.FindUnmigrated(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to validate key: %w", err)
 	}
 
 	for _, key := range keys {
-		if util.VerifyAPIKey(plainKey, key.Hash) {
-			_ = s.repo.UpdateLastUsed(ctx, key.ID)
+		if !util.VerifyAPIKey(plainKey, key.Hash) {
+			continue
+		}
+
+		digest := util.DigestAPIKey(plainKey)
+		if err := s.repo.Update(ctx, key.ID, bson.M{
+			"keyId":    legacyKeyID,
+			"hash":     digest,
+			"hashAlgo": model.APIKeyHashSHA256,
+		}); err != nil {
+			fmt.Printf("[apikey] failed to migrate legacy key %s: %v\n", key.ID.Hex(), err)
+		} else {
+			key.KeyID = legacyKeyID
+			key.Hash = digest
+			key.HashAlgo = model.APIKeyHashSHA256
+		}
+		return key, nil
+	}
+
+	return nil, nil
+}
 
-			// Cache the valid key
-			s.keyCacheMutex.Lock()
-			s.keyCache[plainKey] = &apiKeyCacheEntry{
-				key:       key,
-				expiresAt: time.Now().Add(s.cacheTTL),
+// admitLegacyScan reports whether client may start a legacy scan now, and if so
+// holds off its next one for legacyScanInterval
+func (s *APIKeyService) admitLegacyScan(client string) bool {
+	now := time.Now()
+	s.legacyMu.Lock()
+	defer s.legacyMu.Unlock()
+	if now.Before(s.legacyNext[client]) {
+		return false
+	}
+	if len(s.legacyNext) >= maxLegacyClients {
+		for c, next := range s.legacyNext {
+			if now.After(next) {
+				delete(s.legacyNext, c)
 			}
-			s.keyCacheMutex.Unlock()
+		}
+		// Still full: refuse rather than grow without bound
+		if len(s.legacyNext) >= maxLegacyClients {
+			return false
+		}
+	}
+	s.legacyNext[client] = now.Add(legacyScanInterval)
+	return true
+}
+
+// verifyStoredKey checks a plain key against the hash using the algorithm it was stored with
+func verifyStoredKey(plainKey string, key *model.APIKey) bool {
+	switch key.HashAlgo {
+	case model.APIKeyHashSHA256:
+		return util.VerifyAPIKeyDigest(plainKey, key.Hash)
+	default:
+		return util.VerifyAPIKey(plainKey, key.Hash)
+	}
+}
+
+// isRejected reports whether the key digest was recently rejected
+func (s *APIKeyService) isRejected(digest string) bool {
+	s.keyCacheMutex.RLock()
+	defer s.keyCacheMutex.RUnlock()
+	expiresAt, exists := s.rejectCache[digest]
+	return exists && time.Now().Before(expiresAt)
+}
 
-			return key, nil
+// reject remembers a rejected key digest for the negative cache TTL
+func (s *APIKeyService) reject(digest string) {
+	now := time.Now()
+	s.keyCacheMutex.Lock()
+	defer s.keyCacheMutex.Unlock()
+
+	if len(s.rejectCache) >= maxRejectCacheEntries {
+		for d, expiresAt := range s.rejectCache {
+			if now.After(expiresAt) {
+				delete(s.rejectCache, d)
+			}
+		}
+		// Still full: drop everything rather than grow without bound
+		if len(s.rejectCache) >= maxRejectCacheEntries {
+			s.rejectCache = make(map[string]time.Time)
 		}
 	}
+	s.rejectCache[digest] = now.Add(s.rejectTTL)
+}
 
-	return nil, fmt.Errorf("invalid api key")
+// invalidateKey drops cached entries for a key and forgets rejections so that
+// status changes take effect immediately
+func (s *APIKeyService) invalidateKey(id primitive.ObjectID) {
+	s.keyCacheMutex.Lock()
+	defer s.keyCacheMutex.Unlock()
+	for plainKey, entry := range s.keyCache {
+		if entry.key.ID == id {
+			delete(s.keyCache, plainKey)
+		}
+	}
+	s.rejectCache = make(map[string]time.Time)
 }
 
 // ValidateKeyForOrg validates an API key for a specific organization
@@ -238,7 +408,7 @@ func (s *APIKeyService) ValidateKeyForOrg(ctx context.Context, plainKey string,
 			continue
 		}
 
-		if util.VerifyAPIKey(plainKey, key.Hash) {
+		if verifyStoredKey(plainKey, key) {
 			// Update last used
 			_ = s.repo.UpdateLastUsed(ctx, key.ID)
 			return true, nil
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+	"voidrun/internal/repository/repotest"
+	"voidrun/pkg/util"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A client sending junk old-format keys must not keep the legacy keys of others out
+func TestLegacyKeysOfOtherClientsAreNotHeldBack(t *testing.T) {
+	ctx := context.Background()
+	cfg := &config.Config{APIKeyLegacyFallback: config.DefaultAPIKeyLegacyFallback}
+	repo := repotest.NewAPIKeyRepository()
+	svc := NewAPIKeyService(repo, cfg)
+
+	const legacyKey = "sk_live_issued_before_key_ids"
+	hash, err := util.HashAPIKey(legacyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := &model.APIKey{OrgID: primitive.NewObjectID(), Hash: hash, IsActive: true}
+	if _, err := repo.Create(ctx, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := svc.ValidateKey(ctx, "sk_live_junk_1", "203.0.113.9"); err == nil {
+		t.Fatal("junk key accepted")
+	}
+	// The same client is held off for a while
+	if _, err := svc.ValidateKey(ctx, legacyKey, "203.0.113.9"); err == nil {
+		t.Fatal("second scan of the same client within the interval was admitted")
+	}
+
+	key, err := svc.ValidateKey(ctx, legacyKey, "198.51.100.7")
+	if err != nil {
+		t.Fatalf("legacy key of another client: %v", err)
+	}
+	if key.ID != stored.ID {
+		t.Fatalf("validated key %s, want %s", key.ID.Hex(), stored.ID.Hex())
+	}
+	migrated, _ := repo.FindByKeyID(ctx, util.LegacyAPIKeyID(legacyKey))
+	if migrated == nil || migrated.HashAlgo != model.APIKeyHashSHA256 {
+		t.Fatalf("legacy key not migrated: %+v", migrated)
+	}
+}
@@ -0,0 +1,29 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"voidrun/internal/model"
+	"voidrun/pkg/machine"
+)
+
+// ConsoleLog returns the captured serial console output of a sandbox. The log outlives
+// the VM, so it can be read after a failed boot or a crash. tail limits it to the last bytes.
+func (s *SandboxService) ConsoleLog(ctx context.Context, sandbox *model.Sandbox, tail int64) ([]byte, error) {
+	id := sandbox.ID.Hex()
+	if sandbox.Status == model.SandboxStatusRunning || sandbox.Status == model.SandboxStatusPaused {
+		// Resume capture of VMs booted by a previous server process
+		machine.StartConsoleCapture(id)
+	}
+	return machine.ReadConsoleLog(id, tail)
+}
+
+// AttachConsole opens an interactive session on the serial console of a running sandbox.
+// It works without the guest agent, e.g. to debug an image whose agent never starts.
+func (s *SandboxService) AttachConsole(ctx context.Context, sandbox *model.Sandbox) (*machine.ConsoleSession, error) {
+	if sandbox.Status != model.SandboxStatusRunning && sandbox.Status != model.SandboxStatusPaused {
+		return nil, fmt.Errorf("%w: sandbox is %s", model.ErrInvalidTransition, sandbox.Status)
+	}
+	return machine.AttachConsole(sandbox.ID.Hex())
+}
@@ -0,0 +1,516 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+	"voidrun/pkg/machine"
+	"voidrun/pkg/network"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	maxEgressRules   = 256
+	maxEgressDomains = 256
+)
+
+// EgressService enforces the network policies of sandboxes. A restrictive policy is
+// installed before the VM boots and lifted when it stops or is deleted; allow-all
+// sandboxes are never filtered. Domain allow-lists go through a DNS proxy on the bridge
+// gateway, which only resolves allowed names and lets the sandbox reach the addresses
+// they resolve to until the answer's TTL runs out.
+//
+// Sandboxes are also kept apart on the bridge: each TAP may only send from its sandbox's
+// MAC and IP, and traffic between sandboxes is dropped unless both belong to an org that
+// opted in to sandbox peering.
+type EgressService struct {
+	cfg       *config.Config
+	sandboxes repository.ISandboxRepository
+	orgs      repository.IOrgRepository
+	fw        *network.Firewall  // nil when nftables is unavailable
+	iso       *network.Isolation // nil when nftables is unavailable
+	dnsProxy  bool
+
+	mu      sync.RWMutex
+	applied map[string]*egressState
+	byIP    map[netip.Addr]*egressState
+	peers   map[string]*peerState
+}
+
+// egressState is the policy currently installed for a sandbox
+type egressState struct {
+	id      string
+	ip      netip.Addr
+	domains []string
+}
+
+// peerState is the peer group a sandbox has joined, named after its org
+type peerState struct {
+	id    string
+	group string
+	ip    netip.Addr
+}
+
+func NewEgressService(cfg *config.Config, sandboxes repository.ISandboxRepository, orgs repository.IOrgRepository) *EgressService {
+	return &EgressService{
+		cfg:       cfg,
+		sandboxes: sandboxes,
+		orgs:      orgs,
+		applied:   make(map[string]*egressState),
+		byIP:      make(map[netip.Addr]*egressState),
+		peers:     make(map[string]*peerState),
+	}
+}
+
+// Start rebuilds the firewall from the policies of sandboxes that may have a VM, then
+// starts the DNS proxy. Without nftables the server runs on, but restrictive policies
+// are refused and sandboxes are not isolated from each other.
+func (s *EgressService) Start(ctx context.Context) error {
+	if err := s.startIsolation(ctx); err != nil {
+		return err
+	}
+
+	fw, err := network.NewFirewall(s.cfg.Network.BridgeName, s.cfg.Network.GatewayIP, s.cfg.Network.DNSProxyPort)
+	if err != nil {
+		fmt.Printf("[egress] Network policies disabled: %v\n", err)
+		return nil
+	}
+
+	filter := bson.M{
+		"networkPolicy": bson.M{"$ne": nil},
+		"status": bson.M{"$nin": []string{
+			model.SandboxStatusStopped, model.SandboxStatusHibernated, model.SandboxStatusDeleting,
+		}},
+	}
+	projection := bson.M{"_id": 1, "ip": 1, "networkPolicy": 1}
+	records, err := s.sandboxes.Find(ctx, filter, options.FindOptions{Projection: projection})
+	if err != nil {
+		return fmt.Errorf("failed to list sandboxes with network policies: %w", err)
+	}
+	installed := make(map[string]network.SandboxEgress, len(records))
+	states := make([]*egressState, 0, len(records))
+	for _, sb := range records {
+		ip, err := netip.ParseAddr(sb.IP)
+		if err != nil {
+			continue
+		}
+		id := sb.ID.Hex()
+		installed[id] = network.SandboxEgress{IP: ip, Policy: egressPolicy(sb.NetworkPolicy)}
+		states = append(states, &egressState{id: id, ip: ip, domains: sb.NetworkPolicy.Domains})
+	}
+	if err := fw.Reset(installed); err != nil {
+		fmt.Printf("[egress] Network policies disabled: %v\n", err)
+		return nil
+	}
+	s.mu.Lock()
+	s.fw = fw
+	for _, state := range states {
+		s.trackLocked(state)
+	}
+	s.mu.Unlock()
+	fmt.Printf("[egress] Installed network policies of %d sandboxes\n", len(installed))
+
+	gateway := s.cfg.Network.GetCleanGateway()
+	addr := net.JoinHostPort(gateway, strconv.Itoa(s.cfg.Network.DNSProxyPort))
+	if err := network.NewDNSProxy(addr, s.cfg.Network.DNSUpstream, s).Start(ctx); err != nil {
+		fmt.Printf("[egress] Domain allow-lists disabled: %v\n", err)
+		return nil
+	}
+	s.dnsProxy = true
+	return nil
+}
+
+// startIsolation binds the TAPs of running VMs and rebuilds the peer groups of their orgs,
+// then has every VM started from now on bound before it joins the bridge
+func (s *EgressService) startIsolation(ctx context.Context) error {
+	iso, err := network.NewIsolation(s.cfg.Network.TapPrefix, s.cfg.Network.NetworkCIDR, s.cfg.Network.GatewayIP)
+	if err != nil {
+		fmt.Printf("[egress] Sandboxes are not isolated from each other: %v\n", err)
+		return nil
+	}
+
+	filter := bson.M{"status": bson.M{"$nin": []string{
+		model.SandboxStatusStopped, model.SandboxStatusHibernated, model.SandboxStatusDeleting,
+	}}}
+	projection := bson.M{"_id": 1, "orgId": 1, "ip": 1, "mac": 1}
+	records, err := s.sandboxes.Find(ctx, filter, options.FindOptions{Projection: projection})
+	if err != nil {
+		return fmt.Errorf("failed to list sandboxes: %w", err)
+	}
+	var taps []network.TapBinding
+	groups := make(map[string][]netip.Addr)
+	var peers []*peerState
+	peering := make(map[primitive.ObjectID]bool)
+	for _, sb := range records {
+		ip, err := netip.ParseAddr(sb.IP)
+		if err != nil {
+			continue
+		}
+		id := sb.ID.Hex()
+		if tap, err := os.ReadFile(machine.GetTapPath(id)); err == nil {
+			if mac, err := net.ParseMAC(sb.MAC); err == nil {
+				taps = append(taps, network.TapBinding{Tap: strings.TrimSpace(string(tap)), MAC: mac, IP: ip})
+			}
+		}
+		if sb.OrgID.IsZero() {
+			continue
+		}
+		enabled, ok := peering[sb.OrgID]
+		if !ok {
+			enabled = s.orgPeering(ctx, sb.OrgID)
+			peering[sb.OrgID] = enabled
+		}
+		if enabled {
+			group := sb.OrgID.Hex()
+			groups[group] = append(groups[group], ip)
+			peers = append(peers, &peerState{id: id, group: group, ip: ip})
+		}
+	}
+	if err := iso.Reset(taps, groups); err != nil {
+		fmt.Printf("[egress] Sandboxes are not isolated from each other: %v\n", err)
+		return nil
+	}
+	s.mu.Lock()
+	s.iso = iso
+	for _, peer := range peers {
+		s.peers[peer.id] = peer
+	}
+	s.mu.Unlock()
+	machine.SetIsolation(iso)
+	fmt.Printf("[egress] Isolated %d running sandboxes, %d in peer groups\n", len(taps), len(peers))
+	return nil
+}
+
+// Apply installs the policy recorded on a sandbox, replacing any installed before, and
+// adds it to its org's peer group if the org has peering on. A sandbox without a policy
+// is left unfiltered. Networkless sandboxes have nothing to filter.
+func (s *EgressService) Apply(sandbox *model.Sandbox) error {
+	if sandbox.Networkless() {
+		return nil
+	}
+	id := sandbox.ID.Hex()
+	if err := s.applyPeering(sandbox); err != nil {
+		return err
+	}
+	if sandbox.NetworkPolicy == nil {
+		s.mu.Lock()
+		if state, ok := s.applied[id]; ok {
+			s.removeLocked(state)
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	if s.fw == nil {
+		return model.ErrEgressUnavailable
+	}
+	policy := egressPolicy(sandbox.NetworkPolicy)
+	if policy.DNSProxy && !s.dnsProxy {
+		return fmt.Errorf("%w: the DNS proxy is not running", model.ErrEgressUnavailable)
+	}
+	ip, err := netip.ParseAddr(sandbox.IP)
+	if err != nil {
+		return fmt.Errorf("sandbox %s has no valid IP: %w", id, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prev, ok := s.applied[id]; ok && prev.ip != ip {
+		s.removeLocked(prev)
+	}
+	if err := s.fw.Apply(id, ip, policy); err != nil {
+		return fmt.Errorf("failed to install network policy: %w", err)
+	}
+	s.trackLocked(&egressState{id: id, ip: ip, domains: sandbox.NetworkPolicy.Domains})
+	return nil
+}
+
+// Remove lifts the policy installed for a sandbox, if any, and takes it out of its peer group
+func (s *EgressService) Remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.applied[id]; ok {
+		s.removeLocked(state)
+	}
+	if peer, ok := s.peers[id]; ok {
+		s.leaveLocked(peer)
+	}
+}
+
+// SetOrgPeering adds the org's sandboxes that may have a VM to its peer group, or takes
+// them out of it
+func (s *EgressService) SetOrgPeering(ctx context.Context, orgID primitive.ObjectID, enabled bool) error {
+	if s.iso == nil {
+		return nil
+	}
+	group := orgID.Hex()
+	if !enabled {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, peer := range s.peers {
+			if peer.group == group {
+				s.leaveLocked(peer)
+			}
+		}
+		return nil
+	}
+
+	filter := bson.M{
+		"orgId": orgID,
+		"status": bson.M{"$nin": []string{
+			model.SandboxStatusStopped, model.SandboxStatusHibernated, model.SandboxStatusDeleting,
+		}},
+	}
+	projection := bson.M{"_id": 1, "ip": 1}
+	records, err := s.sandboxes.Find(ctx, filter, options.FindOptions{Projection: projection})
+	if err != nil {
+		return fmt.Errorf("failed to list sandboxes of org: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sb := range records {
+		ip, err := netip.ParseAddr(sb.IP)
+		if err != nil {
+			continue
+		}
+		if err := s.joinLocked(&peerState{id: sb.ID.Hex(), group: group, ip: ip}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AllowDNS lets the DNS proxy resolve the names on the allow-list of the sandbox at src
+func (s *EgressService) AllowDNS(src netip.Addr, name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	state, ok := s.byIP[src]
+	return ok && domainAllowed(state.domains, name)
+}
+
+// Resolved allows the sandbox at src to reach what an allowed name resolved to
+func (s *EgressService) Resolved(src netip.Addr, name string, addrs []netip.Addr, ttl time.Duration) {
+	s.mu.RLock()
+	state, ok := s.byIP[src]
+	s.mu.RUnlock()
+	if !ok || s.fw == nil {
+		return
+	}
+	if err := s.fw.AllowResolved(state.id, addrs, ttl); err != nil {
+		fmt.Printf("[egress] failed to allow %s for %s: %v\n", name, state.id, err)
+	}
+}
+
+// applyPeering puts a sandbox in the peer group of its org when the org has peering on,
+// and takes it out of any other group
+func (s *EgressService) applyPeering(sandbox *model.Sandbox) error {
+	if s.iso == nil {
+		return nil
+	}
+	group := ""
+	if !sandbox.OrgID.IsZero() && s.orgPeering(context.Background(), sandbox.OrgID) {
+		group = sandbox.OrgID.Hex()
+	}
+	ip, err := netip.ParseAddr(sandbox.IP)
+	if err != nil {
+		return fmt.Errorf("sandbox %s has no valid IP: %w", sandbox.ID.Hex(), err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer := &peerState{id: sandbox.ID.Hex(), group: group, ip: ip}
+	if prev, ok := s.peers[peer.id]; ok && *prev != *peer {
+		s.leaveLocked(prev)
+	}
+	if group == "" {
+		return nil
+	}
+	return s.joinLocked(peer)
+}
+
+// orgPeering reports whether an org has sandbox peering on. Lookup failures keep the
+// sandbox isolated.
+func (s *EgressService) orgPeering(ctx context.Context, orgID primitive.ObjectID) bool {
+	org, err := s.orgs.FindByID(ctx, orgID)
+	if err != nil {
+		fmt.Printf("[egress] failed to look up org %s, isolating its sandboxes: %v\n", orgID.Hex(), err)
+		return false
+	}
+	return org != nil && org.SandboxPeering
+}
+
+func (s *EgressService) joinLocked(peer *peerState) error {
+	if err := s.iso.Join(peer.group, peer.ip); err != nil {
+		return fmt.Errorf("failed to join peer group: %w", err)
+	}
+	s.peers[peer.id] = peer
+	return nil
+}
+
+func (s *EgressService) leaveLocked(peer *peerState) {
+	if err := s.iso.Leave(peer.group, peer.ip); err != nil {
+		fmt.Printf("[egress] failed to remove %s from peer group: %v\n", peer.id, err)
+	}
+	delete(s.peers, peer.id)
+}
+
+func (s *EgressService) trackLocked(state *egressState) {
+	s.applied[state.id] = state
+	s.byIP[state.ip] = state
+}
+
+func (s *EgressService) removeLocked(state *egressState) {
+	if err := s.fw.Remove(state.id, state.ip); err != nil {
+		fmt.Printf("[egress] failed to remove network policy of %s: %v\n", state.id, err)
+	}
+	delete(s.applied, state.id)
+	if s.byIP[state.ip] == state {
+		delete(s.byIP, state.ip)
+	}
+}
+
+// normalizeNetworkPolicy validates a requested policy and returns it in canonical form.
+// Allow-all is returned as nil, as sandboxes without a policy are unrestricted.
+func normalizeNetworkPolicy(policy *model.NetworkPolicy) (*model.NetworkPolicy, error) {
+	if policy == nil {
+		return nil, nil
+	}
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", model.ErrInvalidNetworkPolicy, fmt.Sprintf(format, args...))
+	}
+	switch policy.Mode {
+	case model.NetworkPolicyAllowAll, model.NetworkPolicyDenyAll:
+		if len(policy.Allow) > 0 || len(policy.Domains) > 0 {
+			return nil, invalid("allow and domains require mode %s", model.NetworkPolicyAllowList)
+		}
+		if policy.Mode == model.NetworkPolicyAllowAll {
+			return nil, nil
+		}
+		return &model.NetworkPolicy{Mode: model.NetworkPolicyDenyAll}, nil
+	case model.NetworkPolicyAllowList:
+	default:
+		return nil, invalid("mode must be one of %s, %s, %s",
+			model.NetworkPolicyAllowAll, model.NetworkPolicyDenyAll, model.NetworkPolicyAllowList)
+	}
+	if len(policy.Allow) > maxEgressRules {
+		return nil, invalid("at most %d allow rules", maxEgressRules)
+	}
+	if len(policy.Domains) > maxEgressDomains {
+		return nil, invalid("at most %d domains", maxEgressDomains)
+	}
+
+	out := &model.NetworkPolicy{Mode: model.NetworkPolicyAllowList}
+	for _, rule := range policy.Allow {
+		prefix, err := parseEgressCIDR(rule.CIDR)
+		if err != nil {
+			return nil, invalid("%v", err)
+		}
+		protocol := strings.ToLower(rule.Protocol)
+		if protocol != "" && protocol != "tcp" && protocol != "udp" {
+			return nil, invalid("protocol must be tcp or udp in rule for %s", rule.CIDR)
+		}
+		for _, port := range rule.Ports {
+			if port < 1 || port > 65535 {
+				return nil, invalid("port %d out of range in rule for %s", port, rule.CIDR)
+			}
+		}
+		out.Allow = append(out.Allow, model.EgressRule{CIDR: prefix.String(), Protocol: protocol, Ports: rule.Ports})
+	}
+	for _, domain := range policy.Domains {
+		name := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if !validDomain(strings.TrimPrefix(name, "*.")) {
+			return nil, invalid("invalid domain %q", domain)
+		}
+		out.Domains = append(out.Domains, name)
+	}
+	return out, nil
+}
+
+// networkPolicyFor normalizes the policy requested for a sandbox in the given network
+// mode. Networkless sandboxes have no egress, so they take no policy.
+func networkPolicyFor(network string, policy *model.NetworkPolicy) (*model.NetworkPolicy, error) {
+	if network == model.NetworkModeNone && policy != nil {
+		return nil, fmt.Errorf("%w: networkless sandboxes have no egress to restrict", model.ErrInvalidNetworkPolicy)
+	}
+	return normalizeNetworkPolicy(policy)
+}
+
+// egressPolicy converts a normalized policy into firewall rules
+func egressPolicy(policy *model.NetworkPolicy) network.EgressPolicy {
+	out := network.EgressPolicy{DNSProxy: len(policy.Domains) > 0}
+	for _, rule := range policy.Allow {
+		prefix, err := parseEgressCIDR(rule.CIDR)
+		if err != nil {
+			continue
+		}
+		ports := make([]uint16, 0, len(rule.Ports))
+		for _, port := range rule.Ports {
+			ports = append(ports, uint16(port))
+		}
+		out.Allow = append(out.Allow, network.EgressRule{Prefix: prefix, Protocol: rule.Protocol, Ports: ports})
+	}
+	return out
+}
+
+func parseEgressCIDR(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil || !prefix.Addr().Is4() {
+			return netip.Prefix{}, fmt.Errorf("invalid IPv4 CIDR %q", s)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil || !addr.Is4() {
+		return netip.Prefix{}, fmt.Errorf("invalid IPv4 address %q", s)
+	}
+	return netip.PrefixFrom(addr, 32), nil
+}
+
+// validDomain accepts dotted hostnames of letters, digits and hyphens
+func validDomain(name string) bool {
+	labels := strings.Split(name, ".")
+	if len(name) > 253 || len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// domainAllowed matches name against an allow-list: an entry allows itself and its
+// subdomains, and a "*." entry only its subdomains
+func domainAllowed(domains []string, name string) bool {
+	for _, domain := range domains {
+		if suffix, ok := strings.CutPrefix(domain, "*."); ok {
+			if strings.HasSuffix(name, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
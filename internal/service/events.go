@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+	"voidrun/pkg/util"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// eventReplayLimit bounds how many missed events are loaded at once; a resumed stream
+// is sent every missed event, one page at a time
+const eventReplayLimit = 1000
+
+// EventService is the in-process event bus. Events are stored for replay, pushed to
+// live subscribers of the same org and handed to the org's webhooks.
+type EventService struct {
+	repo     repository.IEventRepository
+	webhooks *WebhookService
+
+	mu   sync.Mutex
+	subs map[chan *model.Event]primitive.ObjectID
+}
+
+func NewEventService(repo repository.IEventRepository, webhooks *WebhookService) *EventService {
+	return &EventService{
+		repo:     repo,
+		webhooks: webhooks,
+		subs:     make(map[chan *model.Event]primitive.ObjectID),
+	}
+}
+
+// Publish records an event and fans it out. It never fails the operation that caused
+// the event: storage errors are logged and live delivery goes ahead.
+func (s *EventService) Publish(ctx context.Context, event *model.Event) {
+	if event.ID.IsZero() {
+		event.ID = util.GenerateObjectID()
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	if err := s.repo.Create(context.WithoutCancel(ctx), event); err != nil {
+		fmt.Printf("[events] failed to store %s for %s: %v\n", event.Type, event.SandboxID.Hex(), err)
+	}
+
+	s.mu.Lock()
+	for ch, orgID := range s.subs {
+		if orgID != event.OrgID {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			// Rather than skip an event, end the stalled stream; its client reconnects with
+			// Last-Event-ID and catches up from the store
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+	s.mu.Unlock()
+
+	if s.webhooks != nil {
+		s.webhooks.Dispatch(event)
+	}
+}
+
+// Subscribe returns live events of an org until the returned cancel function is called.
+// The channel is closed when the subscriber falls too far behind to be sent every event.
+func (s *EventService) Subscribe(orgID primitive.ObjectID) (<-chan *model.Event, func()) {
+	ch := make(chan *model.Event, 64)
+	s.mu.Lock()
+	s.subs[ch] = orgID
+	s.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.subs, ch)
+			s.mu.Unlock()
+		})
+	}
+}
+
+// Since returns a page of the stored events of an org after the given event ID, oldest
+// first. more reports that the page is full, so later events may follow it; the caller
+// asks again from the last event of the page.
+func (s *EventService) Since(ctx context.Context, orgIDHex, lastEventID string) (events []*model.Event, more bool, err error) {
+	orgID, err := util.ParseObjectID(orgIDHex)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid org id: %w", err)
+	}
+	after, err := util.ParseObjectID(lastEventID)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid event id: %w", err)
+	}
+	events, err = s.repo.FindSince(ctx, orgID, after, eventReplayLimit)
+	if err != nil {
+		return nil, false, err
+	}
+	return events, len(events) == eventReplayLimit, nil
+}
+
+// publish emits an event about a sandbox; pooled VMs without an org are skipped
+func (s *SandboxService) publish(ctx context.Context, eventType string, sandbox *model.Sandbox, data map[string]interface{}) {
+	if s.events == nil || sandbox == nil || sandbox.OrgID.IsZero() {
+		return
+	}
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["name"] = sandbox.Name
+	s.events.Publish(ctx, &model.Event{
+		Type:      eventType,
+		OrgID:     sandbox.OrgID,
+		SandboxID: sandbox.ID,
+		Data:      data,
+	})
+}
+
+// publishByID looks the sandbox up before emitting an event about it
+func (s *SandboxService) publishByID(ctx context.Context, eventType, id string, data map[string]interface{}) {
+	if s.events == nil {
+		return
+	}
+	if sandbox, found := s.Get(context.WithoutCancel(ctx), id); found {
+		s.publish(ctx, eventType, sandbox, data)
+	}
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/pkg/machine"
+)
+
+// wakeWaitTimeout bounds how long a request waits for another request to finish waking a sandbox
+const wakeWaitTimeout = 30 * time.Second
+
+// Hibernate saves the RAM of a running or paused sandbox to disk and stops its VM process.
+// The sandbox keeps its IP, so it can be woken later with the same address.
+func (s *SandboxService) Hibernate(ctx context.Context, id string) error {
+	sandbox, found := s.Get(ctx, id)
+	if !found {
+		return fmt.Errorf("sandbox not found: %s", id)
+	}
+	from := sandbox.Status
+	if !model.CanTransition(from, model.SandboxStatusHibernating) {
+		return model.ErrInvalidTransition
+	}
+	if err := s.repo.TransitionStatus(ctx, sandbox.ID, []string{from}, model.SandboxStatusHibernating); err != nil {
+		return err
+	}
+
+	if err := s.hv.Hibernate(id); err != nil {
+		s.repo.TransitionStatus(context.Background(), sandbox.ID, []string{model.SandboxStatusHibernating}, from)
+		return fmt.Errorf("hibernate failed: %w", err)
+	}
+	s.egress.Remove(id)
+	if s.metrics != nil {
+		s.metrics.UnregisterSandbox(id)
+	}
+	fmt.Printf("[hibernate] Sandbox %s hibernated\n", id)
+	return s.transition(ctx, sandbox.ID, model.SandboxStatusHibernated)
+}
+
+// wake restores a hibernated sandbox. The caller must already have moved it to starting.
+func (s *SandboxService) wake(ctx context.Context, sandbox *model.Sandbox) error {
+	id := sandbox.ID.Hex()
+	if err := s.egress.Apply(sandbox); err != nil {
+		s.transition(context.Background(), sandbox.ID, model.SandboxStatusHibernated)
+		return err
+	}
+	spec := s.specFor(sandbox)
+	if err := s.hv.Wake(*s.cfg, spec); err != nil {
+		s.egress.Remove(id)
+		s.transition(context.Background(), sandbox.ID, model.SandboxStatusHibernated)
+		return fmt.Errorf("wake failed: %w", err)
+	}
+
+	if err := s.transition(ctx, sandbox.ID, model.SandboxStatusRunning); err != nil {
+		return err
+	}
+	s.touchStarted(ctx, sandbox.ID)
+	if s.metrics != nil {
+		s.metrics.RegisterSandbox(id, sandbox.Name, machine.GetSocketPath(id), spec.CPUs, spec.MemoryMB, spec.DiskMB)
+	}
+	fmt.Printf("[hibernate] Sandbox %s woken\n", id)
+	return nil
+}
+
+// EnsureAwake wakes a hibernated sandbox before a guest request is proxied to it. When
+// another request is already waking it, EnsureAwake waits for that to finish. Sandboxes
+// in any other state are returned unchanged.
+func (s *SandboxService) EnsureAwake(ctx context.Context, sandbox *model.Sandbox) (*model.Sandbox, error) {
+	id := sandbox.ID.Hex()
+	deadline := time.Now().Add(wakeWaitTimeout)
+	for {
+		switch sandbox.Status {
+		case model.SandboxStatusHibernated:
+			err := s.repo.TransitionStatus(ctx, sandbox.ID, []string{model.SandboxStatusHibernated}, model.SandboxStatusStarting)
+			if err == nil {
+				if err := s.wake(ctx, sandbox); err != nil {
+					return nil, err
+				}
+				sandbox.Status = model.SandboxStatusRunning
+				return sandbox, nil
+			}
+			if !errors.Is(err, model.ErrInvalidTransition) {
+				return nil, err
+			}
+		case model.SandboxStatusStarting, model.SandboxStatusHibernating:
+			// Another request owns the transition; wait for it to settle
+		default:
+			return sandbox, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for sandbox %s to wake", id)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		current, found := s.Get(ctx, id)
+		if !found {
+			return nil, fmt.Errorf("sandbox not found: %s", id)
+		}
+		sandbox = current
+	}
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"voidrun/internal/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// applyIOLimits sets the I/O limits of a new sandbox from the request and its org plan
+func (s *SandboxService) applyIOLimits(ctx context.Context, sandbox *model.Sandbox, requested *model.IOLimits) error {
+	limits, err := resolveIOLimits(requested, s.planLimitsFor(ctx, sandbox.OrgID).IOLimits)
+	if err != nil {
+		return err
+	}
+	sandbox.IOLimits = ioLimitsFor(sandbox, limits)
+	return nil
+}
+
+// UpdateIOLimits replaces the I/O limits of a sandbox. Cloud Hypervisor cannot change the
+// rate limiters of a running VM, so they take effect when it next boots or wakes.
+func (s *SandboxService) UpdateIOLimits(ctx context.Context, sandbox *model.Sandbox, req model.UpdateIOLimitsRequest) (*model.Sandbox, error) {
+	switch sandbox.Status {
+	case model.SandboxStatusDeleting, model.SandboxStatusWarm:
+		return nil, model.ErrInvalidTransition
+	}
+	limits, err := resolveIOLimits(&req.IOLimits, s.planLimitsFor(ctx, sandbox.OrgID).IOLimits)
+	if err != nil {
+		return nil, err
+	}
+	limits = ioLimitsFor(sandbox, limits)
+	if err := s.repo.UpdateFields(ctx, sandbox.ID, bson.M{"ioLimits": limits}); err != nil {
+		return nil, err
+	}
+	sandbox.IOLimits = limits
+	fmt.Printf("[io-limits] Sandbox %s I/O limits updated\n", sandbox.ID.Hex())
+	return sandbox, nil
+}
+
+// warmIOLimits are the I/O limits pooled VMs boot with: those of the plan new orgs start on
+func warmIOLimits() *model.IOLimits {
+	limits, _ := resolveIOLimits(nil, model.LimitsForPlan(model.PlanFree).IOLimits)
+	return limits
+}
+
+// ioLimitsFor drops the NIC limit of networkless sandboxes, which have no NIC
+func ioLimitsFor(sandbox *model.Sandbox, limits *model.IOLimits) *model.IOLimits {
+	if limits == nil || !sandbox.Networkless() {
+		return limits
+	}
+	if limits.Disk == nil {
+		return nil
+	}
+	return &model.IOLimits{Disk: limits.Disk}
+}
+
+func sameIOLimits(a, b *model.IOLimits) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// resolveIOLimits fills the omitted values of requested limits from the plan and rejects
+// values above it. The result is nil when nothing is limited.
+func resolveIOLimits(requested *model.IOLimits, plan model.IOLimits) (*model.IOLimits, error) {
+	var req model.IOLimits
+	if requested != nil {
+		req = *requested
+	}
+	disk, err := resolveIOLimit("disk", req.Disk, plan.Disk)
+	if err != nil {
+		return nil, err
+	}
+	net, err := resolveIOLimit("net", req.Net, plan.Net)
+	if err != nil {
+		return nil, err
+	}
+	if disk == nil && net == nil {
+		return nil, nil
+	}
+	return &model.IOLimits{Disk: disk, Net: net}, nil
+}
+
+func resolveIOLimit(device string, requested, plan *model.IOLimit) (*model.IOLimit, error) {
+	var req, caps model.IOLimit
+	if requested != nil {
+		req = *requested
+	}
+	if plan != nil {
+		caps = *plan
+	}
+	out := model.IOLimit{}
+	for _, f := range []struct {
+		name     string
+		req, cap int64
+		out      *int64
+	}{
+		{"bandwidthBytesPerSec", req.BandwidthBytesPerSec, caps.BandwidthBytesPerSec, &out.BandwidthBytesPerSec},
+		{"bandwidthBurstBytes", req.BandwidthBurstBytes, caps.BandwidthBurstBytes, &out.BandwidthBurstBytes},
+		{"opsPerSec", req.OpsPerSec, caps.OpsPerSec, &out.OpsPerSec},
+		{"opsBurst", req.OpsBurst, caps.OpsBurst, &out.OpsBurst},
+	} {
+		switch {
+		case f.req < 0:
+			return nil, fmt.Errorf("%w: %s.%s must not be negative", model.ErrInvalidIOLimits, device, f.name)
+		case f.cap > 0 && f.req > f.cap:
+			return nil, fmt.Errorf("%w: %s.%s must be at most %d on this plan", model.ErrInvalidIOLimits, device, f.name, f.cap)
+		case f.req > 0:
+			*f.out = f.req
+		default:
+			*f.out = f.cap
+		}
+	}
+	if out == (model.IOLimit{}) {
+		return nil, nil
+	}
+	return &out, nil
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"voidrun/internal/model"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// activityTracker remembers when each sandbox was last used through the API and how
+// many requests (including long-lived streams and WebSockets) are still in flight
+type activityTracker struct {
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+	inflight map[string]int
+}
+
+func newActivityTracker() *activityTracker {
+	return &activityTracker{
+		lastSeen: make(map[string]time.Time),
+		inflight: make(map[string]int),
+	}
+}
+
+// BeginActivity marks the start of an API request against a sandbox
+func (s *SandboxService) BeginActivity(id string) {
+	s.activity.mu.Lock()
+	defer s.activity.mu.Unlock()
+	s.activity.inflight[id]++
+	s.activity.lastSeen[id] = time.Now()
+}
+
+// EndActivity marks the end of a request started with BeginActivity
+func (s *SandboxService) EndActivity(id string) {
+	s.activity.mu.Lock()
+	defer s.activity.mu.Unlock()
+	if s.activity.inflight[id] <= 1 {
+		delete(s.activity.inflight, id)
+	} else {
+		s.activity.inflight[id]--
+	}
+	s.activity.lastSeen[id] = time.Now()
+}
+
+// activityOf returns the in-memory last activity time and in-flight request count
+func (s *SandboxService) activityOf(id string) (time.Time, int) {
+	s.activity.mu.Lock()
+	defer s.activity.mu.Unlock()
+	return s.activity.lastSeen[id], s.activity.inflight[id]
+}
+
+func (s *SandboxService) forgetActivity(id string) {
+	s.activity.mu.Lock()
+	defer s.activity.mu.Unlock()
+	delete(s.activity.lastSeen, id)
+	delete(s.activity.inflight, id)
+}
+
+// planLimitsFor returns the limits of the org's plan, falling back to the free tier
+func (s *SandboxService) planLimitsFor(ctx context.Context, orgID primitive.ObjectID) model.PlanLimits {
+	if s.orgRepo == nil || orgID.IsZero() {
+		return model.LimitsForPlan(model.PlanFree)
+	}
+	org, err := s.orgRepo.FindByID(ctx, orgID)
+	if err != nil || org == nil {
+		return model.LimitsForPlan(model.PlanFree)
+	}
+	return model.LimitsForPlan(org.Plan)
+}
+
+// resolveLimit applies a plan default and cap to a requested value in seconds
+func resolveLimit(name string, requested *int, def, max int) (int, error) {
+	v := def
+	if requested != nil {
+		v = *requested
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("%w: %s must not be negative", model.ErrLifetimeExceedsPlan, name)
+	}
+	if max > 0 && (v == 0 || v > max) {
+		return 0, fmt.Errorf("%w: %s must be between 1 and %d", model.ErrLifetimeExceedsPlan, name, max)
+	}
+	return v, nil
+}
+
+// applyLifetime sets the timeout fields of a new sandbox from the request and its org plan
+func (s *SandboxService) applyLifetime(ctx context.Context, sandbox *model.Sandbox, timeoutSec, idleTimeoutSec *int) error {
+	limits := s.planLimitsFor(ctx, sandbox.OrgID)
+	timeout, err := resolveLimit("timeoutSec", timeoutSec, limits.DefaultTimeoutSec, limits.MaxTimeoutSec)
+	if err != nil {
+		return err
+	}
+	idle, err := resolveLimit("idleTimeoutSec", idleTimeoutSec, limits.DefaultIdleTimeoutSec, limits.MaxIdleTimeoutSec)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	sandbox.TimeoutSec = timeout
+	sandbox.IdleTimeoutSec = idle
+	sandbox.LastActiveAt = &now
+	sandbox.ExpiresAt = nil
+	if timeout > 0 {
+		expiresAt := now.Add(time.Duration(timeout) * time.Second)
+		sandbox.ExpiresAt = &expiresAt
+	}
+	return nil
+}
+
+// lifetimeFields returns the lifetime fields of a sandbox as a Mongo update
+func lifetimeFields(sandbox *model.Sandbox) bson.M {
+	fields := bson.M{
+		"timeoutSec":     sandbox.TimeoutSec,
+		"idleTimeoutSec": sandbox.IdleTimeoutSec,
+		"lastActiveAt":   sandbox.LastActiveAt,
+	}
+	if sandbox.ExpiresAt != nil {
+		fields["expiresAt"] = sandbox.ExpiresAt
+	}
+	return fields
+}
+
+// Extend moves the sandbox deadline to timeoutSec seconds from now, within the org plan maximum
+func (s *SandboxService) Extend(ctx context.Context, sandbox *model.Sandbox, timeoutSec int) (*model.Sandbox, error) {
+	if sandbox.Status == model.SandboxStatusDeleting {
+		return nil, model.ErrInvalidTransition
+	}
+	limits := s.planLimitsFor(ctx, sandbox.OrgID)
+	if _, err := resolveLimit("timeoutSec", &timeoutSec, limits.DefaultTimeoutSec, limits.MaxTimeoutSec); err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(time.Duration(timeoutSec) * time.Second)
+	if err := s.repo.UpdateFields(ctx, sandbox.ID, bson.M{"expiresAt": expiresAt, "timeoutSec": timeoutSec}); err != nil {
+		return nil, err
+	}
+	sandbox.ExpiresAt = &expiresAt
+	sandbox.TimeoutSec = timeoutSec
+	return sandbox, nil
+}
+
+// ReapExpired deletes sandboxes past their deadline and stops running sandboxes that
+// have been idle longer than their idle timeout. Idle means no API activity, no
+// in-flight requests and no running commands in the guest.
+func (s *SandboxService) ReapExpired(ctx context.Context) error {
+	filter := bson.M{
+		"status": bson.M{"$in": []string{model.SandboxStatusRunning, model.SandboxStatusPaused, model.SandboxStatusStopped, model.SandboxStatusHibernated}},
+		"$or": []bson.M{
+			{"expiresAt": bson.M{"$exists": true}},
+			{"idleTimeoutSec": bson.M{"$gt": 0}},
+		},
+	}
+	projection := bson.M{"_id": 1, "status": 1, "expiresAt": 1, "idleTimeoutSec": 1, "lastActiveAt": 1, "createdAt": 1}
+	sandboxes, err := s.repo.Find(ctx, filter, options.FindOptions{Projection: projection})
+	if err != nil {
+		return fmt.Errorf("failed to list sandboxes: %w", err)
+	}
+
+	now := time.Now()
+	for _, sb := range sandboxes {
+		id := sb.ID.Hex()
+
+		if sb.ExpiresAt != nil && now.After(*sb.ExpiresAt) {
+			fmt.Printf("[reaper] Sandbox %s expired at %s, deleting\n", id, sb.ExpiresAt.Format(time.RFC3339))
+			if err := s.Delete(ctx, id); err != nil {
+				fmt.Printf("[reaper] delete of %s failed: %v\n", id, err)
+			}
+			continue
+		}
+
+		if sb.IdleTimeoutSec <= 0 || sb.Status == model.SandboxStatusStopped || sb.Status == model.SandboxStatusHibernated {
+			continue
+		}
+
+		lastActive := sb.CreatedAt
+		if sb.LastActiveAt != nil && sb.LastActiveAt.After(lastActive) {
+			lastActive = *sb.LastActiveAt
+		}
+		seen, inflight := s.activityOf(id)
+		if seen.After(lastActive) {
+			lastActive = seen
+			// Persist so idle time survives a server restart
+			s.repo.UpdateFields(ctx, sb.ID, bson.M{"lastActiveAt": seen})
+		}
+		if inflight > 0 || now.Sub(lastActive) < time.Duration(sb.IdleTimeoutSec)*time.Second {
+			continue
+		}
+		if sb.Status == model.SandboxStatusRunning && hasRunningCommands(id) {
+			continue
+		}
+
+		fmt.Printf("[reaper] Sandbox %s idle since %s, stopping\n", id, lastActive.Format(time.RFC3339))
+		if err := s.Stop(ctx, id); err != nil {
+			fmt.Printf("[reaper] stop of %s failed: %v\n", id, err)
+		}
+	}
+	return nil
+}
+
+// hasRunningCommands reports whether the guest agent has background processes still running.
+// An unreachable agent counts as having none.
+func hasRunningCommands(sbxID string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	resp, err := AgentCommand(ctx, nil, sbxID, nil, "/processes", http.MethodGet)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return false
+	}
+
+	var list model.CommandListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return false
+	}
+	for _, p := range list.Processes {
+		if p.Running {
+			return true
+		}
+	}
+	return false
+}
+
+// touchStarted resets the idle clock of a sandbox that was just booted again
+func (s *SandboxService) touchStarted(ctx context.Context, id primitive.ObjectID) {
+	now := time.Now()
+	s.repo.UpdateFields(ctx, id, bson.M{"lastActiveAt": now})
+}
@@ -0,0 +1,344 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/netip"
+
+	"voidrun/internal/config"
+	"voidrun/internal/metrics"
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+	"voidrun/pkg/network"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// leaseAttempts bounds how many lost races Allocate tolerates before giving up
+	leaseAttempts = 100
+	// minGuestCID is the first CID a guest may use; 0-2 are reserved by vsock
+	minGuestCID = 3
+)
+
+// NetworkService hands out the network identity of sandboxes. The IP, MAC and vsock CID
+// of a sandbox are leased together and persisted, so they are unique across the whole
+// NETWORK_CIDR and survive restarts. The IP comes from the address pool serving the
+// sandbox's org or this host; the MAC embeds all four octets of the IP and the CID is
+// drawn at random from the 32-bit CID space.
+type NetworkService struct {
+	cfg       *config.Config
+	ipam      *network.IPAM
+	leases    repository.ILeaseRepository
+	sandboxes repository.ISandboxRepository
+	metrics   *metrics.Manager
+}
+
+func NewNetworkService(cfg *config.Config, ipam *network.IPAM, leases repository.ILeaseRepository, sandboxes repository.ISandboxRepository, metricsManager *metrics.Manager) *NetworkService {
+	return &NetworkService{
+		cfg:       cfg,
+		ipam:      ipam,
+		leases:    leases,
+		sandboxes: sandboxes,
+		metrics:   metricsManager,
+	}
+}
+
+// Allocate leases a free IP, MAC and CID to a sandbox of the given org (empty for warm
+// sandboxes). It returns model.ErrAddressPoolExhausted when the pool is full.
+func (s *NetworkService) Allocate(ctx context.Context, sandboxID primitive.ObjectID, orgID string) (*model.NetworkLease, error) {
+	pool, ok := s.ipam.Select(orgID, s.cfg.Network.HostID)
+	if !ok {
+		return nil, fmt.Errorf("no address pool serves org %q on host %q", orgID, s.cfg.Network.HostID)
+	}
+	taken, err := s.leasedIPs(ctx, pool.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Start at a random offset so concurrent servers rarely race for the same address
+	offset := rand.Uint32()
+	for attempt := 0; attempt < leaseAttempts; attempt++ {
+		addr, ok := s.ipam.Next(pool, offset, taken)
+		if !ok {
+			if s.metrics != nil {
+				s.metrics.ObserveIPPoolExhausted(pool.Name)
+			}
+			return nil, model.ErrAddressPoolExhausted
+		}
+		lease := &model.NetworkLease{
+			SandboxID: sandboxID,
+			Pool:      pool.Name,
+			IP:        addr.String(),
+			MAC:       leaseMAC(net.IP(addr.AsSlice())),
+			CID:       randomCID(),
+		}
+		err := s.leases.Create(ctx, lease)
+		if err == nil {
+			s.recordUsage(ctx, pool)
+			return lease, nil
+		}
+		if !errors.Is(err, model.ErrLeaseConflict) {
+			return nil, err
+		}
+		// Another server took the address, or the CID collided; either way move on
+		taken[addr] = true
+	}
+	return nil, fmt.Errorf("failed to lease an address in pool %s after %d attempts", pool.Name, leaseAttempts)
+}
+
+// PoolFor names the address pool that leases to sandboxes of the given org on this host
+func (s *NetworkService) PoolFor(orgID string) (string, bool) {
+	pool, ok := s.ipam.Select(orgID, s.cfg.Network.HostID)
+	return pool.Name, ok
+}
+
+// AllocateCID leases only a vsock CID, for a networkless sandbox that gets no IP or MAC
+func (s *NetworkService) AllocateCID(ctx context.Context, sandboxID primitive.ObjectID) (*model.NetworkLease, error) {
+	for attempt := 0; attempt < leaseAttempts; attempt++ {
+		lease := &model.NetworkLease{SandboxID: sandboxID, CID: randomCID()}
+		err := s.leases.Create(ctx, lease)
+		if err == nil {
+			return lease, nil
+		}
+		if !errors.Is(err, model.ErrLeaseConflict) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no free CID for sandbox %s", sandboxID.Hex())
+}
+
+// Release frees the lease of a sandbox whose record is gone
+func (s *NetworkService) Release(ctx context.Context, sandboxID primitive.ObjectID) {
+	lease, err := s.leases.FindBySandbox(ctx, sandboxID)
+	if err == nil && lease == nil {
+		return
+	}
+	if err == nil {
+		err = s.leases.DeleteBySandbox(ctx, sandboxID)
+	}
+	if err != nil {
+		fmt.Printf("[network] failed to release lease of %s: %v\n", sandboxID.Hex(), err)
+		return
+	}
+	for _, pool := range s.ipam.Pools() {
+		if pool.Name == lease.Pool {
+			s.recordUsage(ctx, pool)
+		}
+	}
+}
+
+// ListLeases lists the current leases, oldest first, paginated
+func (s *NetworkService) ListLeases(ctx context.Context, page, pageSize int) ([]*model.NetworkLease, int64, int, error) {
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = config.DefaultPageSize
+	} else if pageSize > config.MaxPageSize {
+		pageSize = config.MaxPageSize
+	}
+
+	total, err := s.leases.Count(ctx, bson.M{})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	opts := options.FindOptions{}
+	opts.SetSkip(int64((page - 1) * pageSize))
+	opts.SetLimit(int64(pageSize))
+	opts.SetSort(bson.D{{Key: "createdAt", Value: 1}})
+	leases, err := s.leases.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if leases == nil {
+		leases = []*model.NetworkLease{}
+	}
+	return leases, total, pageSize, nil
+}
+
+// PoolStats reports the size and usage of every address pool
+func (s *NetworkService) PoolStats(ctx context.Context) ([]model.IPPoolStats, error) {
+	stats := make([]model.IPPoolStats, 0, len(s.ipam.Pools()))
+	for _, pool := range s.ipam.Pools() {
+		leased, err := s.leases.Count(ctx, bson.M{"pool": pool.Name})
+		if err != nil {
+			return nil, err
+		}
+		size := s.ipam.Size(pool)
+		stats = append(stats, model.IPPoolStats{
+			Name:   pool.Name,
+			CIDR:   pool.Prefix.String(),
+			OrgID:  pool.OrgID,
+			Host:   pool.Host,
+			Size:   size,
+			Leased: int(leased),
+			Free:   max(size-int(leased), 0),
+		})
+	}
+	return stats, nil
+}
+
+// AllLeases returns every current lease
+func (s *NetworkService) AllLeases(ctx context.Context) ([]*model.NetworkLease, error) {
+	return s.leases.Find(ctx, bson.M{}, options.FindOptions{})
+}
+
+// Backfill leases the IP already recorded on sandboxes created before leases existed,
+// and records the MAC and CID they get with it. They take effect on the next boot. A
+// sandbox whose IP is taken by another lease, as the old allocator allowed, or may not
+// be handed out any more, is moved to a fresh address. Leases made before pools existed
+// are assigned the pool of their IP, and sandboxes made before network modes the bridge mode.
+func (s *NetworkService) Backfill(ctx context.Context) error {
+	if err := s.backfillPools(ctx); err != nil {
+		return err
+	}
+	if err := s.backfillModes(ctx); err != nil {
+		return err
+	}
+
+	filter := bson.M{"cid": bson.M{"$exists": false}}
+	projection := bson.M{"_id": 1, "ip": 1, "orgId": 1}
+	records, err := s.sandboxes.Find(ctx, filter, options.FindOptions{Projection: projection})
+	if err != nil {
+		return fmt.Errorf("failed to list sandboxes without lease: %w", err)
+	}
+
+	for _, sb := range records {
+		lease, err := s.leases.FindBySandbox(ctx, sb.ID)
+		if err != nil {
+			return err
+		}
+		if lease == nil {
+			lease, err = s.leaseExisting(ctx, sb)
+			if err != nil {
+				return err
+			}
+		}
+		if lease.IP != sb.IP {
+			fmt.Printf("[network] Sandbox %s shared IP %s; moved to %s\n", sb.ID.Hex(), sb.IP, lease.IP)
+		}
+		if err := s.sandboxes.UpdateFields(ctx, sb.ID, bson.M{"ip": lease.IP, "mac": lease.MAC, "cid": lease.CID}); err != nil {
+			return err
+		}
+	}
+	if len(records) > 0 {
+		fmt.Printf("[network] Leased addresses of %d existing sandboxes\n", len(records))
+	}
+	for _, pool := range s.ipam.Pools() {
+		s.recordUsage(ctx, pool)
+	}
+	return nil
+}
+
+func (s *NetworkService) backfillPools(ctx context.Context) error {
+	leases, err := s.leases.Find(ctx, bson.M{"pool": bson.M{"$exists": false}}, options.FindOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list leases without pool: %w", err)
+	}
+	for _, lease := range leases {
+		name := ""
+		if addr, err := netip.ParseAddr(lease.IP); err == nil {
+			if pool, ok := s.ipam.PoolOf(addr); ok {
+				name = pool.Name
+			}
+		}
+		if err := s.leases.SetPool(ctx, lease.ID, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *NetworkService) backfillModes(ctx context.Context) error {
+	filter := bson.M{"network": bson.M{"$exists": false}}
+	records, err := s.sandboxes.Find(ctx, filter, options.FindOptions{Projection: bson.M{"_id": 1}})
+	if err != nil {
+		return fmt.Errorf("failed to list sandboxes without network mode: %w", err)
+	}
+	for _, sb := range records {
+		if err := s.sandboxes.UpdateFields(ctx, sb.ID, bson.M{"network": model.NetworkModeBridge}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *NetworkService) leaseExisting(ctx context.Context, sb *model.Sandbox) (*model.NetworkLease, error) {
+	orgID := poolOrg(sb.OrgID)
+	addr, err := netip.ParseAddr(sb.IP)
+	if err != nil || !addr.Is4() {
+		return s.Allocate(ctx, sb.ID, orgID)
+	}
+	pool, ok := s.ipam.PoolOf(addr)
+	if !ok || !s.ipam.Usable(pool, addr) {
+		return s.Allocate(ctx, sb.ID, orgID)
+	}
+	ip := net.IP(addr.AsSlice())
+	for attempt := 0; attempt < leaseAttempts; attempt++ {
+		lease := &model.NetworkLease{SandboxID: sb.ID, Pool: pool.Name, IP: ip.String(), MAC: leaseMAC(ip), CID: randomCID()}
+		err := s.leases.Create(ctx, lease)
+		if err == nil {
+			return lease, nil
+		}
+		if !errors.Is(err, model.ErrLeaseConflict) {
+			return nil, err
+		}
+		if taken, _ := s.leases.Count(ctx, bson.M{"ip": lease.IP}); taken > 0 {
+			return s.Allocate(ctx, sb.ID, orgID)
+		}
+	}
+	return nil, fmt.Errorf("no free CID for sandbox %s", sb.ID.Hex())
+}
+
+// leasedIPs returns the addresses currently leased from a pool
+func (s *NetworkService) leasedIPs(ctx context.Context, pool string) (map[netip.Addr]bool, error) {
+	leases, err := s.leases.Find(ctx, bson.M{"pool": pool}, options.FindOptions{Projection: bson.M{"ip": 1}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list leases of pool %s: %w", pool, err)
+	}
+	taken := make(map[netip.Addr]bool, len(leases))
+	for _, lease := range leases {
+		if addr, err := netip.ParseAddr(lease.IP); err == nil {
+			taken[addr] = true
+		}
+	}
+	return taken, nil
+}
+
+// recordUsage refreshes the usage metrics of a pool
+func (s *NetworkService) recordUsage(ctx context.Context, pool network.Pool) {
+	if s.metrics == nil {
+		return
+	}
+	leased, err := s.leases.Count(ctx, bson.M{"pool": pool.Name})
+	if err != nil {
+		return
+	}
+	s.metrics.SetIPPoolUsage(pool.Name, s.ipam.Size(pool), int(leased))
+}
+
+// poolOrg is the org key pools are scoped by; sandboxes without an org have none
+func poolOrg(orgID primitive.ObjectID) string {
+	if orgID.IsZero() {
+		return ""
+	}
+	return orgID.Hex()
+}
+
+// leaseMAC derives a locally administered unicast MAC from all four octets of ip
+func leaseMAC(ip net.IP) string {
+	ip = ip.To4()
+	return fmt.Sprintf("AA:FC:%02X:%02X:%02X:%02X", ip[0], ip[1], ip[2], ip[3])
+}
+
+// randomCID returns a CID in [minGuestCID, MaxUint32), which excludes VMADDR_CID_ANY
+func randomCID() uint32 {
+	return minGuestCID + uint32(rand.Int63n(int64(math.MaxUint32-minGuestCID)))
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+	"voidrun/internal/repository/repotest"
+	"voidrun/pkg/network"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// newTestNetworkService serves the given network, with its first address as the gateway,
+// from the leases in leases
+func newTestNetworkService(t *testing.T, leases *repotest.LeaseRepository, cidr string, pools, reserved []string) *NetworkService {
+	t.Helper()
+	ipam, err := network.NewIPAM(cidr, netip.MustParsePrefix(cidr).Addr().Next().String(), pools, reserved)
+	if err != nil {
+		t.Fatalf("NewIPAM: %v", err)
+	}
+	cfg := &config.Config{}
+	cfg.Network.HostID = "host-a"
+	return NewNetworkService(cfg, ipam, leases, repotest.NewSandboxRepository(), nil)
+}
+
+func TestAllocateReleaseSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	leases := repotest.NewLeaseRepository()
+	svc := newTestNetworkService(t, leases, "10.0.0.0/29", nil, nil)
+
+	// .0 network, .1 gateway and .7 broadcast leave five addresses
+	held := map[string]primitive.ObjectID{}
+	for i := 0; i < 5; i++ {
+		id := primitive.NewObjectID()
+		lease, err := svc.Allocate(ctx, id, "")
+		if err != nil {
+			t.Fatalf("Allocate #%d: %v", i, err)
+		}
+		if _, dup := held[lease.IP]; dup {
+			t.Fatalf("Allocate handed out %s twice", lease.IP)
+		}
+		if lease.Pool != network.DefaultPoolName || lease.MAC != leaseMAC(netip.MustParseAddr(lease.IP).AsSlice()) {
+			t.Errorf("lease = %+v, want default pool and MAC derived from the IP", lease)
+		}
+		held[lease.IP] = id
+	}
+	for _, ip := range []string{"10.0.0.0", "10.0.0.1", "10.0.0.7"} {
+		if _, ok := held[ip]; ok {
+			t.Errorf("Allocate handed out %s", ip)
+		}
+	}
+
+	// A new service over the same leases, as after a restart, sees the pool as full
+	restarted := newTestNetworkService(t, leases, "10.0.0.0/29", nil, nil)
+	if _, err := restarted.Allocate(ctx, primitive.NewObjectID(), ""); !errors.Is(err, model.ErrAddressPoolExhausted) {
+		t.Fatalf("Allocate on a full pool = %v, want ErrAddressPoolExhausted", err)
+	}
+
+	restarted.Release(ctx, held["10.0.0.4"])
+	if lease, _ := leases.FindBySandbox(ctx, held["10.0.0.4"]); lease != nil {
+		t.Fatalf("lease of released sandbox still stored: %+v", lease)
+	}
+
+	again := newTestNetworkService(t, leases, "10.0.0.0/29", nil, nil)
+	lease, err := again.Allocate(ctx, primitive.NewObjectID(), "")
+	if err != nil {
+		t.Fatalf("Allocate after Release: %v", err)
+	}
+	if lease.IP != "10.0.0.4" {
+		t.Errorf("Allocate after Release = %s, want the freed 10.0.0.4", lease.IP)
+	}
+}
+
+func TestAllocateSkipsReservedAddresses(t *testing.T) {
+	ctx := context.Background()
+	svc := newTestNetworkService(t, repotest.NewLeaseRepository(), "10.0.0.0/29", nil, []string{"10.0.0.2/31", "10.0.0.5"})
+
+	var got []string
+	for {
+		lease, err := svc.Allocate(ctx, primitive.NewObjectID(), "")
+		if errors.Is(err, model.ErrAddressPoolExhausted) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Allocate: %v", err)
+		}
+		got = append(got, lease.IP)
+	}
+	if len(got) != 2 {
+		t.Fatalf("leased %v, want only 10.0.0.4 and 10.0.0.6", got)
+	}
+	for _, ip := range got {
+		if ip != "10.0.0.4" && ip != "10.0.0.6" {
+			t.Errorf("leased %s, want only 10.0.0.4 and 10.0.0.6", ip)
+		}
+	}
+}
+
+func TestAllocateUsesPoolOfOrg(t *testing.T) {
+	ctx := context.Background()
+	orgID := primitive.NewObjectID().Hex()
+	leases := repotest.NewLeaseRepository()
+	svc := newTestNetworkService(t, leases, "10.0.0.0/24", []string{"acme=10.0.0.64/30@org:" + orgID}, nil)
+
+	for i := 0; i < 4; i++ {
+		lease, err := svc.Allocate(ctx, primitive.NewObjectID(), orgID)
+		if err != nil {
+			t.Fatalf("Allocate #%d: %v", i, err)
+		}
+		if lease.Pool != "acme" || !netip.MustParsePrefix("10.0.0.64/30").Contains(netip.MustParseAddr(lease.IP)) {
+			t.Errorf("lease = %+v, want an address of pool acme", lease)
+		}
+	}
+	// Only the network's own broadcast is excluded, so all of .64-.67 are usable
+	if _, err := svc.Allocate(ctx, primitive.NewObjectID(), orgID); !errors.Is(err, model.ErrAddressPoolExhausted) {
+		t.Fatalf("Allocate on a full org pool = %v, want ErrAddressPoolExhausted", err)
+	}
+	lease, err := svc.Allocate(ctx, primitive.NewObjectID(), "")
+	if err != nil || lease.Pool != network.DefaultPoolName {
+		t.Fatalf("Allocate for another org = %+v, %v, want the default pool", lease, err)
+	}
+
+	stats, err := svc.PoolStats(ctx)
+	if err != nil {
+		t.Fatalf("PoolStats: %v", err)
+	}
+	for _, s := range stats {
+		if s.Name == "acme" && (s.Leased != 4 || s.Free != 0) {
+			t.Errorf("acme stats = %+v, want 4 leased and none free", s)
+		}
+	}
+}
+
+func TestAllocateCIDLeasesNoAddress(t *testing.T) {
+	ctx := context.Background()
+	leases := repotest.NewLeaseRepository()
+	svc := newTestNetworkService(t, leases, "10.0.0.0/29", nil, nil)
+
+	for i := 0; i < 10; i++ {
+		lease, err := svc.AllocateCID(ctx, primitive.NewObjectID())
+		if err != nil {
+			t.Fatalf("AllocateCID: %v", err)
+		}
+		if lease.IP != "" || lease.MAC != "" || lease.CID < minGuestCID {
+			t.Errorf("lease = %+v, want only a guest CID", lease)
+		}
+	}
+	// Networkless leases must not use up the address pool
+	if _, err := svc.Allocate(ctx, primitive.NewObjectID(), ""); err != nil {
+		t.Fatalf("Allocate after CID-only leases: %v", err)
+	}
+}
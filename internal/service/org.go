@@ -11,11 +11,12 @@ import (
 
 // OrgService handles organization logic
 type OrgService struct {
-	repo repository.IOrgRepository
+	repo   repository.IOrgRepository
+	egress *EgressService
 }
 
-func NewOrgService(repo repository.IOrgRepository) *OrgService {
-	return &OrgService{repo: repo}
+func NewOrgService(repo repository.IOrgRepository, egress *EgressService) *OrgService {
+	return &OrgService{repo: repo, egress: egress}
 }
 
 // EnsureDefaultOrg checks for an owner org and creates one if missing
@@ -40,3 +41,15 @@ func (s *OrgService) EnsureDefaultOrg(ctx context.Context, ownerID primitive.Obj
 func (s *OrgService) GetByID(ctx context.Context, id primitive.ObjectID) (*model.Organization, error) {
 	return s.repo.FindByID(ctx, id)
 }
+
+// SetSandboxPeering sets whether the org's sandboxes may reach each other and applies it
+// to the sandboxes running on this host. Other hosts apply it as sandboxes boot.
+func (s *OrgService) SetSandboxPeering(ctx context.Context, id primitive.ObjectID, enabled bool) (*model.Organization, error) {
+	if err := s.repo.SetSandboxPeering(ctx, id, enabled); err != nil {
+		return nil, err
+	}
+	if err := s.egress.SetOrgPeering(ctx, id, enabled); err != nil {
+		return nil, err
+	}
+	return s.repo.FindByID(ctx, id)
+}
@@ -0,0 +1,21 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/pkg/machine"
+)
+
+// OpenPortForward connects to a TCP port on localhost in a running sandbox. The stream
+// goes through the guest agent over vsock, so it works for sandboxes whose network is
+// firewalled or absent.
+func (s *SandboxService) OpenPortForward(ctx context.Context, sandbox *model.Sandbox, port int) (net.Conn, error) {
+	if sandbox.Status != model.SandboxStatusRunning {
+		return nil, fmt.Errorf("%w: sandbox is %s", model.ErrInvalidTransition, sandbox.Status)
+	}
+	return machine.DialGuestPort(sandbox.ID.Hex(), port, 5*time.Second)
+}
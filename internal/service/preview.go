@@ -0,0 +1,338 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// PreviewTokenParam, PreviewTokenHeader and PreviewCookie carry share tokens; the
+	// proxy strips all three before a request reaches the sandbox
+	PreviewTokenParam  = "voidrun_preview_token"
+	PreviewTokenHeader = "X-Preview-Token"
+	PreviewCookie      = "voidrun_preview"
+)
+
+// PreviewService exposes TCP ports of sandboxes over HTTP. Requests for
+// <port>-<sandboxId>.<PREVIEW_DOMAIN>, or /preview/<sandboxId>/<port>/, are proxied to
+// the sandbox IP over the bridge, WebSockets included. Callers authenticate with an API
+// key of the sandbox's org or with a share token signed by this service.
+type PreviewService struct {
+	cfg       *config.Config
+	repo      repository.ISandboxRepository
+	secret    []byte
+	transport *http.Transport
+}
+
+func NewPreviewService(cfg *config.Config, repo repository.ISandboxRepository) *PreviewService {
+	secret := []byte(cfg.Preview.TokenSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+		fmt.Println("[preview] PREVIEW_TOKEN_SECRET is not set; share tokens will not survive a restart")
+	}
+	return &PreviewService{
+		cfg:    cfg,
+		repo:   repo,
+		secret: secret,
+		transport: &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+			MaxIdleConnsPerHost:   8,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: 5 * time.Minute,
+		},
+	}
+}
+
+// SetEnabled turns the previews of a sandbox on or off. Turning them off revokes every
+// share token issued for it. Previews reach the sandbox over the bridge, so networkless
+// sandboxes cannot have them.
+func (s *PreviewService) SetEnabled(ctx context.Context, sandbox *model.Sandbox, enabled bool) (*model.Sandbox, error) {
+	if enabled && sandbox.Networkless() {
+		return nil, fmt.Errorf("%w: previews need the bridge network", model.ErrNetworkless)
+	}
+	fields := bson.M{"previewEnabled": enabled}
+	if !enabled && sandbox.PreviewEnabled {
+		fields["previewEpoch"] = sandbox.PreviewEpoch + 1
+	}
+	if err := s.repo.UpdateFields(ctx, sandbox.ID, fields); err != nil {
+		return nil, err
+	}
+	sandbox.PreviewEnabled = enabled
+	if epoch, ok := fields["previewEpoch"].(int); ok {
+		sandbox.PreviewEpoch = epoch
+	}
+	fmt.Printf("[preview] Sandbox %s previews enabled=%t\n", sandbox.ID.Hex(), enabled)
+	return sandbox, nil
+}
+
+// Ports asks the guest agent which TCP ports are listening in a running sandbox
+func (s *PreviewService) Ports(ctx context.Context, sandbox *model.Sandbox) ([]model.PreviewPort, error) {
+	body, err := json.Marshal(map[string]interface{}{"cmd": "cat /proc/net/tcp /proc/net/tcp6 2>/dev/null", "timeout": 5})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := ExecAgentCommand(ctx, nil, sandbox.ID.Hex(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("agent returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	var out model.ExecResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to decode agent response: %w", err)
+	}
+
+	ports := listeningPorts(out.Stdout)
+	for i := range ports {
+		if ports[i].Reachable && sandbox.PreviewEnabled {
+			ports[i].URL = s.URL(sandbox.ID.Hex(), ports[i].Port)
+		}
+	}
+	return ports, nil
+}
+
+// URL returns the preview URL of a sandbox port: a preview host when PREVIEW_DOMAIN is
+// set, else a path on this server
+func (s *PreviewService) URL(sandboxID string, port int) string {
+	if s.cfg.Preview.Domain == "" {
+		return fmt.Sprintf("/preview/%s/%d/", sandboxID, port)
+	}
+	return fmt.Sprintf("%s://%d-%s.%s/", s.cfg.Preview.Scheme, port, sandboxID, s.cfg.Preview.Domain)
+}
+
+// ParseHost extracts the sandbox ID and port from a preview host, <port>-<sandboxId>.<domain>
+func (s *PreviewService) ParseHost(host string) (string, int, bool) {
+	if s.cfg.Preview.Domain == "" {
+		return "", 0, false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	label, ok := strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(s.cfg.Preview.Domain))
+	if !ok {
+		return "", 0, false
+	}
+	portStr, id, ok := strings.Cut(label, "-")
+	if !ok || strings.Contains(id, ".") {
+		return "", 0, false
+	}
+	port, err := ParsePreviewPort(portStr)
+	if err != nil {
+		return "", 0, false
+	}
+	return id, port, true
+}
+
+// IssueToken signs a share token for one port of a sandbox, or every port when port is
+// 0, valid for ttlSec seconds (PREVIEW_TOKEN_TTL_SEC when 0)
+func (s *PreviewService) IssueToken(sandbox *model.Sandbox, port, ttlSec int) (*model.PreviewToken, error) {
+	if !sandbox.PreviewEnabled {
+		return nil, model.ErrPreviewDisabled
+	}
+	if ttlSec == 0 {
+		ttlSec = s.cfg.Preview.DefaultTokenTTLSec
+	}
+	if s.cfg.Preview.MaxTokenTTLSec > 0 && ttlSec > s.cfg.Preview.MaxTokenTTLSec {
+		return nil, fmt.Errorf("ttlSec exceeds the maximum of %d", s.cfg.Preview.MaxTokenTTLSec)
+	}
+	expiresAt := time.Now().Add(time.Duration(ttlSec) * time.Second).Truncate(time.Second)
+
+	payload := make([]byte, 12, 12+16)
+	binary.BigEndian.PutUint64(payload[0:8], uint64(expiresAt.Unix()))
+	binary.BigEndian.PutUint16(payload[8:10], uint16(port))
+	binary.BigEndian.PutUint16(payload[10:12], uint16(sandbox.PreviewEpoch))
+	payload = append(payload, sandbox.ID[:]...)
+	enc := base64.RawURLEncoding
+	token := enc.EncodeToString(payload) + "." + enc.EncodeToString(s.sign(payload))
+
+	out := &model.PreviewToken{Token: token, Port: port, ExpiresAt: expiresAt}
+	if port != 0 {
+		out.URL = s.URL(sandbox.ID.Hex(), port) + "?" + url.Values{PreviewTokenParam: {token}}.Encode()
+	}
+	return out, nil
+}
+
+// TokenSandbox checks the signature and expiry of a share token and returns the ID of the
+// sandbox it was issued for, so a request can be authenticated before any sandbox is loaded
+func (s *PreviewService) TokenSandbox(token string) (string, error) {
+	payload, err := s.decodeToken(token)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(payload[12:]), nil
+}
+
+// VerifyToken checks that a share token was issued for this sandbox and port, has not
+// expired and was not revoked
+func (s *PreviewService) VerifyToken(token string, sandbox *model.Sandbox, port int) error {
+	payload, err := s.decodeToken(token)
+	if err != nil {
+		return err
+	}
+	tokenPort := int(binary.BigEndian.Uint16(payload[8:10]))
+	epoch := int(binary.BigEndian.Uint16(payload[10:12]))
+	switch {
+	case !bytes.Equal(payload[12:], sandbox.ID[:]),
+		tokenPort != 0 && tokenPort != port,
+		epoch != sandbox.PreviewEpoch&0xffff:
+		return model.ErrInvalidPreviewToken
+	}
+	return nil
+}
+
+// decodeToken returns the payload of a share token signed by this service that has not expired
+func (s *PreviewService) decodeToken(token string) ([]byte, error) {
+	enc := base64.RawURLEncoding
+	payloadStr, sigStr, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, model.ErrInvalidPreviewToken
+	}
+	payload, err := enc.DecodeString(payloadStr)
+	if err != nil || len(payload) != 12+len(primitive.ObjectID{}) {
+		return nil, model.ErrInvalidPreviewToken
+	}
+	sig, err := enc.DecodeString(sigStr)
+	if err != nil || !hmac.Equal(sig, s.sign(payload)) {
+		return nil, model.ErrInvalidPreviewToken
+	}
+	if time.Now().After(time.Unix(int64(binary.BigEndian.Uint64(payload[0:8])), 0)) {
+		return nil, model.ErrInvalidPreviewToken
+	}
+	return payload, nil
+}
+
+// Proxy returns a reverse proxy to a port of a sandbox. Preview credentials are removed
+// from requests before they reach the sandbox.
+func (s *PreviewService) Proxy(sandbox *model.Sandbox, port int, onError func(http.ResponseWriter, error)) *httputil.ReverseProxy {
+	target := &url.URL{Scheme: "http", Host: net.JoinHostPort(sandbox.IP, strconv.Itoa(port))}
+	return &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+			r.Out.Host = r.In.Host
+			stripPreviewCredentials(r.Out)
+		},
+		Transport:     s.transport,
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			onError(w, err)
+		},
+	}
+}
+
+func (s *PreviewService) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// ParsePreviewPort parses the port of a preview host or path, rejecting leading zeros
+func ParsePreviewPort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 || strconv.Itoa(port) != s {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+func stripPreviewCredentials(r *http.Request) {
+	r.Header.Del("X-API-Key")
+	r.Header.Del(PreviewTokenHeader)
+	if cookies := r.Cookies(); len(cookies) > 0 {
+		r.Header.Del("Cookie")
+		for _, cookie := range cookies {
+			if cookie.Name != PreviewCookie {
+				r.AddCookie(cookie)
+			}
+		}
+	}
+	if q := r.URL.Query(); q.Has(PreviewTokenParam) {
+		q.Del(PreviewTokenParam)
+		r.URL.RawQuery = q.Encode()
+	}
+}
+
+// listeningPorts parses /proc/net/tcp and /proc/net/tcp6 into the listening ports, sorted.
+// A port is reachable when any of its sockets is bound to a non-loopback address.
+func listeningPorts(procNet string) []model.PreviewPort {
+	byPort := make(map[int]*model.PreviewPort)
+	scanner := bufio.NewScanner(strings.NewReader(procNet))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// sl local_address rem_address st ...; 0A is TCP_LISTEN
+		if len(fields) < 4 || fields[3] != "0A" {
+			continue
+		}
+		addrHex, portHex, ok := strings.Cut(fields[1], ":")
+		if !ok {
+			continue
+		}
+		port, err := strconv.ParseUint(portHex, 16, 16)
+		if err != nil || port == 0 {
+			continue
+		}
+		ip, ok := procNetIP(addrHex)
+		if !ok {
+			continue
+		}
+		reachable := !ip.IsLoopback()
+		if p, ok := byPort[int(port)]; ok {
+			if reachable && !p.Reachable {
+				p.Address, p.Reachable = ip.String(), true
+			}
+			continue
+		}
+		byPort[int(port)] = &model.PreviewPort{Port: int(port), Address: ip.String(), Reachable: reachable}
+	}
+
+	ports := make([]model.PreviewPort, 0, len(byPort))
+	for _, p := range byPort {
+		ports = append(ports, *p)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+	return ports
+}
+
+// procNetIP decodes an address of /proc/net/tcp{,6}, stored as host-order 32-bit words
+func procNetIP(s string) (net.IP, bool) {
+	raw, err := hex.DecodeString(s)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, false
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.LittleEndian.Uint32(raw[i:]))
+	}
+	return ip, true
+}
@@ -0,0 +1,414 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/metrics"
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+	"voidrun/pkg/machine"
+	"voidrun/pkg/network"
+	"voidrun/pkg/util"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ReconcilerService brings the host (VMM processes, TAPs, instance directories) and the
+// sandbox records back in line after crashes. The startup run acts on every mismatch at
+// once, since no request can own anything yet. Later runs only act on a mismatch that has
+// been seen for at least RECONCILER_INTERVAL_SEC, so in-flight creates, deletes and
+// captures are not mistaken for leftovers, however soon runs follow each other.
+type ReconcilerService struct {
+	repo      repository.ISandboxRepository
+	sandboxes *SandboxService
+	cfg       *config.Config
+	metrics   *metrics.Manager
+
+	mu   sync.Mutex
+	last *model.ReconcileReport
+	// suspects holds when each mismatch not yet acted on was first seen
+	suspects map[string]time.Time
+}
+
+func NewReconcilerService(cfg *config.Config, repo repository.ISandboxRepository, sandboxes *SandboxService, metricsManager *metrics.Manager) *ReconcilerService {
+	return &ReconcilerService{
+		repo:      repo,
+		sandboxes: sandboxes,
+		cfg:       cfg,
+		metrics:   metricsManager,
+		suspects:  make(map[string]time.Time),
+	}
+}
+
+// LastReport returns the report of the most recent run, or nil before the first one
+func (r *ReconcilerService) LastReport() *model.ReconcileReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// reconcileRun carries the state of a single pass
+type reconcileRun struct {
+	r        *ReconcilerService
+	report   *model.ReconcileReport
+	suspects map[string]time.Time
+}
+
+// act records a finding and applies fix unless the run is a dry run or the finding is
+// not yet confirmed, i.e. first seen less than a reconcile interval ago
+func (run *reconcileRun) act(finding model.ReconcileFinding, fix func() error) {
+	key := finding.Kind + ":" + finding.SandboxID + ":" + finding.Resource
+	confirmed := run.report.Startup
+	if !confirmed {
+		firstSeen, ok := run.r.suspects[key]
+		if !ok {
+			firstSeen = run.report.StartedAt
+		}
+		confirmed = run.report.StartedAt.Sub(firstSeen) >= run.r.confirmAfter()
+		// A dry run repairs nothing, so its findings stay suspects
+		if !confirmed || run.report.DryRun {
+			run.suspects[key] = firstSeen
+		}
+	}
+	if !confirmed {
+		finding.Action = "deferred"
+	} else if !run.report.DryRun {
+		if err := fix(); err != nil {
+			finding.Error = err.Error()
+		}
+	}
+	if finding.Error != "" {
+		fmt.Printf("[reconcile] %s %s %s: %s failed: %s\n", finding.Kind, finding.SandboxID, finding.Resource, finding.Action, finding.Error)
+	} else {
+		fmt.Printf("[reconcile] %s %s %s: %s\n", finding.Kind, finding.SandboxID, finding.Resource, finding.Action)
+	}
+	run.report.Findings = append(run.report.Findings, finding)
+}
+
+// confirmAfter is how long a mismatch must persist before a periodic run acts on it
+func (r *ReconcilerService) confirmAfter() time.Duration {
+	interval := r.cfg.Reconciler.IntervalSec
+	if interval <= 0 {
+		interval = config.DefaultReconcilerIntervalSec
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// Run inventories the host and the database and repairs what does not match.
+// startup must only be true for the run made before the server accepts requests.
+func (r *ReconcilerService) Run(ctx context.Context, startup bool) *model.ReconcileReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := &model.ReconcileReport{
+		StartedAt: time.Now(),
+		Startup:   startup,
+		DryRun:    r.cfg.Reconciler.DryRun,
+		Findings:  []model.ReconcileFinding{},
+	}
+	run := &reconcileRun{r: r, report: report, suspects: make(map[string]time.Time)}
+	if err := run.reconcile(ctx); err != nil {
+		report.Error = err.Error()
+		fmt.Printf("[reconcile] run failed: %v\n", err)
+		// Keep the suspects of the previous run so a transient failure does not reset them
+		run.suspects = r.suspects
+	}
+	report.FinishedAt = time.Now()
+
+	r.suspects = run.suspects
+	r.last = report
+	return report
+}
+
+func (run *reconcileRun) reconcile(ctx context.Context) error {
+	projection := bson.M{"_id": 1, "status": 1, "baseSnapshotId": 1}
+	records, err := run.r.repo.Find(ctx, bson.M{}, options.FindOptions{Projection: projection})
+	if err != nil {
+		return fmt.Errorf("failed to list sandboxes: %w", err)
+	}
+	dirs, err := machine.ListInstanceIDs()
+	if err != nil {
+		return err
+	}
+	procs, err := machine.ListVMProcesses()
+	if err != nil {
+		return err
+	}
+	taps, err := network.ListTaps(run.r.cfg.Network.TapPrefix)
+	if err != nil {
+		return err
+	}
+	run.report.Inventory = model.ReconcileInventory{
+		Records:      len(records),
+		InstanceDirs: len(dirs),
+		Processes:    len(procs),
+		Taps:         len(taps),
+	}
+
+	byID := make(map[string]*model.Sandbox, len(records))
+	for _, sb := range records {
+		byID[sb.ID.Hex()] = sb
+	}
+	hasDir := make(map[string]bool, len(dirs))
+	for _, id := range dirs {
+		hasDir[id] = true
+	}
+
+	for _, sb := range records {
+		id := sb.ID.Hex()
+		if model.IsTransientStatus(sb.Status) {
+			// Owned by the request driving it, unless that request died with the server.
+			// A delete never takes a reconcile interval, so one seen that long is finished too.
+			if run.report.Startup || sb.Status == model.SandboxStatusDeleting {
+				run.finishTransition(ctx, sb, procs[id])
+			}
+			continue
+		}
+		run.checkRecord(ctx, sb, hasDir[id], procs[id])
+	}
+
+	for _, id := range dirs {
+		if _, ok := byID[id]; ok {
+			continue
+		}
+		if _, err := util.ParseObjectID(id); err != nil {
+			// Not a sandbox directory; leave it to the operator
+			continue
+		}
+		pid := procs[id]
+		run.act(model.ReconcileFinding{Kind: model.ReconcileOrphanDir, SandboxID: id, Resource: machine.GetInstanceDir(id), Action: "removed"}, func() error {
+			if pid > 0 {
+				if err := machine.KillProcess(id, pid); err != nil {
+					return err
+				}
+			}
+			return run.r.sandboxes.destroy(id)
+		})
+	}
+
+	for id, pid := range procs {
+		if _, ok := byID[id]; ok || hasDir[id] {
+			continue
+		}
+		run.act(model.ReconcileFinding{Kind: model.ReconcileOrphanProcess, SandboxID: id, Resource: fmt.Sprintf("pid %d", pid), Action: "killed"}, func() error {
+			return machine.KillProcess(id, pid)
+		})
+	}
+
+	// Leases are listed after the records, so a lease whose record was inserted since
+	// is only suspected by this run and found settled by a later one
+	leases, err := run.r.sandboxes.network.AllLeases(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list network leases: %w", err)
+	}
+	for _, lease := range leases {
+		if _, ok := byID[lease.SandboxID.Hex()]; ok {
+			continue
+		}
+		sandboxID := lease.SandboxID
+		resource := lease.IP
+		if resource == "" {
+			resource = fmt.Sprintf("cid %d", lease.CID)
+		}
+		run.act(model.ReconcileFinding{Kind: model.ReconcileOrphanLease, SandboxID: sandboxID.Hex(), Resource: resource, Action: "released"}, func() error {
+			run.r.sandboxes.network.Release(ctx, sandboxID)
+			return nil
+		})
+	}
+
+	if err := run.reconcileSnapshots(ctx); err != nil {
+		return err
+	}
+
+	// TAPs are listed again because the repairs above delete the TAPs of what they remove
+	taps, err = network.ListTaps(run.r.cfg.Network.TapPrefix)
+	if err != nil {
+		return err
+	}
+	owned := make(map[string]bool)
+	if ids, err := machine.ListInstanceIDs(); err == nil {
+		for _, id := range ids {
+			if tap := machine.InstanceTap(id); tap != "" {
+				owned[tap] = true
+			}
+		}
+	}
+	for _, tap := range taps {
+		if owned[tap] {
+			continue
+		}
+		tap := tap
+		run.act(model.ReconcileFinding{Kind: model.ReconcileOrphanTap, Resource: tap, Action: "deleted"}, func() error {
+			return machine.DeleteTap(tap)
+		})
+	}
+	return nil
+}
+
+// reconcileSnapshots fails captures and finishes deletes that a crash interrupted, and
+// collects fork captures that no sandbox is backed by any more
+func (run *reconcileRun) reconcileSnapshots(ctx context.Context) error {
+	snapshots := run.r.sandboxes.snapshots
+	filter := bson.M{"$or": []bson.M{
+		{"status": bson.M{"$in": []string{model.SnapshotStatusCreating, model.SnapshotStatusDeleting}}},
+		{
+			"ephemeral": true,
+			"status":    bson.M{"$in": []string{model.SnapshotStatusReady, model.SnapshotStatusFailed}},
+			"refCount":  bson.M{"$not": bson.M{"$gt": 0}},
+		},
+	}}
+	records, err := snapshots.Find(ctx, filter, options.FindOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	for _, snap := range records {
+		snap := snap
+		finding := model.ReconcileFinding{Kind: model.ReconcileStuckSnapshot, SandboxID: snap.SandboxID.Hex(), Resource: "snapshot " + snap.ID.Hex()}
+		switch snap.Status {
+		case model.SnapshotStatusCreating:
+			finding.Action = "marked-failed"
+			run.act(finding, func() error {
+				return snapshots.MarkFailed(ctx, snap.ID)
+			})
+		case model.SnapshotStatusDeleting:
+			finding.Action = "deleted"
+			run.act(finding, func() error {
+				if err := machine.DeleteSnapshot(snap.Path); err != nil {
+					return err
+				}
+				return snapshots.Delete(ctx, snap.ID)
+			})
+		default:
+			finding.Kind = model.ReconcileOrphanSnapshot
+			finding.Action = "collected"
+			run.act(finding, func() error {
+				run.r.sandboxes.collectSnapshot(snap)
+				return nil
+			})
+		}
+	}
+	return nil
+}
+
+// checkRecord compares a settled sandbox record with its instance directory and process
+func (run *reconcileRun) checkRecord(ctx context.Context, sb *model.Sandbox, hasDir bool, procPID int) {
+	id := sb.ID.Hex()
+
+	if !hasDir {
+		// Nothing to boot from any more; the record can only mislead
+		run.act(model.ReconcileFinding{Kind: model.ReconcileMissingDir, SandboxID: id, Resource: machine.GetInstanceDir(id), Action: "deleted-record"}, func() error {
+			if procPID > 0 {
+				if err := machine.KillProcess(id, procPID); err != nil {
+					return err
+				}
+			}
+			run.unregister(id)
+			return run.r.sandboxes.deleteRecord(ctx, sb)
+		})
+		return
+	}
+
+	switch sb.Status {
+	case model.SandboxStatusRunning, model.SandboxStatusPaused:
+		if run.vmAlive(ctx, id, procPID) {
+			return
+		}
+		run.act(model.ReconcileFinding{Kind: model.ReconcileStalePID, SandboxID: id, Resource: machine.GetPIDPath(id), Action: "marked-stopped"}, func() error {
+			if err := run.r.repo.TransitionStatus(ctx, sb.ID, []string{sb.Status}, model.SandboxStatusStopped); err != nil {
+				return err
+			}
+			// The VM died unnoticed, e.g. with a host reboot; its restart policy applies
+			run.r.sandboxes.recoverCrashed(ctx, id)
+			return nil
+		})
+	case model.SandboxStatusStopped, model.SandboxStatusHibernated:
+		if procPID == 0 {
+			return
+		}
+		run.act(model.ReconcileFinding{Kind: model.ReconcileOrphanProcess, SandboxID: id, Resource: fmt.Sprintf("pid %d", procPID), Action: "killed"}, func() error {
+			if err := machine.KillProcess(id, procPID); err != nil {
+				return err
+			}
+			return run.r.sandboxes.hv.Kill(id)
+		})
+	}
+}
+
+// finishTransition settles a sandbox that a crashed server left mid-operation
+func (run *reconcileRun) finishTransition(ctx context.Context, sb *model.Sandbox, procPID int) {
+	id := sb.ID.Hex()
+	finding := model.ReconcileFinding{Kind: model.ReconcileStuckTransition, SandboxID: id, Resource: sb.Status}
+
+	settle := func(to string) func() error {
+		return func() error {
+			if err := run.r.sandboxes.hv.Kill(id); err != nil {
+				return err
+			}
+			return run.r.repo.TransitionStatus(ctx, sb.ID, []string{sb.Status}, to)
+		}
+	}
+
+	switch sb.Status {
+	case model.SandboxStatusCreating, model.SandboxStatusDeleting:
+		// A half-built or half-deleted sandbox is removed entirely
+		finding.Action = "deleted"
+		run.act(finding, func() error {
+			if procPID > 0 {
+				machine.KillProcess(id, procPID)
+			}
+			if err := run.r.sandboxes.destroy(id); err != nil {
+				return err
+			}
+			run.unregister(id)
+			return run.r.sandboxes.deleteRecord(ctx, sb)
+		})
+	case model.SandboxStatusStarting:
+		if machine.HasHibernation(id) {
+			finding.Action = "marked-hibernated"
+			run.act(finding, settle(model.SandboxStatusHibernated))
+		} else {
+			finding.Action = "marked-stopped"
+			run.act(finding, settle(model.SandboxStatusStopped))
+		}
+	case model.SandboxStatusStopping:
+		finding.Action = "marked-stopped"
+		run.act(finding, settle(model.SandboxStatusStopped))
+	case model.SandboxStatusHibernating:
+		if run.vmAlive(ctx, id, procPID) {
+			// The VM survived; hand it back running, its memory dump is incomplete
+			finding.Action = "resumed"
+			run.act(finding, func() error {
+				run.r.sandboxes.hv.Resume(id)
+				machine.DiscardHibernation(id)
+				return run.r.repo.TransitionStatus(ctx, sb.ID, []string{sb.Status}, model.SandboxStatusRunning)
+			})
+		} else if machine.HasHibernation(id) {
+			finding.Action = "marked-hibernated"
+			run.act(finding, settle(model.SandboxStatusHibernated))
+		} else {
+			finding.Action = "marked-stopped"
+			run.act(finding, settle(model.SandboxStatusStopped))
+		}
+	}
+}
+
+// vmAlive reports whether a sandbox still has a VM. Drivers without a VMM process,
+// such as the fake one, are asked directly.
+func (run *reconcileRun) vmAlive(ctx context.Context, id string, procPID int) bool {
+	if _, alive := machine.InstancePID(id); alive || procPID > 0 {
+		return true
+	}
+	_, err := run.r.sandboxes.hv.State(ctx, id)
+	return err == nil
+}
+
+func (run *reconcileRun) unregister(id string) {
+	if run.r.metrics != nil {
+		run.r.metrics.UnregisterSandbox(id)
+	}
+}
@@ -0,0 +1,45 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+)
+
+// Runs on demand can follow each other within seconds; a mismatch must still persist for a
+// whole interval before it is acted on, or in-flight operations would be taken for leftovers
+func TestReconcilerActsOnlyOnMismatchesSeenForAnInterval(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Reconciler.IntervalSec = 60
+	r := NewReconcilerService(cfg, nil, nil, nil)
+	start := time.Now()
+
+	fixes := 0
+	runAt := func(at time.Time, startup bool) string {
+		run := &reconcileRun{r: r, report: &model.ReconcileReport{StartedAt: at, Startup: startup}, suspects: make(map[string]time.Time)}
+		run.act(model.ReconcileFinding{Kind: model.ReconcileOrphanLease, SandboxID: "a", Action: "released"}, func() error {
+			fixes++
+			return nil
+		})
+		r.suspects = run.suspects
+		return run.report.Findings[0].Action
+	}
+
+	if got := runAt(start, false); got != "deferred" {
+		t.Fatalf("first sighting = %s, want deferred", got)
+	}
+	if got := runAt(start.Add(time.Second), false); got != "deferred" || fixes != 0 {
+		t.Fatalf("sighting a second later = %s after %d fixes, want deferred", got, fixes)
+	}
+	if got := runAt(start.Add(time.Minute), false); got != "released" || fixes != 1 {
+		t.Fatalf("sighting an interval later = %s after %d fixes, want released", got, fixes)
+	}
+
+	// The first run after a restart owns nothing in flight and acts at once
+	r.suspects = make(map[string]time.Time)
+	if got := runAt(start, true); got != "released" || fixes != 2 {
+		t.Fatalf("startup sighting = %s after %d fixes, want released", got, fixes)
+	}
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/pkg/machine"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// maxRestartBackoff caps the delay between automatic restarts
+const maxRestartBackoff = 5 * time.Minute
+
+// restartBackoff returns the delay before automatic restart number attempt+1
+func (s *SandboxService) restartBackoff(attempt int) time.Duration {
+	base := time.Duration(s.cfg.Sandbox.RestartBackoffSec) * time.Second
+	if base <= 0 {
+		base = 2 * time.Second
+	}
+	delay := base
+	for i := 0; i < attempt && delay < maxRestartBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRestartBackoff)
+}
+
+// maxRestartsFor returns how many automatic restarts a sandbox gets before it is left stopped
+func (s *SandboxService) maxRestartsFor(sandbox *model.Sandbox) int {
+	if sandbox.MaxRestarts != nil {
+		return *sandbox.MaxRestarts
+	}
+	return s.cfg.Sandbox.MaxRestarts
+}
+
+// resetStableRestarts gives a sandbox that stayed up for the stable period since its last
+// automatic restart a fresh budget of restarts, so crashes far apart never exhaust it
+func (s *SandboxService) resetStableRestarts(ctx context.Context, sandbox *model.Sandbox) {
+	stable := time.Duration(s.cfg.Sandbox.RestartStableSec) * time.Second
+	if sandbox.RestartCount == 0 || sandbox.LastRestartAt == nil || stable <= 0 || time.Since(*sandbox.LastRestartAt) < stable {
+		return
+	}
+	if err := s.repo.UpdateFields(ctx, sandbox.ID, bson.M{"restartCount": 0}); err != nil {
+		fmt.Printf("[restart] failed to reset restarts of %s: %v\n", sandbox.ID.Hex(), err)
+		return
+	}
+	sandbox.RestartCount = 0
+}
+
+// shouldRestart applies the restart policy of a sandbox to the way its VM exited
+func shouldRestart(policy string, clean bool) bool {
+	switch policy {
+	case model.RestartPolicyAlways:
+		return true
+	case model.RestartPolicyOnFailure:
+		return !clean
+	}
+	return false
+}
+
+// recoverCrashed handles a sandbox whose VM died without being stopped through the API.
+// The record must already be stopped. The exit reason is stored and, when the restart
+// policy asks for it, the sandbox is cold-booted again from its overlay with backoff.
+func (s *SandboxService) recoverCrashed(ctx context.Context, id string) {
+	reason, clean := machine.ExitReason(id)
+	// Release the TAP and stale sockets of the dead VM
+	if err := s.hv.Kill(id); err != nil {
+		fmt.Printf("[restart] cleanup of %s failed: %v\n", id, err)
+	}
+	s.egress.Remove(id)
+	if s.metrics != nil {
+		s.metrics.UnregisterSandbox(id)
+	}
+
+	sandbox, found := s.Get(ctx, id)
+	if !found {
+		return
+	}
+	now := time.Now()
+	if err := s.repo.UpdateFields(ctx, sandbox.ID, bson.M{"lastExitReason": reason, "lastExitAt": now}); err != nil {
+		fmt.Printf("[restart] failed to record exit of %s: %v\n", id, err)
+	}
+	fmt.Printf("[restart] Sandbox %s died: %s\n", id, reason)
+	eventType := model.EventSandboxCrashed
+	if clean {
+		eventType = model.EventSandboxStopped
+	}
+	s.publish(ctx, eventType, sandbox, map[string]interface{}{"reason": reason})
+
+	// A crash after a long enough run starts over with a fresh budget
+	s.resetStableRestarts(ctx, sandbox)
+	if !shouldRestart(sandbox.RestartPolicy, clean) {
+		return
+	}
+	go s.restartLoop(id)
+}
+
+// restartLoop cold-boots a crashed sandbox until it runs, it is moved by someone else,
+// or it runs out of restarts
+func (s *SandboxService) restartLoop(id string) {
+	ctx := context.Background()
+	for {
+		sandbox, found := s.Get(ctx, id)
+		if !found || sandbox.Status != model.SandboxStatusStopped {
+			return
+		}
+		if max := s.maxRestartsFor(sandbox); sandbox.RestartCount >= max {
+			fmt.Printf("[restart] Sandbox %s reached its restart limit (%d), leaving it stopped\n", id, max)
+			return
+		}
+
+		delay := s.restartBackoff(sandbox.RestartCount)
+		fmt.Printf("[restart] Restarting %s in %s (attempt %d)\n", id, delay, sandbox.RestartCount+1)
+		time.Sleep(delay)
+
+		if err := s.repo.UpdateFields(ctx, sandbox.ID, bson.M{"restartCount": sandbox.RestartCount + 1, "lastRestartAt": time.Now()}); err != nil {
+			fmt.Printf("[restart] failed to count restart of %s: %v\n", id, err)
+			return
+		}
+		err := s.start(ctx, id)
+		if err == nil {
+			fmt.Printf("[restart] Sandbox %s restarted\n", id)
+			return
+		}
+		if errors.Is(err, model.ErrInvalidTransition) {
+			// Started, deleted or otherwise moved while we waited
+			return
+		}
+		s.repo.UpdateFields(ctx, sandbox.ID, bson.M{"lastExitReason": "restart failed: " + err.Error(), "lastExitAt": time.Now()})
+	}
+}
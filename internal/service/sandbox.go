@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -33,17 +34,36 @@ import (
 type SandboxService struct {
 	repo      repository.ISandboxRepository
 	imageRepo repository.IImageRepository
+	orgRepo   repository.IOrgRepository
+	snapshots repository.ISnapshotRepository
+	network   *NetworkService
+	egress    *EgressService
+	hv        machine.Hypervisor
 	cfg       *config.Config
 	metrics   *metrics.Manager
+	pool      *warmPool
+	activity  *activityTracker
+	events    *EventService
 }
 
+// asyncReadyTimeout bounds how long a sandbox created without sync is watched for its agent
+const asyncReadyTimeout = 2 * time.Minute
+
 // NewSandboxService creates a new sandbox service
-func NewSandboxService(cfg *config.Config, repo repository.ISandboxRepository, imageRepo repository.IImageRepository, metricsManager *metrics.Manager) *SandboxService {
+func NewSandboxService(cfg *config.Config, repo repository.ISandboxRepository, imageRepo repository.IImageRepository, orgRepo repository.IOrgRepository, snapshotRepo repository.ISnapshotRepository, network *NetworkService, egress *EgressService, hv machine.Hypervisor, events *EventService, metricsManager *metrics.Manager) *SandboxService {
 	return &SandboxService{
 		repo:      repo,
 		imageRepo: imageRepo,
+		orgRepo:   orgRepo,
+		snapshots: snapshotRepo,
+		network:   network,
+		egress:    egress,
+		hv:        hv,
+		events:    events,
 		cfg:       cfg,
 		metrics:   metricsManager,
+		pool:      newWarmPool(cfg.WarmPool.Classes),
+		activity:  newActivityTracker(),
 	}
 }
 
@@ -138,20 +158,25 @@ func (s *SandboxService) Get(ctx context.Context, id string) (*model.Sandbox, bo
 	return sandbox, true
 }
 
+// GetForOrg returns the sandbox only when it is owned by the given org.
+// Lookups across tenants behave exactly like a missing sandbox.
+func (s *SandboxService) GetForOrg(ctx context.Context, id, orgIDHex string) (*model.Sandbox, bool) {
+	orgID, err := util.ParseObjectID(orgIDHex)
+	if err != nil {
+		return nil, false
+	}
+	sandbox, err := s.repo.FindByIDAndOrg(ctx, id, orgID)
+	if err != nil || sandbox == nil {
+		return nil, false
+	}
+	return sandbox, true
+}
+
 func (s *SandboxService) Exists(ctx context.Context, id string) bool {
 	return s.repo.Exists(ctx, id)
 }
 
 func (s *SandboxService) Create(ctx context.Context, req model.CreateSandboxRequest) (*model.Sandbox, error) {
-	ip, err := s.repo.NextAvailableIP()
-	if err != nil {
-		return nil, fmt.Errorf("IP allocation failed: %w", err)
-	}
-
-	// Generate ObjectID for filesystem-safe directory name
-	objID := util.GenerateObjectID()
-	instanceID := objID.Hex()
-
 	// Apply defaults
 	cpu := req.CPU
 	if cpu == 0 {
@@ -166,214 +191,793 @@ func (s *SandboxService) Create(ctx context.Context, req model.CreateSandboxRequ
 		req.TemplateID = s.cfg.Sandbox.DefaultImage
 	}
 
-	spec := model.SandboxSpec{
-		ID:        instanceID,
-		Type:      req.TemplateID,
-		CPUs:      cpu,
-		MemoryMB:  mem,
-		DiskMB:    diskMB,
-		IPAddress: ip,
+	network := req.Network
+	if network == "" {
+		network = model.NetworkModeBridge
+	}
+	policy, err := networkPolicyFor(network, req.NetworkPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	orID, _ := util.ParseObjectID(req.OrgID)
+	var createdBy primitive.ObjectID
+	if req.UserID != "" {
+		createdBy, _ = util.ParseObjectID(req.UserID)
+	}
+	sandbox := &model.Sandbox{
+		ID:            util.GenerateObjectID(),
+		Name:          req.Name,
+		ImageId:       req.TemplateID,
+		CPU:           cpu,
+		Mem:           mem,
+		DiskMB:        diskMB,
+		OrgID:         orID,
+		CreatedBy:     createdBy,
+		EnvVars:       req.EnvVars, // Store env vars in the sandbox record
+		Network:       network,
+		NetworkPolicy: policy,
+	}
+	if req.RestartPolicy != "" && req.RestartPolicy != model.RestartPolicyNever {
+		sandbox.RestartPolicy = req.RestartPolicy
+	}
+	sandbox.MaxRestarts = req.MaxRestarts
+	if err := s.applyLifetime(ctx, sandbox, req.TimeoutSec, req.IdleTimeoutSec); err != nil {
+		return nil, err
+	}
+	if err := s.applyIOLimits(ctx, sandbox, req.IOLimits); err != nil {
+		return nil, err
+	}
+
+	// Serve from a pre-booted VM when the pool holds one of this shape
+	if claimed := s.claimWarm(ctx, sandbox); claimed != nil {
+		s.publish(ctx, model.EventSandboxCreated, claimed, nil)
+		s.publish(ctx, model.EventSandboxReady, claimed, nil)
+		return claimed, nil
+	}
+
+	syncEnabled := true
+	if req.Sync != nil {
+		syncEnabled = *req.Sync
+	}
+	if err := s.provision(ctx, sandbox, syncEnabled, model.SandboxStatusRunning); err != nil {
+		return nil, err
+	}
+	s.publishCreated(ctx, sandbox, syncEnabled)
+
+	if s.metrics != nil {
+		s.metrics.RegisterSandbox(sandbox.ID.Hex(), sandbox.Name, machine.GetSocketPath(sandbox.ID.Hex()), cpu, mem, diskMB)
+	}
+
+	return sandbox, nil
+}
+
+// provision leases an IP, MAC and CID, records the sandbox as creating so the lifecycle is
+// visible while it boots, prepares its overlay and boots it. On success the record has moved
+// to the final status; on failure the VM, instance dir, record and lease are rolled back.
+func (s *SandboxService) provision(ctx context.Context, sandbox *model.Sandbox, waitReady bool, final string) error {
+	lease, err := s.leaseFor(ctx, sandbox)
+	if err != nil {
+		return fmt.Errorf("IP allocation failed: %w", err)
+	}
+	sandbox.IP, sandbox.MAC, sandbox.CID = lease.IP, lease.MAC, lease.CID
+	sandbox.Status = model.SandboxStatusCreating
+	sandbox.CreatedAt = time.Now()
+	sandbox.MaxCPU = max(s.cfg.Sandbox.MaxVCPUs, sandbox.CPU)
+	sandbox.MaxMem = sandbox.Mem + max(s.cfg.Sandbox.HotplugMemoryMB, 0)
+	spec := s.specFor(sandbox)
+
+	if err := s.repo.Create(ctx, sandbox); err != nil {
+		s.network.Release(context.Background(), sandbox.ID)
+		return fmt.Errorf("DB save failed: %w", err)
+	}
+	discardRecord := func() {
+		if err := s.deleteRecord(context.Background(), sandbox); err != nil {
+			fmt.Printf("   [!] Rollback: failed to delete record %s: %v\n", spec.ID, err)
+		}
+	}
+	// The policy is in place before the guest can send anything
+	if err := s.egress.Apply(sandbox); err != nil {
+		discardRecord()
+		return err
 	}
 
 	// Prepare storage (pass config by value, not pointer)
 	overlay, err := storage.PrepareInstance(ctx, *s.cfg, spec)
 	if err != nil {
-		return nil, fmt.Errorf("storage init failed: %w", err)
+		discardRecord()
+		return fmt.Errorf("storage init failed: %w", err)
 	}
 
 	// Rollback function for cleanup on failure
 	cleanup := func() {
 		fmt.Printf("   [!] Rollback: Deleting failed instance %s\n", spec.ID)
 		os.RemoveAll(filepath.Dir(overlay))
+		discardRecord()
 	}
 
 	bootStart := time.Now()
-	if err := machine.Start(*s.cfg, spec, overlay, ""); err != nil {
+	if err := s.hv.Create(*s.cfg, spec, overlay); err != nil {
 		fmt.Printf("❌ CRITICAL BOOT ERROR: %v\n", err)
 		cleanup()
-		return nil, fmt.Errorf("boot failed: %w", err)
+		return fmt.Errorf("boot failed: %w", err)
 	}
 	fmt.Printf("[boot] Sandbox %s booted in %s\n", spec.ID, time.Since(bootStart))
 
-	syncEnabled := true
-	if req.Sync != nil {
-		syncEnabled = *req.Sync
-	}
-	if syncEnabled {
+	if waitReady {
 		timeout := time.Duration(s.cfg.Sandbox.SyncTimeoutSec) * time.Second
 		readyStart := time.Now()
 		if err := waitForAgent(spec.ID, timeout); err != nil {
-			machine.Stop(spec.ID)
+			s.hv.Kill(spec.ID)
+			// The instance dir goes with the rollback, so keep what the guest printed
+			if tail, _ := machine.ReadConsoleLog(spec.ID, 2048); len(tail) > 0 {
+				fmt.Printf("[agent] Console of %s before giving up:\n%s\n", spec.ID, tail)
+				err = fmt.Errorf("%w; console tail:\n%s", err, tail)
+			}
 			cleanup()
-			return nil, fmt.Errorf("agent not ready: %w", err)
+			return fmt.Errorf("agent not ready: %w", err)
 		}
 		fmt.Printf("[agent] Sandbox %s ready in %s\n", spec.ID, time.Since(readyStart))
 	}
 
-	// Save to DB as pointer with OrgID and CreatedBy
-	orID, _ := util.ParseObjectID(req.OrgID)
-
 	// Set environment variables on the agent if provided
-	if len(req.EnvVars) > 0 {
-		if err := setAgentEnvVars(spec.ID, req.EnvVars); err != nil {
+	if len(sandbox.EnvVars) > 0 {
+		if err := setAgentEnvVars(spec.ID, sandbox.EnvVars); err != nil {
 			fmt.Printf("[WARN] Failed to set env vars on agent: %v\n", err)
 			// Don't fail the creation, just log the warning
 		}
 	}
 
+	if err := s.repo.TransitionStatus(ctx, sandbox.ID, []string{model.SandboxStatusCreating}, final); err != nil {
+		s.hv.Kill(spec.ID)
+		cleanup()
+		return fmt.Errorf("DB save failed: %w", err)
+	}
+	sandbox.Status = final
+	return nil
+}
+
+// Restore creates a new sandbox from a registered snapshot. The VM shape (CPU, memory,
+// disk, image) is taken from the snapshot record; the sandbox gets a fresh IP and MAC.
+// The sandbox's overlay is backed by the snapshot's disk, so it holds a reference on the
+// snapshot until it is deleted.
+func (s *SandboxService) Restore(ctx context.Context, snapshot *model.Snapshot, req model.RestoreSandboxRequest) (*model.Sandbox, error) {
+	// Generate ObjectID for filesystem-safe directory name
+	objID := util.GenerateObjectID()
+	instanceID := objID.Hex()
+
+	// The guest in the snapshot was set up for its network mode, so the sandbox keeps it
+	network := snapshot.Network
+	if network == "" {
+		network = model.NetworkModeBridge
+	}
+	policy, err := networkPolicyFor(network, req.NetworkPolicy)
+	if err != nil {
+		return nil, err
+	}
+	orID, _ := util.ParseObjectID(req.OrgID)
+	var createdBy primitive.ObjectID
+	if req.UserID != "" {
+		createdBy, _ = util.ParseObjectID(req.UserID)
+	}
 	sandbox := &model.Sandbox{
-		ID:        objID,
-		Name:      req.Name,
-		ImageId:   req.TemplateID,
-		IP:        ip,
-		CPU:       cpu,
-		Mem:       mem,
-		DiskMB:    diskMB,
-		OrgID:     orID,
-		EnvVars:   req.EnvVars, // Store env vars in the sandbox record
-		Status:    "running",
-		CreatedAt: time.Now(),
-	}
-	err = s.repo.Create(ctx, sandbox)
+		ID:            objID,
+		Name:          req.Name,
+		ImageId:       snapshot.ImageId,
+		CPU:           snapshot.CPU,
+		Mem:           snapshot.Mem,
+		MaxCPU:        snapshot.MaxCPU,
+		MaxMem:        snapshot.MaxMem,
+		DiskMB:        snapshot.DiskMB,
+		OrgID:         orID,
+		CreatedBy:     createdBy,
+		EnvVars:       snapshot.EnvVars,
+		Status:        model.SandboxStatusCreating,
+		CreatedAt:     time.Now(),
+		Network:       network,
+		NetworkPolicy: policy,
+	}
+	if err := s.applyLifetime(ctx, sandbox, nil, nil); err != nil {
+		return nil, err
+	}
+	if err := s.applyIOLimits(ctx, sandbox, req.IOLimits); err != nil {
+		return nil, err
+	}
+	lease, err := s.leaseFor(ctx, sandbox)
 	if err != nil {
-		machine.Stop(spec.ID)
+		return nil, fmt.Errorf("IP allocation failed: %w", err)
+	}
+	sandbox.IP, sandbox.MAC, sandbox.CID = lease.IP, lease.MAC, lease.CID
+	if err := s.snapshots.AddRef(ctx, snapshot.ID); err != nil {
+		s.network.Release(context.Background(), objID)
+		return nil, err
+	}
+	sandbox.BaseSnapshotID = &snapshot.ID
+	if err := s.repo.Create(ctx, sandbox); err != nil {
+		s.network.Release(context.Background(), objID)
+		s.releaseSnapshot(snapshot.ID)
+		return nil, fmt.Errorf("failed to save restored sandbox: %w", err)
+	}
+	discardRecord := func() {
+		if err := s.deleteRecord(context.Background(), sandbox); err != nil {
+			fmt.Printf("   [!] Rollback: failed to delete record %s: %v\n", instanceID, err)
+		}
+	}
+
+	if err := s.egress.Apply(sandbox); err != nil {
+		discardRecord()
+		return nil, err
+	}
+
+	spec := s.specFor(sandbox)
+	if err := s.hv.Restore(*s.cfg, spec, snapshot.Path, req.Cold); err != nil {
+		discardRecord()
+		return nil, fmt.Errorf("restore failed: %w", err)
+	}
+	cleanup := func() {
+		fmt.Printf("   [!] Rollback: Deleting failed instance %s\n", instanceID)
+		s.destroy(instanceID)
+		discardRecord()
+	}
+
+	// A live-restored guest still carries the source's address, so it must be reachable to be
+	// re-addressed. Reaching it also proves its agent accepts connections under the new CID.
+	syncEnabled := !req.Cold
+	if req.Sync != nil && *req.Sync {
+		syncEnabled = true
+	}
+	if syncEnabled {
+		timeout := time.Duration(s.cfg.Sandbox.SyncTimeoutSec) * time.Second
+		if err := waitForAgent(instanceID, timeout); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("agent not ready: %w", err)
+		}
+	}
+	if !req.Cold && !sandbox.Networkless() {
+		if err := s.reconfigureGuestNetwork(instanceID, sandbox.IP, sandbox.MAC); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("guest network reconfiguration failed: %w", err)
+		}
+	} else if len(sandbox.EnvVars) > 0 {
+		// Env vars only live in agent memory, which a cold boot discards
+		if err := setAgentEnvVars(instanceID, sandbox.EnvVars); err != nil {
+			fmt.Printf("[WARN] Failed to set env vars on agent: %v\n", err)
+		}
+	}
+
+	if err := s.repo.TransitionStatus(ctx, objID, []string{model.SandboxStatusCreating}, model.SandboxStatusRunning); err != nil {
 		cleanup()
 		return nil, fmt.Errorf("DB save failed: %w", err)
 	}
+	sandbox.Status = model.SandboxStatusRunning
 
 	if s.metrics != nil {
-		s.metrics.RegisterSandbox(spec.ID, sandbox.Name, machine.GetSocketPath(spec.ID), cpu, mem, diskMB)
+		s.metrics.RegisterSandbox(instanceID, sandbox.Name, machine.GetSocketPath(instanceID), spec.CPUs, spec.MemoryMB, spec.DiskMB)
 	}
+	s.publishCreated(ctx, sandbox, syncEnabled)
 
 	return sandbox, nil
 }
 
-func (s *SandboxService) Restore(ctx context.Context, req model.RestoreSandboxRequest) (string, error) {
-	// Auto-assign IP if not provided
-	ip := req.NewIP
-	if ip == "" {
-		var err error
-		ip, err = s.repo.NextAvailableIP()
-		if err != nil {
-			return "", fmt.Errorf("IP allocation failed: %w", err)
+// publishCreated announces a new sandbox. When the agent was not waited for, ready is
+// announced once it answers.
+func (s *SandboxService) publishCreated(ctx context.Context, sandbox *model.Sandbox, agentReady bool) {
+	s.publish(ctx, model.EventSandboxCreated, sandbox, nil)
+	if agentReady {
+		s.publish(ctx, model.EventSandboxReady, sandbox, nil)
+		return
+	}
+	if s.events == nil || sandbox.OrgID.IsZero() {
+		return
+	}
+	go func() {
+		if err := waitForAgent(sandbox.ID.Hex(), asyncReadyTimeout); err != nil {
+			fmt.Printf("[events] Sandbox %s never became ready: %v\n", sandbox.ID.Hex(), err)
+			return
 		}
-	}
+		s.publishByID(context.Background(), model.EventSandboxReady, sandbox.ID.Hex(), nil)
+	}()
+}
 
-	// Generate ObjectID for filesystem-safe directory name
-	objID := util.GenerateObjectID()
-	instanceID := objID.Hex()
+// MaxForkCount returns the largest number of children a single fork may create
+func (s *SandboxService) MaxForkCount() int {
+	return s.cfg.Sandbox.MaxForkCount
+}
 
-	// Apply defaults
-	cpu := req.CPU
-	if cpu == 0 {
-		cpu = 1
+// Fork live-clones a running or paused sandbox into count new sandboxes. The source is
+// paused only while its RAM and disk are captured; each child is restored from that capture
+// with its own IP, MAC and vsock CID, under the source's network policy. Children are
+// created all-or-nothing and owned by the calling user, or the source's creator when there
+// is none. The capture is kept as an ephemeral snapshot, backing the children's disks until
+// the last one is deleted.
+func (s *SandboxService) Fork(ctx context.Context, source *model.Sandbox, userIDHex string, count int) ([]*model.Sandbox, error) {
+	id := source.ID.Hex()
+	createdBy := source.CreatedBy
+	if userID, err := util.ParseObjectID(userIDHex); err == nil {
+		createdBy = userID
+	}
+
+	// Hold the source in paused so concurrent lifecycle calls see it as busy
+	pausedHere := false
+	switch source.Status {
+	case model.SandboxStatusRunning:
+		if err := s.Pause(ctx, id); err != nil {
+			return nil, err
+		}
+		pausedHere = true
+	case model.SandboxStatusPaused:
+	default:
+		return nil, model.ErrInvalidTransition
+	}
+
+	forkSnapshot := &model.Snapshot{
+		ID:        util.GenerateObjectID(),
+		Name:      source.Name + "-fork",
+		SandboxID: source.ID,
+		ImageId:   source.ImageId,
+		CPU:       source.CPU,
+		Mem:       source.Mem,
+		DiskMB:    s.specFor(source).DiskMB,
+		Status:    model.SnapshotStatusCreating,
+		EnvVars:   source.EnvVars,
+		Network:   source.Network,
+		OrgID:     source.OrgID,
+		CreatedBy: createdBy,
+		Ephemeral: true,
 	}
-	mem := req.Mem
-	if mem == 0 {
-		mem = 1024
+	forkSnapshot.Path = machine.GetSnapshotDir("fork-" + forkSnapshot.ID.Hex())
+	if err := s.snapshots.Create(ctx, forkSnapshot); err != nil {
+		s.resumeForked(id, pausedHere, time.Now())
+		return nil, fmt.Errorf("DB save failed: %w", err)
 	}
-	diskMB := s.cfg.Sandbox.DefaultDiskMB
 
-	// Perform restore
-	if err := machine.Restore(*s.cfg, instanceID, req.SnapshotPath, ip, req.Cold); err != nil {
-		return "", fmt.Errorf("restore failed: %w", err)
+	pauseStart := time.Now()
+	size, err := s.hv.Snapshot(id, forkSnapshot.Path)
+	s.resumeForked(id, pausedHere, pauseStart)
+	if err != nil {
+		s.snapshots.Delete(context.Background(), forkSnapshot.ID)
+		return nil, fmt.Errorf("snapshot failed: %w", err)
 	}
+	if err := s.snapshots.MarkReady(ctx, forkSnapshot.ID, size); err != nil {
+		machine.DeleteSnapshot(forkSnapshot.Path)
+		s.snapshots.Delete(context.Background(), forkSnapshot.ID)
+		return nil, fmt.Errorf("DB save failed: %w", err)
+	}
+	forkSnapshot.Status = model.SnapshotStatusReady
+	// Without surviving children nothing references the capture any more
+	defer s.collectSnapshot(forkSnapshot)
 
-	// Save to DB using Create with context
-	orID, _ := util.ParseObjectID(req.OrgID)
-	var createdBy primitive.ObjectID
-	if req.UserID != "" {
-		createdBy, _ = util.ParseObjectID(req.UserID)
+	children := make([]*model.Sandbox, count)
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			children[i], errs[i] = s.Restore(ctx, forkSnapshot, model.RestoreSandboxRequest{
+				Name:          fmt.Sprintf("%s-fork-%d", source.Name, i+1),
+				OrgID:         source.OrgID.Hex(),
+				UserID:        createdBy.Hex(),
+				NetworkPolicy: source.NetworkPolicy,
+				IOLimits:      source.IOLimits,
+			})
+		}(i)
 	}
-	sandbox := &model.Sandbox{
-		ID:        objID,
-		Name:      req.NewID, // Store the user-provided name
-		ImageId:   "snapshot",
-		IP:        ip,
-		CPU:       cpu,
-		Mem:       mem,
-		DiskMB:    diskMB,
-		OrgID:     orID,
-		CreatedBy: createdBy,
-		Status:    "running",
-		CreatedAt: time.Now(),
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		for _, child := range children {
+			if child != nil {
+				if derr := s.Delete(context.Background(), child.ID.Hex()); derr != nil {
+					fmt.Printf("[fork] rollback of child %s failed: %v\n", child.ID.Hex(), derr)
+				}
+			}
+		}
+		return nil, fmt.Errorf("fork failed: %w", err)
+	}
+
+	return children, nil
+}
+
+// resumeForked resumes a fork source that Fork paused itself
+func (s *SandboxService) resumeForked(id string, pausedHere bool, pauseStart time.Time) {
+	if !pausedHere {
+		return
+	}
+	if err := s.Resume(context.Background(), id); err != nil {
+		fmt.Printf("[fork] failed to resume source %s: %v\n", id, err)
+	}
+	fmt.Printf("[fork] Source %s paused for %s\n", id, time.Since(pauseStart))
+}
+
+// reconfigureGuestNetwork moves a live-restored guest onto the IP and MAC leased to
+// the new sandbox, replacing the addressing captured in the snapshot's RAM.
+func (s *SandboxService) reconfigureGuestNetwork(sbxID, ip, mac string) error {
+	prefix := 24
+	if _, ipNet, err := net.ParseCIDR(s.cfg.Network.NetworkCIDR); err == nil {
+		prefix, _ = ipNet.Mask.Size()
 	}
-	err := s.repo.Create(ctx, sandbox)
+	script := fmt.Sprintf(
+		"ip link set dev eth0 down && ip link set dev eth0 address %s && ip addr flush dev eth0 && "+
+			"ip addr add %s/%d dev eth0 && ip link set dev eth0 up && ip route replace default via %s",
+		mac, ip, prefix, s.cfg.Network.GetCleanGateway(),
+	)
+
+	body, err := json.Marshal(map[string]interface{}{"cmd": script, "timeout": 10})
 	if err != nil {
-		return "", fmt.Errorf("failed to save restored sandbox: %w", err)
+		return err
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
 
-	if s.metrics != nil {
-		s.metrics.RegisterSandbox(instanceID, sandbox.Name, machine.GetSocketPath(instanceID), cpu, mem, diskMB)
+	resp, err := ExecAgentCommand(ctx, nil, sbxID, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("agent returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
 	}
+	return nil
+}
 
-	return ip, nil
+// transition atomically moves a sandbox into the target state from any state allowed to reach it
+func (s *SandboxService) transition(ctx context.Context, id primitive.ObjectID, to string) error {
+	return s.repo.TransitionStatus(ctx, id, model.TransitionSources(to), to)
 }
 
+// Delete destroys the VM and instance directory of a sandbox and removes its record. When
+// the instance cannot be removed the sandbox returns to its previous state so the delete
+// can be retried.
 func (s *SandboxService) Delete(ctx context.Context, id string) error {
-	if err := machine.Delete(id); err != nil {
+	// Validate ObjectID before touching the VM
+	objID, err := util.ParseObjectID(id)
+	if err != nil {
+		return fmt.Errorf("invalid ID format: %w", err)
+	}
+	sandbox, found := s.Get(ctx, id)
+	if !found {
+		return fmt.Errorf("sandbox not found: %s", id)
+	}
+	previous := sandbox.Status
+	if !model.CanTransition(previous, model.SandboxStatusDeleting) {
+		return model.ErrInvalidTransition
+	}
+	if err := s.repo.TransitionStatus(ctx, objID, []string{previous}, model.SandboxStatusDeleting); err != nil {
+		return err
+	}
+
+	if err := s.destroy(id); err != nil {
+		if terr := s.repo.TransitionStatus(context.Background(), objID, []string{model.SandboxStatusDeleting}, previous); terr != nil {
+			fmt.Printf("[lifecycle] failed to return %s to %s: %v\n", id, previous, terr)
+		}
 		return fmt.Errorf("delete failed: %w", err)
 	}
 	if s.metrics != nil {
 		s.metrics.UnregisterSandbox(id)
 	}
+	s.forgetActivity(id)
 
-	// Delete from database using ObjectID
-	objID, err := util.ParseObjectID(id)
+	if err := s.deleteRecord(ctx, sandbox); err != nil {
+		return err
+	}
+	s.publish(ctx, model.EventSandboxDeleted, sandbox, nil)
+	return nil
+}
+
+// deleteRecord removes the record of a sandbox whose VM and instance directory are gone,
+// then lifts its network policy and releases its network lease and its reference on the
+// snapshot backing its disk
+func (s *SandboxService) deleteRecord(ctx context.Context, sandbox *model.Sandbox) error {
+	if err := s.repo.Delete(ctx, sandbox.ID); err != nil {
+		return err
+	}
+	s.egress.Remove(sandbox.ID.Hex())
+	s.network.Release(context.Background(), sandbox.ID)
+	if sandbox.BaseSnapshotID != nil {
+		s.releaseSnapshot(*sandbox.BaseSnapshotID)
+	}
+	return nil
+}
+
+func (s *SandboxService) releaseSnapshot(id primitive.ObjectID) {
+	snapshot, err := s.snapshots.Release(context.Background(), id)
 	if err != nil {
-		return fmt.Errorf("invalid ID format: %w", err)
+		fmt.Printf("[snapshot] failed to release %s: %v\n", id.Hex(), err)
+		return
+	}
+	if snapshot != nil && snapshot.Ephemeral && snapshot.RefCount <= 0 {
+		s.collectSnapshot(snapshot)
+	}
+}
+
+// collectSnapshot removes an ephemeral snapshot once no sandbox is backed by it any more
+func (s *SandboxService) collectSnapshot(snapshot *model.Snapshot) {
+	ctx := context.Background()
+	if err := s.snapshots.BeginDelete(ctx, snapshot.ID); err != nil {
+		// Still in use, or already being removed
+		return
+	}
+	if err := machine.DeleteSnapshot(snapshot.Path); err != nil {
+		fmt.Printf("[snapshot] failed to remove %s: %v\n", snapshot.ID.Hex(), err)
+		s.snapshots.CancelDelete(ctx, snapshot.ID, snapshot.Status)
+		return
+	}
+	if err := s.snapshots.Delete(ctx, snapshot.ID); err != nil {
+		fmt.Printf("[snapshot] failed to delete record %s: %v\n", snapshot.ID.Hex(), err)
 	}
-	return s.repo.Delete(ctx, objID)
 }
 
-func (s *SandboxService) Stop(id string) error {
-	if err := machine.Stop(id); err != nil {
+// destroy kills the VM of a sandbox and removes its instance directory. The disk is
+// discarded, so there is no point waiting for the guest to shut down.
+func (s *SandboxService) destroy(id string) error {
+	if err := s.hv.Kill(id); err != nil {
+		// Log the error but continue with directory deletion
+		fmt.Printf("Warning: Stop failed for %s: %v\n", id, err)
+	}
+	return machine.RemoveInstance(id)
+}
+
+// Stop shuts down the guest, escalating to signals if it does not power off in time, and
+// releases its TAP. The overlay is kept so the sandbox can be started again. When the VM
+// cannot be confirmed gone the sandbox returns to its previous state with its network
+// policy still installed, so the stop can be retried and a second VM is never booted on
+// the same overlay.
+func (s *SandboxService) Stop(ctx context.Context, id string) error {
+	objID, err := util.ParseObjectID(id)
+	if err != nil {
+		return fmt.Errorf("invalid ID format: %w", err)
+	}
+	sandbox, found := s.Get(ctx, id)
+	if !found {
+		return fmt.Errorf("sandbox not found: %s", id)
+	}
+	previous := sandbox.Status
+	if !model.CanTransition(previous, model.SandboxStatusStopping) {
+		return model.ErrInvalidTransition
+	}
+	if err := s.repo.TransitionStatus(ctx, objID, []string{previous}, model.SandboxStatusStopping); err != nil {
 		return err
 	}
+
+	stage, err := s.hv.Stop(id)
+	if err != nil {
+		fmt.Printf("[lifecycle] stop of %s failed: %v\n", id, err)
+		if terr := s.repo.TransitionStatus(context.Background(), objID, []string{model.SandboxStatusStopping}, previous); terr != nil {
+			fmt.Printf("[lifecycle] failed to return %s to %s: %v\n", id, previous, terr)
+		}
+		return fmt.Errorf("stop failed: %w", err)
+	}
+	fmt.Printf("[lifecycle] Sandbox %s stopped (%s)\n", id, stage)
+	s.egress.Remove(id)
+	// Stopping a hibernated sandbox drops its saved RAM; the next start is a cold boot
+	machine.DiscardHibernation(id)
 	if s.metrics != nil {
 		s.metrics.UnregisterSandbox(id)
 	}
+	if err := s.transition(ctx, objID, model.SandboxStatusStopped); err != nil {
+		return err
+	}
+	s.publishByID(ctx, model.EventSandboxStopped, id, map[string]interface{}{"stage": string(stage)})
 	return nil
 }
 
-func (s *SandboxService) Pause(id string) error {
-	return machine.Pause(id)
+// Start cold-boots a stopped sandbox from its existing overlay, or wakes a hibernated one.
+// A manual start gives the sandbox a fresh budget of automatic restarts.
+func (s *SandboxService) Start(ctx context.Context, id string) error {
+	if err := s.start(ctx, id); err != nil {
+		return err
+	}
+	if objID, err := util.ParseObjectID(id); err == nil {
+		s.repo.UpdateFields(ctx, objID, bson.M{"restartCount": 0})
+	}
+	return nil
 }
 
-func (s *SandboxService) Resume(id string) error {
-	return machine.Resume(id)
+func (s *SandboxService) start(ctx context.Context, id string) error {
+	sandbox, found := s.Get(ctx, id)
+	if !found {
+		return fmt.Errorf("sandbox not found: %s", id)
+	}
+	if sandbox.Status == model.SandboxStatusHibernated {
+		if err := s.repo.TransitionStatus(ctx, sandbox.ID, []string{model.SandboxStatusHibernated}, model.SandboxStatusStarting); err != nil {
+			return err
+		}
+		if err := s.wake(ctx, sandbox); err != nil {
+			return err
+		}
+		s.publish(ctx, model.EventSandboxReady, sandbox, nil)
+		return nil
+	}
+	if err := s.repo.TransitionStatus(ctx, sandbox.ID, []string{model.SandboxStatusStopped}, model.SandboxStatusStarting); err != nil {
+		return err
+	}
+
+	if err := s.egress.Apply(sandbox); err != nil {
+		s.transition(context.Background(), sandbox.ID, model.SandboxStatusStopped)
+		return err
+	}
+	spec := s.specFor(sandbox)
+	if err := s.hv.Boot(*s.cfg, spec); err != nil {
+		s.egress.Remove(id)
+		s.transition(context.Background(), sandbox.ID, model.SandboxStatusStopped)
+		return fmt.Errorf("boot failed: %w", err)
+	}
+
+	timeout := time.Duration(s.cfg.Sandbox.SyncTimeoutSec) * time.Second
+	if err := waitForAgent(id, timeout); err != nil {
+		s.hv.Kill(id)
+		s.egress.Remove(id)
+		s.transition(context.Background(), sandbox.ID, model.SandboxStatusStopped)
+		return fmt.Errorf("agent not ready: %w", err)
+	}
+	if len(sandbox.EnvVars) > 0 {
+		if err := setAgentEnvVars(id, sandbox.EnvVars); err != nil {
+			fmt.Printf("[WARN] Failed to set env vars on agent: %v\n", err)
+		}
+	}
+
+	if err := s.transition(ctx, sandbox.ID, model.SandboxStatusRunning); err != nil {
+		return err
+	}
+	s.touchStarted(ctx, sandbox.ID)
+	if s.metrics != nil {
+		s.metrics.RegisterSandbox(id, sandbox.Name, machine.GetSocketPath(id), spec.CPUs, spec.MemoryMB, spec.DiskMB)
+	}
+	s.publish(ctx, model.EventSandboxReady, sandbox, nil)
+	return nil
 }
 
-func (s *SandboxService) Info(id string) (string, error) {
-	return machine.Info(id)
+func (s *SandboxService) Pause(ctx context.Context, id string) error {
+	objID, err := util.ParseObjectID(id)
+	if err != nil {
+		return fmt.Errorf("invalid ID format: %w", err)
+	}
+	if err := s.repo.TransitionStatus(ctx, objID, []string{model.SandboxStatusRunning}, model.SandboxStatusPaused); err != nil {
+		return err
+	}
+	if err := s.hv.Pause(id); err != nil {
+		s.repo.TransitionStatus(context.Background(), objID, []string{model.SandboxStatusPaused}, model.SandboxStatusRunning)
+		return err
+	}
+	s.publishByID(ctx, model.EventSandboxPaused, id, nil)
+	return nil
 }
 
-func (s *SandboxService) CreateSnapshot(id string) error {
-	return machine.CreateSnapshot(id)
+func (s *SandboxService) Resume(ctx context.Context, id string) error {
+	objID, err := util.ParseObjectID(id)
+	if err != nil {
+		return fmt.Errorf("invalid ID format: %w", err)
+	}
+	if err := s.repo.TransitionStatus(ctx, objID, []string{model.SandboxStatusPaused}, model.SandboxStatusRunning); err != nil {
+		return err
+	}
+	if err := s.hv.Resume(id); err != nil {
+		s.repo.TransitionStatus(context.Background(), objID, []string{model.SandboxStatusRunning}, model.SandboxStatusPaused)
+		return err
+	}
+	return nil
 }
 
-func (s *SandboxService) ListSnapshots(id string) ([]model.Snapshot, error) {
-	basePath := filepath.Join(s.cfg.Paths.InstancesDir, id, "snapshots")
+// Resize hotplugs vCPUs and memory into a running sandbox within the limits it was booted
+// with. Memory is added through ACPI hotplug, which the guest cannot give back, so it
+// can only grow until the next cold boot.
+func (s *SandboxService) Resize(ctx context.Context, sandbox *model.Sandbox, req model.ResizeSandboxRequest) (*model.Sandbox, error) {
+	if sandbox.Status != model.SandboxStatusRunning {
+		return nil, model.ErrInvalidTransition
+	}
+
+	cpu, mem := sandbox.CPU, sandbox.Mem
+	if req.CPU != nil {
+		cpu = *req.CPU
+	}
+	if req.Mem != nil {
+		mem = *req.Mem
+	}
+	maxCPU := max(sandbox.MaxCPU, sandbox.CPU)
+	maxMem := max(sandbox.MaxMem, sandbox.Mem)
+	if cpu < 1 || cpu > maxCPU {
+		return nil, fmt.Errorf("%w: cpu must be between 1 and %d", model.ErrResizeOutOfBounds, maxCPU)
+	}
+	if mem < sandbox.Mem || mem > maxMem {
+		return nil, fmt.Errorf("%w: mem must be between %d and %d", model.ErrResizeOutOfBounds, sandbox.Mem, maxMem)
+	}
+	if cpu == sandbox.CPU && mem == sandbox.Mem {
+		return sandbox, nil
+	}
+
+	id := sandbox.ID.Hex()
+	desiredMem := 0
+	if mem != sandbox.Mem {
+		desiredMem = mem
+	}
+	if err := s.hv.Resize(id, cpu, desiredMem); err != nil {
+		return nil, fmt.Errorf("resize failed: %w", err)
+	}
+	// Recorded only while the sandbox is still running; a resize that raced a pause or
+	// stop fails instead of writing over the record
+	if err := s.repo.UpdateFieldsIf(ctx, sandbox.ID, []string{model.SandboxStatusRunning}, bson.M{"cpu": cpu, "mem": mem}); err != nil {
+		return nil, err
+	}
+	sandbox.CPU = cpu
+	sandbox.Mem = mem
+
+	if s.metrics != nil {
+		spec := s.specFor(sandbox)
+		s.metrics.RegisterSandbox(id, sandbox.Name, machine.GetSocketPath(id), spec.CPUs, spec.MemoryMB, spec.DiskMB)
+	}
+	fmt.Printf("[resize] Sandbox %s resized to %d vCPUs / %d MiB\n", id, cpu, mem)
+	return sandbox, nil
+}
 
-	files, err := os.ReadDir(basePath)
+// UpdateNetworkPolicy replaces the egress policy of a sandbox. A sandbox with a VM gets
+// the new policy at once; a stopped or hibernated one when it next boots.
+func (s *SandboxService) UpdateNetworkPolicy(ctx context.Context, sandbox *model.Sandbox, req model.UpdateNetworkRequest) (*model.Sandbox, error) {
+	policy, err := networkPolicyFor(sandbox.Network, req.NetworkPolicy)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return []model.Snapshot{}, nil
-		}
-		return nil, fmt.Errorf("failed to scan snapshots: %w", err)
+		return nil, err
+	}
+	switch sandbox.Status {
+	case model.SandboxStatusDeleting, model.SandboxStatusWarm:
+		return nil, model.ErrInvalidTransition
 	}
 
-	var snaps []model.Snapshot
-	for _, f := range files {
-		if f.IsDir() {
-			snaps = append(snaps, model.Snapshot{
-				ID:        f.Name(),
-				CreatedAt: f.Name(),
-				FullPath:  filepath.Join(basePath, f.Name()),
-			})
+	// Only a sandbox with a VM has a policy installed
+	live := sandbox.Status != model.SandboxStatusStopped && sandbox.Status != model.SandboxStatusHibernated
+	previous := sandbox.NetworkPolicy
+	sandbox.NetworkPolicy = policy
+	if live {
+		if err := s.egress.Apply(sandbox); err != nil {
+			sandbox.NetworkPolicy = previous
+			return nil, err
 		}
 	}
-	return snaps, nil
+	if err := s.repo.UpdateFields(ctx, sandbox.ID, bson.M{"networkPolicy": policy}); err != nil {
+		sandbox.NetworkPolicy = previous
+		if live {
+			s.egress.Apply(sandbox)
+		}
+		return nil, err
+	}
+	fmt.Printf("[egress] Sandbox %s network policy updated\n", sandbox.ID.Hex())
+	return sandbox, nil
+}
+
+// specFor rebuilds the VM spec of an existing sandbox from its record
+func (s *SandboxService) specFor(sandbox *model.Sandbox) model.SandboxSpec {
+	diskMB := sandbox.DiskMB
+	if diskMB == 0 {
+		diskMB = s.cfg.Sandbox.DefaultDiskMB
+	}
+	return model.SandboxSpec{
+		ID:          sandbox.ID.Hex(),
+		Type:        sandbox.ImageId,
+		CPUs:        sandbox.CPU,
+		MemoryMB:    sandbox.Mem,
+		DiskMB:      diskMB,
+		IPAddress:   sandbox.IP,
+		EnvVars:     sandbox.EnvVars,
+		MaxCPUs:     sandbox.MaxCPU,
+		MaxMemoryMB: sandbox.MaxMem,
+		MACAddress:  sandbox.MAC,
+		CID:         sandbox.CID,
+		IOLimits:    sandbox.IOLimits,
+		Network:     sandbox.Network,
+	}
+}
+
+// leaseFor leases the network identity of a new sandbox: an IP, MAC and CID, or only a
+// CID when the sandbox is networkless
+func (s *SandboxService) leaseFor(ctx context.Context, sandbox *model.Sandbox) (*model.NetworkLease, error) {
+	if sandbox.Networkless() {
+		return s.network.AllocateCID(ctx, sandbox.ID)
+	}
+	return s.network.Allocate(ctx, sandbox.ID, poolOrg(sandbox.OrgID))
+}
+
+func (s *SandboxService) Info(id string) (string, error) {
+	return s.hv.Info(id)
 }
 
 // RegisterMetricsForExisting registers running sandboxes with the metrics manager.
@@ -382,7 +986,7 @@ func (s *SandboxService) RegisterMetricsForExisting(ctx context.Context) error {
 		return nil
 	}
 
-	filter := bson.M{"status": "running"}
+	filter := bson.M{"status": model.SandboxStatusRunning}
 	projection := bson.M{"_id": 1, "name": 1, "cpu": 1, "mem": 1, "diskMb": 1}
 	items, err := s.repo.Find(ctx, filter, options.FindOptions{Projection: projection})
 	if err != nil {
@@ -405,10 +1009,12 @@ func (s *SandboxService) RegisterMetricsForExisting(ctx context.Context) error {
 }
 
 // RefreshStatuses checks each sandbox health and updates status field in DB.
-// Status values: running, paused, stopped.
+// Status values: running, paused, stopped. Sandboxes in a transient lifecycle
+// state are owned by the request driving them and are left alone, as are warm pool
+// and hibernated VMs.
 func (s *SandboxService) RefreshStatuses(ctx context.Context) error {
 	// Optimization 1: Fetch only necessary fields
-	projection := bson.M{"_id": 1, "status": 1}
+	projection := bson.M{"_id": 1, "status": 1, "restartCount": 1, "lastRestartAt": 1}
 	sandboxes, err := s.repo.Find(ctx, bson.M{}, options.FindOptions{Projection: projection})
 	if err != nil {
 		return fmt.Errorf("failed to list sandboxes: %w", err)
@@ -425,63 +1031,67 @@ func (s *SandboxService) RefreshStatuses(ctx context.Context) error {
 		sb := sb
 		id := sb.ID.Hex()
 
-		// --- FAST PATH CHECKS ---
-		client := machine.NewAPIClientForSandbox(id)
-		socketExists := client.IsSocketAvailable() // Fast os.Stat check
-
-		// Case 1: DB says Stopped + Socket is GONE.
-		// Conclusion: It is definitely stopped/dead. No need to call API.
-		if sb.Status == "stopped" && !socketExists {
+		// Warm pool VMs are checked by the refill loop; hibernated ones have no process
+		if model.IsTransientStatus(sb.Status) || sb.Status == model.SandboxStatusWarm || sb.Status == model.SandboxStatusHibernated {
 			continue
 		}
 
-		// Case 2: DB says Running + Socket is GONE.
-		// Conclusion: It crashed. We must update DB to stopped. (Proceeds to update logic)
-
-		// Case 3: Socket Exists (Your specific scenario).
-		// Conclusion: It could be Running, Paused, or Loaded (Stopped).
-		// We MUST call the API to find out.
-
 		wg.Add(1)
 		sem <- struct{}{}
 
 		go func() {
 			defer func() { <-sem; wg.Done() }()
 
-			newState := "stopped"
+			apiCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+			defer cancel()
 
-			if socketExists {
-				apiCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
-				defer cancel()
-
-				sbxState, err := client.GetStateWithContext(apiCtx)
-				if err == nil {
-					// Map Cloud Hypervisor States to your App States
-					switch strings.ToLower(sbxState) {
-					case "running", "runningvirtualized":
-						newState = "running"
-					case "paused":
-						newState = "paused"
-					case "loaded":
-						// 'Loaded' means Process active, but Guest not booted.
-						// For your app, this is "stopped" (ready to start).
-						newState = "stopped"
-					default:
-						newState = "stopped"
-					}
-				} else {
-					// Socket exists, but API refused connection or timed out.
-					// Process is likely zombie or unresponsive. Treat as stopped.
-					fmt.Printf("[health] Sandbox %s unresponsive (socket exists): %v\n", id, err)
+			newState := "stopped"
+			sbxState, err := s.hv.State(apiCtx, id)
+			switch {
+			case errors.Is(err, machine.ErrVMNotRunning):
+				// DB says Stopped + no VM: nothing to do. DB says Running + no VM: it crashed.
+				if sb.Status == model.SandboxStatusStopped {
+					return
+				}
+			case err != nil:
+				// The VM exists, but its hypervisor refused the connection or timed out.
+				// Process is likely zombie or unresponsive. Treat as stopped.
+				fmt.Printf("[health] Sandbox %s unresponsive: %v\n", id, err)
+			default:
+				// Map hypervisor states to your App States
+				switch strings.ToLower(sbxState) {
+				case "running", "runningvirtualized":
+					newState = "running"
+				case "paused":
+					newState = "paused"
+				case "loaded":
+					// 'Loaded' means Process active, but Guest not booted.
+					// For your app, this is "stopped" (ready to start).
+					newState = "stopped"
+				default:
 					newState = "stopped"
 				}
 			}
+			if newState == model.SandboxStatusRunning || newState == model.SandboxStatusPaused {
+				// Picks up console capture of VMs booted by a previous server process
+				machine.StartConsoleCapture(id)
+				s.resetStableRestarts(ctx, sb)
+			}
 
-			// Only write to DB if state actually changed
+			// Only write to DB if state actually changed, and only if no lifecycle
+			// operation moved the sandbox since we read it
 			if sb.Status != newState {
-				if err := s.repo.UpdateStatus(ctx, sb.ID, newState); err != nil {
+				err := s.repo.TransitionStatus(ctx, sb.ID, []string{sb.Status}, newState)
+				if err != nil && !errors.Is(err, model.ErrInvalidTransition) {
 					fmt.Printf("[health] failed to update status for %s: %v\n", id, err)
 				}
+				// A VM that stops on its own has crashed or been shut down from inside
+				crashed := sb.Status == model.SandboxStatusRunning || sb.Status == model.SandboxStatusPaused
+				if err == nil && crashed && newState == model.SandboxStatusStopped {
+					s.recoverCrashed(ctx, id)
+				} else if err == nil && newState == model.SandboxStatusPaused {
+					s.publishByID(ctx, model.EventSandboxPaused, id, nil)
+				}
 			}
 		}()
 	}
@@ -490,12 +1100,6 @@ func (s *SandboxService) RefreshStatuses(ctx context.Context) error {
 	return nil
 }
 
-// GetSnapshotsBasePath returns the base path for snapshots
-func (s *SandboxService) GetSnapshotsBasePath(id string) string {
-	pwd, _ := filepath.Abs(".")
-	return filepath.Join(pwd, "instances", id, "snapshots")
-}
-
 func waitForAgent(sbxID string, timeout time.Duration) error {
 	defer timer.Track("Agent Readiness Wait")()
 	deadline := time.Now().Add(timeout)
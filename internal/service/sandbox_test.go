@@ -0,0 +1,439 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+	"voidrun/internal/repository/repotest"
+	"voidrun/pkg/machine"
+	"voidrun/pkg/network"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// fakeQemuImg stands in for qemu-img so the tests need neither it nor real images. An
+// image file holds the path of its backing file, which is all the storage package reads back.
+const fakeQemuImg = `#!/bin/sh
+cmd=$1; shift
+backing=; file=; chain=
+while [ $# -gt 0 ]; do
+	case $1 in
+	-b) backing=$2; shift 2 ;;
+	-f|-F) shift 2 ;;
+	--backing-chain) chain=1; shift ;;
+	-*) shift ;;
+	*) [ -z "$file" ] && file=$1; shift ;;
+	esac
+done
+case $cmd in
+create|rebase)
+	printf '%s' "$backing" > "$file" ;;
+info)
+	if [ -n "$chain" ]; then
+		sep=; printf '['
+		while [ -n "$file" ]; do printf '%s{"filename":"%s"}' "$sep" "$file"; sep=,; file=$(cat "$file"); done
+		printf ']'
+	else
+		printf '{"format":"qcow2","virtual-size":1073741824,"backing-filename":"%s"}' "$(cat "$file")"
+	fi ;;
+*)
+	echo "unsupported qemu-img command $cmd" >&2; exit 1 ;;
+esac
+`
+
+// testSandboxes is a SandboxService on the Fake driver and in-memory repositories
+type testSandboxes struct {
+	*SandboxService
+	snapshotService *SnapshotService
+	sandboxRepo     *repotest.SandboxRepository
+	snapshotRepo    *repotest.SnapshotRepository
+	leases          *repotest.LeaseRepository
+	events          *repotest.EventRepository
+	hv              *machine.Fake
+}
+
+func newTestSandboxes(t *testing.T) *testSandboxes {
+	t.Helper()
+	// The vsock socket path must fit in a sockaddr_un, so keep the root short
+	root, err := os.MkdirTemp("", "vr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	bin := filepath.Join(root, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "qemu-img"), []byte(fakeQemuImg), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	cfg := &config.Config{}
+	cfg.Paths.BaseImagesDir = filepath.Join(root, "images")
+	cfg.Paths.InstancesDir = filepath.Join(root, "instances")
+	cfg.Network.NetworkCIDR = "10.0.0.0/24"
+	cfg.Network.GatewayIP = "10.0.0.1/24"
+	cfg.Sandbox = config.SandboxConfig{
+		DefaultVCPUs:    1,
+		DefaultMemoryMB: 256,
+		DefaultDiskMB:   1024,
+		DefaultImage:    "alpine",
+		SyncTimeoutSec:  5,
+		MaxForkCount:    4,
+	}
+	for _, dir := range []string{cfg.Paths.BaseImagesDir, cfg.Paths.InstancesDir, filepath.Join(root, "snapshots")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Paths.BaseImagesDir, "alpine-base.qcow2"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	machine.SetInstancesRoot(cfg.Paths.InstancesDir)
+	machine.SetSnapshotsRoot(filepath.Join(root, "snapshots"))
+
+	ipam, err := network.NewIPAM(cfg.Network.NetworkCIDR, cfg.Network.GatewayIP, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testSandboxes{
+		sandboxRepo:  repotest.NewSandboxRepository(),
+		snapshotRepo: repotest.NewSnapshotRepository(),
+		leases:       repotest.NewLeaseRepository(),
+		events:       repotest.NewEventRepository(),
+		hv:           machine.NewFake(),
+	}
+	orgs := repotest.NewOrgRepository()
+	webhooks := NewWebhookService(cfg, repotest.NewWebhookRepository(), repotest.NewWebhookDeliveryRepository())
+	ts.SandboxService = NewSandboxService(cfg, ts.sandboxRepo, repotest.NewImageRepository(), orgs, ts.snapshotRepo,
+		NewNetworkService(cfg, ipam, ts.leases, ts.sandboxRepo, nil),
+		NewEgressService(cfg, ts.sandboxRepo, orgs),
+		ts.hv, NewEventService(ts.events, webhooks), nil)
+	ts.snapshotService = NewSnapshotService(cfg, ts.snapshotRepo, ts.SandboxService)
+	return ts
+}
+
+// requireStatus fails unless the stored sandbox and its VM are in the given states
+func (ts *testSandboxes) requireStatus(t *testing.T, id, status, vmState string) {
+	t.Helper()
+	sandbox, ok := ts.Get(context.Background(), id)
+	if !ok {
+		t.Fatalf("sandbox %s not found", id)
+	}
+	if sandbox.Status != status {
+		t.Fatalf("sandbox %s is %s, want %s", id, sandbox.Status, status)
+	}
+	state, err := ts.hv.State(context.Background(), id)
+	if vmState == "" {
+		if !errors.Is(err, machine.ErrVMNotRunning) {
+			t.Fatalf("VM of %s is %s (%v), want none", id, state, err)
+		}
+	} else if state != vmState {
+		t.Fatalf("VM of %s is %s (%v), want %s", id, state, err, vmState)
+	}
+}
+
+func TestSandboxLifecycle(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestSandboxes(t)
+	orgID := primitive.NewObjectID()
+
+	sandbox, err := ts.Create(ctx, model.CreateSandboxRequest{Name: "lifecycle", OrgID: orgID.Hex()})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	id := sandbox.ID.Hex()
+	if sandbox.Status != model.SandboxStatusRunning || sandbox.IP == "" || sandbox.CID == 0 {
+		t.Fatalf("created sandbox = %+v, want running with a lease", sandbox)
+	}
+	ts.requireStatus(t, id, model.SandboxStatusRunning, machine.VMStateRunning)
+
+	if err := ts.Pause(ctx, id); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	ts.requireStatus(t, id, model.SandboxStatusPaused, machine.VMStatePaused)
+	if err := ts.Pause(ctx, id); !errors.Is(err, model.ErrInvalidTransition) {
+		t.Fatalf("Pause of a paused sandbox = %v, want ErrInvalidTransition", err)
+	}
+	if err := ts.Resume(ctx, id); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	ts.requireStatus(t, id, model.SandboxStatusRunning, machine.VMStateRunning)
+
+	if err := ts.Stop(ctx, id); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	ts.requireStatus(t, id, model.SandboxStatusStopped, "")
+	if err := ts.Pause(ctx, id); !errors.Is(err, model.ErrInvalidTransition) {
+		t.Fatalf("Pause of a stopped sandbox = %v, want ErrInvalidTransition", err)
+	}
+	if err := ts.Start(ctx, id); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	ts.requireStatus(t, id, model.SandboxStatusRunning, machine.VMStateRunning)
+
+	if err := ts.Delete(ctx, id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, ok := ts.Get(ctx, id); ok {
+		t.Fatalf("sandbox %s still recorded after Delete", id)
+	}
+	if _, err := os.Stat(machine.GetInstanceDir(id)); !os.IsNotExist(err) {
+		t.Errorf("instance dir of %s left behind: %v", id, err)
+	}
+	if lease, _ := ts.leases.FindBySandbox(ctx, sandbox.ID); lease != nil {
+		t.Errorf("lease of deleted sandbox kept: %+v", lease)
+	}
+
+	want := []string{
+		model.EventSandboxCreated, model.EventSandboxReady, model.EventSandboxPaused,
+		model.EventSandboxStopped, model.EventSandboxReady, model.EventSandboxDeleted,
+	}
+	if got := ts.events.Types(sandbox.ID); !slices.Equal(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestSnapshotRestoreAndDelete(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestSandboxes(t)
+	orgID := primitive.NewObjectID()
+
+	source, err := ts.Create(ctx, model.CreateSandboxRequest{Name: "source", OrgID: orgID.Hex(), CPU: 2, Mem: 512})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	userID := primitive.NewObjectID()
+	snapshot, err := ts.snapshotService.Create(ctx, source, userID.Hex(), model.CreateSnapshotRequest{Name: "snap"})
+	if err != nil {
+		t.Fatalf("snapshot Create: %v", err)
+	}
+	if snapshot.Status != model.SnapshotStatusReady || snapshot.CreatedBy != userID || snapshot.CPU != 2 || snapshot.Mem != 512 {
+		t.Fatalf("snapshot = %+v, want ready, made by the caller, with the shape of the source", snapshot)
+	}
+
+	restored, err := ts.snapshotService.Restore(ctx, snapshot, model.RestoreSandboxRequest{Name: "restored"})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if restored.OrgID != orgID || restored.CPU != 2 || restored.IP == source.IP || restored.MAC == source.MAC {
+		t.Fatalf("restored = %+v, want the snapshot's org and shape with a fresh address", restored)
+	}
+	ts.requireStatus(t, restored.ID.Hex(), model.SandboxStatusRunning, machine.VMStateRunning)
+
+	// The restored overlay is backed by the snapshot's disk, so the snapshot must stay
+	stored, _ := ts.snapshotService.GetForOrg(ctx, snapshot.ID.Hex(), orgID.Hex())
+	if stored.RefCount != 1 {
+		t.Fatalf("refCount = %d after restore, want 1", stored.RefCount)
+	}
+	if err := ts.snapshotService.Delete(ctx, stored); !errors.Is(err, model.ErrSnapshotInUse) {
+		t.Fatalf("Delete of a snapshot in use = %v, want ErrSnapshotInUse", err)
+	}
+
+	if err := ts.Delete(ctx, restored.ID.Hex()); err != nil {
+		t.Fatalf("Delete restored: %v", err)
+	}
+	stored, _ = ts.snapshotService.GetForOrg(ctx, snapshot.ID.Hex(), orgID.Hex())
+	if stored.RefCount != 0 || stored.Status != model.SnapshotStatusReady {
+		t.Fatalf("snapshot = %+v after its sandbox went, want ready and unreferenced", stored)
+	}
+	if err := ts.snapshotService.Delete(ctx, stored); err != nil {
+		t.Fatalf("Delete snapshot: %v", err)
+	}
+	if _, ok := ts.snapshotService.GetForOrg(ctx, snapshot.ID.Hex(), orgID.Hex()); ok {
+		t.Error("snapshot still recorded after Delete")
+	}
+	if _, err := os.Stat(snapshot.Path); !os.IsNotExist(err) {
+		t.Errorf("snapshot files left behind: %v", err)
+	}
+}
+
+func TestSnapshotOfStoppedSandboxIsRefused(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestSandboxes(t)
+
+	sandbox, err := ts.Create(ctx, model.CreateSandboxRequest{OrgID: primitive.NewObjectID().Hex()})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := ts.Stop(ctx, sandbox.ID.Hex()); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	stopped, _ := ts.Get(ctx, sandbox.ID.Hex())
+	if _, err := ts.snapshotService.Create(ctx, stopped, "", model.CreateSnapshotRequest{}); !errors.Is(err, model.ErrInvalidTransition) {
+		t.Fatalf("snapshot of a stopped sandbox = %v, want ErrInvalidTransition", err)
+	}
+	if n, _ := ts.snapshotRepo.Count(ctx, nil); n != 0 {
+		t.Errorf("%d snapshot records left behind", n)
+	}
+}
+
+// Restore copies the shape of an imported snapshot into the new sandbox, so an archive may
+// not ask for more than a create could, nor describe a VM other than the one it carries
+func TestImportChecksSnapshotShape(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestSandboxes(t)
+	orgID := primitive.NewObjectID().Hex()
+
+	source, err := ts.Create(ctx, model.CreateSandboxRequest{Name: "source", OrgID: orgID, CPU: 2, Mem: 512})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	snapshot, err := ts.snapshotService.Create(ctx, source, "", model.CreateSnapshotRequest{Name: "snap"})
+	if err != nil {
+		t.Fatalf("snapshot Create: %v", err)
+	}
+	archive := func(edit func(*model.SnapshotManifest)) *bytes.Buffer {
+		manifest := model.SnapshotManifest{
+			FormatVersion: model.SnapshotManifestVersion,
+			ImageId:       snapshot.ImageId,
+			CPU:           snapshot.CPU,
+			Mem:           snapshot.Mem,
+			MaxCPU:        snapshot.MaxCPU,
+			MaxMem:        snapshot.MaxMem,
+			DiskMB:        snapshot.DiskMB,
+			Hypervisor:    ts.hv.Name(),
+		}
+		edit(&manifest)
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := machine.ExportSnapshot(&buf, snapshot.Path, data); err != nil {
+			t.Fatalf("ExportSnapshot: %v", err)
+		}
+		return &buf
+	}
+
+	if _, err := ts.snapshotService.Import(ctx, archive(func(*model.SnapshotManifest) {}), orgID, "", ""); err != nil {
+		t.Fatalf("Import of an unchanged archive: %v", err)
+	}
+
+	cases := map[string]struct {
+		edit func(*model.SnapshotManifest)
+		want error
+	}{
+		"too many vCPUs":          {func(m *model.SnapshotManifest) { m.CPU, m.MaxCPU = 64, 64 }, model.ErrIncompatibleSnapshot},
+		"too much memory":         {func(m *model.SnapshotManifest) { m.Mem, m.MaxMem = 1<<20, 1<<20 }, model.ErrIncompatibleSnapshot},
+		"vCPUs above their limit": {func(m *model.SnapshotManifest) { m.CPU = 4 }, model.ErrIncompatibleSnapshot},
+		"too much disk":           {func(m *model.SnapshotManifest) { m.DiskMB = 1 << 30 }, model.ErrIncompatibleSnapshot},
+		"other shape than the VM": {func(m *model.SnapshotManifest) { m.CPU = 1 }, model.ErrInvalidSnapshotArchive},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ts.snapshotService.Import(ctx, archive(tc.edit), orgID, "", ""); !errors.Is(err, tc.want) {
+				t.Fatalf("Import = %v, want %v", err, tc.want)
+			}
+		})
+	}
+	if n, _ := ts.snapshotRepo.Count(ctx, nil); n != 2 {
+		t.Errorf("%d snapshot records, want the source and the one good import", n)
+	}
+}
+
+// Keys need not have a creator; the snapshot and its restores then keep the sandbox's
+func TestSnapshotWithoutUserKeepsCreatorOfSandbox(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestSandboxes(t)
+	creator := primitive.NewObjectID()
+
+	source, err := ts.Create(ctx, model.CreateSandboxRequest{Name: "source", OrgID: primitive.NewObjectID().Hex(), UserID: creator.Hex()})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if source.CreatedBy != creator {
+		t.Fatalf("sandbox CreatedBy = %s, want %s", source.CreatedBy.Hex(), creator.Hex())
+	}
+	snapshot, err := ts.snapshotService.Create(ctx, source, "", model.CreateSnapshotRequest{Name: "snap"})
+	if err != nil {
+		t.Fatalf("snapshot Create: %v", err)
+	}
+	if snapshot.CreatedBy != creator {
+		t.Errorf("snapshot CreatedBy = %s, want the sandbox's %s", snapshot.CreatedBy.Hex(), creator.Hex())
+	}
+	restored, err := ts.snapshotService.Restore(ctx, snapshot, model.RestoreSandboxRequest{Name: "restored"})
+	if err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if restored.CreatedBy != creator {
+		t.Errorf("restored CreatedBy = %s, want the snapshot's %s", restored.CreatedBy.Hex(), creator.Hex())
+	}
+}
+
+func TestForkChildrenBelongToCaller(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestSandboxes(t)
+	creator, caller := primitive.NewObjectID(), primitive.NewObjectID()
+
+	source, err := ts.Create(ctx, model.CreateSandboxRequest{Name: "source", OrgID: primitive.NewObjectID().Hex(), UserID: creator.Hex()})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	children, err := ts.Fork(ctx, source, caller.Hex(), 2)
+	if err != nil {
+		t.Fatalf("Fork: %v", err)
+	}
+	for _, child := range children {
+		if child.CreatedBy != caller || child.OrgID != source.OrgID {
+			t.Errorf("child CreatedBy = %s in org %s, want %s in %s", child.CreatedBy.Hex(), child.OrgID.Hex(), caller.Hex(), source.OrgID.Hex())
+		}
+	}
+
+	// Without a calling user the children keep the source's creator
+	source, _ = ts.Get(ctx, source.ID.Hex())
+	children, err = ts.Fork(ctx, source, "", 1)
+	if err != nil {
+		t.Fatalf("Fork: %v", err)
+	}
+	if children[0].CreatedBy != creator {
+		t.Errorf("child CreatedBy = %s, want the source's %s", children[0].CreatedBy.Hex(), creator.Hex())
+	}
+}
+
+// A resize must not record its shape over a sandbox that left running meanwhile
+func TestResizeOfSandboxThatStoppedRunningIsRefused(t *testing.T) {
+	ctx := context.Background()
+	ts := newTestSandboxes(t)
+	ts.cfg.Sandbox.MaxVCPUs = 2
+
+	sandbox, err := ts.Create(ctx, model.CreateSandboxRequest{Name: "resize", OrgID: primitive.NewObjectID().Hex()})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	id := sandbox.ID.Hex()
+	stale, _ := ts.Get(ctx, id)
+	if err := ts.Pause(ctx, id); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+
+	cpu := 2
+	if _, err := ts.Resize(ctx, stale, model.ResizeSandboxRequest{CPU: &cpu}); !errors.Is(err, model.ErrInvalidTransition) {
+		t.Fatalf("Resize after Pause = %v, want ErrInvalidTransition", err)
+	}
+	ts.requireStatus(t, id, model.SandboxStatusPaused, machine.VMStatePaused)
+	if stored, _ := ts.Get(ctx, id); stored.CPU != 1 {
+		t.Fatalf("stored cpu = %d after refused resize, want 1", stored.CPU)
+	}
+
+	if err := ts.Resume(ctx, id); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	running, _ := ts.Get(ctx, id)
+	if _, err := ts.Resize(ctx, running, model.ResizeSandboxRequest{CPU: &cpu}); err != nil {
+		t.Fatalf("Resize: %v", err)
+	}
+	if stored, _ := ts.Get(ctx, id); stored.CPU != 2 {
+		t.Fatalf("stored cpu = %d after resize, want 2", stored.CPU)
+	}
+}
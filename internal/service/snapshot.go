@@ -0,0 +1,372 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+	"voidrun/pkg/machine"
+	"voidrun/pkg/storage"
+	"voidrun/pkg/util"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SnapshotService manages the snapshot registry and restores sandboxes from it
+type SnapshotService struct {
+	repo      repository.ISnapshotRepository
+	sandboxes *SandboxService
+	cfg       *config.Config
+}
+
+// NewSnapshotService creates a new snapshot service
+func NewSnapshotService(cfg *config.Config, repo repository.ISnapshotRepository, sandboxes *SandboxService) *SnapshotService {
+	return &SnapshotService{
+		repo:      repo,
+		sandboxes: sandboxes,
+		cfg:       cfg,
+	}
+}
+
+// Create captures a running or paused sandbox and records it in the registry, owned by
+// the calling user. It returns model.ErrInvalidTransition when the sandbox is in any other state.
+func (s *SnapshotService) Create(ctx context.Context, sandbox *model.Sandbox, userIDHex string, req model.CreateSnapshotRequest) (*model.Snapshot, error) {
+	if sandbox.Status != model.SandboxStatusRunning && sandbox.Status != model.SandboxStatusPaused {
+		return nil, model.ErrInvalidTransition
+	}
+	// Without a calling user the snapshot is credited to the sandbox's creator
+	createdBy := sandbox.CreatedBy
+	if userID, err := util.ParseObjectID(userIDHex); err == nil {
+		createdBy = userID
+	}
+
+	name := req.Name
+	if name == "" {
+		name = fmt.Sprintf("%s-%s", sandbox.Name, time.Now().Format("20060102-150405"))
+	}
+
+	spec := s.sandboxes.specFor(sandbox)
+	snapID := util.GenerateObjectID()
+	snapshot := &model.Snapshot{
+		ID:        snapID,
+		Name:      name,
+		SandboxID: sandbox.ID,
+		ImageId:   spec.Type,
+		CPU:       spec.CPUs,
+		Mem:       spec.MemoryMB,
+		MaxCPU:    sandbox.MaxCPU,
+		MaxMem:    sandbox.MaxMem,
+		DiskMB:    spec.DiskMB,
+		Status:    model.SnapshotStatusCreating,
+		EnvVars:   sandbox.EnvVars,
+		Network:   sandbox.Network,
+		Path:      machine.GetSnapshotDir(snapID.Hex()),
+		OrgID:     sandbox.OrgID,
+		CreatedBy: createdBy,
+	}
+	if err := s.repo.Create(ctx, snapshot); err != nil {
+		return nil, fmt.Errorf("DB save failed: %w", err)
+	}
+
+	size, err := s.sandboxes.hv.Snapshot(sandbox.ID.Hex(), snapshot.Path)
+	if err != nil {
+		s.repo.Delete(context.Background(), snapID)
+		return nil, err
+	}
+
+	if err := s.repo.MarkReady(ctx, snapID, size); err != nil {
+		machine.DeleteSnapshot(snapshot.Path)
+		s.repo.Delete(context.Background(), snapID)
+		return nil, fmt.Errorf("DB save failed: %w", err)
+	}
+	snapshot.Status = model.SnapshotStatusReady
+	snapshot.SizeBytes = size
+	s.sandboxes.publish(ctx, model.EventSnapshotCreated, sandbox, map[string]interface{}{
+		"snapshotId":   snapID.Hex(),
+		"snapshotName": name,
+		"sizeBytes":    size,
+	})
+
+	return snapshot, nil
+}
+
+// ListByOrgPaginated lists an org's snapshots, newest first, optionally narrowed to one source sandbox
+func (s *SnapshotService) ListByOrgPaginated(ctx context.Context, orgIDHex, sandboxIDHex string, page, pageSize int) ([]*model.Snapshot, int64, int, error) {
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = config.DefaultPageSize
+	} else if pageSize > config.MaxPageSize {
+		pageSize = config.MaxPageSize
+	}
+
+	orgID, err := util.ParseObjectID(orgIDHex)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("invalid org id: %w", err)
+	}
+
+	filter := bson.M{"orgId": orgID, "ephemeral": bson.M{"$ne": true}}
+	if sandboxIDHex != "" {
+		sandboxID, err := util.ParseObjectID(sandboxIDHex)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("invalid sandbox id: %w", err)
+		}
+		filter["sandboxId"] = sandboxID
+	}
+
+	total, err := s.repo.Count(ctx, filter)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	opts := options.FindOptions{}
+	opts.SetSkip(int64((page - 1) * pageSize))
+	opts.SetLimit(int64(pageSize))
+	opts.SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	snapshots, err := s.repo.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	if snapshots == nil {
+		snapshots = []*model.Snapshot{}
+	}
+	return snapshots, total, pageSize, nil
+}
+
+// GetForOrg returns the snapshot only when it is owned by the given org
+func (s *SnapshotService) GetForOrg(ctx context.Context, id, orgIDHex string) (*model.Snapshot, bool) {
+	orgID, err := util.ParseObjectID(orgIDHex)
+	if err != nil {
+		return nil, false
+	}
+	snapshot, err := s.repo.FindByIDAndOrg(ctx, id, orgID)
+	if err != nil || snapshot == nil || snapshot.Ephemeral {
+		return nil, false
+	}
+	return snapshot, true
+}
+
+// Delete removes the files and registry record of a ready or failed snapshot. It returns
+// model.ErrSnapshotInUse while restored sandboxes are still backed by the snapshot.
+func (s *SnapshotService) Delete(ctx context.Context, snapshot *model.Snapshot) error {
+	if snapshot.Status != model.SnapshotStatusReady && snapshot.Status != model.SnapshotStatusFailed {
+		return model.ErrSnapshotNotReady
+	}
+	if err := s.repo.BeginDelete(ctx, snapshot.ID); err != nil {
+		return err
+	}
+	if err := machine.DeleteSnapshot(snapshot.Path); err != nil {
+		s.repo.CancelDelete(context.Background(), snapshot.ID, snapshot.Status)
+		return err
+	}
+	return s.repo.Delete(ctx, snapshot.ID)
+}
+
+// Restore rebuilds a new sandbox from the recorded snapshot spec
+func (s *SnapshotService) Restore(ctx context.Context, snapshot *model.Snapshot, req model.RestoreSandboxRequest) (*model.Sandbox, error) {
+	if snapshot.Status != model.SnapshotStatusReady {
+		return nil, model.ErrSnapshotNotReady
+	}
+	if req.OrgID == "" {
+		req.OrgID = snapshot.OrgID.Hex()
+	}
+	if req.UserID == "" && !snapshot.CreatedBy.IsZero() {
+		req.UserID = snapshot.CreatedBy.Hex()
+	}
+	return s.sandboxes.Restore(ctx, snapshot, req)
+}
+
+// checkManifestShape holds the VM shape of an imported snapshot to what a sandbox created
+// on this host could have reached: the bounds of a create plus the resize headroom of this
+// host. Restore copies the shape into the new sandbox as is.
+func (s *SnapshotService) checkManifestShape(m model.SnapshotManifest) error {
+	maxCPU := max(s.cfg.Sandbox.MaxVCPUs, model.MaxSandboxCPU)
+	maxMem := model.MaxSandboxMemMB + max(s.cfg.Sandbox.HotplugMemoryMB, 0)
+	minMem := model.MinSandboxMemMB
+	if d := s.cfg.Sandbox.DefaultMemoryMB; d > 0 {
+		minMem = min(minMem, d)
+	}
+	// Without resize limits a sandbox keeps the shape it was created with
+	cpuLimit, memLimit := m.MaxCPU, m.MaxMem
+	if cpuLimit == 0 {
+		cpuLimit = model.MaxSandboxCPU
+	}
+	if memLimit == 0 {
+		memLimit = model.MaxSandboxMemMB
+	}
+	switch {
+	case m.MaxCPU < 0 || m.MaxCPU > maxCPU:
+		return fmt.Errorf("vCPU limit %d exceeds the %d of this host", m.MaxCPU, maxCPU)
+	case m.CPU > cpuLimit:
+		return fmt.Errorf("%d vCPUs exceed the limit of %d", m.CPU, cpuLimit)
+	case m.MaxMem < 0 || m.MaxMem > maxMem:
+		return fmt.Errorf("memory limit %d MiB exceeds the %d MiB of this host", m.MaxMem, maxMem)
+	case m.Mem < minMem || m.Mem > memLimit:
+		return fmt.Errorf("%d MiB of memory is outside %d-%d MiB", m.Mem, minMem, memLimit)
+	case m.DiskMB < 0 || m.DiskMB > s.cfg.Sandbox.DefaultDiskMB:
+		return fmt.Errorf("%d MiB of disk exceeds the %d MiB of this host", m.DiskMB, s.cfg.Sandbox.DefaultDiskMB)
+	}
+	return nil
+}
+
+// Export streams a ready snapshot to w as a tar.zst archive with a manifest and checksums
+func (s *SnapshotService) Export(ctx context.Context, snapshot *model.Snapshot, w io.Writer) error {
+	if snapshot.Status != model.SnapshotStatusReady {
+		return model.ErrSnapshotNotReady
+	}
+	manifest := model.SnapshotManifest{
+		FormatVersion:     model.SnapshotManifestVersion,
+		SnapshotID:        snapshot.ID.Hex(),
+		Name:              snapshot.Name,
+		SandboxID:         snapshot.SandboxID.Hex(),
+		ImageId:           snapshot.ImageId,
+		CPU:               snapshot.CPU,
+		Mem:               snapshot.Mem,
+		MaxCPU:            snapshot.MaxCPU,
+		MaxMem:            snapshot.MaxMem,
+		DiskMB:            snapshot.DiskMB,
+		EnvVars:           snapshot.EnvVars,
+		Network:           snapshot.Network,
+		Kernel:            filepath.Base(s.cfg.Paths.KernelPath),
+		Hypervisor:        s.sandboxes.hv.Name(),
+		HypervisorVersion: s.sandboxes.hv.Version(),
+		CreatedAt:         snapshot.CreatedAt,
+		ExportedAt:        time.Now(),
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return machine.ExportSnapshot(w, snapshot.Path, data)
+}
+
+// Import verifies an archive written by Export and registers it as a ready snapshot of
+// the given org. An empty name keeps the name recorded in the archive. It returns
+// model.ErrInvalidSnapshotArchive for malformed or corrupted archives and
+// model.ErrIncompatibleSnapshot for archives this host cannot restore.
+func (s *SnapshotService) Import(ctx context.Context, r io.Reader, orgIDHex, userIDHex, name string) (*model.Snapshot, error) {
+	orgID, err := util.ParseObjectID(orgIDHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid org id: %w", err)
+	}
+	var createdBy primitive.ObjectID
+	if userIDHex != "" {
+		createdBy, _ = util.ParseObjectID(userIDHex)
+	}
+
+	// The limit holds for the upload and, separately, for the files it decompresses into
+	var limited *importLimitReader
+	maxBytes := int64(s.cfg.Sandbox.SnapshotImportMaxMB) << 20
+	if maxBytes > 0 {
+		limited = &importLimitReader{r: r, n: maxBytes}
+		r = limited
+	}
+
+	snapID := util.GenerateObjectID()
+	snapDir := machine.GetSnapshotDir(snapID.Hex())
+	var manifest model.SnapshotManifest
+	err = machine.ImportSnapshot(r, snapDir, maxBytes, func(data []byte) error {
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("%w: bad manifest: %v", model.ErrInvalidSnapshotArchive, err)
+		}
+		if manifest.FormatVersion != model.SnapshotManifestVersion {
+			return fmt.Errorf("%w: unsupported archive format %d", model.ErrIncompatibleSnapshot, manifest.FormatVersion)
+		}
+		if manifest.ImageId == "" || manifest.CPU <= 0 || manifest.Mem <= 0 {
+			return fmt.Errorf("%w: manifest lacks the sandbox spec", model.ErrInvalidSnapshotArchive)
+		}
+		if err := s.checkManifestShape(manifest); err != nil {
+			return fmt.Errorf("%w: %v", model.ErrIncompatibleSnapshot, err)
+		}
+		// Memory state is driver specific; a snapshot cannot move between drivers
+		if manifest.Hypervisor != s.sandboxes.hv.Name() {
+			return fmt.Errorf("%w: taken with the %s driver, this host runs %s", model.ErrIncompatibleSnapshot, manifest.Hypervisor, s.sandboxes.hv.Name())
+		}
+		return nil
+	})
+	if limited != nil && limited.n < 0 {
+		return nil, model.ErrSnapshotTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if version := s.sandboxes.hv.Version(); manifest.HypervisorVersion != "" && version != "" && manifest.HypervisorVersion != version {
+		fmt.Printf("[snapshot] Importing snapshot taken with %s %s on %s %s; live restore may fail\n",
+			manifest.Hypervisor, manifest.HypervisorVersion, s.sandboxes.hv.Name(), version)
+	}
+
+	// The VM config in the archive names host files and devices the restore would open
+	shape := model.SandboxSpec{CPUs: manifest.CPU, MemoryMB: manifest.Mem, MaxCPUs: manifest.MaxCPU, MaxMemoryMB: manifest.MaxMem}
+	if err := s.sandboxes.hv.AdoptSnapshot(*s.cfg, snapDir, shape); err != nil {
+		machine.DeleteSnapshot(snapDir)
+		return nil, err
+	}
+	if err := storage.RebaseOverlay(ctx, *s.cfg, filepath.Join(snapDir, "overlay.qcow2"), manifest.ImageId); err != nil {
+		machine.DeleteSnapshot(snapDir)
+		return nil, fmt.Errorf("%w: %v", model.ErrIncompatibleSnapshot, err)
+	}
+	size := machine.SealSnapshot(snapDir)
+
+	if name == "" {
+		name = manifest.Name
+	}
+	sandboxID, _ := util.ParseObjectID(manifest.SandboxID)
+	now := time.Now()
+	snapshot := &model.Snapshot{
+		ID:         snapID,
+		Name:       name,
+		SandboxID:  sandboxID,
+		ImageId:    manifest.ImageId,
+		CPU:        manifest.CPU,
+		Mem:        manifest.Mem,
+		MaxCPU:     manifest.MaxCPU,
+		MaxMem:     manifest.MaxMem,
+		DiskMB:     manifest.DiskMB,
+		SizeBytes:  size,
+		Status:     model.SnapshotStatusReady,
+		EnvVars:    manifest.EnvVars,
+		Network:    manifest.Network,
+		Path:       snapDir,
+		CreatedAt:  manifest.CreatedAt,
+		CreatedBy:  createdBy,
+		OrgID:      orgID,
+		ImportedAt: &now,
+	}
+	if err := s.repo.Create(ctx, snapshot); err != nil {
+		machine.DeleteSnapshot(snapDir)
+		return nil, fmt.Errorf("DB save failed: %w", err)
+	}
+	fmt.Printf("[snapshot] Imported snapshot %s (%s, %d bytes)\n", snapID.Hex(), name, size)
+	return snapshot, nil
+}
+
+// importLimitReader stops an import once more than n bytes of archive have been read
+type importLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *importLimitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, model.ErrSnapshotTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, model.ErrSnapshotTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,243 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"voidrun/internal/model"
+	"voidrun/pkg/machine"
+	"voidrun/pkg/util"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// warmPoolClass is one pooled VM shape and how many booted VMs of it to keep ready
+type warmPoolClass struct {
+	Image  string
+	CPU    int
+	Mem    int
+	Target int
+}
+
+// Size returns the size-class label used in metrics, e.g. 1x1024
+func (c warmPoolClass) Size() string {
+	return fmt.Sprintf("%dx%d", c.CPU, c.Mem)
+}
+
+// warmPool keeps booted, agent-ready sandboxes on standby. Pooled VMs are ordinary
+// sandbox records in the warm state, so they survive restarts and are claimed with
+// an atomic update rather than in-memory bookkeeping.
+type warmPool struct {
+	classes []warmPoolClass
+	refill  chan struct{}
+}
+
+// parseWarmPoolClass parses an image:CPUxMEM=COUNT entry
+func parseWarmPoolClass(entry string) (warmPoolClass, error) {
+	shape, count, ok := strings.Cut(entry, "=")
+	if !ok {
+		return warmPoolClass{}, fmt.Errorf("missing =COUNT in %q", entry)
+	}
+	image, size, ok := strings.Cut(shape, ":")
+	if !ok || image == "" {
+		return warmPoolClass{}, fmt.Errorf("missing image in %q", entry)
+	}
+	cpuStr, memStr, ok := strings.Cut(size, "x")
+	if !ok {
+		return warmPoolClass{}, fmt.Errorf("size must be CPUxMEM in %q", entry)
+	}
+	cpu, err := strconv.Atoi(cpuStr)
+	if err != nil || cpu < 1 {
+		return warmPoolClass{}, fmt.Errorf("invalid cpu in %q", entry)
+	}
+	mem, err := strconv.Atoi(memStr)
+	if err != nil || mem < 1 {
+		return warmPoolClass{}, fmt.Errorf("invalid memory in %q", entry)
+	}
+	target, err := strconv.Atoi(count)
+	if err != nil || target < 0 {
+		return warmPoolClass{}, fmt.Errorf("invalid count in %q", entry)
+	}
+	return warmPoolClass{Image: image, CPU: cpu, Mem: mem, Target: target}, nil
+}
+
+func newWarmPool(entries []string) *warmPool {
+	pool := &warmPool{refill: make(chan struct{}, 1)}
+	for _, entry := range entries {
+		class, err := parseWarmPoolClass(entry)
+		if err != nil {
+			fmt.Printf("[warm-pool] ignoring class: %v\n", err)
+			continue
+		}
+		pool.classes = append(pool.classes, class)
+	}
+	return pool
+}
+
+// classFor returns the pooled class matching a requested shape
+func (p *warmPool) classFor(image string, cpu, mem int) (warmPoolClass, bool) {
+	for _, class := range p.classes {
+		if class.Image == image && class.CPU == cpu && class.Mem == mem {
+			return class, true
+		}
+	}
+	return warmPoolClass{}, false
+}
+
+// requestRefill wakes the refill loop without blocking the caller
+func (p *warmPool) requestRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// StartWarmPool runs the background refill loop until ctx is cancelled
+func (s *SandboxService) StartWarmPool(ctx context.Context) {
+	if len(s.pool.classes) == 0 {
+		return
+	}
+	interval := time.Duration(s.cfg.WarmPool.RefillIntervalSec) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		s.refillWarmPool(ctx)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-s.pool.refill:
+			}
+			s.refillWarmPool(ctx)
+		}
+	}()
+}
+
+// claimWarm hands a pooled VM of the requested shape to the caller, applying the name,
+// org, env vars and lifetime of the requested sandbox. It returns nil when the shape is
+// not pooled, the pool is empty, the sandbox is networkless, it needs other I/O limits
+// than pooled VMs were booted with, or its org leases from another address pool than
+// pooled VMs, which have no org.
+func (s *SandboxService) claimWarm(ctx context.Context, req *model.Sandbox) *model.Sandbox {
+	class, ok := s.pool.classFor(req.ImageId, req.CPU, req.Mem)
+	if !ok || req.Networkless() || !sameIOLimits(req.IOLimits, warmIOLimits()) {
+		return nil
+	}
+	orgPool, _ := s.network.PoolFor(poolOrg(req.OrgID))
+	if warmPool, _ := s.network.PoolFor(""); orgPool != warmPool {
+		return nil
+	}
+	defer s.pool.requestRefill()
+
+	claim := lifetimeFields(req)
+	claim["name"] = req.Name
+	claim["orgId"] = req.OrgID
+	claim["createdBy"] = req.CreatedBy
+	claim["createdAt"] = time.Now()
+	if len(req.EnvVars) > 0 {
+		claim["envVars"] = req.EnvVars
+	}
+	if req.RestartPolicy != "" {
+		claim["restartPolicy"] = req.RestartPolicy
+	}
+	if req.MaxRestarts != nil {
+		claim["maxRestarts"] = *req.MaxRestarts
+	}
+	if req.NetworkPolicy != nil {
+		claim["networkPolicy"] = req.NetworkPolicy
+	}
+	sandbox, err := s.repo.ClaimWarm(ctx, class.Image, class.CPU, class.Mem, claim)
+	if err != nil {
+		fmt.Printf("[warm-pool] claim failed: %v\n", err)
+	}
+	if s.metrics != nil {
+		s.metrics.ObserveWarmPoolClaim(class.Image, class.Size(), sandbox != nil)
+	}
+	if sandbox == nil {
+		return nil
+	}
+
+	id := sandbox.ID.Hex()
+	if err := s.egress.Apply(sandbox); err != nil {
+		// The VM has been unfiltered; drop it and let the caller boot one from scratch
+		fmt.Printf("[warm-pool] Failed to apply network policy to %s: %v\n", id, err)
+		if err := s.Delete(context.Background(), id); err != nil {
+			fmt.Printf("[warm-pool] Failed to delete %s: %v\n", id, err)
+		}
+		return nil
+	}
+	if len(req.EnvVars) > 0 {
+		if err := setAgentEnvVars(id, req.EnvVars); err != nil {
+			fmt.Printf("[WARN] Failed to set env vars on agent: %v\n", err)
+		}
+	}
+	if s.metrics != nil {
+		s.metrics.RegisterSandbox(id, sandbox.Name, machine.GetSocketPath(id), sandbox.CPU, sandbox.Mem, sandbox.DiskMB)
+	}
+	fmt.Printf("[warm-pool] Claimed %s for %s (%s %s)\n", id, sandbox.Name, class.Image, class.Size())
+	return sandbox
+}
+
+// refillWarmPool drops dead pooled VMs and boots new ones until every class is at its target
+func (s *SandboxService) refillWarmPool(ctx context.Context) {
+	for _, class := range s.pool.classes {
+		filter := bson.M{
+			"status":  model.SandboxStatusWarm,
+			"imageId": class.Image,
+			"cpu":     class.CPU,
+			"mem":     class.Mem,
+		}
+		projection := bson.M{"_id": 1}
+		warm, err := s.repo.Find(ctx, filter, options.FindOptions{Projection: projection})
+		if err != nil {
+			fmt.Printf("[warm-pool] failed to list %s %s: %v\n", class.Image, class.Size(), err)
+			continue
+		}
+
+		ready := 0
+		for _, sb := range warm {
+			id := sb.ID.Hex()
+			if _, err := s.hv.State(ctx, id); err == nil {
+				ready++
+				continue
+			}
+			fmt.Printf("[warm-pool] Discarding dead warm sandbox %s\n", id)
+			if err := s.Delete(ctx, id); err != nil {
+				fmt.Printf("[warm-pool] failed to discard %s: %v\n", id, err)
+			}
+		}
+
+		for ; ready < class.Target; ready++ {
+			if ctx.Err() != nil {
+				return
+			}
+			sandbox := &model.Sandbox{
+				ID:       util.GenerateObjectID(),
+				Name:     fmt.Sprintf("warm-%s-%s", class.Image, class.Size()),
+				ImageId:  class.Image,
+				CPU:      class.CPU,
+				Mem:      class.Mem,
+				DiskMB:   s.cfg.Sandbox.DefaultDiskMB,
+				Network:  model.NetworkModeBridge,
+				IOLimits: warmIOLimits(),
+			}
+			if err := s.provision(ctx, sandbox, true, model.SandboxStatusWarm); err != nil {
+				fmt.Printf("[warm-pool] failed to boot %s %s: %v\n", class.Image, class.Size(), err)
+				break
+			}
+		}
+
+		if s.metrics != nil {
+			s.metrics.SetWarmPoolReady(class.Image, class.Size(), ready)
+		}
+	}
+}
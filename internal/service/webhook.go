@@ -0,0 +1,341 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+	"voidrun/internal/repository"
+	"voidrun/pkg/util"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// maxWebhookBackoff caps the delay between delivery attempts
+	maxWebhookBackoff = 10 * time.Minute
+	// webhookSecretPrefix marks signing secrets so they are recognisable in config files
+	webhookSecretPrefix = "whsec_"
+)
+
+// nonPublicPrefixes are special-purpose ranges the net/netip predicates do not cover:
+// "this network", carrier-grade NAT, benchmarking and the NAT64 prefix, which reaches
+// any IPv4 address through a translator
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// errWebhookAddressForbidden is recorded for deliveries whose host resolves to an internal address
+var errWebhookAddressForbidden = errors.New("webhook address is not publicly routable")
+
+// WebhookService manages org webhooks and delivers events to them. Each delivery is
+// signed with the webhook secret and retried with exponential backoff; every attempt
+// is written to the delivery log. Pending retries do not survive a server restart.
+type WebhookService struct {
+	repo       repository.IWebhookRepository
+	deliveries repository.IWebhookDeliveryRepository
+	cfg        *config.Config
+	client     *http.Client
+	// sandboxNet is NETWORK_CIDR, which webhooks may not reach
+	sandboxNet netip.Prefix
+}
+
+func NewWebhookService(cfg *config.Config, repo repository.IWebhookRepository, deliveries repository.IWebhookDeliveryRepository) *WebhookService {
+	timeout := time.Duration(cfg.Events.WebhookTimeoutSec) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	s := &WebhookService{
+		repo:       repo,
+		deliveries: deliveries,
+		cfg:        cfg,
+	}
+	if prefix, err := netip.ParsePrefix(cfg.Network.NetworkCIDR); err == nil {
+		s.sandboxNet = prefix.Masked()
+	}
+	// Every connection is checked after name resolution, so a host that resolves to an
+	// internal address at delivery time is refused as well. Redirects are not followed,
+	// since they could point anywhere.
+	dialer := &net.Dialer{Timeout: timeout, Control: s.controlDial}
+	s.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return s
+}
+
+// controlDial refuses connections to addresses a webhook must not reach
+func (s *WebhookService) controlDial(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errWebhookAddressForbidden, address)
+	}
+	if !s.publicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", errWebhookAddressForbidden, addrPort.Addr())
+	}
+	return nil
+}
+
+// publicAddr reports whether addr is outside loopback, link-local, private, multicast,
+// unspecified and nonPublicPrefixes space and outside the sandbox network
+func (s *WebhookService) publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsPrivate() || addr.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return !s.sandboxNet.IsValid() || !s.sandboxNet.Contains(addr)
+}
+
+// Create registers a webhook and generates its signing secret, which is only returned here
+func (s *WebhookService) Create(ctx context.Context, orgIDHex, userIDHex string, req model.CreateWebhookRequest) (*model.Webhook, error) {
+	orgID, err := util.ParseObjectID(orgIDHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid org id: %w", err)
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, model.ErrInvalidWebhookURL
+	}
+	// Hostnames are checked on every delivery, when they are resolved
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !s.publicAddr(addr) {
+		return nil, model.ErrInvalidWebhookURL
+	}
+	for _, t := range req.Events {
+		if !isEventType(t) {
+			return nil, fmt.Errorf("%w: %s", model.ErrUnknownEventType, t)
+		}
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate secret: %w", err)
+	}
+	webhook := &model.Webhook{
+		OrgID:  orgID,
+		URL:    req.URL,
+		Events: req.Events,
+		Secret: webhookSecretPrefix + hex.EncodeToString(secret),
+	}
+	if userIDHex != "" {
+		webhook.CreatedBy, _ = util.ParseObjectID(userIDHex)
+	}
+	if err := s.repo.Create(ctx, webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func isEventType(t string) bool {
+	for _, known := range model.EventTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// ListByOrg returns the org's webhooks without their secrets
+func (s *WebhookService) ListByOrg(ctx context.Context, orgIDHex string) ([]*model.Webhook, error) {
+	orgID, err := util.ParseObjectID(orgIDHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid org id: %w", err)
+	}
+	opts := options.FindOptions{}
+	opts.SetSort(bson.D{bson.E{Key: "createdAt", Value: -1}})
+	webhooks, err := s.repo.Find(ctx, bson.M{"orgId": orgID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if webhooks == nil {
+		webhooks = []*model.Webhook{}
+	}
+	for _, w := range webhooks {
+		w.Secret = ""
+	}
+	return webhooks, nil
+}
+
+// GetForOrg returns the webhook only when it is owned by the given org
+func (s *WebhookService) GetForOrg(ctx context.Context, id, orgIDHex string) (*model.Webhook, bool) {
+	orgID, err := util.ParseObjectID(orgIDHex)
+	if err != nil {
+		return nil, false
+	}
+	webhook, err := s.repo.FindByIDAndOrg(ctx, id, orgID)
+	if err != nil || webhook == nil {
+		return nil, false
+	}
+	webhook.Secret = ""
+	return webhook, true
+}
+
+// Delete removes a webhook; deliveries already in flight finish their current attempt
+func (s *WebhookService) Delete(ctx context.Context, webhook *model.Webhook) error {
+	return s.repo.Delete(ctx, webhook.ID)
+}
+
+// ListDeliveries returns the delivery log of a webhook, newest first
+func (s *WebhookService) ListDeliveries(ctx context.Context, webhook *model.Webhook, page, pageSize int) ([]*model.WebhookDelivery, int64, int, error) {
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 {
+		pageSize = config.DefaultPageSize
+	} else if pageSize > config.MaxPageSize {
+		pageSize = config.MaxPageSize
+	}
+
+	filter := bson.M{"webhookId": webhook.ID}
+	total, err := s.deliveries.Count(ctx, filter)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	opts := options.FindOptions{}
+	opts.SetSort(bson.D{bson.E{Key: "createdAt", Value: -1}})
+	opts.SetSkip(int64((page - 1) * pageSize))
+	opts.SetLimit(int64(pageSize))
+	deliveries, err := s.deliveries.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if deliveries == nil {
+		deliveries = []*model.WebhookDelivery{}
+	}
+	return deliveries, total, pageSize, nil
+}
+
+// Dispatch delivers an event to every webhook of its org that subscribes to it
+func (s *WebhookService) Dispatch(event *model.Event) {
+	go func() {
+		ctx := context.Background()
+		webhooks, err := s.repo.Find(ctx, bson.M{"orgId": event.OrgID}, options.FindOptions{})
+		if err != nil {
+			fmt.Printf("[webhook] failed to list webhooks for %s: %v\n", event.OrgID.Hex(), err)
+			return
+		}
+		body, err := json.Marshal(event)
+		if err != nil {
+			fmt.Printf("[webhook] failed to encode event %s: %v\n", event.ID.Hex(), err)
+			return
+		}
+		for _, w := range webhooks {
+			if w.Wants(event.Type) {
+				go s.deliver(ctx, w, event, body)
+			}
+		}
+	}()
+}
+
+// deliver posts the event until the endpoint answers 2xx or the attempts run out
+func (s *WebhookService) deliver(ctx context.Context, webhook *model.Webhook, event *model.Event, body []byte) {
+	maxAttempts := max(s.cfg.Events.WebhookMaxAttempts, 1)
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(s.webhookBackoff(attempt - 1))
+			// A webhook deleted meanwhile gets no further attempts
+			if w, err := s.repo.FindByIDAndOrg(ctx, webhook.ID.Hex(), webhook.OrgID); err == nil && w == nil {
+				return
+			}
+		}
+		if s.attempt(ctx, webhook, event, body, attempt) {
+			return
+		}
+	}
+	fmt.Printf("[webhook] giving up on %s for %s after %d attempts\n", event.ID.Hex(), webhook.URL, maxAttempts)
+}
+
+// webhookBackoff doubles the configured delay for each failed attempt
+func (s *WebhookService) webhookBackoff(failures int) time.Duration {
+	delay := time.Duration(max(s.cfg.Events.WebhookBackoffSec, 1)) * time.Second
+	for i := 1; i < failures && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxWebhookBackoff)
+}
+
+// attempt makes one signed delivery and records it in the delivery log
+func (s *WebhookService) attempt(ctx context.Context, webhook *model.Webhook, event *model.Event, body []byte, attempt int) bool {
+	record := &model.WebhookDelivery{
+		WebhookID: webhook.ID,
+		OrgID:     webhook.OrgID,
+		EventID:   event.ID,
+		EventType: event.Type,
+		Attempt:   attempt,
+	}
+
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err == nil {
+		timestamp := strconv.FormatInt(start.Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "VoidRun-Webhook/1")
+		req.Header.Set("X-VoidRun-Event", event.Type)
+		req.Header.Set("X-VoidRun-Delivery", event.ID.Hex())
+		req.Header.Set("X-VoidRun-Timestamp", timestamp)
+		req.Header.Set("X-VoidRun-Signature", "sha256="+SignWebhook(webhook.Secret, timestamp, body))
+
+		var resp *http.Response
+		if resp, err = s.client.Do(req); err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			record.StatusCode = resp.StatusCode
+			record.Success = resp.StatusCode >= 200 && resp.StatusCode < 300
+			if !record.Success {
+				record.Error = resp.Status
+			}
+		}
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	record.DurationMs = time.Since(start).Milliseconds()
+
+	if err := s.deliveries.Create(ctx, record); err != nil {
+		fmt.Printf("[webhook] failed to log delivery of %s: %v\n", event.ID.Hex(), err)
+	}
+	return record.Success
+}
+
+// SignWebhook computes the hex HMAC-SHA256 of "<timestamp>.<body>" with the webhook
+// secret. Receivers recompute it to verify the X-VoidRun-Signature header.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
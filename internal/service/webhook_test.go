@@ -0,0 +1,35 @@
+package service
+
+import (
+	"net/netip"
+	"testing"
+
+	"voidrun/internal/config"
+)
+
+func TestPublicAddrRefusesSpecialPurposeRanges(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Network.NetworkCIDR = "192.0.2.0/24"
+	s := NewWebhookService(cfg, nil, nil)
+
+	for addr, want := range map[string]bool{
+		"93.184.216.34":        true,
+		"2606:2800:220:1::248": true,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"169.254.169.254":      false,
+		"0.1.2.3":              false,
+		"100.64.0.1":           false,
+		"100.127.255.254":      false,
+		"198.18.0.1":           false,
+		"198.19.255.254":       false,
+		"64:ff9b::a9fe:a9fe":   false,
+		"::ffff:100.64.0.1":    false,
+		"fd00::1":              false,
+		"192.0.2.10":           false,
+	} {
+		if got := s.publicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("publicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -3,15 +3,15 @@ package machine
 import (
 	"fmt"
 	"os"
-)
+	"path/filepath"
 
-func Delete(id string) error {
-	if err := Stop(id); err != nil {
-		// Log the error but continue with directory deletion
-		fmt.Printf("Warning: Stop failed for %s: %v\n", id, err)
-	}
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+)
 
-	// Delete the instance directory
+// RemoveInstance deletes the instance directory of a sandbox. The VM must already have
+// been killed through its Hypervisor.
+func RemoveInstance(id string) error {
 	instanceDir := GetInstanceDir(id)
 	fmt.Printf(">> Deleting instance %s at %s\n", id, instanceDir)
 
@@ -21,6 +21,21 @@ func Delete(id string) error {
 	return nil
 }
 
+// ColdBoot starts a stopped sandbox again from the overlay left in its instance directory.
+// Guest RAM is not preserved; the guest boots fresh on the existing disk.
+func ColdBoot(cfg config.Config, spec model.SandboxSpec) error {
+	overlayPath := filepath.Join(GetInstanceDir(spec.ID), "overlay.qcow2")
+	if _, err := os.Stat(overlayPath); err != nil {
+		return fmt.Errorf("overlay missing for %s: %w", spec.ID, err)
+	}
+
+	// Stale sockets from the previous process would make the new one fail to bind
+	os.Remove(GetSocketPath(spec.ID))
+	os.Remove(GetVsockPath(spec.ID))
+
+	return Start(cfg, spec, overlayPath, "")
+}
+
 func Pause(id string) error {
 	client := NewAPIClientForSandbox(id)
 	if !client.IsSocketAvailable() {
@@ -37,6 +52,18 @@ func Resume(id string) error {
 	return client.Send("vm.resume")
 }
 
+// Resize hotplugs vCPUs and/or memory into a running sandbox. Zero values are left unchanged.
+func Resize(id string, vcpus, memMB int) error {
+	client := NewAPIClientForSandbox(id)
+	if !client.IsSocketAvailable() {
+		return fmt.Errorf("Sandbox not running")
+	}
+	return client.SendJSON("vm.resize", ResizeConfig{
+		DesiredVcpus: vcpus,
+		DesiredRam:   int64(memMB) * 1024 * 1024,
+	})
+}
+
 // Info returns the raw JSON info from Cloud Hypervisor
 func Info(id string) (string, error) {
 	client := NewAPIClientForSandbox(id)
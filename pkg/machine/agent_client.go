@@ -1,13 +1,17 @@
 package machine
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 	"time"
+
+	"voidrun/internal/model"
 )
 
 // AgentResponse represents a response from the guest agent
@@ -94,6 +98,77 @@ func DialVsock(sbxID string, port uint32, timeout time.Duration) (net.Conn, erro
 	return result, nil
 }
 
+// DialGuestPort opens a raw TCP stream to localhost:port in the guest. The agent is asked
+// to upgrade GET /port-forward?port=N to a "tcp" connection, after which bytes written to
+// the returned conn reach the guest port and its replies can be read back. An agent that
+// predates port forwarding yields model.ErrPortForwardUnsupported.
+func DialGuestPort(sbxID string, port int, timeout time.Duration) (net.Conn, error) {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	conn, err := DialVsock(sbxID, GuestAgentPort, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("set deadline failed: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://agent/port-forward?port=%d", port), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("port-forward request failed: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("port-forward response failed: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		conn.Close()
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+			return nil, model.ErrPortForwardUnsupported
+		}
+		return nil, fmt.Errorf("agent refused port %d: %s %s", port, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to clear deadline: %w", err)
+	}
+	// Bytes the agent sent right after its response are already buffered
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn reads through the reader that consumed the upgrade response
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite half-closes the stream when the underlying socket supports it
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
 func ExecuteCommand(sbxID string, cmd string, args []string) (*AgentResponse, error) {
 	// Use the common DialVsock helper
 	conn, err := DialVsock(sbxID, GuestAgentPort, 2*time.Second)
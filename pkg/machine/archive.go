@@ -0,0 +1,297 @@
+package machine
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"voidrun/internal/model"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Snapshot archives are zstd-compressed tar streams. manifest.json comes first, so an
+// import can reject an incompatible archive before extracting gigabytes of disk. The
+// snapshot files follow, and SHA256SUMS comes last, covering every entry before it.
+const (
+	archiveManifest  = "manifest.json"
+	archiveChecksums = "SHA256SUMS"
+	// archiveMetaMax bounds manifest.json and SHA256SUMS, which are read into memory
+	archiveMetaMax = 1 << 20
+)
+
+// ExportSnapshot writes the files of the snapshot in snapDir to w as an archive, with
+// manifest stored as manifest.json
+func ExportSnapshot(w io.Writer, snapDir string, manifest []byte) error {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	sums := make(map[string]string)
+	now := time.Now()
+
+	if err := writeArchiveEntry(tw, archiveManifest, manifest, now); err != nil {
+		return err
+	}
+	sums[archiveManifest] = sha256Hex(manifest)
+
+	err = filepath.WalkDir(snapDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(snapDir, p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if name == archiveManifest || name == archiveChecksums {
+			return fmt.Errorf("snapshot file %s clashes with archive metadata", name)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime(), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(tw, h), f); err != nil {
+			return err
+		}
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive snapshot: %w", err)
+	}
+
+	if err := writeArchiveEntry(tw, archiveChecksums, formatChecksums(sums), now); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ImportSnapshot extracts an archive written by ExportSnapshot into snapDir and verifies
+// every file against SHA256SUMS. check is called with the manifest before anything is
+// extracted; an error from it aborts the import. maxBytes, when above 0, caps the total
+// size of the extracted files, so a small archive cannot decompress into a full disk;
+// past it the import fails with model.ErrSnapshotTooLarge. On failure snapDir is removed.
+// The files are left writable; SealSnapshot locks them once the caller is done with them.
+func ImportSnapshot(r io.Reader, snapDir string, maxBytes int64, check func(manifest []byte) error) (err error) {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", model.ErrInvalidSnapshotArchive, err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("%w: %v", model.ErrInvalidSnapshotArchive, err)
+	}
+	if hdr.Name != archiveManifest {
+		return fmt.Errorf("%w: archive must start with %s", model.ErrInvalidSnapshotArchive, archiveManifest)
+	}
+	manifest, err := readArchiveMeta(tr)
+	if err != nil {
+		return err
+	}
+	if err := check(manifest); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(snapDir); err == nil {
+		return fmt.Errorf("snapshot directory %s already exists", snapDir)
+	}
+	if err := os.MkdirAll(snapDir, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(snapDir)
+		}
+	}()
+
+	got := map[string]string{archiveManifest: sha256Hex(manifest)}
+	var want map[string]string
+	var extracted int64
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", model.ErrInvalidSnapshotArchive, err)
+		}
+		if want != nil {
+			return fmt.Errorf("%w: entries after %s", model.ErrInvalidSnapshotArchive, archiveChecksums)
+		}
+		if hdr.Name == archiveChecksums {
+			data, err := readArchiveMeta(tr)
+			if err != nil {
+				return err
+			}
+			if want, err = parseChecksums(data); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name, err := archiveEntryName(hdr)
+		if err != nil {
+			return err
+		}
+		if _, dup := got[name]; dup {
+			return fmt.Errorf("%w: duplicate entry %s", model.ErrInvalidSnapshotArchive, name)
+		}
+		limit := int64(-1)
+		if maxBytes > 0 {
+			if limit = maxBytes - extracted; hdr.Size > limit {
+				return model.ErrSnapshotTooLarge
+			}
+		}
+		sum, n, err := extractArchiveFile(tr, filepath.Join(snapDir, filepath.FromSlash(name)), limit)
+		if err != nil {
+			return err
+		}
+		extracted += n
+		got[name] = sum
+	}
+
+	if want == nil {
+		return fmt.Errorf("%w: %s missing", model.ErrInvalidSnapshotArchive, archiveChecksums)
+	}
+	for name, sum := range got {
+		if want[name] != sum {
+			return fmt.Errorf("%w: checksum mismatch for %s", model.ErrInvalidSnapshotArchive, name)
+		}
+	}
+	for name := range want {
+		if _, ok := got[name]; !ok {
+			return fmt.Errorf("%w: %s listed in %s but missing", model.ErrInvalidSnapshotArchive, name, archiveChecksums)
+		}
+	}
+	return nil
+}
+
+// archiveEntryName validates a file entry and returns its cleaned relative path.
+// Links, devices and paths escaping the snapshot directory are rejected.
+func archiveEntryName(hdr *tar.Header) (string, error) {
+	if hdr.Typeflag != tar.TypeReg {
+		return "", fmt.Errorf("%w: unsupported entry type for %s", model.ErrInvalidSnapshotArchive, hdr.Name)
+	}
+	name := path.Clean(hdr.Name)
+	if name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("%w: illegal path %s", model.ErrInvalidSnapshotArchive, hdr.Name)
+	}
+	return name, nil
+}
+
+// extractArchiveFile writes r to dst and returns its checksum and size. It stops with
+// model.ErrSnapshotTooLarge after limit bytes unless limit is negative.
+func extractArchiveFile(r io.Reader, dst string, limit int64) (string, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", 0, err
+	}
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", 0, err
+	}
+	if limit >= 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		f.Close()
+		return "", n, fmt.Errorf("%w: %v", model.ErrInvalidSnapshotArchive, err)
+	}
+	if err := f.Close(); err != nil {
+		return "", n, err
+	}
+	if limit >= 0 && n > limit {
+		return "", n, model.ErrSnapshotTooLarge
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func readArchiveMeta(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, archiveMetaMax+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", model.ErrInvalidSnapshotArchive, err)
+	}
+	if len(data) > archiveMetaMax {
+		return nil, fmt.Errorf("%w: metadata entry too large", model.ErrInvalidSnapshotArchive)
+	}
+	return data, nil
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// formatChecksums renders sums in the format of sha256sum, sorted by name
+func formatChecksums(sums map[string]string) []byte {
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s  %s\n", sums[name], name)
+	}
+	return []byte(b.String())
+}
+
+func parseChecksums(data []byte) (map[string]string, error) {
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		sum, name, ok := strings.Cut(line, "  ")
+		if !ok || len(sum) != sha256.Size*2 {
+			return nil, fmt.Errorf("%w: malformed %s line %q", model.ErrInvalidSnapshotArchive, archiveChecksums, line)
+		}
+		sums[name] = sum
+	}
+	return sums, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
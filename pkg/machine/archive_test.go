@@ -0,0 +1,40 @@
+package machine
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"voidrun/internal/model"
+)
+
+// A few KB of zstd can expand to gigabytes, so the import limit must hold for the
+// extracted files and not only for the upload
+func TestImportSnapshotCapsExtractedSize(t *testing.T) {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "overlay.qcow2"), make([]byte, 8<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := ExportSnapshot(&archive, srcDir, []byte(`{"formatVersion":1}`)); err != nil {
+		t.Fatalf("ExportSnapshot: %v", err)
+	}
+	if archive.Len() > 1<<20 {
+		t.Fatalf("archive of zeros is %d bytes, want it well under the limit", archive.Len())
+	}
+
+	snapDir := filepath.Join(t.TempDir(), "imported")
+	err := ImportSnapshot(bytes.NewReader(archive.Bytes()), snapDir, 1<<20, func([]byte) error { return nil })
+	if !errors.Is(err, model.ErrSnapshotTooLarge) {
+		t.Fatalf("ImportSnapshot = %v, want ErrSnapshotTooLarge", err)
+	}
+	if _, err := os.Stat(snapDir); !os.IsNotExist(err) {
+		t.Fatalf("snapshot directory left behind: %v", err)
+	}
+
+	if err := ImportSnapshot(bytes.NewReader(archive.Bytes()), snapDir, 16<<20, func([]byte) error { return nil }); err != nil {
+		t.Fatalf("ImportSnapshot within the limit: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package machine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+)
+
+// CLH drives VMs with the cloud-hypervisor binary through its HTTP API on the
+// vm.sock of each instance
+type CLH struct{}
+
+func NewCLH() *CLH {
+	return &CLH{}
+}
+
+func (CLH) Name() string { return DriverCLH }
+
+var (
+	clhVersionOnce sync.Once
+	clhVersion     string
+)
+
+// Version runs cloud-hypervisor --version once, e.g. "v41.0"
+func (CLH) Version() string {
+	clhVersionOnce.Do(func() {
+		out, err := exec.Command("cloud-hypervisor", "--version").Output()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(string(out))
+		if len(fields) > 0 {
+			clhVersion = fields[len(fields)-1]
+		}
+	})
+	return clhVersion
+}
+
+func (CLH) Create(cfg config.Config, spec model.SandboxSpec, overlayPath string) error {
+	return Start(cfg, spec, overlayPath, "")
+}
+
+func (CLH) Boot(cfg config.Config, spec model.SandboxSpec) error {
+	return ColdBoot(cfg, spec)
+}
+
+func (CLH) Pause(id string) error { return Pause(id) }
+
+func (CLH) Resume(id string) error { return Resume(id) }
+
+func (CLH) Resize(id string, vcpus, memMB int) error { return Resize(id, vcpus, memMB) }
+
+func (CLH) Snapshot(id, snapDir string) (int64, error) { return CreateSnapshot(id, snapDir) }
+
+func (CLH) Restore(cfg config.Config, spec model.SandboxSpec, snapshotPath string, cold bool) error {
+	return Restore(cfg, spec, snapshotPath, cold)
+}
+
+func (CLH) AdoptSnapshot(cfg config.Config, snapshotPath string, spec model.SandboxSpec) error {
+	return adoptSnapshotConfig(filepath.Join(snapshotPath, "state"), cfg.Paths.KernelPath, cfg.Paths.InitrdPath, spec)
+}
+
+func (CLH) Hibernate(id string) error { return Hibernate(id) }
+
+func (CLH) Wake(cfg config.Config, spec model.SandboxSpec) error { return Wake(cfg, spec) }
+
+func (CLH) Info(id string) (string, error) { return Info(id) }
+
+func (CLH) State(ctx context.Context, id string) (string, error) {
+	client := NewAPIClientForSandbox(id)
+	if !client.IsSocketAvailable() {
+		return "", ErrVMNotRunning
+	}
+	return client.GetStateWithContext(ctx)
+}
+
+func (CLH) Stop(id string) (StopStage, error) { return Stop(id) }
+
+func (CLH) Kill(id string) error { return Kill(id) }
+
+// Counters reads vm.counters, falling back to its /api/v1 path on newer Cloud Hypervisor releases
+func (CLH) Counters(ctx context.Context, id string) (*VMCounters, error) {
+	socketPath := GetSocketPath(id)
+	body, status, err := unixGet(ctx, socketPath, "/vm.counters")
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		body, status, err = unixGet(ctx, socketPath, "/api/v1/vm.counters")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("vm.counters status %d", status)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, fmt.Errorf("decode vm.counters: %w", err)
+	}
+
+	counters := &VMCounters{
+		Disks: map[string]DiskCounters{},
+		Nets:  map[string]NetCounters{},
+	}
+	if cpuRaw, ok := raw["cpu"]; ok {
+		var cpu UsageCounter
+		if err := json.Unmarshal(cpuRaw, &cpu); err == nil {
+			counters.CPU = &cpu
+		}
+	}
+	if memRaw, ok := raw["memory"]; ok {
+		var mem UsageCounter
+		if err := json.Unmarshal(memRaw, &mem); err == nil {
+			counters.Memory = &mem
+		}
+	}
+	for key, payload := range raw {
+		switch {
+		case strings.HasPrefix(key, "_disk"):
+			var disk DiskCounters
+			if err := json.Unmarshal(payload, &disk); err == nil {
+				counters.Disks[key] = disk
+			}
+		case strings.HasPrefix(key, "_net"):
+			var netc NetCounters
+			if err := json.Unmarshal(payload, &netc); err == nil {
+				counters.Nets[key] = netc
+			}
+		}
+	}
+	return counters, nil
+}
+
+func unixGet(ctx context.Context, socketPath, urlPath string) ([]byte, int, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socketPath)
+		},
+		DisableKeepAlives: true,
+	}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+urlPath, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, resp.StatusCode, err
+	}
+	return body, resp.StatusCode, nil
+}
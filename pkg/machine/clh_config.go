@@ -6,7 +6,7 @@ type CLHConfig struct {
 	Cpus    CpusConfig    `json:"cpus"`
 	Memory  MemoryConfig  `json:"memory"`
 	Disks   []DiskConfig  `json:"disks"`
-	Net     []NetConfig   `json:"net"`
+	Net     []NetConfig   `json:"net,omitempty"`
 	Rng     RngConfig     `json:"rng"`
 	Serial  ConsoleConfig `json:"serial"`
 	Console ConsoleConfig `json:"console"`
@@ -25,20 +25,43 @@ type CpusConfig struct {
 }
 
 type MemoryConfig struct {
-	Size      int64 `json:"size"`
-	Shared    bool  `json:"shared"`
-	Mergeable bool  `json:"mergeable"`
-	Prefault  bool  `json:"prefault"`
+	Size        int64 `json:"size"`
+	HotplugSize int64 `json:"hotplug_size,omitempty"`
+	Shared      bool  `json:"shared"`
+	Mergeable   bool  `json:"mergeable"`
+	Prefault    bool  `json:"prefault"`
+}
+
+// ResizeConfig is the body of vm.resize; zero fields are left unchanged
+type ResizeConfig struct {
+	DesiredVcpus int   `json:"desired_vcpus,omitempty"`
+	DesiredRam   int64 `json:"desired_ram,omitempty"`
 }
 
 type DiskConfig struct {
-	Path string `json:"path"`
+	Path              string             `json:"path"`
+	RateLimiterConfig *RateLimiterConfig `json:"rate_limiter_config,omitempty"`
 }
 
 type NetConfig struct {
-	Tap string `json:"tap"`
-	Mac string `json:"mac"`
-	IP  string `json:"ip,omitempty"` // Optional, but accepted by API
+	Tap               string             `json:"tap"`
+	Mac               string             `json:"mac"`
+	IP                string             `json:"ip,omitempty"` // Optional, but accepted by API
+	RateLimiterConfig *RateLimiterConfig `json:"rate_limiter_config,omitempty"`
+}
+
+// RateLimiterConfig throttles a disk or NIC; a nil bucket is unlimited
+type RateLimiterConfig struct {
+	Bandwidth *TokenBucket `json:"bandwidth,omitempty"`
+	Ops       *TokenBucket `json:"ops,omitempty"`
+}
+
+// TokenBucket holds Size tokens, bytes or operations, refilled every RefillTime ms.
+// OneTimeBurst tokens are granted once on top.
+type TokenBucket struct {
+	Size         int64 `json:"size"`
+	OneTimeBurst int64 `json:"one_time_burst,omitempty"`
+	RefillTime   int64 `json:"refill_time"`
 }
 
 type RngConfig struct {
@@ -46,7 +69,8 @@ type RngConfig struct {
 }
 
 type ConsoleConfig struct {
-	Mode string `json:"mode"` // "Null", "Tty", "File"
+	Mode   string `json:"mode"` // "Null", "Tty", "File", "Socket"
+	Socket string `json:"socket,omitempty"`
 }
 
 type VsockConfig struct {
@@ -20,6 +20,9 @@ const (
 
 var InstancesRoot string
 
+// SnapshotsRoot holds snapshot directories; kept apart from instances so snapshots outlive their source sandbox
+var SnapshotsRoot string
+
 // SetInstancesRoot sets the instances root directory from configuration
 func SetInstancesRoot(path string) {
 	if path != "" {
@@ -27,6 +30,13 @@ func SetInstancesRoot(path string) {
 	}
 }
 
+// SetSnapshotsRoot sets the snapshots root directory from configuration
+func SetSnapshotsRoot(path string) {
+	if path != "" {
+		SnapshotsRoot = path
+	}
+}
+
 // KernelPath is the path to the kernel image
 // var KernelPath = DefaultKernelPath
 
@@ -233,3 +243,7 @@ func GetPIDPath(sbxID string) string {
 func GetTapPath(sbxID string) string {
 	return fmt.Sprintf("%s/%s/vm.tap", InstancesRoot, sbxID)
 }
+
+func GetSnapshotDir(snapshotID string) string {
+	return fmt.Sprintf("%s/%s", SnapshotsRoot, snapshotID)
+}
@@ -0,0 +1,288 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The serial port of every VM is a unix socket in its instance directory. The server
+// keeps the only connection to it, writes everything the guest prints to console.log
+// (rotated to console.log.1) and fans the output out to attached clients.
+
+// consoleBootTimeout bounds the wait for the serial socket of a booting VM
+const consoleBootTimeout = 30 * time.Second
+
+var (
+	consoleLogMaxBytes int64 = 1 << 20
+	// consoleEcho copies console output to the server's stdout for boot debugging
+	consoleEcho bool
+)
+
+// SetConsoleLog sets the console log rotation size and whether output is echoed to stdout
+func SetConsoleLog(maxBytes int64, echo bool) {
+	if maxBytes > 0 {
+		consoleLogMaxBytes = maxBytes
+	}
+	consoleEcho = echo
+}
+
+func GetConsoleSocketPath(sbxID string) string {
+	return filepath.Join(GetInstanceDir(sbxID), "console.sock")
+}
+
+func GetConsoleLogPath(sbxID string) string {
+	return filepath.Join(GetInstanceDir(sbxID), "console.log")
+}
+
+// consoleCapture owns the serial socket connection of one running VM
+type consoleCapture struct {
+	id   string
+	conn net.Conn
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	clients map[chan []byte]struct{}
+}
+
+var (
+	capturesMu sync.Mutex
+	captures   = make(map[string]*consoleCapture)
+)
+
+// StartConsoleCapture connects to the serial socket of a sandbox and starts logging its
+// output. It is a no-op when the console is already captured, so it can be called for
+// every running sandbox after a server restart.
+func StartConsoleCapture(sbxID string) error {
+	_, err := ensureCapture(sbxID)
+	return err
+}
+
+// captureConsoleOnBoot connects console capture as soon as the serial socket of a sandbox
+// appears. Cloud Hypervisor only creates the socket while it handles vm.boot, so this is
+// started before vm.boot to be attached before the guest prints anything. The returned
+// channel yields the outcome.
+func captureConsoleOnBoot(sbxID string, timeout time.Duration) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		path := GetConsoleSocketPath(sbxID)
+		deadline := time.Now().Add(timeout)
+		for {
+			_, err := os.Stat(path)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				done <- fmt.Errorf("console socket unavailable: %w", err)
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		_, err := ensureCapture(sbxID)
+		done <- err
+	}()
+	return done
+}
+
+func ensureCapture(sbxID string) (*consoleCapture, error) {
+	capturesMu.Lock()
+	defer capturesMu.Unlock()
+	if c, ok := captures[sbxID]; ok {
+		return c, nil
+	}
+
+	conn, err := dialConsole(GetConsoleSocketPath(sbxID), 2*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(GetConsoleLogPath(sbxID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open console log: %w", err)
+	}
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	c := &consoleCapture{id: sbxID, conn: conn, file: file, size: size, clients: make(map[chan []byte]struct{})}
+	captures[sbxID] = c
+	go c.pump()
+	return c, nil
+}
+
+// dialConsole connects to the serial socket, retrying while the VMM starts listening.
+// A missing socket fails at once: the VM was booted without one.
+func dialConsole(path string, timeout time.Duration) (net.Conn, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("console socket unavailable: %w", err)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.Dial("unix", path)
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("console socket unavailable: %w", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// pump copies console output until the VMM closes the socket
+func (c *consoleCapture) pump() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+		if n > 0 {
+			c.record(buf[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	capturesMu.Lock()
+	if captures[c.id] == c {
+		delete(captures, c.id)
+	}
+	capturesMu.Unlock()
+
+	c.mu.Lock()
+	c.conn.Close()
+	c.file.Close()
+	for ch := range c.clients {
+		close(ch)
+	}
+	c.clients = nil
+	c.mu.Unlock()
+}
+
+func (c *consoleCapture) record(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size+int64(len(p)) > consoleLogMaxBytes {
+		c.rotate()
+	}
+	if n, err := c.file.Write(p); err == nil {
+		c.size += int64(n)
+	}
+	if consoleEcho {
+		os.Stdout.Write(p)
+	}
+
+	for ch := range c.clients {
+		out := make([]byte, len(p))
+		copy(out, p)
+		select {
+		case ch <- out:
+		default:
+			// A client that cannot keep up loses output rather than stalling the guest
+		}
+	}
+}
+
+// rotate moves console.log to console.log.1 and starts a new file
+func (c *consoleCapture) rotate() {
+	path := GetConsoleLogPath(c.id)
+	c.file.Close()
+	os.Rename(path, path+".1")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		// Keep writing somewhere harmless until the next rotation attempt
+		file, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	}
+	c.file = file
+	c.size = 0
+}
+
+// ConsoleSession is one interactive attachment to a sandbox console
+type ConsoleSession struct {
+	capture *consoleCapture
+	ch      chan []byte
+	once    sync.Once
+}
+
+// AttachConsole subscribes to the console output of a running sandbox. Output is
+// delivered on Output until the VM exits or Close is called.
+func AttachConsole(sbxID string) (*ConsoleSession, error) {
+	c, err := ensureCapture(sbxID)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan []byte, 256)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clients == nil {
+		return nil, errors.New("console closed")
+	}
+	c.clients[ch] = struct{}{}
+	return &ConsoleSession{capture: c, ch: ch}, nil
+}
+
+// Output returns the channel of console output; it is closed when the VM exits
+func (s *ConsoleSession) Output() <-chan []byte {
+	return s.ch
+}
+
+// Write sends input to the guest's serial port
+func (s *ConsoleSession) Write(p []byte) (int, error) {
+	return s.capture.conn.Write(p)
+}
+
+// Close detaches the session; the console keeps being captured
+func (s *ConsoleSession) Close() {
+	s.once.Do(func() {
+		c := s.capture
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.clients[s.ch]; ok {
+			delete(c.clients, s.ch)
+			close(s.ch)
+		}
+	})
+}
+
+// ReadConsoleLog returns the captured console output of a sandbox, oldest first. When
+// tail is positive only the last tail bytes are returned.
+func ReadConsoleLog(sbxID string, tail int64) ([]byte, error) {
+	path := GetConsoleLogPath(sbxID)
+	current, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if tail > 0 && int64(len(current)) >= tail {
+		return current[int64(len(current))-tail:], nil
+	}
+
+	previous, err := readTail(path+".1", tail-int64(len(current)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return append(previous, current...), nil
+}
+
+// readTail reads the last n bytes of a file, or all of it when n is not positive
+func readTail(path string, n int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if n > 0 {
+		if info, err := f.Stat(); err == nil && info.Size() > n {
+			if _, err := f.Seek(-n, io.SeekEnd); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return io.ReadAll(f)
+}
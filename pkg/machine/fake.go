@@ -0,0 +1,387 @@
+package machine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+	"voidrun/pkg/storage"
+)
+
+// Fake is a Hypervisor that runs no VMs. It keeps the state of each sandbox in memory,
+// writes the instance, snapshot and hibernation files the rest of the server looks at,
+// and serves a stand-in guest agent on the vsock socket of every "running" sandbox, so
+// the API can be exercised on hosts without KVM. VMs do not survive a server restart.
+type Fake struct {
+	// Agent serves the requests made to the guest agent; FakeAgentHandler when nil
+	Agent http.Handler
+
+	mu  sync.Mutex
+	vms map[string]*fakeVM
+}
+
+type fakeVM struct {
+	state string
+	cpus  int
+	memMB int
+	agent *http.Server
+}
+
+// fakeVMConfig is what the fake stores as config.json in snapshot and hibernation state
+type fakeVMConfig struct {
+	CPUs     int `json:"cpus"`
+	MemoryMB int `json:"memoryMb"`
+}
+
+func NewFake() *Fake {
+	return &Fake{vms: make(map[string]*fakeVM)}
+}
+
+func (f *Fake) Name() string { return DriverFake }
+
+func (f *Fake) Version() string { return "" }
+
+func (f *Fake) Create(cfg config.Config, spec model.SandboxSpec, overlayPath string) error {
+	if _, err := os.Stat(overlayPath); err != nil {
+		return fmt.Errorf("overlay missing for %s: %w", spec.ID, err)
+	}
+	return f.start(spec.ID, spec.CPUs, spec.MemoryMB)
+}
+
+func (f *Fake) Boot(cfg config.Config, spec model.SandboxSpec) error {
+	return f.Create(cfg, spec, filepath.Join(GetInstanceDir(spec.ID), "overlay.qcow2"))
+}
+
+func (f *Fake) Pause(id string) error {
+	return f.setState(id, VMStateRunning, VMStatePaused)
+}
+
+func (f *Fake) Resume(id string) error {
+	return f.setState(id, VMStatePaused, VMStateRunning)
+}
+
+func (f *Fake) Resize(id string, vcpus, memMB int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vm, ok := f.vms[id]
+	if !ok {
+		return fmt.Errorf("Sandbox not running")
+	}
+	if vcpus > 0 {
+		vm.cpus = vcpus
+	}
+	if memMB > 0 {
+		vm.memMB = memMB
+	}
+	return nil
+}
+
+func (f *Fake) Snapshot(id, snapDir string) (int64, error) {
+	vm, err := f.get(id)
+	if err != nil {
+		return 0, fmt.Errorf("Sandbox socket not found. Is Sandbox running?")
+	}
+	if err := writeFakeState(filepath.Join(snapDir, "state"), vm); err != nil {
+		os.RemoveAll(snapDir)
+		return 0, err
+	}
+	srcDisk := filepath.Join(GetInstanceDir(id), "overlay.qcow2")
+	dstDisk := filepath.Join(snapDir, "overlay.qcow2")
+	if err := copyFile(srcDisk, dstDisk); err != nil {
+		os.RemoveAll(snapDir)
+		return 0, fmt.Errorf("disk copy failed: %w", err)
+	}
+	if err := storage.DetachOverlay(context.Background(), dstDisk); err != nil {
+		os.RemoveAll(snapDir)
+		return 0, err
+	}
+
+	return SealSnapshot(snapDir), nil
+}
+
+func (f *Fake) Restore(cfg config.Config, spec model.SandboxSpec, snapshotPath string, cold bool) error {
+	instanceDir := GetInstanceDir(spec.ID)
+	if _, err := os.Stat(instanceDir); err == nil {
+		return fmt.Errorf("Sandbox ID %s already exists", spec.ID)
+	}
+	if err := os.MkdirAll(instanceDir, 0755); err != nil {
+		return fmt.Errorf("failed to create instance dir: %w", err)
+	}
+	dstDisk := filepath.Join(instanceDir, "overlay.qcow2")
+	if err := storage.CloneOverlay(context.Background(), filepath.Join(snapshotPath, "overlay.qcow2"), dstDisk); err != nil {
+		os.RemoveAll(instanceDir)
+		return err
+	}
+
+	cpus, memMB := spec.CPUs, spec.MemoryMB
+	if !cold {
+		// A live restore keeps the shape of the captured VM
+		state, err := readFakeState(filepath.Join(snapshotPath, "state"))
+		if err != nil {
+			os.RemoveAll(instanceDir)
+			return err
+		}
+		cpus, memMB = state.CPUs, state.MemoryMB
+	}
+	if err := f.start(spec.ID, cpus, memMB); err != nil {
+		os.RemoveAll(instanceDir)
+		return err
+	}
+	return nil
+}
+
+// AdoptSnapshot only checks that the captured VM shape can be read back and matches spec
+func (f *Fake) AdoptSnapshot(cfg config.Config, snapshotPath string, spec model.SandboxSpec) error {
+	state, err := readFakeState(filepath.Join(snapshotPath, "state"))
+	if err != nil || state.CPUs <= 0 || state.MemoryMB <= 0 {
+		return fmt.Errorf("%w: bad VM state", model.ErrInvalidSnapshotArchive)
+	}
+	if state.CPUs != spec.CPUs || state.MemoryMB != spec.MemoryMB {
+		return fmt.Errorf("%w: VM state has %d vCPUs and %d MiB, manifest %d and %d", model.ErrInvalidSnapshotArchive,
+			state.CPUs, state.MemoryMB, spec.CPUs, spec.MemoryMB)
+	}
+	return nil
+}
+
+func (f *Fake) Hibernate(id string) error {
+	vm, err := f.get(id)
+	if err != nil {
+		return err
+	}
+	if err := writeFakeState(GetHibernateDir(id), vm); err != nil {
+		return err
+	}
+	return f.Kill(id)
+}
+
+func (f *Fake) Wake(cfg config.Config, spec model.SandboxSpec) error {
+	state, err := readFakeState(GetHibernateDir(spec.ID))
+	if err != nil {
+		return fmt.Errorf("hibernation state missing for %s: %w", spec.ID, err)
+	}
+	if err := f.start(spec.ID, state.CPUs, state.MemoryMB); err != nil {
+		return err
+	}
+	DiscardHibernation(spec.ID)
+	return nil
+}
+
+func (f *Fake) Info(id string) (string, error) {
+	vm, err := f.get(id)
+	if err != nil {
+		return "", fmt.Errorf("Sandbox not running (socket missing)")
+	}
+	info := map[string]interface{}{
+		"state": vm.state,
+		"config": map[string]interface{}{
+			"cpus":   map[string]int{"boot_vcpus": vm.cpus},
+			"memory": map[string]int64{"size": int64(vm.memMB) * 1024 * 1024},
+		},
+	}
+	body, err := json.Marshal(info)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (f *Fake) State(ctx context.Context, id string) (string, error) {
+	vm, err := f.get(id)
+	if err != nil {
+		return "", err
+	}
+	return vm.state, nil
+}
+
+// Stop powers the VM off at once; a fake guest always honours the power button
+func (f *Fake) Stop(id string) (StopStage, error) {
+	if _, err := f.get(id); err != nil {
+		return StopStageNotRunning, nil
+	}
+	return StopStageShutdown, f.Kill(id)
+}
+
+func (f *Fake) Kill(id string) error {
+	f.mu.Lock()
+	vm, ok := f.vms[id]
+	delete(f.vms, id)
+	f.mu.Unlock()
+	if ok {
+		vm.agent.Close()
+	}
+	os.Remove(GetVsockPath(id))
+	return nil
+}
+
+// Counters reports an idle VM
+func (f *Fake) Counters(ctx context.Context, id string) (*VMCounters, error) {
+	if _, err := f.get(id); err != nil {
+		return nil, err
+	}
+	return &VMCounters{
+		CPU:    &UsageCounter{},
+		Memory: &UsageCounter{},
+		Disks:  map[string]DiskCounters{"_disk0": {}},
+		Nets:   map[string]NetCounters{"_net0": {}},
+	}, nil
+}
+
+// start registers a running VM and begins serving its agent
+func (f *Fake) start(id string, cpus, memMB int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.vms[id]; ok {
+		return fmt.Errorf("Sandbox %s already running", id)
+	}
+
+	vsockPath := GetVsockPath(id)
+	os.Remove(vsockPath)
+	ln, err := net.Listen("unix", vsockPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on vsock socket: %w", err)
+	}
+	handler := f.Agent
+	if handler == nil {
+		handler = FakeAgentHandler()
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(&vsockListener{Listener: ln})
+
+	f.vms[id] = &fakeVM{state: VMStateRunning, cpus: cpus, memMB: memMB, agent: srv}
+	return nil
+}
+
+func (f *Fake) get(id string) (fakeVM, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vm, ok := f.vms[id]
+	if !ok {
+		return fakeVM{}, ErrVMNotRunning
+	}
+	return *vm, nil
+}
+
+func (f *Fake) setState(id, from, to string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	vm, ok := f.vms[id]
+	if !ok {
+		return fmt.Errorf("Sandbox not running")
+	}
+	// Cloud Hypervisor's "already paused/running" errors are ignored as well
+	if vm.state == from {
+		vm.state = to
+	}
+	return nil
+}
+
+func writeFakeState(dir string, vm fakeVM) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(fakeVMConfig{CPUs: vm.cpus, MemoryMB: vm.memMB})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "config.json"), data, 0644)
+}
+
+func readFakeState(dir string) (fakeVMConfig, error) {
+	var state fakeVMConfig
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse VM state: %w", err)
+	}
+	return state, nil
+}
+
+// vsockListener answers the "CONNECT <port>" handshake that Cloud Hypervisor's vsock
+// muxer expects before handing the connection to the agent
+type vsockListener struct {
+	net.Listener
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := acceptVsockHandshake(conn); err != nil {
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+}
+
+func acceptVsockHandshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	// Read byte by byte so nothing after the handshake line is consumed
+	var line strings.Builder
+	buf := [1]byte{}
+	for {
+		if _, err := conn.Read(buf[:]); err != nil {
+			return err
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		line.WriteByte(buf[0])
+		if line.Len() > 64 {
+			return errors.New("handshake too long")
+		}
+	}
+	port, ok := strings.CutPrefix(strings.TrimSpace(line.String()), "CONNECT ")
+	if !ok {
+		return fmt.Errorf("unexpected handshake %q", line.String())
+	}
+	_, err := fmt.Fprintf(conn, "OK %s\n", port)
+	return err
+}
+
+// FakeAgentHandler is the default guest agent of the Fake driver. It answers the
+// readiness probe, metrics, env and process list requests; commands run by /exec
+// produce no output and exit 0.
+func FakeAgentHandler() http.Handler {
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{"cpuUsagePercent": 0, "memUsedBytes": 0, "diskUsedBytes": 0})
+	})
+	mux.HandleFunc("/env", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]bool{"success": true})
+	})
+	mux.HandleFunc("/processes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, model.CommandListResponse{Success: true, Processes: []model.ProcessInfo{}})
+	})
+	mux.HandleFunc("/exec", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, model.ExecResponse{ExitCode: 0})
+	})
+	return mux
+}
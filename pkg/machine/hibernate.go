@@ -0,0 +1,109 @@
+package machine
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+)
+
+// GetHibernateDir returns where the RAM state of a hibernated sandbox is kept
+func GetHibernateDir(sbxID string) string {
+	return filepath.Join(GetInstanceDir(sbxID), "hibernate")
+}
+
+// Hibernate saves the memory of a sandbox next to its overlay, then kills the VM process
+// and deletes its TAP. The overlay stays in place, so unlike CreateSnapshot no disk copy
+// is made: nothing else writes to it until Wake.
+func Hibernate(sbxID string) error {
+	client := NewAPIClientForSandbox(sbxID)
+	if !client.IsSocketAvailable() {
+		return fmt.Errorf("Sandbox not running")
+	}
+
+	state, err := client.GetState()
+	if err != nil {
+		return fmt.Errorf("failed to get Sandbox state: %w", err)
+	}
+	if state != "Running" && state != "Paused" {
+		return fmt.Errorf("cannot hibernate Sandbox in state: %s", state)
+	}
+
+	log.Printf(">> Hibernating Sandbox ID: %s\n", sbxID)
+	if state == "Running" {
+		if err := client.Send("vm.pause"); err != nil {
+			return fmt.Errorf("pause failed: %w", err)
+		}
+	}
+	resume := func() {
+		if state == "Running" {
+			client.Send("vm.resume")
+		}
+	}
+
+	stateDir := GetHibernateDir(sbxID)
+	os.RemoveAll(stateDir)
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		resume()
+		return err
+	}
+	payload := map[string]string{
+		"destination_url": fmt.Sprintf("file://%s", stateDir),
+	}
+	if err := client.SendJSON("vm.snapshot", payload); err != nil {
+		resume()
+		os.RemoveAll(stateDir)
+		return fmt.Errorf("snapshot failed: %w", err)
+	}
+	fmt.Println("   [+] Memory Dumped")
+
+	// The process is gone from here on; only the overlay and the state dir remain
+	Kill(sbxID)
+	os.Remove(GetSocketPath(sbxID))
+	os.Remove(GetVsockPath(sbxID))
+	return nil
+}
+
+// Wake restores a hibernated sandbox from its saved memory on a fresh TAP and resumes it.
+// spec must carry the IP the sandbox had when it was hibernated.
+func Wake(cfg config.Config, spec model.SandboxSpec) error {
+	stateDir := GetHibernateDir(spec.ID)
+	if _, err := os.Stat(filepath.Join(stateDir, "config.json")); err != nil {
+		return fmt.Errorf("hibernation state missing for %s: %w", spec.ID, err)
+	}
+	overlayPath := filepath.Join(GetInstanceDir(spec.ID), "overlay.qcow2")
+
+	log.Printf(">> Waking Sandbox ID: %s\n", spec.ID)
+	os.Remove(GetSocketPath(spec.ID))
+	os.Remove(GetVsockPath(spec.ID))
+	if err := Start(cfg, spec, overlayPath, stateDir); err != nil {
+		return err
+	}
+
+	client := NewAPIClientForSandbox(spec.ID)
+	if err := client.WaitForSocket(2 * time.Second); err != nil {
+		Kill(spec.ID)
+		return fmt.Errorf("socket timed out waiting for resume: %w", err)
+	}
+	if err := client.Send("vm.resume"); err != nil {
+		Kill(spec.ID)
+		return fmt.Errorf("resume failed: %w", err)
+	}
+
+	// The guest now runs ahead of the saved state; waking it again would roll it back
+	DiscardHibernation(spec.ID)
+	fmt.Println("   [+] Sandbox Woken")
+	return nil
+}
+
+// DiscardHibernation removes the saved memory of a hibernated sandbox
+func DiscardHibernation(sbxID string) error {
+	if err := os.RemoveAll(GetHibernateDir(sbxID)); err != nil {
+		return fmt.Errorf("failed to discard hibernation state: %w", err)
+	}
+	return nil
+}
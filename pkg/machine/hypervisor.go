@@ -0,0 +1,114 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+)
+
+// Hypervisor is the driver that runs sandbox VMs. The service layer and the metrics
+// manager reach VMs only through it. Instance directories, console logs and the vsock
+// socket of the guest agent are laid out the same way whichever driver is used.
+type Hypervisor interface {
+	// Name identifies the driver in logs and configuration
+	Name() string
+	// Version reports the version of the VMM behind the driver, empty when unknown
+	Version() string
+	// Create spawns a VM for spec on the overlay at overlayPath and boots it
+	Create(cfg config.Config, spec model.SandboxSpec, overlayPath string) error
+	// Boot starts a stopped sandbox again from the overlay left in its instance directory
+	Boot(cfg config.Config, spec model.SandboxSpec) error
+	Pause(id string) error
+	Resume(id string) error
+	// Resize hotplugs vCPUs and/or memory; zero values are left unchanged
+	Resize(id string, vcpus, memMB int) error
+	// Snapshot writes the RAM and a copy of the disk of a sandbox into snapDir and
+	// returns the size of the snapshot on disk. The copied disk is backed by the base
+	// image only, even when the sandbox was itself restored from a snapshot.
+	Snapshot(id, snapDir string) (int64, error)
+	// Restore creates sandbox spec.ID from the snapshot at snapshotPath. The new overlay
+	// is backed by the snapshot's disk, which must be kept until the sandbox is removed.
+	Restore(cfg config.Config, spec model.SandboxSpec, snapshotPath string, cold bool) error
+	// AdoptSnapshot prepares the VM state of a snapshot imported into snapshotPath for
+	// restores on this host. The captured VM must have the vCPUs and memory of spec and fit
+	// within its MaxCPUs and MaxMemoryMB. State it refuses to restore yields
+	// model.ErrInvalidSnapshotArchive.
+	AdoptSnapshot(cfg config.Config, snapshotPath string, spec model.SandboxSpec) error
+	// Hibernate saves the RAM of a sandbox next to its overlay and ends the VM
+	Hibernate(id string) error
+	// Wake resumes a hibernated sandbox from its saved RAM
+	Wake(cfg config.Config, spec model.SandboxSpec) error
+	// Info returns the driver's raw JSON description of a VM
+	Info(id string) (string, error)
+	// State returns one of the VMState values, or ErrVMNotRunning when there is no VM
+	State(ctx context.Context, id string) (string, error)
+	// Stop shuts a VM down gracefully and reports which stage ended it
+	Stop(id string) (StopStage, error)
+	// Kill ends a VM without asking the guest and releases its sockets and TAP
+	Kill(id string) error
+	// Counters returns the device and usage counters of a running VM
+	Counters(ctx context.Context, id string) (*VMCounters, error)
+}
+
+// VM states reported by Hypervisor.State, named as Cloud Hypervisor names them
+const (
+	VMStateCreated  = "Created"
+	VMStateRunning  = "Running"
+	VMStatePaused   = "Paused"
+	VMStateShutdown = "Shutdown"
+)
+
+// ErrVMNotRunning is returned by Hypervisor.State when a sandbox has no live VM
+var ErrVMNotRunning = errors.New("sandbox not running")
+
+// Hypervisor driver names accepted by NewHypervisor
+const (
+	DriverCLH  = "clh"
+	DriverFake = "fake"
+)
+
+// NewHypervisor returns the driver configured by name
+func NewHypervisor(name string) (Hypervisor, error) {
+	switch name {
+	case "", DriverCLH:
+		return NewCLH(), nil
+	case DriverFake:
+		return NewFake(), nil
+	}
+	return nil, fmt.Errorf("unknown hypervisor driver %q", name)
+}
+
+// VMCounters holds the counters of one VM. Disks and Nets are keyed by device name.
+type VMCounters struct {
+	CPU    *UsageCounter
+	Memory *UsageCounter
+	Disks  map[string]DiskCounters
+	Nets   map[string]NetCounters
+}
+
+type UsageCounter struct {
+	Usage float64 `json:"usage"`
+}
+
+type DiskCounters struct {
+	ReadBytes       uint64  `json:"read_bytes"`
+	WriteBytes      uint64  `json:"write_bytes"`
+	ReadOps         uint64  `json:"read_ops"`
+	WriteOps        uint64  `json:"write_ops"`
+	ReadLatencyMin  float64 `json:"read_latency_min"`
+	ReadLatencyMax  float64 `json:"read_latency_max"`
+	ReadLatencyAvg  float64 `json:"read_latency_avg"`
+	WriteLatencyMin float64 `json:"write_latency_min"`
+	WriteLatencyMax float64 `json:"write_latency_max"`
+	WriteLatencyAvg float64 `json:"write_latency_avg"`
+}
+
+type NetCounters struct {
+	RxBytes  uint64 `json:"rx_bytes"`
+	TxBytes  uint64 `json:"tx_bytes"`
+	RxFrames uint64 `json:"rx_frames"`
+	TxFrames uint64 `json:"tx_frames"`
+}
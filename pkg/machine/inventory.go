@@ -0,0 +1,147 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ListInstanceIDs returns the names of all instance directories under InstancesRoot
+func ListInstanceIDs() ([]string, error) {
+	entries, err := os.ReadDir(InstancesRoot)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read instances dir: %w", err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			ids = append(ids, entry.Name())
+		}
+	}
+	return ids, nil
+}
+
+// ListVMProcesses finds running Cloud Hypervisor processes whose API socket lives under
+// InstancesRoot, keyed by sandbox ID. Unlike vm.pid files it also finds processes whose
+// PID file was lost or whose instance directory was removed.
+func ListVMProcesses() (map[string]int, error) {
+	root, err := filepath.Abs(InstancesRoot)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read /proc: %w", err)
+	}
+
+	procs := make(map[string]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		if id, ok := vmProcessSandbox(root, pid); ok {
+			procs[id] = pid
+		}
+	}
+	return procs, nil
+}
+
+// vmProcessSandbox returns the sandbox whose API socket, under root, the Cloud Hypervisor
+// process pid was started with. It reports false for any other process, including one
+// that has exited or been reaped.
+func vmProcessSandbox(root string, pid int) (string, bool) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil || len(data) == 0 {
+		return "", false
+	}
+	args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+	if filepath.Base(args[0]) != "cloud-hypervisor" {
+		return "", false
+	}
+	for i := 1; i+1 < len(args); i++ {
+		if args[i] != "--api-socket" {
+			continue
+		}
+		dir := filepath.Dir(filepath.Clean(args[i+1]))
+		if filepath.Dir(dir) == root {
+			return filepath.Base(dir), true
+		}
+		break
+	}
+	return "", false
+}
+
+// isSandboxVMM reports whether pid is still the Cloud Hypervisor process of sandbox id.
+// A recorded PID can be reused by an unrelated process once the VMM is gone, so it is
+// checked before every signal.
+func isSandboxVMM(id string, pid int) bool {
+	root, err := filepath.Abs(InstancesRoot)
+	if err != nil {
+		return false
+	}
+	owner, ok := vmProcessSandbox(root, pid)
+	return ok && owner == id
+}
+
+// InstancePID returns the PID recorded in vm.pid and whether that process is alive and
+// still the sandbox's VMM
+func InstancePID(sbxID string) (int, bool) {
+	pid := readPID(GetPIDPath(sbxID))
+	return pid, pid > 0 && processAlive(pid) && isSandboxVMM(sbxID, pid)
+}
+
+// HasHibernation reports whether a sandbox has saved RAM waiting to be woken
+func HasHibernation(sbxID string) bool {
+	_, err := os.Stat(filepath.Join(GetHibernateDir(sbxID), "config.json"))
+	return err == nil
+}
+
+// KillProcess sends SIGTERM, then SIGKILL, to the VMM process of sandbox id that has no
+// usable instance directory and waits for it to exit. A pid that is no longer that VMM
+// is left alone.
+func KillProcess(id string, pid int) error {
+	if !processAlive(pid) || !isSandboxVMM(id, pid) {
+		return nil
+	}
+	syscall.Kill(pid, syscall.SIGTERM)
+	if waitForPID(pid, stopTermTimeout) {
+		return nil
+	}
+	if !isSandboxVMM(id, pid) {
+		return nil
+	}
+	syscall.Kill(pid, syscall.SIGKILL)
+	if waitForPID(pid, stopKillTimeout) {
+		return nil
+	}
+	return fmt.Errorf("process %d survived SIGKILL", pid)
+}
+
+func waitForPID(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// InstanceTap returns the TAP name recorded for a sandbox, or "" when it has none
+func InstanceTap(sbxID string) string {
+	data, err := os.ReadFile(GetTapPath(sbxID))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -16,6 +17,24 @@ import (
 	"voidrun/pkg/timer"
 )
 
+// isolation binds the TAP of every VM to its sandbox's MAC and IP; nil leaves TAPs unfiltered
+var isolation *network.Isolation
+
+// SetIsolation makes Start bind each TAP before it is attached to the bridge
+func SetIsolation(iso *network.Isolation) {
+	isolation = iso
+}
+
+// DeleteTap removes a TAP together with its isolation rules
+func DeleteTap(tapName string) error {
+	if isolation != nil && tapName != "" {
+		if err := isolation.UnbindTap(tapName); err != nil {
+			fmt.Printf("   [!] Failed to unbind TAP %s: %v\n", tapName, err)
+		}
+	}
+	return network.DeleteTap(tapName)
+}
+
 // Start handles Fresh Boot (API Injection) and Restore (API Restore)
 func Start(cfg config.Config, spec model.SandboxSpec, overlayPath string, restorePath string) error {
 	defer timer.Track("Sandbox Start (Total)")()
@@ -29,22 +48,33 @@ func Start(cfg config.Config, spec model.SandboxSpec, overlayPath string, restor
 	pidPath := filepath.Join(instanceDir, "vm.pid")
 	tapPath := filepath.Join(instanceDir, "vm.tap")
 	vsockPath := filepath.Join(instanceDir, "vsock.sock")
+	consolePath := filepath.Join(instanceDir, "console.sock")
 
-	// Generate MAC based on IP
-	macAddr := network.GenerateMAC(spec.IPAddress)
-	log.Printf("   [Net] Generated MAC %s for IP %s\n", macAddr, spec.IPAddress)
+	// MAC and CID are leased together with the IP
+	macAddr := spec.MACAddress
+	diskLimiter, netLimiter := rateLimiters(spec.IOLimits)
 
-	// Create TAP interface (Detached state)
-	// We do NOT attach to bridge yet to avoid EBUSY errors in CLH
-	tapName, err := network.CreateRandomTap(macAddr, cfg.Network.TapPrefix)
-	if err != nil {
-		return err
-	}
+	// Networkless VMs get no NIC at all; the guest is reached over vsock only
+	networkless := spec.Network == model.NetworkModeNone
+	tapName := ""
+	if networkless {
+		log.Printf("   [Net] Networkless, using CID %d only\n", spec.CID)
+	} else {
+		log.Printf("   [Net] Using MAC %s and CID %d for IP %s\n", macAddr, spec.CID, spec.IPAddress)
+
+		// Create TAP interface (Detached state)
+		// We do NOT attach to bridge yet to avoid EBUSY errors in CLH
+		var err error
+		tapName, err = network.CreateRandomTap(macAddr, cfg.Network.TapPrefix)
+		if err != nil {
+			return err
+		}
 
-	log.Printf("   [Net] Created TAP interface %s\n", tapName)
+		log.Printf("   [Net] Created TAP interface %s\n", tapName)
 
-	// Save TAP name for cleanup later
-	os.WriteFile(tapPath, []byte(tapName), 0644)
+		// Save TAP name for cleanup later
+		os.WriteFile(tapPath, []byte(tapName), 0644)
+	}
 
 	// 3. Start "Empty" Cloud Hypervisor Process
 	clhPath, _ := exec.LookPath("cloud-hypervisor")
@@ -78,7 +108,7 @@ func Start(cfg config.Config, spec model.SandboxSpec, overlayPath string, restor
 	if err := client.WaitForSocket(2 * time.Second); err != nil {
 		// Read log for debugging
 		logs, _ := os.ReadFile(logPath)
-		Stop(spec.ID) // Cleanup
+		Kill(spec.ID) // Cleanup
 		return fmt.Errorf("VM crashed on start. Logs:\n%s", string(logs))
 	}
 
@@ -88,18 +118,29 @@ func Start(cfg config.Config, spec model.SandboxSpec, overlayPath string, restor
 		fmt.Printf("   [+] Restoring from snapshot: %s\n", restorePath)
 		absRestorePath, _ := filepath.Abs(restorePath)
 
+		// Re-attach disk, network and vsock of this instance
+		if err := rewriteRestoreConfig(absRestorePath, overlayPath, vsockPath, consolePath, tapName, macAddr, uint64(spec.CID), diskLimiter, netLimiter); err != nil {
+			Kill(spec.ID)
+			return err
+		}
+
 		// Restore Payload
 		restoreConfig := map[string]interface{}{
 			"source_url": fmt.Sprintf("file://%s", absRestorePath),
-			// We re-attach network config here
-			"net": []NetConfig{{Tap: tapName, Mac: macAddr}},
 		}
 
 		if err := client.SendJSON("vm.restore", restoreConfig); err != nil {
-			Stop(spec.ID)
+			Kill(spec.ID)
 			return fmt.Errorf("restore API failed: %w", err)
 		}
 
+		// The restored VM stays paused until the caller resumes it, so nothing it prints
+		// after the restore is missed. Snapshots taken before console capture have no
+		// serial socket; they just run without a log.
+		if err := StartConsoleCapture(spec.ID); err != nil {
+			fmt.Printf("   [!] Console capture unavailable for %s: %v\n", spec.ID, err)
+		}
+
 		// Note: The caller (Restore function) usually handles 'resume',
 		// but if we are here via direct Start call, we leave it paused
 		// or let the caller handle it.
@@ -123,17 +164,21 @@ func Start(cfg config.Config, spec model.SandboxSpec, overlayPath string, restor
 			hostname,
 			iface,
 		)
+		var nets []NetConfig
+		if networkless {
+			kernelIPArgs = "ip=off"
+		} else {
+			nets = []NetConfig{{Tap: tapName, Mac: macAddr, RateLimiterConfig: netLimiter}}
+		}
 
 		envVars := ""
 
-		debugConsole := cfg.Sandbox.DebugBootConsole
-		if debugConsole {
-			log.Printf("   [Boot] Debug console enabled (vm log: %s)", logPath)
-		}
-		consoleArgs := "console=hvc0"
-		if debugConsole {
-			consoleArgs = "console=ttyS0 console=hvc0"
+		if cfg.Sandbox.DebugBootConsole {
+			log.Printf("   [Boot] Debug console enabled (console log: %s)", GetConsoleLogPath(spec.ID))
 		}
+		// The last console= becomes /dev/console, so init and login prompts land on the
+		// captured serial port
+		consoleArgs := "console=hvc0 console=ttyS0"
 
 		cmdLine := fmt.Sprintf(
 			"%s root=/dev/vda rw init=/sbin/init net.ifnames=0 biosdevname=0 %s %s",
@@ -162,50 +207,47 @@ func Start(cfg config.Config, spec model.SandboxSpec, overlayPath string, restor
 			Payload: payload,
 			Cpus: CpusConfig{
 				BootVcpus: spec.CPUs,
-				MaxVcpus:  spec.CPUs,
+				MaxVcpus:  max(spec.MaxCPUs, spec.CPUs),
 			},
 			Memory: MemoryConfig{
-				Size:      int64(spec.MemoryMB) * 1024 * 1024,
-				Shared:    true,
-				Mergeable: true,
-				Prefault:  false,
+				Size:        int64(spec.MemoryMB) * 1024 * 1024,
+				HotplugSize: int64(max(spec.MaxMemoryMB-spec.MemoryMB, 0)) * 1024 * 1024,
+				Shared:      true,
+				Mergeable:   true,
+				Prefault:    false,
 			},
 			Disks: []DiskConfig{
-				{Path: overlayPath},
+				{Path: overlayPath, RateLimiterConfig: diskLimiter},
 			},
 			// Remove IP from here (Kernel handles it), just pass Layer 2 info
-			Net:     []NetConfig{{Tap: tapName, Mac: macAddr}},
+			Net:     nets,
 			Rng:     RngConfig{Src: "/dev/urandom"},
-			Serial:  ConsoleConfig{Mode: func() string {
-				if debugConsole {
-					return "Tty"
-				}
-				return "Null"
-			}()},
-			Console: ConsoleConfig{Mode: func() string {
-				if debugConsole {
-					return "Tty"
-				}
-				return "Null"
-			}()},
+			Serial:  ConsoleConfig{Mode: "Socket", Socket: consolePath},
+			Console: ConsoleConfig{Mode: "Null"},
 			Vsock: &VsockConfig{
-				Cid:    getCidFromIP(spec.IPAddress),
+				Cid:    uint64(spec.CID),
 				Socket: vsockPath,
 			},
 		}
 
 		// A. Send Config
 		if err := client.SendJSON("vm.create", cfg); err != nil {
-			Stop(spec.ID)
+			Kill(spec.ID)
 			return fmt.Errorf("vm.create failed: %w", err)
 		}
 
+		// Attach to the serial socket while the VM boots, so early kernel output is logged
+		captured := captureConsoleOnBoot(spec.ID, consoleBootTimeout)
+
 		// B. Send Boot Signal
 		fmt.Println("   [+] Sending Boot Signal...")
 		if err := client.Send("vm.boot"); err != nil {
-			Stop(spec.ID)
+			Kill(spec.ID)
 			return fmt.Errorf("vm.boot failed: %w", err)
 		}
+		if err := <-captured; err != nil {
+			fmt.Printf("   [!] Console capture unavailable for %s: %v\n", spec.ID, err)
+		}
 	}
 
 	// ---------------------------------------------------------
@@ -213,11 +255,19 @@ func Start(cfg config.Config, spec model.SandboxSpec, overlayPath string, restor
 	// Cloud Hypervisor has opened the TAP. Now we attach it to the bridge.
 	// This avoids the "Device Busy" error during restore.
 	// ---------------------------------------------------------
-	fmt.Printf("   [Net] Config Bridge Name: %s\n", cfg.Network.BridgeName)
-	fmt.Printf("   [Net] Attaching %s to bridge %s...\n", tapName, cfg.Network.BridgeName)
-	if err := network.EnableTap(cfg.Network.BridgeName, tapName); err != nil {
-		Stop(spec.ID)
-		return fmt.Errorf("network attach failed (bridge: %s, tap: %s): %v", cfg.Network.BridgeName, tapName, err)
+	if !networkless {
+		if isolation != nil {
+			if err := bindTap(tapName, macAddr, spec.IPAddress); err != nil {
+				Kill(spec.ID)
+				return fmt.Errorf("failed to isolate tap %s: %w", tapName, err)
+			}
+		}
+		fmt.Printf("   [Net] Config Bridge Name: %s\n", cfg.Network.BridgeName)
+		fmt.Printf("   [Net] Attaching %s to bridge %s...\n", tapName, cfg.Network.BridgeName)
+		if err := network.EnableTap(cfg.Network.BridgeName, tapName); err != nil {
+			Kill(spec.ID)
+			return fmt.Errorf("network attach failed (bridge: %s, tap: %s): %v", cfg.Network.BridgeName, tapName, err)
+		}
 	}
 	// ---------------------------------------------------------
 
@@ -228,34 +278,6 @@ func Start(cfg config.Config, spec model.SandboxSpec, overlayPath string, restor
 // WaitForAgent attempts to connect to the guest agent via VSOCK until it responds or the timeout elapses.
 // This is used for synchronous sandbox creation flows when the client requests readiness.
 
-// Stop gracefully kills the VM and cleans up network
-func Stop(id string) error {
-	instanceDir := GetInstanceDir(id)
-	pidPath := GetPIDPath(id)
-	tapPath := GetTapPath(id)
-
-	// 1. Kill Process
-	data, err := os.ReadFile(pidPath)
-	if err == nil {
-		pid, _ := strconv.Atoi(string(data))
-		if process, err := os.FindProcess(pid); err == nil {
-			process.Signal(syscall.SIGTERM)
-		}
-		os.Remove(pidPath)
-	}
-
-	// 2. Clean Network
-	if tapData, err := os.ReadFile(tapPath); err == nil {
-		tapName := string(tapData)
-		network.DeleteTap(tapName)
-		os.Remove(tapPath)
-	}
-
-	fmt.Printf("   [+] VM %s Stopped.\n", id)
-	_ = instanceDir // Suppress unused variable warning
-	return nil
-}
-
 func VerifyVMNetwork(vmID string) error {
 	gatewayIP := "192.168.100.1"
 
@@ -278,16 +300,15 @@ func VerifyVMNetwork(vmID string) error {
 	return nil
 }
 
-// getCidFromIP generates a CID from an IP address for vsock
-func getCidFromIP(ipStr string) uint64 {
-	ip := net.ParseIP(ipStr)
-	if ip == nil {
-		return 0
+// bindTap restricts a TAP to the MAC and IP leased to its sandbox
+func bindTap(tapName, macAddr, ip string) error {
+	mac, err := net.ParseMAC(macAddr)
+	if err != nil {
+		return fmt.Errorf("bad mac: %w", err)
 	}
-	ip = ip.To4()
-	if ip == nil {
-		return 0
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("bad ip: %w", err)
 	}
-	// Take the last byte and add offset (3 is minimum, 1000 is safe)
-	return uint64(ip[3]) + 1000
+	return isolation.BindTap(network.TapBinding{Tap: tapName, MAC: mac, IP: addr})
 }
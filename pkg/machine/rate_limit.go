@@ -0,0 +1,33 @@
+package machine
+
+import "voidrun/internal/model"
+
+// rateLimiters turns the I/O limits of a sandbox into the rate limiters of its disk and NIC
+func rateLimiters(limits *model.IOLimits) (disk, net *RateLimiterConfig) {
+	if limits == nil {
+		return nil, nil
+	}
+	return rateLimiter(limits.Disk), rateLimiter(limits.Net)
+}
+
+func rateLimiter(limit *model.IOLimit) *RateLimiterConfig {
+	if limit == nil {
+		return nil
+	}
+	cfg := &RateLimiterConfig{
+		Bandwidth: tokenBucket(limit.BandwidthBytesPerSec, limit.BandwidthBurstBytes),
+		Ops:       tokenBucket(limit.OpsPerSec, limit.OpsBurst),
+	}
+	if cfg.Bandwidth == nil && cfg.Ops == nil {
+		return nil
+	}
+	return cfg
+}
+
+// tokenBucket refills perSec tokens every second; a zero rate is unlimited
+func tokenBucket(perSec, burst int64) *TokenBucket {
+	if perSec <= 0 {
+		return nil
+	}
+	return &TokenBucket{Size: perSec, OneTimeBurst: max(burst, 0), RefillTime: 1000}
+}
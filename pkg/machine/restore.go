@@ -1,22 +1,27 @@
 package machine
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"time"
 	"voidrun/internal/config"
 	"voidrun/internal/model"
+	"voidrun/pkg/storage"
 )
 
-func Restore(cfg config.Config, newID, snapshotPath, ip string, cold bool) error {
-	newInstanceDir := GetInstanceDir(newID)
-	log.Printf(">> Restoring Sandbox ID: %s from Snapshot: %s\n", newID, snapshotPath)
+// Restore creates sandbox spec.ID from the snapshot stored at snapshotPath.
+// Cold restores boot the snapshot disk with the CPU and memory of spec; live restores
+// resume the captured RAM, in which case the VM shape comes from the snapshot itself.
+func Restore(cfg config.Config, spec model.SandboxSpec, snapshotPath string, cold bool) error {
+	newInstanceDir := GetInstanceDir(spec.ID)
+	log.Printf(">> Restoring Sandbox ID: %s from Snapshot: %s\n", spec.ID, snapshotPath)
 
 	if _, err := os.Stat(newInstanceDir); err == nil {
-		return fmt.Errorf("Sandbox ID %s already exists", newID)
+		return fmt.Errorf("Sandbox ID %s already exists", spec.ID)
 	}
 
 	if err := os.MkdirAll(newInstanceDir, 0755); err != nil {
@@ -27,10 +32,12 @@ func Restore(cfg config.Config, newID, snapshotPath, ip string, cold bool) error
 	srcDisk := filepath.Join(snapshotPath, "overlay.qcow2")
 	dstDisk := filepath.Join(newInstanceDir, "overlay.qcow2")
 
-	fmt.Println("   [+] Copying Disk...")
-	if err := exec.Command("cp", srcDisk, dstDisk).Run(); err != nil {
+	// The snapshot disk becomes the read-only backing file of a fresh overlay, so nothing
+	// is copied; the snapshot must outlive the sandbox (see Snapshot.RefCount)
+	fmt.Println("   [+] Creating Overlay on Snapshot Disk...")
+	if err := storage.CloneOverlay(context.Background(), srcDisk, dstDisk); err != nil {
 		os.RemoveAll(newInstanceDir)
-		return fmt.Errorf("disk copy failed: %w", err)
+		return err
 	}
 
 	// Logic Branch: Cold vs Live
@@ -40,8 +47,9 @@ func Restore(cfg config.Config, newID, snapshotPath, ip string, cold bool) error
 		srcState := filepath.Join(snapshotPath, "state")
 		dstState = filepath.Join(newInstanceDir, "snapshot_state")
 
-		fmt.Printf("   [+] Copying RAM State from %s to %s\n", srcState, dstState)
-		if err := exec.Command("cp", "-r", srcState, dstState).Run(); err != nil {
+		// The memory files are only read on restore; config.json is rewritten below
+		fmt.Printf("   [+] Linking RAM State from %s to %s\n", srcState, dstState)
+		if err := linkTree(srcState, dstState, "config.json"); err != nil {
 			os.RemoveAll(newInstanceDir)
 			return fmt.Errorf("state copy failed: %w", err)
 		}
@@ -49,23 +57,16 @@ func Restore(cfg config.Config, newID, snapshotPath, ip string, cold bool) error
 		fmt.Println("   [+] Cold Boot Mode: Discarding old RAM.")
 	}
 
-	// Config
-	spec := model.SandboxSpec{
-		ID:        newID,
-		IPAddress: ip,
-		CPUs:      1,
-		MemoryMB:  1024,
-	}
-
 	// Start process
 	if err := Start(cfg, spec, dstDisk, dstState); err != nil {
+		os.RemoveAll(newInstanceDir)
 		return err
 	}
 
 	// Send Resume (only for live restore)
 	if !cold {
 		fmt.Println("   [+] Waiting for socket to resume...")
-		client := NewAPIClientForSandbox(newID)
+		client := NewAPIClientForSandbox(spec.ID)
 
 		if err := client.WaitForSocket(2 * time.Second); err != nil {
 			return fmt.Errorf("socket timed out waiting for resume: %w", err)
@@ -83,3 +84,67 @@ func Restore(cfg config.Config, newID, snapshotPath, ip string, cold bool) error
 
 	return nil
 }
+
+// rewriteRestoreConfig points the VM config captured in a snapshot at the devices of the
+// new instance. Cloud Hypervisor reopens the disk, TAP, vsock and serial sockets named in
+// config.json on vm.restore, which would otherwise still be those of the source sandbox.
+// The vsock device gets the CID of the new instance, while a live-restored guest kernel
+// keeps the one it booted with; the guest agent must therefore bind VMADDR_CID_ANY rather
+// than its own CID. Live restores wait for the agent, so an agent that does not fails them.
+// The rate limiters of the disk and NIC are replaced too, nil removing them. Without a
+// tapName the VM is networkless and the NIC is dropped.
+func rewriteRestoreConfig(stateDir, overlayPath, vsockPath, consolePath, tapName, macAddr string, cid uint64, diskLimiter, netLimiter *RateLimiterConfig) error {
+	configPath := filepath.Join(stateDir, "config.json")
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot config: %w", err)
+	}
+
+	var vmConfig map[string]interface{}
+	if err := json.Unmarshal(data, &vmConfig); err != nil {
+		return fmt.Errorf("failed to parse snapshot config: %w", err)
+	}
+
+	if disks, ok := vmConfig["disks"].([]interface{}); ok && len(disks) > 0 {
+		if disk, ok := disks[0].(map[string]interface{}); ok {
+			disk["path"] = overlayPath
+			setRateLimiter(disk, diskLimiter)
+		}
+	}
+	if tapName == "" {
+		delete(vmConfig, "net")
+	} else if nets, ok := vmConfig["net"].([]interface{}); ok && len(nets) > 0 {
+		if nic, ok := nets[0].(map[string]interface{}); ok {
+			nic["tap"] = tapName
+			nic["mac"] = macAddr
+			setRateLimiter(nic, netLimiter)
+		}
+	}
+	if vsock, ok := vmConfig["vsock"].(map[string]interface{}); ok {
+		vsock["socket"] = vsockPath
+		vsock["cid"] = cid
+	}
+	if serial, ok := vmConfig["serial"].(map[string]interface{}); ok && serial["mode"] == "Socket" {
+		serial["socket"] = consolePath
+	}
+
+	out, err := json.Marshal(vmConfig)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot config: %w", err)
+	}
+
+	// Copied state files keep the read-only mode of the snapshot
+	os.Chmod(configPath, 0644)
+	if err := os.WriteFile(configPath, out, 0644); err != nil {
+		return fmt.Errorf("failed to write snapshot config: %w", err)
+	}
+	return nil
+}
+
+func setRateLimiter(device map[string]interface{}, limiter *RateLimiterConfig) {
+	if limiter == nil {
+		delete(device, "rate_limiter_config")
+		return
+	}
+	device["rate_limiter_config"] = limiter
+}
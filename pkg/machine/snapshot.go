@@ -1,15 +1,20 @@
 package machine
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"time"
+
+	"voidrun/pkg/storage"
 )
 
-func CreateSnapshot(sbxID string) error {
+// CreateSnapshot writes the memory state and a copy of the overlay disk of a sandbox into snapDir.
+// The VM stays paused until both are captured so that RAM and disk describe the same instant.
+// It returns the total size of the snapshot on disk.
+func CreateSnapshot(sbxID, snapDir string) (int64, error) {
 	instanceDir := GetInstanceDir(sbxID)
 	socketPath := GetSocketPath(sbxID)
 
@@ -17,93 +22,102 @@ func CreateSnapshot(sbxID string) error {
 
 	client := NewAPIClient(socketPath)
 	if !client.IsSocketAvailable() {
-		return fmt.Errorf("Sandbox socket not found. Is Sandbox running?")
+		return 0, fmt.Errorf("Sandbox socket not found. Is Sandbox running?")
 	}
 
 	// Check Sandbox state
 	state, err := client.GetState()
 	log.Printf("   [+] Current State: %s\n", state)
 	if err != nil {
-		return fmt.Errorf("failed to get Sandbox state: %w", err)
+		return 0, fmt.Errorf("failed to get Sandbox state: %w", err)
 	}
 
 	if state != "Running" && state != "Paused" {
-		return fmt.Errorf("cannot snapshot Sandbox in state: %s (Must be Running or Paused)", state)
+		return 0, fmt.Errorf("cannot snapshot Sandbox in state: %s (Must be Running or Paused)", state)
 	}
 
 	// Pause if running
 	if state == "Running" {
 		if err := client.Send("vm.pause"); err != nil {
-			return fmt.Errorf("pause failed: %w", err)
+			return 0, fmt.Errorf("pause failed: %w", err)
 		}
 		fmt.Println("   [+] Sandbox Paused")
 	}
+	resume := func() {
+		if state != "Running" {
+			return
+		}
+		if err := client.Send("vm.resume"); err != nil {
+			log.Printf("   [ERROR] Resume failed: %v\n", err)
+			return
+		}
+		fmt.Println("   [+] Sandbox Resumed")
+	}
 
 	// Prepare directories
-	timestamp := time.Now().Format("20060102-150405")
-	snapDir := filepath.Join(instanceDir, "snapshots", timestamp)
-	if err := os.MkdirAll(snapDir, 0755); err != nil {
-		return err
+	stateDir := filepath.Join(snapDir, "state")
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		resume()
+		return 0, err
 	}
 
-	tempStateDir := filepath.Join(instanceDir, "snapshot_temp")
-	os.RemoveAll(tempStateDir)
-	os.MkdirAll(tempStateDir, 0755)
-
 	fmt.Printf(">> Snapshotting to %s\n", snapDir)
 
 	// Trigger snapshot
 	snapshotPayload := map[string]string{
-		"destination_url": fmt.Sprintf("file://%s", tempStateDir),
+		"destination_url": fmt.Sprintf("file://%s", stateDir),
 	}
 	if err := client.SendJSON("vm.snapshot", snapshotPayload); err != nil {
-		if state == "Running" {
-			client.Send("vm.resume")
-		}
-		return fmt.Errorf("snapshot failed: %w", err)
+		resume()
+		os.RemoveAll(snapDir)
+		return 0, fmt.Errorf("snapshot failed: %w", err)
 	}
 	fmt.Println("   [+] Memory Dumped")
 
-	// Resume immediately
-	if state == "Running" {
-		if err := client.Send("vm.resume"); err != nil {
-			return fmt.Errorf("resume failed: %w", err)
-		}
-		fmt.Println("   [+] Sandbox Resumed")
-	}
-
-	// Copy disk and finalize in background
-	go finalizeSnapshot(instanceDir, snapDir, tempStateDir)
-
-	return nil
-}
-
-// finalizeSnapshot copies disk and moves state files in the background
-func finalizeSnapshot(instanceDir, snapDir, tempStateDir string) {
+	// Copy disk while the guest cannot write to it
 	srcDisk := filepath.Join(instanceDir, "overlay.qcow2")
 	dstDisk := filepath.Join(snapDir, "overlay.qcow2")
-
-	log.Printf("   [Background] Copying disk to snapshot...\n")
-	if err := exec.Command("cp", srcDisk, dstDisk).Run(); err != nil {
-		log.Printf("   [ERROR] Disk copy failed: %v\n", err)
-		return
+	if out, err := exec.Command("cp", "--sparse=always", srcDisk, dstDisk).CombinedOutput(); err != nil {
+		resume()
+		os.RemoveAll(snapDir)
+		return 0, fmt.Errorf("disk copy failed: %v: %s", err, string(out))
 	}
 	log.Println("   [+] Disk Cloned")
 
-	// Move state files
-	finalStateDir := filepath.Join(snapDir, "state")
-	if err := os.Rename(tempStateDir, finalStateDir); err != nil {
-		log.Printf("   [ERROR] State move failed: %v\n", err)
-		return
+	resume()
+
+	// A restored sandbox's overlay backs onto the snapshot it came from; fold that
+	// chain into the copy so this snapshot depends on the base image alone
+	if err := storage.DetachOverlay(context.Background(), dstDisk); err != nil {
+		os.RemoveAll(snapDir)
+		return 0, err
 	}
 
-	// Lock state files (read-only)
-	filepath.Walk(finalStateDir, func(path string, info os.FileInfo, err error) error {
+	size := SealSnapshot(snapDir)
+	log.Printf("   [+] Snapshot finalized: %s\n", snapDir)
+	return size, nil
+}
+
+// SealSnapshot makes the files of a complete snapshot read-only and returns their total size
+func SealSnapshot(snapDir string) int64 {
+	var size int64
+	filepath.Walk(snapDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil
 		}
-		return os.Chmod(path, 0444)
+		if !info.IsDir() {
+			size += info.Size()
+			os.Chmod(path, 0444)
+		}
+		return nil
 	})
+	return size
+}
 
-	log.Printf("   [+] Snapshot finalized: %s\n", snapDir)
+// DeleteSnapshot removes a snapshot directory and everything in it
+func DeleteSnapshot(snapDir string) error {
+	if err := os.RemoveAll(snapDir); err != nil {
+		return fmt.Errorf("failed to delete snapshot: %w", err)
+	}
+	return nil
 }
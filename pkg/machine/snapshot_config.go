@@ -0,0 +1,228 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"voidrun/internal/model"
+)
+
+// Cloud Hypervisor restores a VM from the config.json in its snapshot state and opens
+// every host file and socket named there. The config of an imported snapshot was written
+// on another host, or by whoever crafted the archive, so it may only describe the devices
+// this server gives its own VMs: one disk, at most one NIC, the vsock, /dev/urandom and a
+// serial socket. The paths of those are replaced on restore by rewriteRestoreConfig.
+
+// snapshotConfigSections lists the config.json sections an imported snapshot may set.
+// Any other section, e.g. fs, pmem, devices, vdpa or tpm, must be absent or empty.
+var snapshotConfigSections = map[string]bool{
+	"cpus":              true,
+	"memory":            true,
+	"payload":           true,
+	"disks":             true,
+	"net":               true,
+	"rng":               true,
+	"serial":            true,
+	"console":           true,
+	"debug_console":     true,
+	"vsock":             true,
+	"balloon":           true,
+	"numa":              true,
+	"platform":          true,
+	"pci_segments":      true,
+	"rate_limit_groups": true,
+	"iommu":             true,
+	"watchdog":          true,
+	"pvpanic":           true,
+}
+
+// adoptSnapshotConfig checks the VM config in stateDir of an imported snapshot and points
+// its payload at the kernel and initramfs of this host. A config that would give the VM
+// any other host file, socket or device, or a shape other than spec's, is rejected with
+// model.ErrInvalidSnapshotArchive.
+func adoptSnapshotConfig(stateDir, kernelPath, initrdPath string, spec model.SandboxSpec) error {
+	configPath := filepath.Join(stateDir, "config.json")
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return fmt.Errorf("%w: snapshot config missing: %v", model.ErrInvalidSnapshotArchive, err)
+	}
+	var vmConfig map[string]interface{}
+	if err := json.Unmarshal(data, &vmConfig); err != nil {
+		return fmt.Errorf("%w: bad snapshot config: %v", model.ErrInvalidSnapshotArchive, err)
+	}
+	if err := checkSnapshotConfig(vmConfig); err != nil {
+		return fmt.Errorf("%w: snapshot config %v", model.ErrInvalidSnapshotArchive, err)
+	}
+	if err := checkSnapshotShape(vmConfig, spec); err != nil {
+		return fmt.Errorf("%w: snapshot config %v", model.ErrInvalidSnapshotArchive, err)
+	}
+
+	payload := vmConfig["payload"].(map[string]interface{})
+	payload["kernel"] = kernelPath
+	delete(payload, "initramfs")
+	if initrdPath != "" {
+		payload["initramfs"], _ = filepath.Abs(initrdPath)
+	}
+
+	out, err := json.Marshal(vmConfig)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot config: %w", err)
+	}
+	return os.WriteFile(configPath, out, 0644)
+}
+
+func checkSnapshotConfig(vmConfig map[string]interface{}) error {
+	for key, value := range vmConfig {
+		if !snapshotConfigSections[key] && !emptyConfigValue(value) {
+			return fmt.Errorf("sets %s", key)
+		}
+	}
+
+	payload, ok := vmConfig["payload"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("has no payload")
+	}
+	for _, key := range []string{"firmware", "igvm", "host_data"} {
+		if !emptyConfigValue(payload[key]) {
+			return fmt.Errorf("sets payload.%s", key)
+		}
+	}
+
+	if memory, ok := vmConfig["memory"].(map[string]interface{}); ok {
+		zones, _ := memory["zones"].([]interface{})
+		for _, z := range zones {
+			if zone, ok := z.(map[string]interface{}); !ok || !emptyConfigValue(zone["file"]) {
+				return fmt.Errorf("backs memory with a host file")
+			}
+		}
+	}
+
+	disks, _ := vmConfig["disks"].([]interface{})
+	if len(disks) != 1 {
+		return fmt.Errorf("has %d disks, want 1", len(disks))
+	}
+	if err := checkConfigDevice("disk", disks[0], "vhost_user", "vhost_socket"); err != nil {
+		return err
+	}
+	nets, _ := vmConfig["net"].([]interface{})
+	if len(nets) > 1 {
+		return fmt.Errorf("has %d NICs, want at most 1", len(nets))
+	}
+	for _, nic := range nets {
+		if err := checkConfigDevice("net", nic, "vhost_user", "vhost_socket", "fds"); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := vmConfig["vsock"].(map[string]interface{}); !ok {
+		return fmt.Errorf("has no vsock")
+	}
+	if rng, ok := vmConfig["rng"].(map[string]interface{}); ok && rng["src"] != "/dev/urandom" {
+		return fmt.Errorf("reads entropy from %v", rng["src"])
+	}
+
+	// Tty would hand the guest the VMM's stdio and File a host path
+	if err := checkConfigConsole("serial", vmConfig["serial"], "Off", "Null", "Socket"); err != nil {
+		return err
+	}
+	if err := checkConfigConsole("console", vmConfig["console"], "Off", "Null"); err != nil {
+		return err
+	}
+	return checkConfigConsole("debug_console", vmConfig["debug_console"], "Off", "Null")
+}
+
+// checkSnapshotShape checks that the VM of config.json has the vCPUs and memory of spec,
+// and no more hotplug headroom than spec allows. A resize changes boot_vcpus and adds to
+// hotplugged_size, so both describe the VM as it was captured.
+func checkSnapshotShape(vmConfig map[string]interface{}, spec model.SandboxSpec) error {
+	cpus, _ := vmConfig["cpus"].(map[string]interface{})
+	bootVCPUs, ok1 := configInt(cpus, "boot_vcpus")
+	maxVCPUs, ok2 := configInt(cpus, "max_vcpus")
+	if !ok1 || !ok2 {
+		return fmt.Errorf("has no vCPU count")
+	}
+	if bootVCPUs != int64(spec.CPUs) {
+		return fmt.Errorf("boots %d vCPUs, manifest has %d", bootVCPUs, spec.CPUs)
+	}
+	if maxVCPUs > int64(max(spec.MaxCPUs, spec.CPUs)) {
+		return fmt.Errorf("allows %d vCPUs, manifest at most %d", maxVCPUs, max(spec.MaxCPUs, spec.CPUs))
+	}
+
+	memory, _ := vmConfig["memory"].(map[string]interface{})
+	size, ok := configInt(memory, "size")
+	if !ok {
+		return fmt.Errorf("has no memory size")
+	}
+	hotplugged, _ := configInt(memory, "hotplugged_size")
+	hotplug, _ := configInt(memory, "hotplug_size")
+	const mib = 1 << 20
+	if size+hotplugged != int64(spec.MemoryMB)*mib {
+		return fmt.Errorf("has %d MiB of memory, manifest %d", (size+hotplugged)/mib, spec.MemoryMB)
+	}
+	if size+hotplug > int64(max(spec.MaxMemoryMB, spec.MemoryMB))*mib {
+		return fmt.Errorf("allows %d MiB of memory, manifest at most %d", (size+hotplug)/mib, max(spec.MaxMemoryMB, spec.MemoryMB))
+	}
+	return nil
+}
+
+// configInt reads a non-negative integer of a config.json section; JSON numbers decode as float64
+func configInt(section map[string]interface{}, key string) (int64, bool) {
+	v, ok := section[key].(float64)
+	if !ok || v < 0 || v != float64(int64(v)) {
+		return 0, false
+	}
+	return int64(v), true
+}
+
+// checkConfigDevice rejects a disk or NIC that sets any of the given host-facing fields
+func checkConfigDevice(kind string, value interface{}, denied ...string) error {
+	device, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("has a malformed %s", kind)
+	}
+	for _, key := range denied {
+		if !emptyConfigValue(device[key]) {
+			return fmt.Errorf("sets %s.%s", kind, key)
+		}
+	}
+	return nil
+}
+
+// checkConfigConsole accepts an absent console device or one in one of the given modes
+func checkConfigConsole(kind string, value interface{}, modes ...string) error {
+	if value == nil {
+		return nil
+	}
+	console, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("has a malformed %s", kind)
+	}
+	if !emptyConfigValue(console["file"]) {
+		return fmt.Errorf("writes %s to a host file", kind)
+	}
+	for _, mode := range modes {
+		if console["mode"] == mode {
+			return nil
+		}
+	}
+	return fmt.Errorf("uses %s mode %v", kind, console["mode"])
+}
+
+// emptyConfigValue reports whether a config.json value leaves its setting off
+func emptyConfigValue(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
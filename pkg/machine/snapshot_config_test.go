@@ -0,0 +1,253 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"voidrun/internal/config"
+	"voidrun/internal/model"
+)
+
+// restoreConfigFixture is the config.json Cloud Hypervisor writes for a VM booted by Start
+const restoreConfigFixture = `{
+  "cpus": {"boot_vcpus": 1, "max_vcpus": 2, "topology": null, "kvm_hyperv": false, "max_phys_bits": 46, "affinity": null, "features": {"amx": false}},
+  "memory": {"size": 536870912, "mergeable": true, "hotplug_method": "Acpi", "hotplug_size": null, "hotplugged_size": null, "shared": true, "hugepages": false, "hugepage_size": null, "prefault": false, "zones": null, "thp": true},
+  "payload": {"firmware": null, "kernel": "/srv/voidrun/vmlinux", "cmdline": "console=hvc0 console=ttyS0 root=/dev/vda rw", "initramfs": "/srv/voidrun/initrd.img", "igvm": null, "host_data": null},
+  "rate_limit_groups": null,
+  "disks": [{"path": "/var/lib/voidrun/instances/abc/overlay.qcow2", "readonly": false, "direct": false, "iommu": false, "num_queues": 1, "queue_size": 128, "vhost_user": false, "vhost_socket": null, "rate_limit_group": null, "rate_limiter_config": null, "id": "_disk0", "disable_io_uring": false, "disable_aio": false, "pci_segment": 0, "serial": null, "queue_affinity": null}],
+  "net": [{"tap": "vr-1a2b3c", "ip": "192.168.249.1", "mask": "255.255.255.0", "mac": "02:c0:a8:64:00:0a", "host_mac": null, "mtu": null, "iommu": false, "num_queues": 2, "queue_size": 256, "vhost_user": false, "vhost_socket": null, "vhost_mode": "Client", "id": "_net1", "fds": null, "rate_limiter_config": null, "pci_segment": 0, "offload_tso": true, "offload_ufo": true, "offload_csum": true}],
+  "rng": {"src": "/dev/urandom", "iommu": false},
+  "balloon": null,
+  "fs": null,
+  "pmem": null,
+  "serial": {"file": null, "mode": "Socket", "iommu": false, "socket": "/var/lib/voidrun/instances/abc/console.sock"},
+  "console": {"file": null, "mode": "Null", "iommu": false, "socket": null},
+  "debug_console": {"file": null, "mode": "Off", "iobase": 233},
+  "devices": null,
+  "user_devices": null,
+  "vdpa": null,
+  "vsock": {"cid": 1234, "socket": "/var/lib/voidrun/instances/abc/vsock.sock", "iommu": false, "id": "_vsock2", "pci_segment": 0},
+  "pvpanic": false,
+  "iommu": false,
+  "sgx_epc": null,
+  "numa": null,
+  "watchdog": false,
+  "pci_segments": null,
+  "platform": null,
+  "tpm": null,
+  "preserved_fds": null,
+  "landlock_enable": false,
+  "landlock_rules": null
+}`
+
+// fixtureSpec is the VM shape of restoreConfigFixture
+var fixtureSpec = model.SandboxSpec{CPUs: 1, MemoryMB: 512, MaxCPUs: 2, MaxMemoryMB: 512}
+
+// writeRestoreConfig writes the fixture with edit applied as stateDir/config.json
+func writeRestoreConfig(t *testing.T, stateDir string, edit func(map[string]interface{})) {
+	t.Helper()
+	var vmConfig map[string]interface{}
+	if err := json.Unmarshal([]byte(restoreConfigFixture), &vmConfig); err != nil {
+		t.Fatal(err)
+	}
+	if edit != nil {
+		edit(vmConfig)
+	}
+	data, err := json.Marshal(vmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, "config.json"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdoptSnapshotConfigPointsPayloadAtLocalKernel(t *testing.T) {
+	stateDir := filepath.Join(t.TempDir(), "state")
+	writeRestoreConfig(t, stateDir, nil)
+
+	if err := adoptSnapshotConfig(stateDir, "/opt/voidrun/vmlinux", "", fixtureSpec); err != nil {
+		t.Fatalf("adoptSnapshotConfig: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(stateDir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vmConfig map[string]interface{}
+	if err := json.Unmarshal(data, &vmConfig); err != nil {
+		t.Fatal(err)
+	}
+	payload := vmConfig["payload"].(map[string]interface{})
+	if payload["kernel"] != "/opt/voidrun/vmlinux" {
+		t.Errorf("kernel = %v, want /opt/voidrun/vmlinux", payload["kernel"])
+	}
+	if _, ok := payload["initramfs"]; ok {
+		t.Errorf("initramfs = %v, want none", payload["initramfs"])
+	}
+}
+
+func TestAdoptSnapshotConfigRejectsHostAccess(t *testing.T) {
+	device := func(v map[string]interface{}) []interface{} { return []interface{}{v} }
+	cases := map[string]func(map[string]interface{}){
+		"second disk": func(c map[string]interface{}) {
+			c["disks"] = append(c["disks"].([]interface{}), map[string]interface{}{"path": "/etc/shadow"})
+		},
+		"no disk": func(c map[string]interface{}) {
+			c["disks"] = []interface{}{}
+		},
+		"second nic": func(c map[string]interface{}) {
+			c["net"] = append(c["net"].([]interface{}), map[string]interface{}{"tap": "eth0"})
+		},
+		"nic fds": func(c map[string]interface{}) {
+			c["net"].([]interface{})[0].(map[string]interface{})["fds"] = []interface{}{3.0}
+		},
+		"vhost-user disk": func(c map[string]interface{}) {
+			disk := c["disks"].([]interface{})[0].(map[string]interface{})
+			disk["vhost_user"] = true
+			disk["vhost_socket"] = "/run/spdk.sock"
+		},
+		"pmem": func(c map[string]interface{}) {
+			c["pmem"] = device(map[string]interface{}{"file": "/root/.ssh/id_ed25519"})
+		},
+		"fs": func(c map[string]interface{}) {
+			c["fs"] = device(map[string]interface{}{"tag": "root", "socket": "/run/virtiofsd.sock"})
+		},
+		"vfio device": func(c map[string]interface{}) {
+			c["devices"] = device(map[string]interface{}{"path": "/sys/bus/pci/devices/0000:01:00.0"})
+		},
+		"vdpa": func(c map[string]interface{}) {
+			c["vdpa"] = device(map[string]interface{}{"path": "/dev/vhost-vdpa-0"})
+		},
+		"tpm": func(c map[string]interface{}) {
+			c["tpm"] = map[string]interface{}{"socket": "/run/swtpm.sock"}
+		},
+		"unknown section": func(c map[string]interface{}) {
+			c["future_device"] = map[string]interface{}{"path": "/dev/sda"}
+		},
+		"memory file": func(c map[string]interface{}) {
+			c["memory"].(map[string]interface{})["zones"] = device(map[string]interface{}{"id": "z0", "size": 1.0, "file": "/dev/mem"})
+		},
+		"rng source": func(c map[string]interface{}) {
+			c["rng"].(map[string]interface{})["src"] = "/etc/shadow"
+		},
+		"serial file": func(c map[string]interface{}) {
+			c["serial"] = map[string]interface{}{"mode": "File", "file": "/etc/cron.d/x"}
+		},
+		"serial tty": func(c map[string]interface{}) {
+			c["serial"] = map[string]interface{}{"mode": "Tty"}
+		},
+		"console file": func(c map[string]interface{}) {
+			c["console"] = map[string]interface{}{"mode": "File", "file": "/etc/passwd"}
+		},
+		"console socket": func(c map[string]interface{}) {
+			c["console"] = map[string]interface{}{"mode": "Socket", "socket": "/run/docker.sock"}
+		},
+		"debug console file": func(c map[string]interface{}) {
+			c["debug_console"] = map[string]interface{}{"mode": "File", "file": "/etc/passwd"}
+		},
+		"firmware": func(c map[string]interface{}) {
+			c["payload"].(map[string]interface{})["firmware"] = "/root/firmware.fd"
+		},
+		"no vsock": func(c map[string]interface{}) {
+			delete(c, "vsock")
+		},
+	}
+	for name, edit := range cases {
+		t.Run(name, func(t *testing.T) {
+			stateDir := filepath.Join(t.TempDir(), "state")
+			writeRestoreConfig(t, stateDir, edit)
+			err := adoptSnapshotConfig(stateDir, "/opt/voidrun/vmlinux", "", fixtureSpec)
+			if !errors.Is(err, model.ErrInvalidSnapshotArchive) {
+				t.Fatalf("adoptSnapshotConfig = %v, want ErrInvalidSnapshotArchive", err)
+			}
+		})
+	}
+}
+
+// The shape in config.json is what a live restore boots, so it must be the one the
+// manifest was checked for
+func TestAdoptSnapshotConfigChecksShape(t *testing.T) {
+	cases := map[string]struct {
+		edit func(map[string]interface{})
+		ok   bool
+	}{
+		"as booted": {nil, true},
+		"resized": {func(c map[string]interface{}) {
+			c["cpus"].(map[string]interface{})["boot_vcpus"] = 2
+			c["memory"].(map[string]interface{})["hotplugged_size"] = 256 << 20
+		}, false},
+		"more vCPUs": {func(c map[string]interface{}) {
+			c["cpus"].(map[string]interface{})["boot_vcpus"] = 64
+		}, false},
+		"more vCPU headroom": {func(c map[string]interface{}) {
+			c["cpus"].(map[string]interface{})["max_vcpus"] = 64
+		}, false},
+		"more memory": {func(c map[string]interface{}) {
+			c["memory"].(map[string]interface{})["size"] = 64 << 30
+		}, false},
+		"more memory headroom": {func(c map[string]interface{}) {
+			c["memory"].(map[string]interface{})["hotplug_size"] = 64 << 30
+		}, false},
+		"no cpus": {func(c map[string]interface{}) {
+			delete(c, "cpus")
+		}, false},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			stateDir := filepath.Join(t.TempDir(), "state")
+			writeRestoreConfig(t, stateDir, tc.edit)
+			err := adoptSnapshotConfig(stateDir, "/opt/voidrun/vmlinux", "", fixtureSpec)
+			if tc.ok && err != nil {
+				t.Fatalf("adoptSnapshotConfig: %v", err)
+			}
+			if !tc.ok && !errors.Is(err, model.ErrInvalidSnapshotArchive) {
+				t.Fatalf("adoptSnapshotConfig = %v, want ErrInvalidSnapshotArchive", err)
+			}
+		})
+	}
+
+	// A resized VM matches a manifest recording the resized shape
+	stateDir := filepath.Join(t.TempDir(), "state")
+	writeRestoreConfig(t, stateDir, cases["resized"].edit)
+	resized := model.SandboxSpec{CPUs: 2, MemoryMB: 768, MaxCPUs: 2, MaxMemoryMB: 1024}
+	if err := adoptSnapshotConfig(stateDir, "/opt/voidrun/vmlinux", "", resized); err != nil {
+		t.Fatalf("adoptSnapshotConfig of a resized VM: %v", err)
+	}
+}
+
+// A hostile config.json survives export and checksum verification, so it must be caught
+// when the imported snapshot is adopted
+func TestImportedSnapshotWithHostileConfigIsRejected(t *testing.T) {
+	srcDir := filepath.Join(t.TempDir(), "src")
+	writeRestoreConfig(t, filepath.Join(srcDir, "state"), func(c map[string]interface{}) {
+		c["pmem"] = []interface{}{map[string]interface{}{"file": "/etc/shadow", "discard_writes": false}}
+		c["serial"] = map[string]interface{}{"mode": "File", "file": "/root/.bashrc"}
+	})
+	if err := os.WriteFile(filepath.Join(srcDir, "overlay.qcow2"), []byte("disk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := ExportSnapshot(&archive, srcDir, []byte(`{"formatVersion":1}`)); err != nil {
+		t.Fatalf("ExportSnapshot: %v", err)
+	}
+	snapDir := filepath.Join(t.TempDir(), "imported")
+	if err := ImportSnapshot(&archive, snapDir, 0, func([]byte) error { return nil }); err != nil {
+		t.Fatalf("ImportSnapshot: %v", err)
+	}
+
+	cfg := config.Config{}
+	cfg.Paths.KernelPath = "/opt/voidrun/vmlinux"
+	err := CLH{}.AdoptSnapshot(cfg, snapDir, fixtureSpec)
+	if !errors.Is(err, model.ErrInvalidSnapshotArchive) {
+		t.Fatalf("AdoptSnapshot = %v, want ErrInvalidSnapshotArchive", err)
+	}
+}
@@ -0,0 +1,253 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StopStage names the step of the stop sequence that ended the VM process
+type StopStage string
+
+const (
+	// StopStageNotRunning means there was no live VM process to stop
+	StopStageNotRunning StopStage = "not-running"
+	// StopStageShutdown means the guest powered off after the ACPI power button
+	StopStageShutdown StopStage = "shutdown"
+	StopStageSIGTERM  StopStage = "sigterm"
+	StopStageSIGKILL  StopStage = "sigkill"
+)
+
+const (
+	// Time given to the VMM to exit after SIGTERM and SIGKILL respectively
+	stopTermTimeout = 5 * time.Second
+	stopKillTimeout = 2 * time.Second
+)
+
+// stopGracePeriod is how long Stop waits for the guest to power off before signalling the VMM
+var stopGracePeriod = 10 * time.Second
+
+// SetStopGracePeriod sets the guest shutdown grace period from configuration
+func SetStopGracePeriod(d time.Duration) {
+	if d >= 0 {
+		stopGracePeriod = d
+	}
+}
+
+// Stop shuts a sandbox down and releases its TAP. The guest is first asked to power off
+// through the ACPI power button so it can flush its filesystems; if it has not done so
+// within the grace period the VMM gets SIGTERM, then SIGKILL. Stop only returns once the
+// process is gone and its sockets are removed, and reports which stage ended it.
+func Stop(id string) (StopStage, error) {
+	return halt(id, true)
+}
+
+// Kill stops a sandbox without asking the guest to shut down. It is meant for VMs whose
+// guest state no longer matters: failed boots, deletes and hibernation after the RAM is saved.
+func Kill(id string) error {
+	_, err := halt(id, false)
+	return err
+}
+
+func halt(id string, graceful bool) (StopStage, error) {
+	pidPath := GetPIDPath(id)
+	pid := readPID(pidPath)
+
+	stage := StopStageNotRunning
+	var err error
+	if pid > 0 && processAlive(pid) {
+		if isSandboxVMM(id, pid) {
+			stage, err = terminate(id, pid, graceful)
+		} else {
+			fmt.Printf("   [!] PID %d of %s is not its VMM any more; leaving it alone\n", pid, id)
+		}
+	}
+	if err != nil {
+		// Keep the PID file so a later stop can find the process again
+		return stage, err
+	}
+	os.Remove(pidPath)
+	if pid > 0 {
+		// A deliberate stop needs no exit reason
+		exitMu.Lock()
+		delete(exitStatuses, pid)
+		exitMu.Unlock()
+	}
+
+	// Clean Network
+	tapPath := GetTapPath(id)
+	if tapData, err := os.ReadFile(tapPath); err == nil {
+		DeleteTap(strings.TrimSpace(string(tapData)))
+		os.Remove(tapPath)
+	}
+
+	// Stale sockets would make the next boot of this sandbox fail to bind
+	for _, path := range []string{GetSocketPath(id), GetVsockPath(id), GetConsoleSocketPath(id)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return stage, fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+
+	fmt.Printf("   [+] VM %s Stopped (%s).\n", id, stage)
+	return stage, nil
+}
+
+// terminate walks the shutdown sequence until the process exits. Before each signal it
+// checks that pid is still the sandbox's VMM, so a reused PID is never signalled.
+func terminate(id string, pid int, graceful bool) (StopStage, error) {
+	if graceful && stopGracePeriod > 0 && requestPowerOff(id) {
+		if waitForExit(id, pid, stopGracePeriod) {
+			return StopStageShutdown, nil
+		}
+		fmt.Printf("   [!] VM %s did not power off within %s\n", id, stopGracePeriod)
+	}
+
+	if !isSandboxVMM(id, pid) {
+		return StopStageNotRunning, nil
+	}
+	syscall.Kill(pid, syscall.SIGTERM)
+	if waitForExit(id, pid, stopTermTimeout) {
+		return StopStageSIGTERM, nil
+	}
+
+	if !isSandboxVMM(id, pid) {
+		return StopStageSIGTERM, nil
+	}
+	syscall.Kill(pid, syscall.SIGKILL)
+	if waitForExit(id, pid, stopKillTimeout) {
+		return StopStageSIGKILL, nil
+	}
+	return StopStageSIGKILL, fmt.Errorf("VM process %d of %s survived SIGKILL", pid, id)
+}
+
+// requestPowerOff presses the ACPI power button of the guest. A paused guest cannot
+// react to it, so it is resumed first. It reports whether the request was delivered.
+func requestPowerOff(id string) bool {
+	client := NewAPIClientForSandbox(id)
+	if !client.IsSocketAvailable() {
+		return false
+	}
+	state, err := client.GetState()
+	if err != nil {
+		return false
+	}
+	switch state {
+	case "Paused":
+		if err := client.Send("vm.resume"); err != nil {
+			return false
+		}
+	case "Running":
+	default:
+		// Created or already shut down: there is no guest to ask
+		return false
+	}
+	return client.Send("vm.power-button") == nil
+}
+
+// waitForExit polls until the VMM process is gone. Once the guest has powered off the
+// VMM itself is asked to exit, since it otherwise idles with the VM in Shutdown state.
+func waitForExit(id string, pid int, timeout time.Duration) bool {
+	client := NewAPIClientForSandbox(id)
+	askedVMM := false
+	deadline := time.Now().Add(timeout)
+	for {
+		if !processAlive(pid) {
+			return true
+		}
+		if !askedVMM && client.IsSocketAvailable() {
+			if state, err := client.GetState(); err == nil && state == "Shutdown" {
+				client.Send("vmm.shutdown")
+				askedVMM = true
+			}
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+var (
+	exitMu sync.Mutex
+	// exitStatuses keeps the wait status of reaped VMMs so ExitReason can explain a crash
+	exitStatuses = make(map[int]syscall.WaitStatus)
+)
+
+// processAlive reports whether pid is still running. VMMs spawned by this server are
+// its children, so an exited one is reaped here instead of lingering as a zombie.
+func processAlive(pid int) bool {
+	var status syscall.WaitStatus
+	if wpid, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil); err == nil && wpid == pid {
+		exitMu.Lock()
+		exitStatuses[pid] = status
+		exitMu.Unlock()
+		return false
+	}
+	return syscall.Kill(pid, 0) == nil
+}
+
+// ExitReason explains why the VM of a sandbox is no longer running and whether that was
+// a clean exit. It must be called before the sandbox is cleaned up, while vm.pid is
+// still present. The exit status is only known for VMMs started by this server process.
+func ExitReason(sbxID string) (string, bool) {
+	pid := readPID(GetPIDPath(sbxID))
+	if pid == 0 {
+		return "vmm pid unknown", false
+	}
+	if processAlive(pid) {
+		// The VMM outlived its VM, which only happens when the guest powers off or halts
+		return "guest shut down", true
+	}
+
+	exitMu.Lock()
+	status, known := exitStatuses[pid]
+	delete(exitStatuses, pid)
+	exitMu.Unlock()
+	switch {
+	case known && status.Exited() && status.ExitStatus() == 0:
+		return "vmm exited with code 0", true
+	case known && status.Exited():
+		return fmt.Sprintf("vmm exited with code %d%s", status.ExitStatus(), lastLogError(sbxID)), false
+	case known && status.Signaled():
+		return fmt.Sprintf("vmm killed by %s%s", status.Signal(), lastLogError(sbxID)), false
+	}
+	return "vmm exited unexpectedly" + lastLogError(sbxID), false
+}
+
+// lastLogError returns the last error line of vm.log, formatted as a reason suffix
+func lastLogError(sbxID string) string {
+	data, err := os.ReadFile(filepath.Join(GetInstanceDir(sbxID), "vm.log"))
+	if err != nil {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for i := len(lines) - 1; i >= 0 && i >= len(lines)-50; i-- {
+		line := strings.TrimSpace(lines[i])
+		lower := strings.ToLower(line)
+		if strings.Contains(lower, "error") || strings.Contains(lower, "panic") {
+			if len(line) > 200 {
+				line = line[:200]
+			}
+			return ": " + line
+		}
+	}
+	return ""
+}
+
+func readPID(pidPath string) int {
+	data, err := os.ReadFile(pidPath)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
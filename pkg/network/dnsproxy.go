@@ -0,0 +1,274 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsTimeout = 5 * time.Second
+	// Resolved addresses stay allowed for at least minResolvedTTL, so a client that
+	// connects right after a short-lived answer expires is not cut off
+	minResolvedTTL = 60 * time.Second
+	maxResolvedTTL = time.Hour
+)
+
+// DNSPolicy decides which names a sandbox may resolve through the proxy and learns the
+// addresses they resolved to
+type DNSPolicy interface {
+	// AllowDNS reports whether the sandbox holding src may resolve name
+	AllowDNS(src netip.Addr, name string) bool
+	// Resolved is called with the IPv4 addresses an allowed name resolved to, before the
+	// answer is passed on to the sandbox
+	Resolved(src netip.Addr, name string, addrs []netip.Addr, ttl time.Duration)
+}
+
+// DNSProxy answers the DNS queries of sandboxes whose egress is limited to domains. It
+// forwards queries for allowed names to the upstream resolver and refuses the others
+// with NXDOMAIN.
+type DNSProxy struct {
+	addr     string
+	upstream string
+	policy   DNSPolicy
+}
+
+// NewDNSProxy returns a proxy listening on addr (UDP and TCP). An empty upstream uses the
+// first nameserver of the host's /etc/resolv.conf.
+func NewDNSProxy(addr, upstream string, policy DNSPolicy) *DNSProxy {
+	if upstream == "" {
+		upstream = systemResolver()
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+	return &DNSProxy{addr: addr, upstream: upstream, policy: policy}
+}
+
+// Start binds the proxy and serves until ctx is cancelled
+func (p *DNSProxy) Start(ctx context.Context) error {
+	udp, err := net.ListenPacket("udp", p.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on udp %s: %w", p.addr, err)
+	}
+	tcp, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		udp.Close()
+		return fmt.Errorf("failed to listen on tcp %s: %w", p.addr, err)
+	}
+	go func() {
+		<-ctx.Done()
+		udp.Close()
+		tcp.Close()
+	}()
+	go p.serveUDP(udp)
+	go p.serveTCP(tcp)
+	fmt.Printf("[dns-proxy] Listening on %s, upstream %s\n", p.addr, p.upstream)
+	return nil
+}
+
+func (p *DNSProxy) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			src, ok := sourceAddr(from)
+			if !ok {
+				return
+			}
+			if resp := p.answer("udp", src, query); resp != nil {
+				conn.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+func (p *DNSProxy) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			src, ok := sourceAddr(conn.RemoteAddr())
+			if !ok {
+				return
+			}
+			for {
+				conn.SetDeadline(time.Now().Add(dnsTimeout))
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				resp := p.answer("tcp", src, query)
+				if resp == nil || writeTCPMessage(conn, resp) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// answer handles one query and returns the response, or nil to drop it
+func (p *DNSProxy) answer(network string, src netip.Addr, query []byte) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+	name := strings.TrimSuffix(strings.ToLower(question.Name.String()), ".")
+	if !p.policy.AllowDNS(src, name) {
+		return reply(header, question, dnsmessage.RCodeNameError)
+	}
+
+	resp, err := p.exchange(network, query)
+	if err != nil {
+		fmt.Printf("[dns-proxy] upstream query for %s failed: %v\n", name, err)
+		return reply(header, question, dnsmessage.RCodeServerFailure)
+	}
+	if addrs, ttl := answerAddrs(resp); len(addrs) > 0 {
+		p.policy.Resolved(src, name, addrs, ttl)
+	}
+	return resp
+}
+
+// exchange forwards a query to the upstream resolver over the same transport
+func (p *DNSProxy) exchange(network string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, p.upstream, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// answerAddrs returns the A records of a response and the TTL to allow them for
+func answerAddrs(resp []byte) ([]netip.Addr, time.Duration) {
+	var parser dnsmessage.Parser
+	if _, err := parser.Start(resp); err != nil {
+		return nil, 0
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, 0
+	}
+	var addrs []netip.Addr
+	ttl := maxResolvedTTL
+	for {
+		header, err := parser.AnswerHeader()
+		if err != nil {
+			break
+		}
+		if header.Type != dnsmessage.TypeA {
+			if err := parser.SkipAnswer(); err != nil {
+				break
+			}
+			continue
+		}
+		a, err := parser.AResource()
+		if err != nil {
+			break
+		}
+		addrs = append(addrs, netip.AddrFrom4(a.A))
+		ttl = min(ttl, time.Duration(header.TTL)*time.Second)
+	}
+	return addrs, max(ttl, minResolvedTTL)
+}
+
+func reply(header dnsmessage.Header, question dnsmessage.Question, rcode dnsmessage.RCode) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	if err := b.StartQuestions(); err != nil {
+		return nil
+	}
+	if err := b.Question(question); err != nil {
+		return nil
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	framed := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[2:], msg)
+	_, err := w.Write(framed)
+	return err
+}
+
+func sourceAddr(addr net.Addr) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
+
+// systemResolver returns the first nameserver of /etc/resolv.conf, or a public resolver
+func systemResolver() string {
+	f, err := os.Open("/etc/resolv.conf")
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return fields[1]
+			}
+		}
+	}
+	return "1.1.1.1"
+}
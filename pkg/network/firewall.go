@@ -0,0 +1,194 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net/netip"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// firewallTable is the nftables table holding every sandbox egress rule
+const firewallTable = "ip voidrun"
+
+// EgressRule allows traffic to a prefix, optionally only to some ports of one protocol
+type EgressRule struct {
+	Prefix   netip.Prefix
+	Protocol string // "tcp", "udp" or empty for both
+	Ports    []uint16
+}
+
+// EgressPolicy lists what a restricted sandbox may reach; everything else is dropped.
+// With DNSProxy set its DNS queries are redirected to the host proxy, and the addresses
+// the proxy resolves for it are allowed until their TTL runs out.
+type EgressPolicy struct {
+	Allow    []EgressRule
+	DNSProxy bool
+}
+
+// SandboxEgress is the policy installed for the sandbox holding IP
+type SandboxEgress struct {
+	IP     netip.Addr
+	Policy EgressPolicy
+}
+
+// Firewall enforces sandbox egress policies with nftables. Each restricted sandbox gets
+// a chain of its own, and a verdict map keyed by sandbox IP sends everything the sandbox
+// forwards or sends to the host through it. Sandboxes without an entry are not filtered.
+type Firewall struct {
+	bridge  string
+	gateway netip.Addr
+	dnsPort int
+}
+
+// NewFirewall checks that nft is available. dnsPort is where the DNS proxy listens on
+// the gateway address.
+func NewFirewall(bridge, gateway string, dnsPort int) (*Firewall, error) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil, fmt.Errorf("nft not found: %w", err)
+	}
+	gw, err := netip.ParseAddr(strings.Split(gateway, "/")[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid gateway %q: %w", gateway, err)
+	}
+	return &Firewall{bridge: bridge, gateway: gw, dnsPort: dnsPort}, nil
+}
+
+// Reset replaces the whole table in one transaction, installing the policies of the
+// given sandboxes, keyed by sandbox ID
+func (f *Firewall) Reset(sandboxes map[string]SandboxEgress) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table %s\n", firewallTable)
+	fmt.Fprintf(&b, "delete table %s\n", firewallTable)
+	fmt.Fprintf(&b, "table %s {\n", firewallTable)
+	b.WriteString("\tmap egress { type ipv4_addr : verdict; }\n")
+	b.WriteString("\tset dns_redirect { type ipv4_addr; }\n")
+	for _, hook := range []string{"forward", "input"} {
+		fmt.Fprintf(&b, "\tchain %s {\n", hook)
+		fmt.Fprintf(&b, "\t\ttype filter hook %s priority filter; policy accept;\n", hook)
+		fmt.Fprintf(&b, "\t\tiifname %q ct state established,related accept\n", f.bridge)
+		fmt.Fprintf(&b, "\t\tiifname %q ip saddr vmap @egress\n", f.bridge)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("\tchain prerouting {\n")
+	b.WriteString("\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q ip saddr @dns_redirect meta l4proto { tcp, udp } th dport 53 dnat to %s:%d\n", f.bridge, f.gateway, f.dnsPort)
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	for id, sandbox := range sandboxes {
+		f.writeApply(&b, id, sandbox.IP, sandbox.Policy)
+	}
+	return nft(b.String())
+}
+
+// Apply installs or replaces the policy of a sandbox. Addresses previously resolved
+// for it through the DNS proxy are dropped.
+func (f *Firewall) Apply(id string, ip netip.Addr, policy EgressPolicy) error {
+	var b strings.Builder
+	f.writeApply(&b, id, ip, policy)
+	return nft(b.String())
+}
+
+// Remove lifts the policy of a sandbox, leaving its traffic unfiltered
+func (f *Firewall) Remove(id string, ip netip.Addr) error {
+	var b strings.Builder
+	chain, set := sandboxChain(id), resolvedSet(id)
+	// Every delete is preceded by an add so the transaction succeeds whatever is left
+	fmt.Fprintf(&b, "add chain %s %s\n", firewallTable, chain)
+	fmt.Fprintf(&b, "add set %s %s { type ipv4_addr; flags timeout; }\n", firewallTable, set)
+	fmt.Fprintf(&b, "add element %s egress { %s : jump %s }\n", firewallTable, ip, chain)
+	fmt.Fprintf(&b, "add element %s dns_redirect { %s }\n", firewallTable, ip)
+	fmt.Fprintf(&b, "delete element %s egress { %s }\n", firewallTable, ip)
+	fmt.Fprintf(&b, "delete element %s dns_redirect { %s }\n", firewallTable, ip)
+	fmt.Fprintf(&b, "flush chain %s %s\n", firewallTable, chain)
+	fmt.Fprintf(&b, "delete chain %s %s\n", firewallTable, chain)
+	fmt.Fprintf(&b, "delete set %s %s\n", firewallTable, set)
+	return nft(b.String())
+}
+
+// AllowResolved lets a sandbox reach addresses its allowed domains resolved to, for ttl
+func (f *Firewall) AllowResolved(id string, addrs []netip.Addr, ttl time.Duration) error {
+	if len(addrs) == 0 {
+		return nil
+	}
+	set := resolvedSet(id)
+	elems := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		elems = append(elems, addr.String())
+	}
+	list := strings.Join(elems, ", ")
+	timed := make([]string, 0, len(addrs))
+	for _, elem := range elems {
+		timed = append(timed, fmt.Sprintf("%s timeout %ds", elem, int(ttl.Seconds())))
+	}
+	// Deleting and re-adding refreshes the timeout of addresses already in the set
+	var b strings.Builder
+	fmt.Fprintf(&b, "add element %s %s { %s }\n", firewallTable, set, list)
+	fmt.Fprintf(&b, "delete element %s %s { %s }\n", firewallTable, set, list)
+	fmt.Fprintf(&b, "add element %s %s { %s }\n", firewallTable, set, strings.Join(timed, ", "))
+	return nft(b.String())
+}
+
+func (f *Firewall) writeApply(b *strings.Builder, id string, ip netip.Addr, policy EgressPolicy) {
+	chain, set := sandboxChain(id), resolvedSet(id)
+	fmt.Fprintf(b, "add chain %s %s\n", firewallTable, chain)
+	fmt.Fprintf(b, "add set %s %s { type ipv4_addr; flags timeout; }\n", firewallTable, set)
+	fmt.Fprintf(b, "flush chain %s %s\n", firewallTable, chain)
+	fmt.Fprintf(b, "flush set %s %s\n", firewallTable, set)
+	rule := func(format string, args ...interface{}) {
+		fmt.Fprintf(b, "add rule %s %s %s\n", firewallTable, chain, fmt.Sprintf(format, args...))
+	}
+	if policy.DNSProxy {
+		rule("ip daddr %s meta l4proto { tcp, udp } th dport %d accept", f.gateway, f.dnsPort)
+		rule("ip daddr @%s accept", set)
+	}
+	for _, allow := range policy.Allow {
+		switch {
+		case len(allow.Ports) > 0:
+			ports := make([]string, 0, len(allow.Ports))
+			for _, port := range allow.Ports {
+				ports = append(ports, fmt.Sprint(port))
+			}
+			protocols := []string{allow.Protocol}
+			if allow.Protocol == "" {
+				protocols = []string{"tcp", "udp"}
+			}
+			for _, proto := range protocols {
+				rule("ip daddr %s %s dport { %s } accept", allow.Prefix, proto, strings.Join(ports, ", "))
+			}
+		case allow.Protocol != "":
+			rule("ip daddr %s meta l4proto %s accept", allow.Prefix, allow.Protocol)
+		default:
+			rule("ip daddr %s accept", allow.Prefix)
+		}
+	}
+	rule("counter drop")
+
+	// The redirect must match the policy, so it is removed by adding then deleting it
+	fmt.Fprintf(b, "add element %s dns_redirect { %s }\n", firewallTable, ip)
+	if !policy.DNSProxy {
+		fmt.Fprintf(b, "delete element %s dns_redirect { %s }\n", firewallTable, ip)
+	}
+	fmt.Fprintf(b, "add element %s egress { %s : jump %s }\n", firewallTable, ip, chain)
+}
+
+func sandboxChain(id string) string {
+	return "sbx_" + id
+}
+
+func resolvedSet(id string) string {
+	return "dns_" + id
+}
+
+// nft runs an nft script as one atomic transaction
+func nft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
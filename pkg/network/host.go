@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"voidrun/pkg/timer"
 	"net"
+	"strings"
 
 	"github.com/vishvananda/netlink"
 )
@@ -98,15 +99,20 @@ func DeleteTap(tapName string) error {
 	return netlink.LinkDel(link)
 }
 
-func GenerateMAC(ip string) string {
-	mac := "AA:FC:00:00:00:01"
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return mac
+// ListTaps returns the names of all links whose name starts with tapPrefix
+func ListTaps(tapPrefix string) ([]string, error) {
+	if tapPrefix == "" {
+		return nil, fmt.Errorf("tap prefix is empty")
 	}
-	ipv4 := parsedIP.To4()
-	if ipv4 == nil {
-		return mac
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links: %w", err)
+	}
+	var taps []string
+	for _, link := range links {
+		if name := link.Attrs().Name; strings.HasPrefix(name, tapPrefix) {
+			taps = append(taps, name)
+		}
 	}
-	return fmt.Sprintf("AA:FC:00:00:00:%02X", ipv4[3])
+	return taps, nil
 }
@@ -0,0 +1,216 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// DefaultPoolName names the pool covering the whole sandbox network
+const DefaultPoolName = "default"
+
+// Pool is a named range of sandbox addresses inside the sandbox network. A pool scoped to
+// an org or a host serves only the sandboxes of that org, or those created on that host.
+type Pool struct {
+	Name   string       `json:"name"`
+	Prefix netip.Prefix `json:"cidr"`
+	OrgID  string       `json:"orgId,omitempty"`
+	Host   string       `json:"host,omitempty"`
+}
+
+// ParsePool parses a pool entry of the form name=CIDR, optionally followed by
+// @org:<orgId> or @host:<hostname>
+func ParsePool(entry string) (Pool, error) {
+	name, rest, ok := strings.Cut(entry, "=")
+	if !ok || name == "" {
+		return Pool{}, fmt.Errorf("pool must be name=CIDR in %q", entry)
+	}
+	cidr, scope, scoped := strings.Cut(rest, "@")
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil || !prefix.Addr().Is4() {
+		return Pool{}, fmt.Errorf("invalid IPv4 CIDR in %q", entry)
+	}
+	pool := Pool{Name: name, Prefix: prefix.Masked()}
+	if scoped {
+		kind, value, _ := strings.Cut(scope, ":")
+		switch {
+		case kind == "org" && value != "":
+			pool.OrgID = value
+		case kind == "host" && value != "":
+			pool.Host = value
+		default:
+			return Pool{}, fmt.Errorf("scope must be org:<id> or host:<name> in %q", entry)
+		}
+	}
+	return pool, nil
+}
+
+// IPAM knows which addresses of the sandbox network may be handed out and from which
+// pool. It holds no lease state: callers pass the addresses already taken.
+//
+// An address belongs to the narrowest pool containing it, so a broad pool never hands out
+// addresses of a narrower pool carved out of it. The network and broadcast addresses, the
+// gateway and the reserved ranges are never handed out.
+type IPAM struct {
+	network  netip.Prefix
+	pools    []Pool
+	reserved []netip.Prefix
+	sizes    map[string]int
+}
+
+// NewIPAM validates the pools and reservations of the sandbox network. Unless an entry
+// redefines it, a pool named default covers the whole network and serves every sandbox
+// without a pool of its own.
+func NewIPAM(networkCIDR, gateway string, poolEntries, reservedEntries []string) (*IPAM, error) {
+	network, err := netip.ParsePrefix(networkCIDR)
+	if err != nil || !network.Addr().Is4() {
+		return nil, fmt.Errorf("invalid IPv4 NETWORK_CIDR %q", networkCIDR)
+	}
+	network = network.Masked()
+	ipam := &IPAM{network: network, sizes: make(map[string]int)}
+
+	var pools []Pool
+	hasDefault := false
+	for _, entry := range poolEntries {
+		pool, err := ParsePool(entry)
+		if err != nil {
+			return nil, err
+		}
+		hasDefault = hasDefault || pool.Name == DefaultPoolName
+		pools = append(pools, pool)
+	}
+	if !hasDefault {
+		pools = append([]Pool{{Name: DefaultPoolName, Prefix: network}}, pools...)
+	}
+	for i, pool := range pools {
+		if !network.Contains(pool.Prefix.Addr()) || pool.Prefix.Bits() < network.Bits() {
+			return nil, fmt.Errorf("pool %s (%s) is outside %s", pool.Name, pool.Prefix, network)
+		}
+		// IPv4 prefixes are always nested or disjoint, so only identical ranges are ambiguous
+		for _, other := range pools[:i] {
+			if other.Name == pool.Name {
+				return nil, fmt.Errorf("duplicate pool %s", pool.Name)
+			}
+			if other.Prefix == pool.Prefix {
+				return nil, fmt.Errorf("pools %s and %s cover the same range %s", other.Name, pool.Name, pool.Prefix)
+			}
+		}
+	}
+	ipam.pools = pools
+
+	// The network and broadcast addresses are unusable on the bridge
+	first := network.Addr()
+	last := addrAt(first, uint32(prefixSize(network)-1))
+	ipam.reserved = append(ipam.reserved, netip.PrefixFrom(first, 32), netip.PrefixFrom(last, 32))
+	if gw, err := netip.ParseAddr(strings.Split(gateway, "/")[0]); err == nil {
+		ipam.reserved = append(ipam.reserved, netip.PrefixFrom(gw, 32))
+	}
+	for _, entry := range reservedEntries {
+		prefix, err := parseAddrOrPrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		ipam.reserved = append(ipam.reserved, prefix)
+	}
+
+	for _, pool := range ipam.pools {
+		size := 0
+		for i := uint64(0); i < prefixSize(pool.Prefix); i++ {
+			if ipam.Usable(pool, addrAt(pool.Prefix.Addr(), uint32(i))) {
+				size++
+			}
+		}
+		ipam.sizes[pool.Name] = size
+	}
+	return ipam, nil
+}
+
+// Pools returns the configured pools
+func (a *IPAM) Pools() []Pool {
+	return a.pools
+}
+
+// Size returns how many addresses pool can hand out
+func (a *IPAM) Size(pool Pool) int {
+	return a.sizes[pool.Name]
+}
+
+// Select picks the pool for a sandbox: the pool of its org, else the pool of this host,
+// else an unscoped pool
+func (a *IPAM) Select(orgID, host string) (Pool, bool) {
+	for _, match := range []func(Pool) bool{
+		func(p Pool) bool { return orgID != "" && p.OrgID == orgID },
+		func(p Pool) bool { return host != "" && p.Host == host },
+		func(p Pool) bool { return p.OrgID == "" && p.Host == "" },
+	} {
+		for _, pool := range a.pools {
+			if match(pool) {
+				return pool, true
+			}
+		}
+	}
+	return Pool{}, false
+}
+
+// PoolOf returns the pool an address belongs to, the narrowest one containing it
+func (a *IPAM) PoolOf(addr netip.Addr) (Pool, bool) {
+	var best Pool
+	found := false
+	for _, pool := range a.pools {
+		if pool.Prefix.Contains(addr) && (!found || pool.Prefix.Bits() > best.Prefix.Bits()) {
+			best, found = pool, true
+		}
+	}
+	return best, found
+}
+
+// Next returns the first address of pool at or after offset, wrapping around, that is
+// neither reserved nor in taken. It reports false when the pool is exhausted.
+func (a *IPAM) Next(pool Pool, offset uint32, taken map[netip.Addr]bool) (netip.Addr, bool) {
+	size := prefixSize(pool.Prefix)
+	for i := uint64(0); i < size; i++ {
+		addr := addrAt(pool.Prefix.Addr(), uint32((uint64(offset)+i)%size))
+		if !taken[addr] && a.Usable(pool, addr) {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// Usable reports whether addr may be handed out from pool
+func (a *IPAM) Usable(pool Pool, addr netip.Addr) bool {
+	for _, r := range a.reserved {
+		if r.Contains(addr) {
+			return false
+		}
+	}
+	owner, ok := a.PoolOf(addr)
+	return ok && owner.Name == pool.Name
+}
+
+func prefixSize(p netip.Prefix) uint64 {
+	return uint64(1) << (32 - p.Bits())
+}
+
+func addrAt(base netip.Addr, offset uint32) netip.Addr {
+	b := base.As4()
+	var out [4]byte
+	binary.BigEndian.PutUint32(out[:], binary.BigEndian.Uint32(b[:])+offset)
+	return netip.AddrFrom4(out)
+}
+
+func parseAddrOrPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid reserved range %q", s)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid reserved address %q", s)
+	}
+	return netip.PrefixFrom(addr, 32), nil
+}
@@ -0,0 +1,143 @@
+package network
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestNewIPAMAddsDefaultPool(t *testing.T) {
+	ipam, err := NewIPAM("10.0.0.0/24", "10.0.0.1/24", nil, nil)
+	if err != nil {
+		t.Fatalf("NewIPAM: %v", err)
+	}
+	pools := ipam.Pools()
+	if len(pools) != 1 || pools[0].Name != DefaultPoolName || pools[0].Prefix != netip.MustParsePrefix("10.0.0.0/24") {
+		t.Fatalf("pools = %+v, want only default covering 10.0.0.0/24", pools)
+	}
+	// 256 addresses minus network, broadcast and gateway
+	if got := ipam.Size(pools[0]); got != 253 {
+		t.Errorf("Size(default) = %d, want 253", got)
+	}
+}
+
+func TestNewIPAMRejectsBadPools(t *testing.T) {
+	cases := map[string][]string{
+		"outside network":  {"a=10.1.0.0/28"},
+		"wider than net":   {"a=10.0.0.0/16"},
+		"duplicate name":   {"a=10.0.0.0/28", "a=10.0.0.16/28"},
+		"same range":       {"a=10.0.0.0/28", "b=10.0.0.0/28"},
+		"missing cidr":     {"a"},
+		"bad scope":        {"a=10.0.0.0/28@team:x"},
+		"ipv6":             {"a=fd00::/64"},
+		"empty scope name": {"a=10.0.0.0/28@org:"},
+	}
+	for name, pools := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewIPAM("10.0.0.0/24", "10.0.0.1", pools, nil); err == nil {
+				t.Fatalf("NewIPAM(%v) succeeded, want error", pools)
+			}
+		})
+	}
+	if _, err := NewIPAM("not-a-cidr", "", nil, nil); err == nil {
+		t.Error("NewIPAM accepted an invalid network")
+	}
+	if _, err := NewIPAM("10.0.0.0/24", "", nil, []string{"10.0.0.x"}); err == nil {
+		t.Error("NewIPAM accepted an invalid reservation")
+	}
+}
+
+func TestNextSkipsReservedGatewayAndBroadcast(t *testing.T) {
+	ipam, err := NewIPAM("10.0.0.0/29", "10.0.0.1", nil, []string{"10.0.0.2", "10.0.0.4/31"})
+	if err != nil {
+		t.Fatalf("NewIPAM: %v", err)
+	}
+	pool, _ := ipam.Select("", "")
+
+	var got []string
+	taken := map[netip.Addr]bool{}
+	for {
+		addr, ok := ipam.Next(pool, 0, taken)
+		if !ok {
+			break
+		}
+		taken[addr] = true
+		got = append(got, addr.String())
+	}
+	// .0 network, .1 gateway, .2 and .4-.5 reserved, .7 broadcast
+	want := []string{"10.0.0.3", "10.0.0.6"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("handed out %v, want %v", got, want)
+	}
+	if ipam.Size(pool) != len(want) {
+		t.Errorf("Size = %d, want %d", ipam.Size(pool), len(want))
+	}
+}
+
+func TestNextWrapsAroundFromOffset(t *testing.T) {
+	ipam, err := NewIPAM("10.0.0.0/29", "10.0.0.1", nil, nil)
+	if err != nil {
+		t.Fatalf("NewIPAM: %v", err)
+	}
+	pool, _ := ipam.Select("", "")
+	taken := map[netip.Addr]bool{netip.MustParseAddr("10.0.0.6"): true}
+	addr, ok := ipam.Next(pool, 6, taken)
+	if !ok || addr != netip.MustParseAddr("10.0.0.2") {
+		t.Fatalf("Next from .6 = %v %v, want 10.0.0.2", addr, ok)
+	}
+}
+
+func TestSelectPrefersOrgThenHostThenUnscoped(t *testing.T) {
+	ipam, err := NewIPAM("10.0.0.0/24", "10.0.0.1", []string{
+		"acme=10.0.0.64/26@org:acme",
+		"edge=10.0.0.128/26@host:edge-1",
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewIPAM: %v", err)
+	}
+	cases := []struct {
+		org, host, want string
+	}{
+		{"acme", "edge-1", "acme"},
+		{"acme", "", "acme"},
+		{"other", "edge-1", "edge"},
+		{"other", "edge-2", DefaultPoolName},
+		{"", "", DefaultPoolName},
+	}
+	for _, c := range cases {
+		pool, ok := ipam.Select(c.org, c.host)
+		if !ok || pool.Name != c.want {
+			t.Errorf("Select(%q, %q) = %s, want %s", c.org, c.host, pool.Name, c.want)
+		}
+	}
+}
+
+func TestBroadPoolNeverHandsOutNarrowerPool(t *testing.T) {
+	ipam, err := NewIPAM("10.0.0.0/28", "10.0.0.1", []string{"acme=10.0.0.8/29@org:acme"}, nil)
+	if err != nil {
+		t.Fatalf("NewIPAM: %v", err)
+	}
+	def, _ := ipam.Select("", "")
+	acme, _ := ipam.Select("acme", "")
+
+	taken := map[netip.Addr]bool{}
+	for {
+		addr, ok := ipam.Next(def, 0, taken)
+		if !ok {
+			break
+		}
+		if acme.Prefix.Contains(addr) {
+			t.Fatalf("default pool handed out %s of pool acme", addr)
+		}
+		taken[addr] = true
+	}
+	// .0 network and .1 gateway leave .2-.7 to default; .15 broadcast leaves .8-.14 to acme
+	if len(taken) != 6 {
+		t.Errorf("default handed out %d addresses, want 6", len(taken))
+	}
+	if got := ipam.Size(acme); got != 7 {
+		t.Errorf("Size(acme) = %d, want 7", got)
+	}
+	if pool, _ := ipam.PoolOf(netip.MustParseAddr("10.0.0.9")); pool.Name != "acme" {
+		t.Errorf("PoolOf(10.0.0.9) = %s, want acme", pool.Name)
+	}
+}
@@ -0,0 +1,181 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"strings"
+)
+
+// isolationTable is the nftables table keeping sandboxes on the bridge apart
+const isolationTable = "bridge voidrun"
+
+// TapBinding ties a TAP to the only MAC and IP its sandbox may send from
+type TapBinding struct {
+	Tap string
+	MAC net.HardwareAddr
+	IP  netip.Addr
+}
+
+// Isolation blocks traffic between sandboxes on the shared bridge with nftables
+// bridge-family rules. Each bound TAP gets a chain that drops frames not sent from its
+// sandbox's MAC and IP, and anything but IPv4 and ARP; frames from TAPs that are not bound
+// are dropped. Frames between two TAPs, and packets the host routes from one sandbox back
+// to another, pass only when the sender is in a peer group and the target address is in
+// the same group. Traffic between sandboxes and the host is not affected.
+type Isolation struct {
+	tapPrefix string
+	network   netip.Prefix
+	gateway   netip.Addr
+}
+
+// NewIsolation checks that nft is available
+func NewIsolation(tapPrefix, networkCIDR, gateway string) (*Isolation, error) {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return nil, fmt.Errorf("nft not found: %w", err)
+	}
+	if tapPrefix == "" {
+		return nil, fmt.Errorf("tap prefix is empty")
+	}
+	prefix, err := netip.ParsePrefix(networkCIDR)
+	if err != nil || !prefix.Addr().Is4() {
+		return nil, fmt.Errorf("invalid IPv4 network %q", networkCIDR)
+	}
+	gw, err := netip.ParseAddr(strings.Split(gateway, "/")[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid gateway %q: %w", gateway, err)
+	}
+	return &Isolation{tapPrefix: tapPrefix, network: prefix.Masked(), gateway: gw}, nil
+}
+
+// Reset replaces the whole table in one transaction, binding the given TAPs and filling
+// the peer groups, whose members are keyed by group name
+func (i *Isolation) Reset(taps []TapBinding, groups map[string][]netip.Addr) error {
+	wildcard := fmt.Sprintf("%q", i.tapPrefix+"*")
+	var b strings.Builder
+	fmt.Fprintf(&b, "add table %s\n", isolationTable)
+	fmt.Fprintf(&b, "delete table %s\n", isolationTable)
+	fmt.Fprintf(&b, "table %s {\n", isolationTable)
+	b.WriteString("\tmap ports { type ifname : verdict; }\n")
+	b.WriteString("\tmap targets { type ifname : verdict; }\n")
+	b.WriteString("\tmap peers { type ipv4_addr : verdict; }\n")
+	b.WriteString("\tchain prerouting {\n")
+	b.WriteString("\t\ttype filter hook prerouting priority filter; policy accept;\n")
+	b.WriteString("\t\tiifname vmap @ports\n")
+	fmt.Fprintf(&b, "\t\tiifname %s counter drop\n", wildcard)
+	b.WriteString("\t}\n")
+	b.WriteString("\tchain forward {\n")
+	b.WriteString("\t\ttype filter hook forward priority filter; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %s oifname %s jump east_west\n", wildcard, wildcard)
+	b.WriteString("\t}\n")
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority filter; policy accept;\n")
+	fmt.Fprintf(&b, "\t\toifname %s ether type ip ip saddr %s ip saddr != %s jump east_west\n", wildcard, i.network, i.gateway)
+	b.WriteString("\t}\n")
+	b.WriteString("\tchain east_west {\n")
+	// The target chain of the outgoing TAP drops frames addressed to another sandbox's IP
+	b.WriteString("\t\toifname vmap @targets\n")
+	b.WriteString("\t\tether type ip ip saddr vmap @peers\n")
+	b.WriteString("\t\tether type arp arp saddr ip vmap @peers\n")
+	b.WriteString("\t\tcounter drop\n")
+	b.WriteString("\t}\n")
+	b.WriteString("}\n")
+	for _, tap := range taps {
+		writeBind(&b, tap)
+	}
+	for group, members := range groups {
+		for _, ip := range members {
+			writeJoin(&b, group, ip)
+		}
+	}
+	return nft(b.String())
+}
+
+// BindTap restricts a TAP to the MAC and IP of its sandbox. Call it before the TAP is
+// attached to the bridge.
+func (i *Isolation) BindTap(tap TapBinding) error {
+	var b strings.Builder
+	writeBind(&b, tap)
+	return nft(b.String())
+}
+
+// UnbindTap removes the chains of a TAP, whose frames are then dropped
+func (i *Isolation) UnbindTap(tap string) error {
+	var b strings.Builder
+	port, target := portChain(tap), targetChain(tap)
+	// Every delete is preceded by an add so the transaction succeeds whatever is left
+	fmt.Fprintf(&b, "add chain %s %s\n", isolationTable, port)
+	fmt.Fprintf(&b, "add chain %s %s\n", isolationTable, target)
+	fmt.Fprintf(&b, "add element %s ports { %q : jump %s }\n", isolationTable, tap, port)
+	fmt.Fprintf(&b, "add element %s targets { %q : jump %s }\n", isolationTable, tap, target)
+	fmt.Fprintf(&b, "delete element %s ports { %q }\n", isolationTable, tap)
+	fmt.Fprintf(&b, "delete element %s targets { %q }\n", isolationTable, tap)
+	for _, chain := range []string{port, target} {
+		fmt.Fprintf(&b, "flush chain %s %s\n", isolationTable, chain)
+		fmt.Fprintf(&b, "delete chain %s %s\n", isolationTable, chain)
+	}
+	return nft(b.String())
+}
+
+// Join puts the sandbox holding ip into a peer group, letting it reach the other members
+func (i *Isolation) Join(group string, ip netip.Addr) error {
+	var b strings.Builder
+	writeJoin(&b, group, ip)
+	return nft(b.String())
+}
+
+// Leave takes the sandbox holding ip out of a peer group
+func (i *Isolation) Leave(group string, ip netip.Addr) error {
+	var b strings.Builder
+	writeJoin(&b, group, ip)
+	fmt.Fprintf(&b, "delete element %s peers { %s }\n", isolationTable, ip)
+	fmt.Fprintf(&b, "delete element %s %s { %s }\n", isolationTable, groupSet(group), ip)
+	return nft(b.String())
+}
+
+func writeBind(b *strings.Builder, tap TapBinding) {
+	port, target := portChain(tap.Tap), targetChain(tap.Tap)
+	fmt.Fprintf(b, "add chain %s %s\n", isolationTable, port)
+	fmt.Fprintf(b, "add chain %s %s\n", isolationTable, target)
+	fmt.Fprintf(b, "flush chain %s %s\n", isolationTable, port)
+	fmt.Fprintf(b, "flush chain %s %s\n", isolationTable, target)
+	rule := func(chain, format string, args ...interface{}) {
+		fmt.Fprintf(b, "add rule %s %s %s\n", isolationTable, chain, fmt.Sprintf(format, args...))
+	}
+	rule(port, "ether saddr != %s counter drop", tap.MAC)
+	rule(port, "ether type ip ip saddr %s accept", tap.IP)
+	rule(port, "ether type arp arp saddr ether %s arp saddr ip %s accept", tap.MAC, tap.IP)
+	rule(port, "counter drop")
+	rule(target, "ether type ip ip daddr != %s counter drop", tap.IP)
+	rule(target, "ether type arp arp daddr ip != %s counter drop", tap.IP)
+	fmt.Fprintf(b, "add element %s ports { %q : jump %s }\n", isolationTable, tap.Tap, port)
+	fmt.Fprintf(b, "add element %s targets { %q : jump %s }\n", isolationTable, tap.Tap, target)
+}
+
+func writeJoin(b *strings.Builder, group string, ip netip.Addr) {
+	chain, set := groupChain(group), groupSet(group)
+	fmt.Fprintf(b, "add set %s %s { type ipv4_addr; }\n", isolationTable, set)
+	fmt.Fprintf(b, "add chain %s %s\n", isolationTable, chain)
+	fmt.Fprintf(b, "flush chain %s %s\n", isolationTable, chain)
+	fmt.Fprintf(b, "add rule %s %s ether type ip ip daddr @%s accept\n", isolationTable, chain, set)
+	fmt.Fprintf(b, "add rule %s %s ether type arp arp daddr ip @%s accept\n", isolationTable, chain, set)
+	fmt.Fprintf(b, "add element %s %s { %s }\n", isolationTable, set, ip)
+	fmt.Fprintf(b, "add element %s peers { %s : jump %s }\n", isolationTable, ip, chain)
+}
+
+func portChain(tap string) string {
+	return "port_" + tap
+}
+
+func targetChain(tap string) string {
+	return "target_" + tap
+}
+
+func groupChain(group string) string {
+	return "peer_" + group
+}
+
+func groupSet(group string) string {
+	return "members_" + group
+}
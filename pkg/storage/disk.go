@@ -113,3 +113,116 @@ func getQcow2VirtualSizeMB(ctx context.Context, imagePath string) (int, error) {
 	mb := int((info.VirtualSize + (1024*1024 - 1)) / (1024 * 1024))
 	return mb, nil
 }
+
+// RebaseOverlay points an overlay at this host's base image for imageType. Overlays record
+// the absolute path of their backing file, which differs on hosts with another
+// BASE_IMAGES_DIR. Only the metadata is rewritten, so the base images must be identical.
+// The overlay may come from an imported archive, so it is opened as qcow2 only, never
+// probed, and one that keeps its data in an external file is refused.
+func RebaseOverlay(ctx context.Context, cfg config.Config, overlayPath, imageType string) error {
+	if !safePathRegex.MatchString(imageType) {
+		return fmt.Errorf("invalid characters in image name: %q", imageType)
+	}
+	basePath := filepath.Join(cfg.Paths.BaseImagesDir, imageType+"-base.qcow2")
+	if _, err := os.Stat(basePath); err != nil {
+		return fmt.Errorf("base image missing at path: %s", basePath)
+	}
+
+	cmdCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(cmdCtx, "qemu-img", "info", "-f", "qcow2", "--output=json", overlayPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img info failed: %v. Output: %s", err, string(output))
+	}
+	var info struct {
+		Format          string `json:"format"`
+		BackingFilename string `json:"backing-filename"`
+		FormatSpecific  struct {
+			Data struct {
+				DataFile string `json:"data-file"`
+			} `json:"data"`
+		} `json:"format-specific"`
+	}
+	if err := json.Unmarshal(output, &info); err != nil {
+		return fmt.Errorf("parse json: %w", err)
+	}
+	if info.Format != "qcow2" {
+		return fmt.Errorf("overlay is %q, want qcow2", info.Format)
+	}
+	if info.FormatSpecific.Data.DataFile != "" {
+		return fmt.Errorf("overlay keeps its data in %s", info.FormatSpecific.Data.DataFile)
+	}
+	if info.BackingFilename == basePath {
+		return nil
+	}
+
+	log.Printf("[DEBUG] Rebasing overlay: %s -> %s (was %s)", overlayPath, basePath, info.BackingFilename)
+	output, err = exec.CommandContext(cmdCtx, "qemu-img", "rebase", "-u",
+		"-f", "qcow2",
+		"-b", basePath,
+		"-F", "qcow2",
+		overlayPath,
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img rebase failed: %v. Output: %s", err, string(output))
+	}
+	return nil
+}
+
+// CloneOverlay creates a new overlay at overlayPath whose backing file is the disk at
+// backingPath. Nothing is copied: the new overlay only receives the guest's later writes,
+// so the backing disk must stay in place and unchanged for as long as the overlay lives.
+func CloneOverlay(ctx context.Context, backingPath, overlayPath string) error {
+	defer timer.Track("CloneOverlay")()
+
+	backingPath, err := filepath.Abs(backingPath)
+	if err != nil {
+		return err
+	}
+	cmdCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(cmdCtx, "qemu-img", "create",
+		"-f", "qcow2",
+		"-b", backingPath,
+		"-F", "qcow2",
+		overlayPath,
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img create failed: %v. Output: %s", err, string(output))
+	}
+	return nil
+}
+
+// DetachOverlay rebases an overlay that backs onto another overlay, such as the disk of a
+// restored sandbox, onto the base image at the bottom of its chain. The clusters it
+// inherited from the layers in between are copied into it, so afterwards it depends on
+// the base image only.
+func DetachOverlay(ctx context.Context, overlayPath string) error {
+	output, err := exec.CommandContext(ctx, "qemu-img", "info", "--backing-chain", "--output=json", overlayPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img info failed: %v. Output: %s", err, string(output))
+	}
+	var chain []struct {
+		Filename string `json:"filename"`
+	}
+	if err := json.Unmarshal(output, &chain); err != nil {
+		return fmt.Errorf("parse json: %w", err)
+	}
+	if len(chain) <= 2 {
+		return nil
+	}
+	basePath := chain[len(chain)-1].Filename
+
+	log.Printf("[DEBUG] Detaching overlay %s onto %s (%d layers)", overlayPath, basePath, len(chain))
+	output, err = exec.CommandContext(ctx, "qemu-img", "rebase",
+		"-b", basePath,
+		"-F", "qcow2",
+		overlayPath,
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("qemu-img rebase failed: %v. Output: %s", err, string(output))
+	}
+	return nil
+}
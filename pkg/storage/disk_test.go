@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"voidrun/internal/config"
+)
+
+// stubQemuImg puts a qemu-img on PATH that answers info with info and logs its arguments
+func stubQemuImg(t *testing.T, info string) string {
+	t.Helper()
+	dir := t.TempDir()
+	log := filepath.Join(dir, "args")
+	script := "#!/bin/sh\necho \"$@\" >> " + log + "\n[ \"$1\" = info ] && printf '%s' '" + info + "'\nexit 0\n"
+	if err := os.WriteFile(filepath.Join(dir, "qemu-img"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+func TestRebaseOverlayRefusesForeignImages(t *testing.T) {
+	cfg := config.Config{}
+	cfg.Paths.BaseImagesDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(cfg.Paths.BaseImagesDir, "alpine-base.qcow2"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]string{
+		"raw":       `{"format":"raw"}`,
+		"vmdk":      `{"format":"vmdk","backing-filename":"/etc/shadow"}`,
+		"data file": `{"format":"qcow2","format-specific":{"type":"qcow2","data":{"data-file":"/dev/sda"}}}`,
+	}
+	for name, info := range cases {
+		t.Run(name, func(t *testing.T) {
+			log := stubQemuImg(t, info)
+			if err := RebaseOverlay(context.Background(), cfg, "/tmp/overlay.qcow2", "alpine"); err == nil {
+				t.Fatal("RebaseOverlay accepted the overlay")
+			}
+			args, _ := os.ReadFile(log)
+			if strings.Contains(string(args), "rebase") {
+				t.Errorf("overlay rebased before it was checked: %s", args)
+			}
+		})
+	}
+
+	log := stubQemuImg(t, `{"format":"qcow2","backing-filename":"/elsewhere/alpine-base.qcow2"}`)
+	if err := RebaseOverlay(context.Background(), cfg, "/tmp/overlay.qcow2", "alpine"); err != nil {
+		t.Fatalf("RebaseOverlay: %v", err)
+	}
+	args, _ := os.ReadFile(log)
+	for _, line := range strings.Split(strings.TrimSpace(string(args)), "\n") {
+		if !strings.Contains(line, "-f qcow2") {
+			t.Errorf("qemu-img %s probes the format", line)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package util
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"strings"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -13,23 +17,69 @@ const (
 	APIKeyPrefix = "org"
 	// APIKeyLength is the length of the random part in bytes
 	APIKeyLength = 32
+	// APIKeyIDLength is the length of the public lookup ID in bytes
+	APIKeyIDLength = 8
 	// BCryptCost is the cost factor for bcrypt hashing
 	BCryptCost = 12
+	// LegacyAPIKeyIDPrefix marks lookup IDs derived for keys issued before lookup IDs existed
+	LegacyAPIKeyIDPrefix = "legacy"
 )
 
-// GenerateAPIKey generates a new secure API key with format: org_<random_base64>
-func GenerateAPIKey() (string, error) {
+// GenerateAPIKey generates a new secure API key with format: org_<keyid>_<random_base64>.
+// The key ID is public and is used to find the stored hash in a single lookup.
+func GenerateAPIKey() (apiKey string, keyID string, err error) {
+	idBytes := make([]byte, APIKeyIDLength)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", fmt.Errorf("failed to generate key id: %w", err)
+	}
 	randomBytes := make([]byte, APIKeyLength)
-	_, err := rand.Read(randomBytes)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	if _, err := rand.Read(randomBytes); err != nil {
+		return "", "", fmt.Errorf("failed to generate random bytes: %w", err)
 	}
 
-	// Use URL-safe base64 encoding without padding for cleaner keys
+	// Hex key ID never contains the '_' separator; the secret uses URL-safe base64 without padding
+	keyID = hex.EncodeToString(idBytes)
 	randomPart := base64.RawURLEncoding.EncodeToString(randomBytes)
-	apiKey := fmt.Sprintf("%s_%s", APIKeyPrefix, randomPart)
+	apiKey = fmt.Sprintf("%s_%s_%s", APIKeyPrefix, keyID, randomPart)
+
+	return apiKey, keyID, nil
+}
+
+// ParseAPIKeyID extracts the public lookup ID from a key in org_<keyid>_<secret> format.
+// It returns false for legacy org_<secret> keys.
+func ParseAPIKeyID(apiKey string) (string, bool) {
+	parts := strings.SplitN(apiKey, "_", 3)
+	if len(parts) != 3 || parts[0] != APIKeyPrefix || parts[2] == "" {
+		return "", false
+	}
+	keyID := parts[1]
+	if len(keyID) != hex.EncodedLen(APIKeyIDLength) {
+		return "", false
+	}
+	for _, r := range keyID {
+		if !((r >= '0' && r <= '9') || (r >= 'a' && r <= 'f')) {
+			return "", false
+		}
+	}
+	return keyID, true
+}
+
+// LegacyAPIKeyID derives a stable lookup ID for a legacy key from its digest.
+// Legacy keys get this ID assigned once they have been verified through bcrypt.
+func LegacyAPIKeyID(apiKey string) string {
+	return LegacyAPIKeyIDPrefix + DigestAPIKey(apiKey)[:hex.EncodedLen(APIKeyIDLength)]
+}
+
+// DigestAPIKey returns the hex SHA-256 digest of an API key.
+// Keys carry 256 bits of entropy, so a fast digest is sufficient and keeps auth cheap.
+func DigestAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
 
-	return apiKey, nil
+// VerifyAPIKeyDigest compares a provided API key with its SHA-256 digest in constant time
+func VerifyAPIKeyDigest(providedKey, digest string) bool {
+	return subtle.ConstantTimeCompare([]byte(DigestAPIKey(providedKey)), []byte(digest)) == 1
 }
 
 // HashAPIKey hashes an API key using bcrypt